@@ -15,38 +15,109 @@
 package agent
 
 import (
+	"errors"
 	"github.com/armon/go-socks5"
 	"github.com/elazarl/goproxy"
 	"github.com/rsrdesarrollo/SaSSHimi/common"
 	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
 
+// Options configures the agent. The embedded AgentOptions can also be set
+// by the server through the channel.
+type Options struct {
+	UseHttpProxy bool
+	KeepBinary   bool
+	PidFile      string
+
+	// Preamble writes common.Preamble before the first message
+	Preamble bool
+
+	common.AgentOptions
+}
+
 type agent struct {
 	common.ChannelForwarder
-	sockFilePath string
-	sockFamily   string
+	sockFilePath  string
+	sockFamily    string
+	proxyListener net.Listener
+
+	// options are replaced by the setup messages while the agent runs,
+	// they are read with currentOptions
+	options     Options
+	optionsLock sync.Mutex
+
+	refusedClients map[string]bool
+	overloaded     bool
+	operators      map[string]*operator
+	pprofListener  *utils.PipeListener
+	dialPacer      *dialPacer
+	dnsCache       *dnsCache
+	handshakes     *handshakePool
+
+	// targets are the destination sockets by client
+	targets     map[string]*targetConn
+	targetsLock sync.Mutex
+
+	watchdogLock sync.Mutex
+	lastProgress time.Time
+	busyClient   *common.Client
+
+	// embedded is set for agents run by Serve, which leave the state of
+	// the process to the program embedding them
+	embedded bool
+
+	// restartable is set when the agent owns its process and its channel is
+	// on stdin and stdout, so it can be replaced by another binary
+	restartable bool
+	upgradeLock sync.Mutex
+	upgradePath string
+
+	rewriter *destinationRewriter
+
+	// fileDrop is the running file drop, nil if none
+	fileDrop *fileDrop
 }
 
-func newAgent() agent {
-	return agent{
+func newAgent(options Options) *agent {
+	a := &agent{
 		ChannelForwarder: common.ChannelForwarder{
-			OutChannel:  make(chan *common.DataMessage, 10),
-			InChannel:   make(chan *common.DataMessage, 10),
+			OutQueue:    common.NewFairQueue(),
+			InChannel:   make(chan *common.DataMessage, common.MaxQueueLimit),
 			Reader:      os.Stdin,
 			Writer:      os.Stdout,
 			ChannelOpen: false,
 			Clients:     make(map[string]*common.Client),
 			ClientsLock: &sync.Mutex{},
 		},
-		sockFamily:   "unix",
-		sockFilePath: "./daemon_" + utils.RandStringRunes(10),
+		sockFamily:     "unix",
+		sockFilePath:   "./daemon_" + utils.RandStringRunes(10),
+		options:        options,
+		refusedClients: make(map[string]bool),
+		operators:      make(map[string]*operator),
+		dialPacer:      newDialPacer(),
+		dnsCache:       newDNSCache(),
+		handshakes:     newHandshakePool(),
+		targets:        make(map[string]*targetConn),
 	}
+	a.rewriter = &destinationRewriter{resolver: a.dnsCache}
+
+	return a
+}
+
+// currentOptions returns a copy of the options of the agent
+func (a *agent) currentOptions() Options {
+	a.optionsLock.Lock()
+	defer a.optionsLock.Unlock()
+
+	return a.options
 }
 
 func (a *agent) runProxyServer(done chan struct{}, useHttpProxy bool) {
@@ -57,6 +128,7 @@ func (a *agent) runProxyServer(done chan struct{}, useHttpProxy bool) {
 	}
 
 	utils.Logger.Noticef("Remote proxy server bind at [%s] %s", a.sockFamily, a.sockFilePath)
+	a.proxyListener = ln
 
 	if useHttpProxy {
 		proxy := goproxy.NewProxyHttpServer()
@@ -66,7 +138,12 @@ func (a *agent) runProxyServer(done chan struct{}, useHttpProxy bool) {
 		http.Serve(ln, proxy)
 	} else {
 		conf := &socks5.Config{
-			Logger: log.New(os.Stderr, "", log.LstdFlags),
+			AuthMethods: []socks5.Authenticator{clientAuthenticator{}},
+			Rules:       clientRules{},
+			Logger:      log.New(os.Stderr, "", log.LstdFlags),
+			Dial:        a.dial,
+			Resolver:    a.rewriter,
+			Rewriter:    a.rewriter,
 		}
 
 		server, err := socks5.New(conf)
@@ -76,7 +153,7 @@ func (a *agent) runProxyServer(done chan struct{}, useHttpProxy bool) {
 		}
 
 		done <- struct{}{}
-		err = server.Serve(ln)
+		err = a.handshakes.serve(ln, server.ServeConn)
 
 		if err != nil {
 			utils.Logger.Error("ERROR Running socks socksServer: " + err.Error())
@@ -87,11 +164,40 @@ func (a *agent) runProxyServer(done chan struct{}, useHttpProxy bool) {
 func (a *agent) handleInOutData() {
 	for a.ChannelOpen {
 		msg := <-a.InChannel
+		a.InputTaken()
+		a.markProgress()
+
+		if msg.IsCorrupted() {
+			// Never deliver damaged data, reset the connection instead
+			a.ClientsLock.Lock()
+			client, prs := a.Clients[msg.ClientId]
+			if prs && !client.IsDead() {
+				client.Terminate()
+				client.NotifyEOF(true)
+			}
+			a.ClientsLock.Unlock()
+			continue
+		}
+
+		if msg.Ping {
+			a.sendHello()
+			continue
+		}
 
 		if msg.KeepAlive {
 			continue
 		}
 
+		if msg.Setup {
+			a.applySetup(msg)
+			continue
+		}
+
+		if msg.Restart {
+			a.restart()
+			break
+		}
+
 		if msg.CloseChannel {
 			a.Close()
 			break
@@ -100,8 +206,42 @@ func (a *agent) handleInOutData() {
 		a.ClientsLock.Lock()
 		client, prs := a.Clients[msg.ClientId]
 
+		if prs == false && (msg.CloseClient || msg.DeadClient || a.refusedClients[msg.ClientId]) {
+			// Nothing to close or the client was refused
+			if msg.CloseClient && !a.refusedClients[msg.ClientId] {
+				// The client closed before sending any data, acknowledge it
+				// so the other side releases the connection
+				outQueue, id := a.route(msg.ClientId)
+				reply := common.NewMessage(id, []byte{})
+				reply.CloseClient = true
+				outQueue.Push(reply)
+			} else if msg.CloseClient {
+				delete(a.refusedClients, msg.ClientId)
+			}
+			a.ClientsLock.Unlock()
+			continue
+		}
+
+		if prs == false && (a.rejectSocksGreeting(msg) || a.rejectSocks4Request(msg)) {
+			a.ClientsLock.Unlock()
+			continue
+		}
+
+		if prs == false && !a.canAcceptClient() {
+			a.refuseClient(msg.ClientId)
+			a.ClientsLock.Unlock()
+			continue
+		}
+
+		if prs == false && a.isPprofClient(msg.ClientId) && a.pprofListener == nil {
+			utils.Logger.Warning("Profiling is not enabled, refusing client", msg.ClientId)
+			a.refuseClient(msg.ClientId)
+			a.ClientsLock.Unlock()
+			continue
+		}
+
 		if prs == false {
-			conn, err := net.Dial(a.sockFamily, a.sockFilePath)
+			conn, err := a.dialClient(msg)
 
 			if err != nil {
 				utils.Logger.Error("Connection dial error: ", err)
@@ -109,21 +249,44 @@ func (a *agent) handleInOutData() {
 				continue
 			}
 
+			outQueue, clientId := a.route(msg.ClientId)
 			client = common.NewClient(
-				msg.ClientId,
+				clientId,
 				conn,
-				a.OutChannel,
+				outQueue,
 			)
+			options := a.currentOptions()
+			client.SetIdleTimeout(options.ClientIdleTimeout)
+			client.SetFrameSize(options.FrameSize)
 
-			utils.Logger.Debug("New connection to socks proxy from", conn.LocalAddr().String(), "for client", client.Id)
+			utils.Logger.Debug("New connection to socks proxy from", conn.LocalAddr().String(), "for client", msg.ClientId)
 			a.Clients[msg.ClientId] = client
 
 			go client.ReadFromClientToChannel()
 		}
 		a.ClientsLock.Unlock()
 
+		if msg.DeadClient {
+			// The destination is reset before the SOCKS server half-closes it
+			if msg.Reset {
+				a.resetTarget(msg.ClientId)
+				client.Reset()
+			} else {
+				client.Terminate()
+			}
+			// ACK for client termination
+			client.NotifyEOF(false)
+
+			a.ClientsLock.Lock()
+			delete(a.Clients, msg.ClientId)
+			a.ClientsLock.Unlock()
+
+			continue
+		}
+
 		if msg.CloseClient {
 			utils.Logger.Debug("Closing client sock connection for ", client.Id)
+			client.CloseWrite()
 
 			a.ClientsLock.Lock()
 			delete(a.Clients, msg.ClientId)
@@ -132,31 +295,73 @@ func (a *agent) handleInOutData() {
 			continue
 		}
 
+		// Replies are scheduled in the class the server chose for the client
+		client.SetPriority(msg.Priority)
+
 		// While receiving data from dead clients ingore it until remote end confirms closure
 		if !client.IsDead() {
-			err := client.Write(msg.Data)
+			a.setBusyClient(client)
+			err := client.Deliver(msg)
+			a.setBusyClient(nil)
 
 			if err != nil {
 				utils.Logger.Error("Error writing to client connection: ", err.Error())
 
-				client.Terminate()
-				client.NotifyEOF(true)
+				client.NotifyError(err)
 			}
 		}
 
 	}
 }
 
-func Run(useHttpProxy bool, keepBinary bool) {
+// configure applies the options the agent was created with
+func (a *agent) configure() {
+	options := a.currentOptions()
+
+	a.dialPacer.configure(options.AgentOptions)
+	a.dnsCache.configure(options.AgentOptions)
+	a.rewriter.configure(options.AgentOptions)
+	a.handshakes.configure(options.AgentOptions)
+	a.SetCoalesceDelay(options.CoalesceDelay)
+	a.SetQueueMemory(queueMemory(options.AgentOptions))
+	a.configureFileDrop(options.AgentOptions)
+}
+
+// deployedAgentName is the file name of the agent uploaded by the server
+const deployedAgentName = ".daemon"
+
+// enterAgentDirectory makes the directory of a deployed agent the working
+// directory, where it keeps its sockets and pid file: the server runs it by
+// its path, without changing directory first.
+func enterAgentDirectory() {
+	executable, err := os.Executable()
+	if err != nil || filepath.Base(executable) != deployedAgentName {
+		return
+	}
+
+	if err := os.Chdir(filepath.Dir(executable)); err != nil {
+		utils.Logger.Warning("Unable to enter the agent directory: ", err.Error())
+	}
+}
+
+func Run(options Options) {
+	enterAgentDirectory()
 
-	agent := newAgent()
+	agent := newAgent(options)
+	agent.restartable = canExec
+	agent.applyPriority()
+	agent.configure()
+
+	if options.TransparentMode {
+		agent.enableTransparency()
+	}
 
 	onExit := func() {
 		utils.Logger.Notice("Agent is closing")
 		selfFilePath, _ := os.Executable()
-		os.Remove(agent.sockFilePath)
+		agent.removeFiles()
 
-		if !keepBinary {
+		if !options.KeepBinary && !utils.RelayOnly {
 			os.Remove(selfFilePath)
 		}
 	}
@@ -165,17 +370,82 @@ func Run(useHttpProxy bool, keepBinary bool) {
 	utils.ExitCallback(onExit)
 
 	proxyReady := make(chan struct{})
-	go agent.runProxyServer(proxyReady, useHttpProxy)
+	go agent.runProxyServer(proxyReady, options.UseHttpProxy)
 	<-proxyReady
 
 	agent.ChannelOpen = true
 
+	if options.Preamble {
+		agent.writePreamble()
+	}
+
 	go agent.ReadInputData()
 	go agent.WriteOutputData()
 
 	go agent.handleInOutData()
+	go agent.watchdog()
+
+	if options.Shared {
+		go agent.listenOperators()
+	}
+
+	if options.Sandbox {
+		agent.enableSandbox()
+	}
 
 	for agent.ChannelOpen {
 		time.Sleep(1 * time.Second)
 	}
 }
+
+// removeFiles removes the sockets and the pid file of the agent
+func (a *agent) removeFiles() {
+	options := a.currentOptions()
+
+	os.Remove(a.sockFilePath)
+
+	if options.Shared {
+		os.Remove(ShareSocket)
+	}
+
+	if options.TransparentMode {
+		a.disableTransparency()
+	}
+}
+
+// Serve runs an agent forwarding the channel read from and written to
+// transport until it is closed, like the agent of a test or of a program
+// embedding SaSSHimi. Unlike Run it leaves the process alone: no priority
+// change, environment, verbosity, exit handler, sharing, transparent mode,
+// sandbox or removal of the executable, whether they are set in options or
+// by the server. It returns an error if options ask for one of them.
+func Serve(options Options, transport io.ReadWriter) error {
+	if options.Sandbox || options.Shared || options.TransparentMode {
+		return errors.New("The sandbox, sharing and transparent mode change the whole process, they cannot be used by an embedded agent")
+	}
+
+	agent := newAgent(options)
+	agent.embedded = true
+	agent.Reader = transport
+	agent.Writer = transport
+	agent.configure()
+
+	proxyReady := make(chan struct{})
+	go agent.runProxyServer(proxyReady, options.UseHttpProxy)
+	<-proxyReady
+
+	agent.ChannelOpen = true
+
+	go agent.ReadInputData()
+	go agent.WriteOutputData()
+
+	go agent.handleInOutData()
+	go agent.watchdog()
+
+	for agent.ChannelOpen {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	agent.proxyListener.Close()
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"encoding/binary"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	pcapSnapLen       = 65535
+	pcapLinkEthernet  = 1
+	pcapMagic         = 0xa1b2c3d4
+	pcapVersionMajor  = 2
+	pcapVersionMinor  = 4
+	pcapRecordHdrSize = 16
+)
+
+type pcapWriter struct {
+	out io.Writer
+}
+
+func newPcapWriter(out io.Writer) (*pcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(header[6:], pcapVersionMinor)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkEthernet)
+
+	_, err := out.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pcapWriter{out: out}, nil
+}
+
+func (w *pcapWriter) WritePacket(timestamp time.Time, packet []byte) error {
+	record := make([]byte, pcapRecordHdrSize+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(timestamp.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(timestamp.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	copy(record[pcapRecordHdrSize:], packet)
+
+	_, err := w.out.Write(record)
+	return err
+}
+
+// RunCapture captures every packet seen on iface using raw sockets and
+// writes them in pcap format to stdout until the channel is closed.
+func RunCapture(iface string, keepBinary bool) {
+	onExit := func() {
+		if !keepBinary && !utils.RelayOnly {
+			selfFilePath, _ := os.Executable()
+			os.Remove(selfFilePath)
+		}
+	}
+
+	defer onExit()
+	utils.ExitCallback(onExit)
+
+	writer, err := newPcapWriter(os.Stdout)
+	if err != nil {
+		utils.Logger.Error("Failed to write pcap header: ", err.Error())
+		return
+	}
+
+	err = rawCapture(iface, writer)
+	if err != nil {
+		utils.Logger.Error("Capture error: ", err.Error())
+	}
+}
@@ -0,0 +1,71 @@
+//go:build linux
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func htons(value uint16) uint16 {
+	return value<<8 | value>>8
+}
+
+func rawCapture(iface string, writer *pcapWriter) error {
+	var ifIndex int
+
+	if iface != "" && iface != "any" {
+		netIface, err := net.InterfaceByName(iface)
+		if err != nil {
+			return fmt.Errorf("Unknown interface: %w", err)
+		}
+		ifIndex = netIface.Index
+	}
+
+	protocol := htons(unix.ETH_P_ALL)
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(protocol))
+	if err != nil {
+		return fmt.Errorf("Failed to open raw socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	err = unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: protocol, Ifindex: ifIndex})
+	if err != nil {
+		return fmt.Errorf("Failed to bind raw socket: %w", err)
+	}
+
+	buffer := make([]byte, pcapSnapLen)
+
+	for {
+		readed, _, err := unix.Recvfrom(fd, buffer, 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read raw socket: %w", err)
+		}
+
+		err = writer.WritePacket(time.Now(), buffer[:readed])
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"net"
+	"sync"
+	"time"
+)
+
+// portsCheckInterval is how long the count of TIME_WAIT sockets is reused
+const portsCheckInterval = time.Second
+
+// dialFailuresSize bounds the number of destinations with a cached failure
+const dialFailuresSize = 4096
+
+type dialFailure struct {
+	err     error
+	expires time.Time
+}
+
+// dialPacer limits the dials to destinations in progress at the same time
+// and spaces them, so connect scans do not fill the conntrack table of the
+// remote host. It also holds new dials while the local ports in use by
+// dials and TIME_WAIT sockets reach maxPorts.
+type dialPacer struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	dialing  int
+	nextDial time.Time
+
+	timeWait        int
+	timeWaitChecked time.Time
+	throttled       bool
+
+	// failures are the recent dial errors by destination
+	failures map[string]dialFailure
+
+	concurrency int
+	interval    time.Duration
+	fastOpen    bool
+	maxPorts    int
+	failureTTL  time.Duration
+}
+
+func newDialPacer() *dialPacer {
+	p := &dialPacer{failures: make(map[string]dialFailure)}
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+// configure applies the dial options, waiting dials use them right away
+func (p *dialPacer) configure(options common.AgentOptions) {
+	p.lock.Lock()
+	p.concurrency = options.DialConcurrency
+	p.interval = options.DialInterval
+	p.fastOpen = options.FastOpen
+	p.maxPorts = options.MaxPorts
+	p.failureTTL = options.DialFailureCache
+	p.failures = make(map[string]dialFailure)
+	p.cond.Broadcast()
+	p.lock.Unlock()
+
+	if options.FastOpen && !fastOpenSupported {
+		utils.Logger.Warning("TCP Fast Open is not supported on this system, dialing normally")
+	}
+
+	if options.MaxPorts > 0 && timeWaitSockets() < 0 {
+		utils.Logger.Warning("TIME_WAIT sockets cannot be counted on this system, only dials in progress are limited")
+	}
+}
+
+// portsInUse returns the local ports used by dials in progress and sockets
+// in TIME_WAIT, the latter counted at most once per portsCheckInterval
+func (p *dialPacer) portsInUse() int {
+	if time.Since(p.timeWaitChecked) >= portsCheckInterval {
+		p.timeWait = timeWaitSockets()
+		if p.timeWait < 0 {
+			p.timeWait = 0
+		}
+		p.timeWaitChecked = time.Now()
+	}
+
+	return p.dialing + p.timeWait
+}
+
+// portsAvailable tells if a new dial stays below maxPorts, logging when the
+// dials start and stop being held
+func (p *dialPacer) portsAvailable() bool {
+	if p.maxPorts <= 0 {
+		return true
+	}
+
+	inUse := p.portsInUse()
+	available := inUse < p.maxPorts
+
+	if !available && !p.throttled {
+		utils.Logger.Warningf("%d local ports in use by dials and TIME_WAIT sockets, holding new connections", inUse)
+	} else if available && p.throttled {
+		utils.Logger.Notice("Local ports available again, resuming new connections")
+	}
+	p.throttled = !available
+
+	return available
+}
+
+// acquire waits for a free dial slot and the end of the pacing interval
+func (p *dialPacer) acquire() (fastOpen bool) {
+	p.lock.Lock()
+	for {
+		if p.concurrency > 0 && p.dialing >= p.concurrency {
+			p.cond.Wait()
+			continue
+		}
+
+		if !p.portsAvailable() {
+			// TIME_WAIT sockets expire without notice, check again later
+			p.lock.Unlock()
+			time.Sleep(portsCheckInterval / 4)
+			p.lock.Lock()
+			continue
+		}
+
+		break
+	}
+	p.dialing++
+
+	now := time.Now()
+	if p.nextDial.Before(now) {
+		p.nextDial = now
+	}
+	wait := p.nextDial.Sub(now)
+	p.nextDial = p.nextDial.Add(p.interval)
+	fastOpen = p.fastOpen
+	p.lock.Unlock()
+
+	time.Sleep(wait)
+	return fastOpen
+}
+
+// cachedFailure returns the error of the last dial to address if it failed
+// less than failureTTL ago
+func (p *dialPacer) cachedFailure(address string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	failure, prs := p.failures[address]
+	if !prs {
+		return nil
+	}
+
+	if time.Now().After(failure.expires) {
+		delete(p.failures, address)
+		return nil
+	}
+
+	return failure.err
+}
+
+// recordFailure remembers that dialing address failed with err
+func (p *dialPacer) recordFailure(address string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.failureTTL <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if len(p.failures) >= dialFailuresSize {
+		for key, failure := range p.failures {
+			if now.After(failure.expires) {
+				delete(p.failures, key)
+			}
+		}
+		if len(p.failures) >= dialFailuresSize {
+			p.failures = make(map[string]dialFailure)
+		}
+	}
+
+	p.failures[address] = dialFailure{err: err, expires: now.Add(p.failureTTL)}
+}
+
+func (p *dialPacer) release() {
+	p.lock.Lock()
+	p.dialing--
+	p.cond.Signal()
+	p.lock.Unlock()
+}
+
+// dial connects the SOCKS server to destinations, following the pacing and
+// Fast Open options. Destinations that failed recently fail again at once.
+func (a *agent) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := a.dialPacer.cachedFailure(address); err != nil {
+		utils.Logger.Debug("Failing fast to", address, "with cached error:", err.Error())
+		return nil, err
+	}
+
+	fastOpen := a.dialPacer.acquire()
+	defer a.dialPacer.release()
+
+	dialer := net.Dialer{}
+	if fastOpen {
+		dialer.Control = fastOpenControl
+	}
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		if ctx.Err() == nil {
+			a.dialPacer.recordFailure(address, err)
+		}
+		return nil, err
+	}
+
+	return a.trackTarget(ctx, conn), nil
+}
@@ -0,0 +1,281 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Answers are kept for their TTL, bounded by dnsMaxTTL. Names answered
+// without DNS, like those of the hosts file, are kept dnsDefaultTTL.
+const dnsMaxTTL = 10 * time.Minute
+const dnsDefaultTTL = 30 * time.Second
+const dnsCacheSize = 4096
+
+type ttlRecorderKey struct{}
+
+type dnsServersKey struct{}
+
+// dnsServers are the servers of a lookup, used in turn by the resolver
+type dnsServers struct {
+	lock    sync.Mutex
+	servers []string
+	next    int
+}
+
+// pick returns the server of the next query
+func (s *dnsServers) pick() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	server := s.servers[s.next%len(s.servers)]
+	s.next++
+	return server
+}
+
+// dnsRules are the DNS servers of the DNSServers option
+type dnsRules struct {
+	// Servers of every name, none for the system ones
+	servers []string
+	// Servers of the names under a domain
+	domains map[string][]string
+}
+
+// parseDNSServers reads the DNSServers option
+func parseDNSServers(option string) (dnsRules, error) {
+	rules := dnsRules{domains: make(map[string][]string)}
+
+	for _, item := range strings.Split(option, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		domain, server := "", item
+		if idx := strings.Index(item, "="); idx >= 0 {
+			domain, server = strings.ToLower(strings.Trim(item[:idx], ".")), item[idx+1:]
+		}
+
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		if host, _, _ := net.SplitHostPort(server); net.ParseIP(host) == nil {
+			return rules, errors.New("invalid DNS server " + item + ", expected an IP address")
+		}
+
+		if domain == "" {
+			rules.servers = append(rules.servers, server)
+		} else {
+			rules.domains[domain] = append(rules.domains[domain], server)
+		}
+	}
+
+	return rules, nil
+}
+
+// match returns the servers of name: those of its longest domain rule,
+// else the default ones
+func (r dnsRules) match(name string) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	var matched string
+	for domain := range r.domains {
+		if (name == domain || strings.HasSuffix(name, "."+domain)) && len(domain) > len(matched) {
+			matched = domain
+		}
+	}
+
+	if matched != "" {
+		return r.domains[matched]
+	}
+	return r.servers
+}
+
+// ttlRecorder collects the lowest TTL of the DNS answers of a lookup
+type ttlRecorder struct {
+	lock sync.Mutex
+	ttl  time.Duration
+	seen bool
+}
+
+func (r *ttlRecorder) record(ttl time.Duration) {
+	r.lock.Lock()
+	if !r.seen || ttl < r.ttl {
+		r.ttl = ttl
+	}
+	r.seen = true
+	r.lock.Unlock()
+}
+
+// ttlConn reads the TTLs of the DNS answers received by the resolver over
+// UDP, where a datagram holds a whole message. It stays a net.PacketConn so
+// the resolver keeps using datagrams.
+type ttlConn struct {
+	*net.UDPConn
+	recorder *ttlRecorder
+}
+
+func (c *ttlConn) Read(data []byte) (int, error) {
+	n, err := c.UDPConn.Read(data)
+
+	if n > 0 {
+		var parser dnsmessage.Parser
+		if _, parseErr := parser.Start(data[:n]); parseErr == nil && parser.SkipAllQuestions() == nil {
+			answers, _ := parser.AllAnswers()
+			for _, answer := range answers {
+				c.recorder.record(time.Duration(answer.Header.TTL) * time.Second)
+			}
+		}
+	}
+
+	return n, err
+}
+
+type dnsEntry struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// dnsCache resolves the host names of SOCKS requests with the Go resolver
+// and keeps the answers for their TTL
+type dnsCache struct {
+	lock     sync.Mutex
+	entries  map[string]dnsEntry
+	resolver *net.Resolver
+	disabled bool
+	rules    dnsRules
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{
+		entries: make(map[string]dnsEntry),
+		resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				if servers, ok := ctx.Value(dnsServersKey{}).(*dnsServers); ok {
+					address = servers.pick()
+				}
+
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+
+				// TCP answers keep the default TTL
+				udpConn, isUDP := conn.(*net.UDPConn)
+				if recorder, ok := ctx.Value(ttlRecorderKey{}).(*ttlRecorder); ok && isUDP {
+					return &ttlConn{UDPConn: udpConn, recorder: recorder}, nil
+				}
+				return conn, err
+			},
+		},
+	}
+}
+
+// configure enables or disables the cache and sets the DNS servers
+func (c *dnsCache) configure(options common.AgentOptions) {
+	rules, err := parseDNSServers(options.DNSServers)
+	if err != nil {
+		utils.Logger.Error(err.Error() + ", using the system DNS servers")
+		rules = dnsRules{}
+	}
+
+	c.lock.Lock()
+	c.disabled = options.DisableDNSCache
+	c.rules = rules
+	c.entries = make(map[string]dnsEntry)
+	c.lock.Unlock()
+}
+
+// lookup resolves name and returns how long the answer can be kept
+func (c *dnsCache) lookup(ctx context.Context, name string) (net.IP, time.Duration, error) {
+	recorder := &ttlRecorder{}
+	ctx = context.WithValue(ctx, ttlRecorderKey{}, recorder)
+
+	c.lock.Lock()
+	servers := c.rules.match(name)
+	c.lock.Unlock()
+
+	if len(servers) > 0 {
+		ctx = context.WithValue(ctx, dnsServersKey{}, &dnsServers{servers: servers})
+	}
+
+	addrs, err := c.resolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(addrs) == 0 {
+		return nil, 0, errors.New("no address for " + name)
+	}
+
+	ttl := dnsDefaultTTL
+	if recorder.seen {
+		ttl = recorder.ttl
+	}
+	if ttl > dnsMaxTTL {
+		ttl = dnsMaxTTL
+	}
+
+	return addrs[0].IP, ttl, nil
+}
+
+// Resolve implements socks5.NameResolver
+func (c *dnsCache) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	now := time.Now()
+
+	c.lock.Lock()
+	entry, prs := c.entries[name]
+	disabled := c.disabled
+	c.lock.Unlock()
+
+	if prs && now.Before(entry.expires) {
+		return ctx, entry.ip, nil
+	}
+
+	ip, ttl, err := c.lookup(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	if ttl > 0 && !disabled {
+		c.lock.Lock()
+		if len(c.entries) >= dnsCacheSize {
+			c.purge(now)
+		}
+		c.entries[name] = dnsEntry{ip: ip, expires: now.Add(ttl)}
+		c.lock.Unlock()
+	}
+
+	utils.Logger.Debugf("Resolved %s to %s with a TTL of %s", name, ip, ttl)
+	return ctx, ip, nil
+}
+
+// purge drops the expired entries, or all of them if none expired
+func (c *dnsCache) purge(now time.Time) {
+	for name, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, name)
+		}
+	}
+
+	if len(c.entries) >= dnsCacheSize {
+		c.entries = make(map[string]dnsEntry)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+const fastOpenSupported = true
+
+// fastOpenControl enables TCP Fast Open on outgoing sockets, the SYN then
+// carries the first data when the destination gave a cookie before
+func fastOpenControl(network, address string, conn syscall.RawConn) error {
+	return conn.Control(func(fd uintptr) {
+		err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		if err != nil {
+			utils.Logger.Debug("Unable to enable TCP Fast Open: ", err.Error())
+		}
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileDrop serves the files of a directory over HTTP, each file only once,
+// until it expires
+type fileDrop struct {
+	dir      string
+	listener net.Listener
+	timer    *time.Timer
+
+	lock   sync.Mutex
+	served map[string]bool
+}
+
+// configureFileDrop stops the running file drop and starts the one of
+// options if any
+func (a *agent) configureFileDrop(options common.AgentOptions) {
+	if a.fileDrop != nil {
+		a.fileDrop.stop("replaced")
+		a.fileDrop = nil
+	}
+
+	if options.FileDrop == "" {
+		return
+	}
+
+	bind := options.FileDropBind
+	if bind == "" {
+		bind = common.DefaultFileDropBind
+	}
+	expiry := options.FileDropExpiry
+	if expiry <= 0 {
+		expiry = common.DefaultFileDropExpiry
+	}
+
+	if info, err := os.Stat(options.FileDrop); err != nil || !info.IsDir() {
+		utils.Logger.Error("File drop disabled: " + options.FileDrop + " is not a directory")
+		return
+	}
+
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		utils.Logger.Error("File drop disabled: " + err.Error())
+		return
+	}
+
+	drop := &fileDrop{dir: options.FileDrop, listener: listener, served: make(map[string]bool)}
+	drop.timer = time.AfterFunc(expiry, func() { drop.stop("expired") })
+	a.fileDrop = drop
+
+	go http.Serve(listener, drop)
+
+	utils.Logger.Noticef("File drop of %s served on http://%s/ until %s", drop.dir, listener.Addr().String(),
+		time.Now().Add(expiry).Format(time.RFC3339))
+}
+
+// stop closes the file drop, reason is logged
+func (d *fileDrop) stop(reason string) {
+	d.timer.Stop()
+	if d.listener.Close() == nil {
+		utils.Logger.Notice("File drop of", d.dir, reason)
+	}
+}
+
+// ServeHTTP sends the file requested by GET /name, at most once. Directories
+// are not listed.
+func (d *fileDrop) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + request.URL.Path)
+	file, err := os.Open(filepath.Join(d.dir, filepath.FromSlash(name)))
+	if err != nil {
+		http.NotFound(response, request)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(response, request)
+		return
+	}
+
+	if request.Method == http.MethodGet {
+		d.lock.Lock()
+		served := d.served[name]
+		d.served[name] = true
+		d.lock.Unlock()
+
+		if served {
+			http.Error(response, "already served", http.StatusGone)
+			return
+		}
+
+		utils.Logger.Notice("File drop serving", name, "to", request.RemoteAddr)
+	}
+
+	http.ServeContent(response, request, info.Name(), info.ModTime(), file)
+}
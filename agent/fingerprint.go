@@ -0,0 +1,47 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/rsrdesarrollo/SaSSHimi/version"
+	"io"
+	"os"
+)
+
+// PrintFingerprint writes the engagement identifier and the SHA-256 of the
+// running binary, so the exact agent used can be whitelisted by defenders.
+func PrintFingerprint(output io.Writer) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Unable to find the agent binary: %w", err)
+	}
+
+	sum, err := utils.FileSHA256(executable)
+	if err != nil {
+		return fmt.Errorf("Unable to read the agent binary: %w", err)
+	}
+
+	engagement := version.Engagement
+	if engagement == "" {
+		engagement = "none"
+	}
+
+	fmt.Fprintf(output, "Version:    %s %s\n", version.ToolName, version.VersionTag)
+	fmt.Fprintf(output, "Engagement: %s\n", engagement)
+	fmt.Fprintf(output, "SHA-256:    %s\n", sum)
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultHandshakeWorkers is the number of SOCKS negotiations run at the
+// same time when the HandshakeWorkers option is not set
+const defaultHandshakeWorkers = 64
+
+// handshakeQueueSize bounds the connections waiting for a worker, new ones
+// are closed above it
+const handshakeQueueSize = 4096
+
+// handshakePool runs the SOCKS negotiation of new connections, up to the
+// destination dial and the reply, in a bounded number of workers. A burst of
+// new connections then waits in the queue instead of competing for the CPU
+// with the goroutines moving data of established ones.
+type handshakePool struct {
+	queue chan net.Conn
+
+	lock      sync.Mutex
+	serveConn func(net.Conn) error
+	workers   int
+	size      int
+}
+
+func newHandshakePool() *handshakePool {
+	return &handshakePool{
+		queue: make(chan net.Conn, handshakeQueueSize),
+		size:  defaultHandshakeWorkers,
+	}
+}
+
+// configure resizes the pool, extra workers stop after their current
+// negotiation
+func (p *handshakePool) configure(options common.AgentOptions) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.size = options.HandshakeWorkers
+	if p.size <= 0 {
+		p.size = defaultHandshakeWorkers
+	}
+
+	p.startWorkers()
+}
+
+// startWorkers starts the missing workers once serve was called. Must be
+// called with lock held.
+func (p *handshakePool) startWorkers() {
+	if p.serveConn == nil {
+		return
+	}
+
+	for ; p.workers < p.size; p.workers++ {
+		go p.work(p.serveConn)
+	}
+}
+
+// serve negotiates with serveConn the connections accepted on ln until it
+// is closed
+func (p *handshakePool) serve(ln net.Listener, serveConn func(net.Conn) error) error {
+	p.lock.Lock()
+	p.serveConn = serveConn
+	p.startWorkers()
+	p.lock.Unlock()
+
+	for {
+		conn, err := utils.Accept(ln)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case p.queue <- conn:
+		default:
+			utils.Logger.Warning("Too many SOCKS negotiations waiting, closing new connection")
+			conn.Close()
+		}
+	}
+}
+
+func (p *handshakePool) work(serve func(net.Conn) error) {
+	for conn := range p.queue {
+		client, err := readPreamble(conn)
+		if err != nil {
+			utils.Logger.Warning("Invalid SOCKS connection preamble:", err.Error())
+			conn.Close()
+			continue
+		}
+
+		negotiated := make(chan struct{})
+		handshake := &handshakeConn{Conn: conn, client: client, negotiated: negotiated}
+
+		go func() {
+			serve(handshake)
+			handshake.done()
+		}()
+
+		<-negotiated
+
+		if p.shrink() {
+			return
+		}
+	}
+}
+
+// shrink stops the calling worker if the pool has too many of them
+func (p *handshakePool) shrink() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.workers > p.size {
+		p.workers--
+		return true
+	}
+	return false
+}
+
+// handshakeConn tells when the SOCKS server wrote its reply to the request
+// of the client, after its reply to the greeting, ending the negotiation. It
+// carries the id of the client read from the preamble.
+type handshakeConn struct {
+	net.Conn
+	client     string
+	writes     int32
+	negotiated chan struct{}
+	once       sync.Once
+}
+
+func (c *handshakeConn) Write(data []byte) (int, error) {
+	n, err := c.Conn.Write(data)
+
+	if atomic.LoadInt32(&c.writes) < 2 && atomic.AddInt32(&c.writes, 1) == 2 {
+		c.done()
+	}
+
+	return n, err
+}
+
+func (c *handshakeConn) CloseWrite() error {
+	return utils.CloseWrite(c.Conn)
+}
+
+func (c *handshakeConn) done() {
+	c.once.Do(func() { close(c.negotiated) })
+}
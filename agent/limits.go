@@ -0,0 +1,132 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+const watchdogPeriod = 1 * time.Second
+const watchdogTimeout = 30 * time.Second
+
+// canAcceptClient checks the resource limits before opening a new client
+// connection. Must be called with ClientsLock held.
+func (a *agent) canAcceptClient() bool {
+	options := a.currentOptions()
+
+	if options.MaxClients > 0 && len(a.Clients) >= options.MaxClients {
+		utils.Logger.Warningf("Client limit reached (%d connections)", len(a.Clients))
+		return false
+	}
+
+	if options.MaxGoroutines > 0 && runtime.NumGoroutine() >= options.MaxGoroutines {
+		utils.Logger.Warningf("Goroutine limit reached (%d goroutines)", runtime.NumGoroutine())
+		return false
+	}
+
+	if a.overloaded {
+		utils.Logger.Warning("Memory limit reached")
+		return false
+	}
+
+	return true
+}
+
+// refuseClient tells the other end that clientId is dead without opening a
+// connection for it. Must be called with ClientsLock held.
+func (a *agent) refuseClient(clientId string) {
+	a.refusedClients[clientId] = true
+
+	outQueue, id := a.route(clientId)
+	msg := common.NewMessage(id, []byte{})
+	msg.DeadClient = true
+	outQueue.Push(msg)
+}
+
+// queueMemory returns the bytes the channel queues may hold, a quarter of the
+// memory limit if any
+func queueMemory(options common.AgentOptions) int64 {
+	if options.MaxMemory == 0 {
+		return 0
+	}
+	return int64(options.MaxMemory / 4)
+}
+
+func (a *agent) markProgress() {
+	a.watchdogLock.Lock()
+	a.lastProgress = time.Now()
+	a.watchdogLock.Unlock()
+}
+
+// setBusyClient records the client the worker is writing to, so the watchdog
+// can unblock the worker if the write never completes.
+func (a *agent) setBusyClient(client *common.Client) {
+	a.watchdogLock.Lock()
+	a.lastProgress = time.Now()
+	a.busyClient = client
+	a.watchdogLock.Unlock()
+}
+
+func (a *agent) checkMemory() {
+	options := a.currentOptions()
+
+	if options.MaxMemory == 0 {
+		return
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	if stats.HeapAlloc >= options.MaxMemory {
+		debug.FreeOSMemory()
+		runtime.ReadMemStats(&stats)
+	}
+
+	a.overloaded = stats.HeapAlloc >= options.MaxMemory
+}
+
+// watchdog enforces the memory limit and unblocks the data worker when it
+// stops making progress writing to a client while messages are waiting. No
+// other worker is started, messages of a client must be handled in order.
+func (a *agent) watchdog() {
+	for a.ChannelOpen {
+		time.Sleep(watchdogPeriod)
+
+		a.checkMemory()
+
+		a.watchdogLock.Lock()
+		stalled := len(a.InChannel) > 0 && time.Since(a.lastProgress) > watchdogTimeout
+		busyClient := a.busyClient
+		if stalled {
+			a.lastProgress = time.Now()
+		}
+		a.watchdogLock.Unlock()
+
+		if !stalled {
+			continue
+		}
+
+		if busyClient != nil {
+			utils.Logger.Warning("Data worker blocked writing to client", busyClient.Id, "terminating it")
+			busyClient.Terminate()
+		} else {
+			utils.Logger.Warning("Data worker is not responding")
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShareSocket is the unix socket, relative to the agent working directory,
+// other operators attach to when the agent is shared.
+const ShareSocket = ".sasshimi-mux"
+
+// Client ids of attached operators are prefixed with the operator name and
+// this separator, so they never collide with the ids of other operators.
+const operatorSeparator = "/"
+
+type operator struct {
+	common.ChannelForwarder
+	name string
+	conn net.Conn
+}
+
+// listenOperators accepts other operators attaching to the agent through
+// the share socket. Every operator gets its own channel to the agent.
+func (a *agent) listenOperators() {
+	ln, err := net.Listen("unix", ShareSocket)
+	if err != nil {
+		utils.Logger.Warning("Unable to share agent: " + err.Error())
+		return
+	}
+	defer ln.Close()
+
+	// Only the user running the agent can attach
+	os.Chmod(ShareSocket, 0600)
+	utils.Logger.Notice("Agent shared on", ShareSocket)
+
+	for count := 1; a.ChannelOpen; count++ {
+		conn, err := ln.Accept()
+		if err != nil {
+			utils.Logger.Error("Operator accept error: ", err.Error())
+			return
+		}
+
+		go a.serveOperator(conn, fmt.Sprintf("op%d", count))
+	}
+}
+
+// route returns the queue and the operator side id of the client stored
+// under key.
+func (a *agent) route(key string) (*common.FairQueue, string) {
+	if idx := strings.Index(key, operatorSeparator); idx >= 0 {
+		if op, prs := a.operators[key[:idx]]; prs {
+			return op.OutQueue, key[idx+len(operatorSeparator):]
+		}
+	}
+	return a.OutQueue, key
+}
+
+func (a *agent) serveOperator(conn net.Conn, name string) {
+	options := a.currentOptions()
+
+	op := &operator{
+		ChannelForwarder: common.ChannelForwarder{
+			OutQueue:    common.NewFairQueue(),
+			InChannel:   make(chan *common.DataMessage, common.MaxQueueLimit),
+			Reader:      conn,
+			Writer:      conn,
+			ChannelOpen: true,
+		},
+		name: name,
+		conn: conn,
+	}
+	op.SetCoalesceDelay(options.CoalesceDelay)
+	op.SetQueueMemory(queueMemory(options.AgentOptions))
+
+	a.ClientsLock.Lock()
+	a.operators[name] = op
+	a.ClientsLock.Unlock()
+
+	utils.Logger.Notice("Operator", name, "attached")
+
+	go op.ReadInputData()
+	go op.WriteOutputData()
+
+	for op.ChannelOpen && a.ChannelOpen {
+		var msg *common.DataMessage
+		select {
+		case msg = <-op.InChannel:
+		case <-time.After(time.Second):
+			continue
+		}
+		op.InputTaken()
+
+		if msg.KeepAlive && !msg.IsCorrupted() {
+			continue
+		}
+
+		if (msg.Setup || msg.Restart) && !msg.IsCorrupted() {
+			// Only the operator who started the agent configures and
+			// restarts it
+			continue
+		}
+
+		if msg.CloseChannel && !msg.IsCorrupted() {
+			break
+		}
+
+		msg.ClientId = name + operatorSeparator + msg.ClientId
+		a.InChannel <- msg
+	}
+
+	a.detachOperator(op)
+}
+
+// detachOperator closes the connections of op and its channel, leaving the
+// other operators untouched.
+func (a *agent) detachOperator(op *operator) {
+	prefix := op.name + operatorSeparator
+
+	a.ClientsLock.Lock()
+	delete(a.operators, op.name)
+	for key, client := range a.Clients {
+		if strings.HasPrefix(key, prefix) {
+			client.Terminate()
+			delete(a.Clients, key)
+		}
+	}
+	for key := range a.refusedClients {
+		if strings.HasPrefix(key, prefix) {
+			delete(a.refusedClients, key)
+		}
+	}
+	a.ClientsLock.Unlock()
+
+	// Closing the queue also drops the closure reports of the terminated
+	// clients and stops the writer
+	op.Close()
+	op.conn.Close()
+	utils.Logger.Notice("Operator", op.name, "detached")
+}
+
+// RunAttach relays stdin and stdout to the shared agent running in the
+// current directory, or the directory of the deployed agent.
+func RunAttach() {
+	enterAgentDirectory()
+
+	conn, err := net.Dial("unix", ShareSocket)
+	if err != nil {
+		utils.Logger.Fatal("Unable to attach to shared agent: " + err.Error())
+	}
+
+	var once sync.Once
+	done := make(chan struct{})
+	finish := func() { once.Do(func() { close(done) }) }
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		finish()
+	}()
+	go func() {
+		io.Copy(os.Stdout, conn)
+		finish()
+	}()
+
+	<-done
+	conn.Close()
+}
@@ -0,0 +1,65 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// enablePprof starts the profiler served to the clients with a pprof id
+func (a *agent) enablePprof() {
+	a.pprofListener = utils.NewPipeListener()
+	go http.Serve(a.pprofListener, utils.PprofHandler())
+
+	utils.Logger.Info("Profiling enabled")
+}
+
+func (a *agent) isPprofClient(clientId string) bool {
+	_, id := a.route(clientId)
+	return strings.HasPrefix(id, common.PprofClientPrefix)
+}
+
+// dialClient connects the new client sending msg to the SOCKS server, or to
+// the profiler for pprof clients. SOCKS4 clients are translated to SOCKS5.
+func (a *agent) dialClient(msg *common.DataMessage) (net.Conn, error) {
+	if a.isPprofClient(msg.ClientId) {
+		return a.pprofListener.Dial()
+	}
+
+	if a.isUpgradeClient(msg.ClientId) {
+		local, remote := net.Pipe()
+		go a.receiveUpgrade(local)
+		return remote, nil
+	}
+
+	conn, err := net.Dial(a.sockFamily, a.sockFilePath)
+	if err != nil || a.currentOptions().UseHttpProxy {
+		return conn, err
+	}
+
+	if err := writePreamble(conn, msg.ClientId); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if isSocks4Request(msg.Data) {
+		return newSocks4Conn(conn), nil
+	}
+	return conn, nil
+}
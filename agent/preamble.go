@@ -0,0 +1,44 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"os"
+)
+
+// preambleFlag is the agent command flag writing common.Preamble
+const preambleFlag = "--preamble"
+
+// writePreamble writes the marker the server skips the noise before the
+// channel up to. It is written before any message goes out.
+func (a *agent) writePreamble() {
+	if _, err := a.Writer.Write(common.Preamble); err != nil {
+		utils.Logger.Error("Failed to write preamble: " + err.Error())
+	}
+}
+
+// restartArgs returns the arguments of the agent without the preamble flag,
+// as a restarted agent goes on with the channel the server already synced
+func restartArgs() []string {
+	args := make([]string, 0, len(os.Args))
+	for _, arg := range os.Args {
+		if arg != preambleFlag {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
@@ -0,0 +1,82 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	ioPrioClassBestEffort = 2
+	ioPrioClassIdle       = 3
+)
+
+func parseCPUList(cpus string) ([]int, error) {
+	var list []int
+
+	for _, token := range strings.Split(cpus, ",") {
+		cpu, err := strconv.Atoi(strings.TrimSpace(token))
+		if err != nil || cpu < 0 {
+			return nil, errors.New("invalid CPU list: " + cpus)
+		}
+		list = append(list, cpu)
+	}
+
+	return list, nil
+}
+
+// applyPriority lowers the agent footprint on the remote host according to
+// the scheduling options. Failures are logged but never fatal.
+func (a *agent) applyPriority() {
+	options := a.currentOptions()
+
+	if options.MaxProcs > 0 {
+		runtime.GOMAXPROCS(options.MaxProcs)
+	}
+
+	if options.Nice != 0 {
+		if err := setNice(options.Nice); err != nil {
+			utils.Logger.Warning("Unable to set nice value: ", err.Error())
+		}
+	}
+
+	switch options.IONice {
+	case "":
+	case "idle":
+		if err := setIOPriority(ioPrioClassIdle, 0); err != nil {
+			utils.Logger.Warning("Unable to set I/O priority: ", err.Error())
+		}
+	case "best-effort":
+		if err := setIOPriority(ioPrioClassBestEffort, 7); err != nil {
+			utils.Logger.Warning("Unable to set I/O priority: ", err.Error())
+		}
+	default:
+		utils.Logger.Warning("Unknown I/O priority class ", options.IONice)
+	}
+
+	if options.CPUs != "" {
+		cpus, err := parseCPUList(options.CPUs)
+		if err == nil {
+			err = setCPUAffinity(cpus)
+		}
+		if err != nil {
+			utils.Logger.Warning("Unable to set CPU affinity: ", err.Error())
+		}
+	}
+}
@@ -0,0 +1,86 @@
+//go:build linux
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"strconv"
+)
+
+const ioPrioWhoProcess = 1
+const ioPrioClassShift = 13
+
+// forEachThread calls apply with the id of every thread of the agent. On
+// Linux the nice value, I/O priority and affinity belong to each thread, and
+// the runtime has already started several. New threads inherit them from
+// the thread creating them, so threads are listed again until no new one
+// shows up.
+func forEachThread(apply func(tid int) error) error {
+	done := map[int]bool{}
+	for {
+		entries, err := ioutil.ReadDir("/proc/self/task")
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for _, entry := range entries {
+			tid, err := strconv.Atoi(entry.Name())
+			if err != nil || done[tid] {
+				continue
+			}
+			found = true
+			done[tid] = true
+
+			// The thread may have exited meanwhile
+			if err := apply(tid); err != nil && err != unix.ESRCH {
+				return err
+			}
+		}
+
+		if !found {
+			return nil
+		}
+	}
+}
+
+func setNice(nice int) error {
+	return forEachThread(func(tid int) error {
+		return unix.Setpriority(unix.PRIO_PROCESS, tid, nice)
+	})
+}
+
+func setIOPriority(class int, level int) error {
+	return forEachThread(func(tid int) error {
+		_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioPrioWhoProcess, uintptr(tid), uintptr(class<<ioPrioClassShift|level))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
+
+func setCPUAffinity(cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return forEachThread(func(tid int) error {
+		return unix.SchedSetaffinity(tid, &set)
+	})
+}
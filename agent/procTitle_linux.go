@@ -0,0 +1,25 @@
+//go:build linux
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import "io/ioutil"
+
+// setProcessTitle renames the thread group leader, so /proc/<pid>/comm and
+// ps show title. PR_SET_NAME would only rename the calling thread.
+func setProcessTitle(title string) error {
+	return ioutil.WriteFile("/proc/self/comm", []byte(title), 0)
+}
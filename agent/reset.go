@@ -0,0 +1,154 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"github.com/armon/go-socks5"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
+	"net"
+)
+
+// maxPreambleSize bounds the client id line sent before the SOCKS stream
+const maxPreambleSize = 512
+
+// clientPayload is the key of the client id in the SOCKS auth context
+const clientPayload = "client"
+
+// clientKey is the context key of the client id given to the dial
+type clientKey struct{}
+
+// The SOCKS server only sees the local socket of a client, so the agent
+// starts every SOCKS connection with a line holding the client id. The id
+// goes from the connection to the auth context, then to the dial context, so
+// the destination socket can be found by client to replicate resets.
+
+// writePreamble sends the id of client on conn before its SOCKS stream
+func writePreamble(conn net.Conn, client string) error {
+	_, err := conn.Write([]byte(client + "\n"))
+	return err
+}
+
+// readPreamble reads the client id line at the beginning of conn, one byte
+// at a time to leave the SOCKS stream untouched
+func readPreamble(conn net.Conn) (string, error) {
+	var line []byte
+	var b [1]byte
+
+	for len(line) < maxPreambleSize {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+
+	return "", errors.New("client preamble too long")
+}
+
+// clientAuthenticator accepts SOCKS clients without authentication like
+// socks5.NoAuthAuthenticator, and records the client id of the connection
+type clientAuthenticator struct{}
+
+func (clientAuthenticator) GetCode() uint8 {
+	return socks5.NoAuth
+}
+
+func (clientAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*socks5.AuthContext, error) {
+	auth, err := socks5.NoAuthAuthenticator{}.Authenticate(reader, writer)
+
+	if conn, ok := writer.(*handshakeConn); ok && auth != nil {
+		auth.Payload = map[string]string{clientPayload: conn.client}
+	}
+	return auth, err
+}
+
+// clientRules permits every request and passes the client id to the dial
+type clientRules struct{}
+
+func (clientRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.AuthContext != nil && req.AuthContext.Payload[clientPayload] != "" {
+		ctx = context.WithValue(ctx, clientKey{}, req.AuthContext.Payload[clientPayload])
+	}
+	return socks5.PermitAll().Allow(ctx, req)
+}
+
+// targetConn is a destination socket of a client, it reports a reset of the
+// destination so the client is reset too instead of closed
+type targetConn struct {
+	net.Conn
+	agent  *agent
+	client string
+}
+
+// trackTarget registers conn as the destination of the client in ctx
+func (a *agent) trackTarget(ctx context.Context, conn net.Conn) net.Conn {
+	client, ok := ctx.Value(clientKey{}).(string)
+	if !ok {
+		return conn
+	}
+
+	target := &targetConn{Conn: conn, agent: a, client: client}
+
+	a.targetsLock.Lock()
+	a.targets[client] = target
+	a.targetsLock.Unlock()
+
+	return target
+}
+
+// resetTarget resets the destination socket of client, if any
+func (a *agent) resetTarget(client string) {
+	a.targetsLock.Lock()
+	target := a.targets[client]
+	a.targetsLock.Unlock()
+
+	if target != nil {
+		utils.ResetConn(target.Conn)
+	}
+}
+
+func (c *targetConn) Read(data []byte) (int, error) {
+	n, err := c.Conn.Read(data)
+
+	if err != nil && utils.IsConnReset(err) {
+		// The SOCKS server only half-closes the client on errors
+		c.agent.ClientsLock.Lock()
+		if client, prs := c.agent.Clients[c.client]; prs {
+			client.ResetOnEOF()
+		}
+		c.agent.ClientsLock.Unlock()
+	}
+
+	return n, err
+}
+
+func (c *targetConn) CloseWrite() error {
+	return utils.CloseWrite(c.Conn)
+}
+
+func (c *targetConn) Close() error {
+	c.agent.targetsLock.Lock()
+	if c.agent.targets[c.client] == c {
+		delete(c.agent.targets, c.client)
+	}
+	c.agent.targetsLock.Unlock()
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+const canExec = true
+
+// execAgent replaces the agent process with executable, keeping its
+// arguments but the preamble, environment and the channel on stdin and stdout
+func execAgent(executable string) error {
+	return syscall.Exec(executable, restartArgs(), os.Environ())
+}
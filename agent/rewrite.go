@@ -0,0 +1,200 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/armon/go-socks5"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// rewriteRule sends the connections to destinations matching pattern, a
+// host:port wildcard pattern or a regular expression, to target
+type rewriteRule struct {
+	pattern string
+	regexp  *regexp.Regexp
+	target  string
+}
+
+// parseRewriteRules reads the Rewrites option: one rule per line,
+// pattern=target. Patterns are host:port with * wildcards, like
+// *.corp.local:443 or *.corp.local:*, or regular expressions matching the
+// whole host:port after a ~, whose groups can be used in the target as $1.
+// A target without port keeps the requested one.
+func parseRewriteRules(option string) ([]rewriteRule, error) {
+	var rules []rewriteRule
+
+	for _, line := range strings.Split(option, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		idx := strings.LastIndex(line, "=")
+		if idx <= 0 || idx == len(line)-1 {
+			return nil, errors.New("invalid destination rewrite " + line + ", expected pattern=target")
+		}
+
+		rule := rewriteRule{pattern: line[:idx], target: line[idx+1:]}
+
+		if strings.HasPrefix(rule.pattern, "~") {
+			var err error
+			rule.regexp, err = regexp.Compile("^(?:" + rule.pattern[1:] + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid destination rewrite %s: %w", line, err)
+			}
+		} else {
+			if !strings.Contains(rule.pattern, ":") {
+				rule.pattern += ":*"
+			}
+			if _, err := path.Match(rule.pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid destination rewrite %s: %w", line, err)
+			}
+			rule.pattern = strings.ToLower(rule.pattern)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// apply returns the target of destination, a host:port, if it matches
+func (r rewriteRule) apply(destination string) (string, bool) {
+	if r.regexp != nil {
+		match := r.regexp.FindStringSubmatchIndex(destination)
+		if match == nil {
+			return "", false
+		}
+		return string(r.regexp.ExpandString(nil, r.target, destination, match)), true
+	}
+
+	if matched, _ := path.Match(r.pattern, strings.ToLower(destination)); !matched {
+		return "", false
+	}
+	return r.target, true
+}
+
+// matchesHost tells if the rule may match destinations of host, whatever
+// their port
+func (r rewriteRule) matchesHost(host string) bool {
+	if r.regexp != nil {
+		return true
+	}
+
+	hostPattern := r.pattern[:strings.LastIndex(r.pattern, ":")]
+	matched, _ := path.Match(hostPattern, strings.ToLower(host))
+	return matched
+}
+
+// destinationRewriter rewrites the destinations of SOCKS requests with the
+// Rewrites rules, the first matching rule wins. Host names matched by a rule
+// are only resolved once rewritten, so names that do not exist on the remote
+// network can be mapped.
+type destinationRewriter struct {
+	lock     sync.Mutex
+	rules    []rewriteRule
+	resolver *dnsCache
+}
+
+// configure sets the rewrite rules
+func (r *destinationRewriter) configure(options common.AgentOptions) {
+	rules, err := parseRewriteRules(options.Rewrites)
+	if err != nil {
+		utils.Logger.Error(err.Error() + ", destinations are not rewritten")
+		rules = nil
+	}
+
+	r.lock.Lock()
+	r.rules = rules
+	r.lock.Unlock()
+}
+
+func (r *destinationRewriter) getRules() []rewriteRule {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.rules
+}
+
+// Resolve implements socks5.NameResolver, it leaves the names matched by a
+// rule to Rewrite
+func (r *destinationRewriter) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	for _, rule := range r.getRules() {
+		if rule.matchesHost(name) {
+			return ctx, nil, nil
+		}
+	}
+
+	return r.resolver.Resolve(ctx, name)
+}
+
+// Rewrite implements socks5.AddressRewriter
+func (r *destinationRewriter) Rewrite(ctx context.Context, request *socks5.Request) (context.Context, *socks5.AddrSpec) {
+	destination := request.DestAddr
+
+	host := destination.FQDN
+	if host == "" {
+		host = destination.IP.String()
+	}
+	requested := net.JoinHostPort(host, strconv.Itoa(destination.Port))
+
+	for _, rule := range r.getRules() {
+		target, ok := rule.apply(requested)
+		if !ok {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, strconv.Itoa(destination.Port))
+		}
+
+		utils.Logger.Debug("Rewrote destination", requested, "to", target)
+		return r.resolve(ctx, target)
+	}
+
+	if destination.IP == nil && destination.FQDN != "" {
+		// Left unresolved by Resolve for a rule of another port
+		return r.resolve(ctx, requested)
+	}
+
+	return ctx, destination
+}
+
+// resolve returns the address of the host:port address, left for the
+// dialer to resolve when the DNS lookup fails
+func (r *destinationRewriter) resolve(ctx context.Context, address string) (context.Context, *socks5.AddrSpec) {
+	host, portString, _ := net.SplitHostPort(address)
+	port, _ := strconv.Atoi(portString)
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ctx, &socks5.AddrSpec{IP: ip, Port: port}
+	}
+
+	ctx, ip, err := r.resolver.Resolve(ctx, host)
+	if err != nil {
+		utils.Logger.Debug("Failed to resolve", host, ":", err.Error())
+	}
+
+	return ctx, &socks5.AddrSpec{FQDN: host, IP: ip, Port: port}
+}
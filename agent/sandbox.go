@@ -0,0 +1,47 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"os"
+)
+
+// enableSandbox restricts the agent to the system calls it needs to relay
+// connections, to limit what an attacker taking over the agent through the
+// channel could do. It cannot be undone.
+func (a *agent) enableSandbox() {
+	options := a.currentOptions()
+
+	// Files the agent removes when it exits
+	removable := []string{a.sockFilePath}
+	if selfFilePath, err := os.Executable(); err == nil {
+		removable = append(removable, selfFilePath)
+	}
+	if options.TransparentMode && options.PidFile != "" {
+		removable = append(removable, options.PidFile)
+	}
+	if options.Shared {
+		removable = append(removable, ShareSocket)
+	}
+
+	err := applySandbox(removable)
+	if err != nil {
+		utils.Logger.Warning("Unable to sandbox the agent: ", err.Error())
+		return
+	}
+
+	utils.Logger.Notice("Agent sandboxed")
+}
@@ -0,0 +1,140 @@
+//go:build linux && amd64
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Values of linux/seccomp.h and linux/audit.h missing from x/sys
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetKillProcess  = 0x80000000
+	seccompRetErrno        = 0x00050000
+	seccompRetAllow        = 0x7fff0000
+	auditArchX86_64        = 0xc000003e
+
+	// Offsets in struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// sandboxSyscalls are the system calls of the Go runtime and of glibc, of the
+// network connections and of the clean up on exit. Files can only be opened
+// for reading, for the resolver configuration and /proc.
+var sandboxSyscalls = []uintptr{
+	unix.SYS_READ, unix.SYS_WRITE, unix.SYS_READV, unix.SYS_WRITEV, unix.SYS_PREAD64,
+	unix.SYS_CLOSE, unix.SYS_FSTAT, unix.SYS_NEWFSTATAT, unix.SYS_LSEEK, unix.SYS_READLINKAT,
+	unix.SYS_FCNTL, unix.SYS_PIPE2, unix.SYS_SPLICE, unix.SYS_EVENTFD2,
+	unix.SYS_UNLINKAT, unix.SYS_FCHMODAT,
+
+	unix.SYS_MMAP, unix.SYS_MUNMAP, unix.SYS_MPROTECT, unix.SYS_MADVISE, unix.SYS_BRK,
+	unix.SYS_CLONE, unix.SYS_EXIT, unix.SYS_EXIT_GROUP, unix.SYS_FUTEX, unix.SYS_SCHED_YIELD,
+	unix.SYS_SCHED_GETAFFINITY, unix.SYS_NANOSLEEP, unix.SYS_CLOCK_NANOSLEEP, unix.SYS_CLOCK_GETTIME,
+	unix.SYS_RESTART_SYSCALL, unix.SYS_ARCH_PRCTL, unix.SYS_UNAME, unix.SYS_GETRANDOM,
+	unix.SYS_GETPID, unix.SYS_GETTID, unix.SYS_TGKILL, unix.SYS_GETRLIMIT, unix.SYS_PRLIMIT64,
+	unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK, unix.SYS_RT_SIGRETURN, unix.SYS_SIGALTSTACK,
+	unix.SYS_TIMER_CREATE, unix.SYS_TIMER_SETTIME, unix.SYS_TIMER_DELETE, unix.SYS_SETITIMER,
+	unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL, unix.SYS_EPOLL_WAIT, unix.SYS_EPOLL_PWAIT,
+	unix.SYS_POLL, unix.SYS_PPOLL, unix.SYS_SET_ROBUST_LIST, unix.SYS_RSEQ,
+
+	unix.SYS_SOCKET, unix.SYS_CONNECT, unix.SYS_BIND, unix.SYS_LISTEN, unix.SYS_ACCEPT4,
+	unix.SYS_GETSOCKOPT, unix.SYS_SETSOCKOPT, unix.SYS_GETSOCKNAME, unix.SYS_GETPEERNAME,
+	unix.SYS_SHUTDOWN, unix.SYS_SENDTO, unix.SYS_RECVFROM, unix.SYS_SENDMSG, unix.SYS_RECVMSG,
+	unix.SYS_SENDMMSG, unix.SYS_RECVMMSG,
+}
+
+// sandboxOpenFlags are the openat flags refused by the sandbox
+const sandboxOpenFlags = unix.O_WRONLY | unix.O_RDWR | unix.O_CREAT | unix.O_TRUNC | unix.O_APPEND
+
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// sandboxFilter returns the seccomp program allowing sandboxSyscalls and
+// read only openat, other system calls fail with EPERM. clone3 fails with
+// ENOSYS instead, for glibc to create threads with clone.
+func sandboxFilter() []unix.SockFilter {
+	const first = 8
+	count := len(sandboxSyscalls)
+
+	// The program ends with the returns, jumps are relative to the next
+	// instruction
+	deny := first + count
+	allow := deny + 1
+	unsupported := allow + 1
+
+	filter := []unix.SockFilter{
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, auditArchX86_64, 1, 0),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetKillProcess),
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.SYS_CLONE3, uint8(unsupported-5), 0),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.SYS_OPENAT, 0, 2),
+		// Lower half of the flags argument
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArgs+2*8),
+		bpfJump(unix.BPF_JMP|unix.BPF_JSET|unix.BPF_K, sandboxOpenFlags, uint8(deny-first), uint8(allow-first)),
+	}
+
+	for i, nr := range sandboxSyscalls {
+		filter = append(filter, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), uint8(allow-(first+i+1)), 0))
+	}
+
+	return append(filter,
+		bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.EPERM)),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetAllow),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.ENOSYS)),
+	)
+}
+
+// applySandbox installs the seccomp filter on every thread of the process.
+// Removing files is allowed anywhere, removable is only needed on OpenBSD.
+func applySandbox(removable []string) error {
+	filter := sandboxFilter()
+	program := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	// No new privileges must be set on the thread installing the filter
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to set no new privileges: %w", err)
+	}
+
+	_, _, errno := syscall.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync,
+		uintptr(unsafe.Pointer(&program)))
+	if errno != 0 {
+		return errors.New("failed to install seccomp filter: " + errno.Error())
+	}
+
+	return nil
+}
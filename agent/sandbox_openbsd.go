@@ -0,0 +1,53 @@
+//go:build openbsd
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+)
+
+// applySandbox pledges the agent to networking and reading the resolver
+// configuration, files in removable can still be removed
+func applySandbox(removable []string) error {
+	unveiled := map[string]string{
+		"/etc/resolv.conf": "r",
+		"/etc/hosts":       "r",
+	}
+	for _, path := range removable {
+		unveiled[path] = "c"
+	}
+
+	for path, permissions := range unveiled {
+		err := unix.Unveil(path, permissions)
+		if err != nil {
+			return fmt.Errorf("failed to unveil %s: %w", path, err)
+		}
+	}
+
+	err := unix.UnveilBlock()
+	if err != nil {
+		return fmt.Errorf("failed to lock unveil: %w", err)
+	}
+
+	err = unix.PledgePromises("stdio rpath cpath inet unix dns")
+	if err != nil {
+		return fmt.Errorf("failed to pledge: %w", err)
+	}
+
+	return nil
+}
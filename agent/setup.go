@@ -0,0 +1,215 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/rsrdesarrollo/SaSSHimi/version"
+	"os"
+)
+
+// applySetup applies the settings sent by the server in the handshake
+func (a *agent) applySetup(msg *common.DataMessage) {
+	setup, err := common.ParseSetup(msg)
+	if err != nil {
+		utils.Logger.Error(err.Error())
+		return
+	}
+
+	a.replyHello(setup)
+
+	if a.embedded {
+		// The environment, the logger and the leak watcher are shared
+		// with the program embedding the agent
+		if len(setup.Env) > 0 {
+			utils.Logger.Warningf("Ignoring %d environment variables from the server, the agent is embedded", len(setup.Env))
+		}
+	} else {
+		a.applyProcessSetup(setup)
+	}
+
+	if setup.Pprof && a.pprofListener == nil {
+		a.enablePprof()
+	}
+
+	a.applyOptions(setup.Options)
+}
+
+// applyProcessSetup applies the settings of setup changing the state of the
+// whole process
+func (a *agent) applyProcessSetup(setup common.AgentSetup) {
+	for name, value := range setup.Env {
+		os.Setenv(name, value)
+	}
+
+	if len(setup.Env) > 0 {
+		utils.Logger.Infof("Set %d environment variables from the server", len(setup.Env))
+	}
+
+	utils.SetVerbosity(setup.Verbosity)
+
+	if setup.DebugLeaks > 0 && utils.LeakInterval() == 0 {
+		utils.SetLeakInterval(setup.DebugLeaks)
+		go utils.WatchLeaks(a.leakCounters()...)
+	}
+}
+
+// replyHello sends the agent version to the server, which refuses to work
+// with an incompatible agent. Servers older than protocol versioning would
+// not understand the reply.
+func (a *agent) replyHello(setup common.AgentSetup) {
+	if setup.Protocol == 0 {
+		utils.Logger.Warning("Server is older than protocol versioning, channel errors are possible")
+		return
+	}
+
+	if err := common.CheckProtocol(setup.Protocol, setup.MinProtocol); err != nil {
+		utils.Logger.Errorf("Server %s is not compatible with this agent %s: %s", setup.Version, version.VersionTag, err.Error())
+	}
+
+	a.sendHello()
+}
+
+// sendHello sends the agent version, in reply to the setup and to pings
+func (a *agent) sendHello() {
+	a.OutQueue.Push(common.NewHelloMessage(common.AgentHello{
+		Protocol:    common.ProtocolVersion,
+		MinProtocol: common.MinProtocolVersion,
+		Version:     version.VersionTag,
+		AuthSock:    os.Getenv("SSH_AUTH_SOCK"),
+	}))
+}
+
+// leakCounters returns the agent maps watched by --debug-leaks
+func (a *agent) leakCounters() []utils.LeakCounter {
+	count := func(size func() int) func() int {
+		return func() int {
+			a.ClientsLock.Lock()
+			defer a.ClientsLock.Unlock()
+			return size()
+		}
+	}
+
+	return []utils.LeakCounter{
+		{Name: "clients", Count: count(func() int { return len(a.Clients) })},
+		{Name: "refused", Count: count(func() int { return len(a.refusedClients) })},
+		{Name: "operators", Count: count(func() int { return len(a.operators) })},
+		{Name: "in_queue", Count: func() int { depth, _ := a.InDepth(); return depth }},
+		{Name: "out_queue", Count: func() int { depth, _ := a.OutQueue.Depth(); return depth }},
+	}
+}
+
+// applyOptions switches the agent to options while it is running
+func (a *agent) applyOptions(options common.AgentOptions) {
+	previous := a.currentOptions().AgentOptions
+
+	if previous.TransparentMode && !options.TransparentMode {
+		utils.Logger.Warning("Transparent mode cannot be disabled while the agent is running")
+		options.TransparentMode = true
+	}
+
+	if previous.Shared && !options.Shared {
+		utils.Logger.Warning("Sharing cannot be disabled while the agent is running")
+		options.Shared = true
+	}
+
+	if previous.Sandbox && !options.Sandbox {
+		utils.Logger.Warning("The sandbox cannot be disabled while the agent is running")
+		options.Sandbox = true
+	}
+
+	if a.embedded {
+		options = withoutProcessOptions(options, previous)
+	}
+
+	if err := common.CheckFrameSize(options.FrameSize); err != nil {
+		utils.Logger.Warning(err.Error() + ", keeping the previous one")
+		options.FrameSize = previous.FrameSize
+	}
+
+	a.optionsLock.Lock()
+	a.options.AgentOptions = options
+	a.optionsLock.Unlock()
+
+	if options.Nice != previous.Nice || options.IONice != previous.IONice ||
+		options.CPUs != previous.CPUs || options.MaxProcs != previous.MaxProcs {
+		a.applyPriority()
+	}
+
+	if options.DialConcurrency != previous.DialConcurrency || options.DialInterval != previous.DialInterval ||
+		options.FastOpen != previous.FastOpen || options.MaxPorts != previous.MaxPorts ||
+		options.DialFailureCache != previous.DialFailureCache {
+		a.dialPacer.configure(options)
+	}
+
+	if options.DisableDNSCache != previous.DisableDNSCache || options.DNSServers != previous.DNSServers {
+		a.dnsCache.configure(options)
+	}
+
+	if options.Rewrites != previous.Rewrites {
+		a.rewriter.configure(options)
+	}
+
+	if options.FileDrop != previous.FileDrop || options.FileDropBind != previous.FileDropBind ||
+		options.FileDropExpiry != previous.FileDropExpiry {
+		a.configureFileDrop(options)
+	}
+
+	if options.MaxMemory != previous.MaxMemory {
+		a.SetQueueMemory(queueMemory(options))
+	}
+
+	if options.CoalesceDelay != previous.CoalesceDelay {
+		a.SetCoalesceDelay(options.CoalesceDelay)
+	}
+
+	if options.HandshakeWorkers != previous.HandshakeWorkers {
+		a.handshakes.configure(options)
+	}
+
+	if options.TransparentMode && !previous.TransparentMode {
+		a.enableTransparency()
+	}
+
+	if options.Shared && !previous.Shared {
+		go a.listenOperators()
+	}
+
+	// Last, what is above may need system calls refused by the sandbox
+	if options.Sandbox && !previous.Sandbox {
+		a.enableSandbox()
+	}
+
+	utils.Logger.Debugf("Agent options set by the server: %+v", options)
+}
+
+// withoutProcessOptions returns options with the settings changing the
+// process left to previous, for an agent embedded in another program
+func withoutProcessOptions(options common.AgentOptions, previous common.AgentOptions) common.AgentOptions {
+	if options.Nice != previous.Nice || options.IONice != previous.IONice ||
+		options.CPUs != previous.CPUs || options.MaxProcs != previous.MaxProcs {
+		utils.Logger.Warning("Ignoring the priority set by the server, the agent is embedded")
+		options.Nice, options.IONice = previous.Nice, previous.IONice
+		options.CPUs, options.MaxProcs = previous.CPUs, previous.MaxProcs
+	}
+
+	if options.TransparentMode || options.Shared || options.Sandbox {
+		utils.Logger.Warning("Ignoring transparent mode, sharing and sandbox set by the server, the agent is embedded")
+		options.TransparentMode, options.Shared, options.Sandbox = false, false, false
+	}
+
+	return options
+}
@@ -0,0 +1,49 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+)
+
+// TestApplyOptionsWhileServing changes the options while clients are being
+// accepted, the race detector reports unguarded accesses
+func TestApplyOptionsWhileServing(t *testing.T) {
+	a := newAgent(Options{})
+	a.embedded = true
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			a.applyOptions(common.AgentOptions{MaxClients: i % 2})
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		a.ClientsLock.Lock()
+		a.canAcceptClient()
+		a.ClientsLock.Unlock()
+	}
+	wg.Wait()
+
+	if options := a.currentOptions(); options.MaxClients != 1 {
+		t.Errorf("MaxClients = %d after the last setup, want 1", options.MaxClients)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	socks4Version  = 4
+	socks4Connect  = 1
+	socks4Granted  = 0x5A
+	socks4Rejected = 0x5B
+)
+
+// isSocks4Request tells if data starts like a SOCKS4 or SOCKS4a request
+func isSocks4Request(data []byte) bool {
+	return len(data) > 0 && data[0] == socks4Version
+}
+
+// socks4Reply returns a SOCKS4 reply with the given status
+func socks4Reply(status byte) []byte {
+	return []byte{0, status, 0, 0, 0, 0, 0, 0}
+}
+
+// parseSocks4Request returns the SOCKS5 connect request equivalent to the
+// SOCKS4 or SOCKS4a request at the start of data, and the size of the
+// request. It returns a zero size if the request is not complete yet.
+func parseSocks4Request(data []byte) ([]byte, int, error) {
+	if len(data) < 9 {
+		return nil, 0, nil
+	}
+
+	if data[1] != socks4Connect {
+		return nil, 0, errors.New("unsupported SOCKS4 command")
+	}
+
+	port := data[2:4]
+	ip := data[4:8]
+
+	userEnd := bytes.IndexByte(data[8:], 0)
+	if userEnd < 0 {
+		return nil, 0, nil
+	}
+	size := 8 + userEnd + 1
+
+	request := []byte{socks5Version, socks4Connect, 0}
+
+	// SOCKS4a sends the host name after the user id with IP 0.0.0.x
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		hostEnd := bytes.IndexByte(data[size:], 0)
+		if hostEnd < 0 {
+			return nil, 0, nil
+		}
+		if hostEnd == 0 || hostEnd > 255 {
+			return nil, 0, errors.New("invalid SOCKS4a host name")
+		}
+
+		request = append(request, 3, byte(hostEnd))
+		request = append(request, data[size:size+hostEnd]...)
+		size += hostEnd + 1
+	} else {
+		request = append(request, 1)
+		request = append(request, ip...)
+	}
+
+	return append(request, port...), size, nil
+}
+
+// rejectSocks4Request answers the first message of a new client when it is
+// a SOCKS4 request that cannot be served: SOCKS4 is disabled or the command
+// is not CONNECT.
+func (a *agent) rejectSocks4Request(msg *common.DataMessage) bool {
+	options := a.currentOptions()
+
+	if options.UseHttpProxy || a.isPprofClient(msg.ClientId) || a.isUpgradeClient(msg.ClientId) || !isSocks4Request(msg.Data) {
+		return false
+	}
+
+	switch {
+	case options.DisableSocks4:
+		utils.Logger.Warningf("SOCKS4 is disabled, refusing client %s", msg.ClientId)
+	case len(msg.Data) > 1 && msg.Data[1] != socks4Connect:
+		utils.Logger.Warningf("Unsupported SOCKS4 command %d from client %s", msg.Data[1], msg.ClientId)
+	default:
+		return false
+	}
+
+	outQueue, id := a.route(msg.ClientId)
+	reply := common.NewMessage(id, socks4Reply(socks4Rejected))
+	reply.ClientSeq = 1
+	outQueue.Push(reply)
+
+	a.refuseClient(msg.ClientId)
+	return true
+}
+
+// socks4Conn speaks SOCKS4 to the client and SOCKS5 to the proxy server:
+// the request written by the client is translated to SOCKS5, and the SOCKS5
+// replies read from the server are translated back to a SOCKS4 reply.
+type socks4Conn struct {
+	net.Conn
+
+	request []byte
+	sent    bool
+
+	replyOnce sync.Once
+	reply     []byte
+	replyErr  error
+}
+
+func newSocks4Conn(conn net.Conn) *socks4Conn {
+	return &socks4Conn{Conn: conn}
+}
+
+func (c *socks4Conn) Write(data []byte) (int, error) {
+	if c.sent {
+		return c.Conn.Write(data)
+	}
+
+	c.request = append(c.request, data...)
+
+	request, size, err := parseSocks4Request(c.request)
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		// Wait for the rest of the request
+		return len(data), nil
+	}
+
+	translated := append([]byte{socks5Version, 1, socksNoAuth}, request...)
+	translated = append(translated, c.request[size:]...)
+	c.request = nil
+	c.sent = true
+
+	_, err = c.Conn.Write(translated)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (c *socks4Conn) CloseWrite() error {
+	return utils.CloseWrite(c.Conn)
+}
+
+func (c *socks4Conn) Read(data []byte) (int, error) {
+	c.replyOnce.Do(c.readReply)
+
+	if len(c.reply) > 0 {
+		n := copy(data, c.reply)
+		c.reply = c.reply[n:]
+		return n, nil
+	}
+
+	if c.replyErr != nil {
+		return 0, c.replyErr
+	}
+
+	return c.Conn.Read(data)
+}
+
+// readReply reads the SOCKS5 method selection and connect replies and
+// prepares the SOCKS4 reply
+func (c *socks4Conn) readReply() {
+	header := make([]byte, 2+4)
+	_, err := io.ReadFull(c.Conn, header)
+	if err != nil || header[1] != socksNoAuth || header[3] != 0 {
+		c.reply = socks4Reply(socks4Rejected)
+		c.replyErr = io.EOF
+		return
+	}
+
+	var addressSize int
+	switch header[5] {
+	case 1:
+		addressSize = 4
+	case 4:
+		addressSize = 16
+	case 3:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(c.Conn, length)
+		addressSize = int(length[0])
+	}
+
+	address := make([]byte, addressSize+2)
+	if err == nil {
+		_, err = io.ReadFull(c.Conn, address)
+	}
+	if err != nil {
+		c.reply = socks4Reply(socks4Rejected)
+		c.replyErr = io.EOF
+		return
+	}
+
+	c.reply = socks4Reply(socks4Granted)
+
+	// Bound address, only an IPv4 one can be given to a SOCKS4 client
+	if header[5] == 1 {
+		binary.BigEndian.PutUint16(c.reply[2:4], binary.BigEndian.Uint16(address[4:6]))
+		copy(c.reply[4:8], address[:4])
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+)
+
+var (
+	// socks4IPRequest connects to 10.0.0.1:80 with user id "bob"
+	socks4IPRequest = []byte{4, 1, 0, 80, 10, 0, 0, 1, 'b', 'o', 'b', 0}
+
+	// socks4aRequest connects to example.com:443 with an empty user id
+	socks4aRequest = append([]byte{4, 1, 1, 187, 0, 0, 0, 1, 0}, "example.com\x00"...)
+)
+
+func TestParseSocks4Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		request []byte
+		size    int
+		fails   bool
+	}{
+		{
+			name:    "SOCKS4 IP",
+			data:    socks4IPRequest,
+			request: []byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80},
+			size:    len(socks4IPRequest),
+		},
+		{
+			name:    "SOCKS4 IP followed by data",
+			data:    append(append([]byte{}, socks4IPRequest...), "GET /"...),
+			request: []byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80},
+			size:    len(socks4IPRequest),
+		},
+		{
+			name:    "SOCKS4a domain",
+			data:    socks4aRequest,
+			request: append([]byte{5, 1, 0, 3, 11}, "example.com\x01\xbb"...),
+			size:    len(socks4aRequest),
+		},
+		{name: "user id without NUL", data: []byte{4, 1, 0, 80, 10, 0, 0, 1, 'b', 'o', 'b'}},
+		{name: "truncated header", data: []byte{4, 1, 0, 80, 10, 0}},
+		{name: "header only", data: socks4IPRequest[:8]},
+		{name: "SOCKS4a domain without NUL", data: socks4aRequest[:len(socks4aRequest)-1]},
+		{name: "SOCKS4a empty domain", data: []byte{4, 1, 1, 187, 0, 0, 0, 1, 0, 0}, fails: true},
+		{name: "BIND command", data: []byte{4, 2, 0, 80, 10, 0, 0, 1, 0}, fails: true},
+	}
+
+	for _, test := range tests {
+		request, size, err := parseSocks4Request(test.data)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if size != test.size || !bytes.Equal(request, test.request) {
+			t.Errorf("%s: got %v (size %d), want %v (size %d)", test.name, request, size, test.request, test.size)
+		}
+	}
+}
+
+func TestIsSocks4Request(t *testing.T) {
+	tests := []struct {
+		data   []byte
+		socks4 bool
+	}{
+		{socks4IPRequest, true},
+		{socks4aRequest, true},
+		{socks4IPRequest[:1], true},
+		{[]byte{5, 1, 0}, false},
+		{[]byte("GET / HTTP/1.1\r\n"), false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if socks4 := isSocks4Request(test.data); socks4 != test.socks4 {
+			t.Errorf("isSocks4Request(%v) = %t", test.data, socks4)
+		}
+	}
+}
+
+// newSocks4TestAgent returns an agent with the given options and only what
+// rejectSocks4Request uses
+func newSocks4TestAgent(options Options) *agent {
+	return &agent{
+		ChannelForwarder: common.ChannelForwarder{OutQueue: common.NewFairQueue()},
+		options:          options,
+		refusedClients:   make(map[string]bool),
+	}
+}
+
+func TestRejectSocks4Request(t *testing.T) {
+	disabled := Options{AgentOptions: common.AgentOptions{DisableSocks4: true}}
+
+	tests := []struct {
+		name     string
+		options  Options
+		data     []byte
+		rejected bool
+	}{
+		{"SOCKS4 disabled", disabled, socks4IPRequest, true},
+		{"SOCKS4a disabled", disabled, socks4aRequest, true},
+		{"SOCKS5 with SOCKS4 disabled", disabled, []byte{5, 1, 0}, false},
+		{"SOCKS4 enabled", Options{}, socks4IPRequest, false},
+		{"SOCKS4a enabled", Options{}, socks4aRequest, false},
+		{"BIND command", Options{}, []byte{4, 2, 0, 80, 10, 0, 0, 1, 0}, true},
+	}
+
+	for _, test := range tests {
+		a := newSocks4TestAgent(test.options)
+
+		if rejected := a.rejectSocks4Request(common.NewMessage("client", test.data)); rejected != test.rejected {
+			t.Errorf("%s: rejected = %t", test.name, rejected)
+			continue
+		}
+		if !test.rejected {
+			continue
+		}
+
+		reply := a.OutQueue.PopWithin(time.Second)
+		if reply == nil || !bytes.Equal(reply.Data, socks4Reply(socks4Rejected)) {
+			t.Errorf("%s: no SOCKS4 rejection sent", test.name)
+			continue
+		}
+		if dead := a.OutQueue.PopWithin(time.Second); dead == nil || !dead.DeadClient || !a.refusedClients["client"] {
+			t.Errorf("%s: client not refused", test.name)
+		}
+	}
+}
+
+// serveSocks5 answers the SOCKS5 method selection and connect request read
+// from conn with a success bound to 192.0.2.1:1080, and returns the request
+func serveSocks5(conn net.Conn, size int) ([]byte, error) {
+	request := make([]byte, size)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, err
+	}
+
+	_, err := conn.Write([]byte{5, 0, 5, 0, 0, 1, 192, 0, 2, 1, 4, 56})
+	return request, err
+}
+
+func TestSocks4Conn(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  []byte
+		expected []byte
+	}{
+		{"SOCKS4 IP", socks4IPRequest, []byte{5, 1, 0, 5, 1, 0, 1, 10, 0, 0, 1, 0, 80}},
+		{"SOCKS4a domain", socks4aRequest, append([]byte{5, 1, 0, 5, 1, 0, 3, 11}, "example.com\x01\xbb"...)},
+	}
+
+	for _, test := range tests {
+		client, server := net.Pipe()
+		conn := newSocks4Conn(client)
+
+		received := make(chan []byte, 1)
+		go func() {
+			request, _ := serveSocks5(server, len(test.expected))
+			received <- request
+		}()
+
+		// The request is split to check it is buffered until complete
+		for _, part := range [][]byte{test.request[:3], test.request[3:10], test.request[10:]} {
+			if _, err := conn.Write(part); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+
+		reply := make([]byte, 8)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if request := <-received; !bytes.Equal(request, test.expected) {
+			t.Errorf("%s: sent %v, want %v", test.name, request, test.expected)
+		}
+		if expected := []byte{0, socks4Granted, 4, 56, 192, 0, 2, 1}; !bytes.Equal(reply, expected) {
+			t.Errorf("%s: reply %v, want %v", test.name, reply, expected)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
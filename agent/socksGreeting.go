@@ -0,0 +1,105 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"strings"
+)
+
+const (
+	socks5Version      = 5
+	socksNoAuth        = 0x00
+	socksNoAcceptable  = 0xFF
+	socksPrivateMethod = 0x80
+)
+
+var socksMethodNames = map[byte]string{
+	0x00: "no authentication",
+	0x01: "GSSAPI",
+	0x02: "username/password",
+	0x03: "CHAP",
+	0x05: "challenge-response",
+	0x06: "SSL",
+	0x07: "NDS",
+	0x08: "multi-authentication framework",
+	0x09: "JSON parameter block",
+}
+
+func socksMethodName(method byte) string {
+	name, prs := socksMethodNames[method]
+	switch {
+	case prs:
+	case method >= socksPrivateMethod && method < socksNoAcceptable:
+		name = "private method"
+	default:
+		name = "unknown method"
+	}
+	return fmt.Sprintf("%s (0x%02x)", name, method)
+}
+
+// parseSocksGreeting returns the authentication methods of a complete
+// SOCKS5 greeting, or false if data is not one.
+func parseSocksGreeting(data []byte) ([]byte, bool) {
+	if len(data) < 2 || data[0] != socks5Version || len(data) < 2+int(data[1]) {
+		return nil, false
+	}
+	return data[2 : 2+int(data[1])], true
+}
+
+// rejectSocksGreeting answers the first message of a new client when it is
+// a SOCKS5 greeting offering only authentication methods the proxy does not
+// support, like GSSAPI used by Windows clients. The SOCKS server would reply
+// too, but the client would stay connected; the client is refused so its
+// connection is closed as RFC 1928 requires.
+func (a *agent) rejectSocksGreeting(msg *common.DataMessage) bool {
+	if a.currentOptions().UseHttpProxy || a.isPprofClient(msg.ClientId) || a.isUpgradeClient(msg.ClientId) {
+		return false
+	}
+
+	methods, ok := parseSocksGreeting(msg.Data)
+	if !ok {
+		return false
+	}
+
+	names := make([]string, 0, len(methods))
+	supported := false
+	for _, method := range methods {
+		if method == socksNoAuth {
+			supported = true
+			continue
+		}
+		names = append(names, socksMethodName(method))
+	}
+
+	if supported {
+		if len(names) > 0 {
+			utils.Logger.Debugf("SOCKS client %s also offered %s, using no authentication", msg.ClientId, strings.Join(names, ", "))
+		}
+		return false
+	}
+
+	utils.Logger.Warningf("SOCKS client %s only offered unsupported authentication methods: %s", msg.ClientId, strings.Join(names, ", "))
+
+	outQueue, id := a.route(msg.ClientId)
+	reply := common.NewMessage(id, []byte{socks5Version, socksNoAcceptable})
+	reply.ClientSeq = 1
+	outQueue.Push(reply)
+
+	a.refuseClient(msg.ClientId)
+	return true
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// tcpStateTimeWait is the TIME_WAIT state in /proc/net/tcp
+const tcpStateTimeWait = "06"
+
+// timeWaitSockets returns the number of TCP sockets in TIME_WAIT on the
+// host, or -1 if unknown
+func timeWaitSockets() int {
+	count := -1
+
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+
+		if count < 0 {
+			count = 0
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 3 && fields[3] == tcpStateTimeWait {
+				count++
+			}
+		}
+		file.Close()
+	}
+
+	return count
+}
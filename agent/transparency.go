@@ -0,0 +1,67 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/rsrdesarrollo/SaSSHimi/version"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+const processTitle = "sasshimi-agent"
+
+// enableTransparency makes the agent easy to spot and audit by the remote
+// host administrators: it writes a pid file, logs to syslog and sets a
+// descriptive process title.
+func (a *agent) enableTransparency() {
+	options := a.currentOptions()
+
+	err := utils.EnableSyslog(processTitle)
+	if err != nil {
+		utils.Logger.Warning("Unable to log to syslog: ", err.Error())
+	}
+
+	err = setProcessTitle(processTitle)
+	if err != nil {
+		utils.Logger.Warning("Unable to set process title: ", err.Error())
+	}
+
+	if options.PidFile != "" {
+		err = ioutil.WriteFile(options.PidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+		if err != nil {
+			utils.Logger.Warning("Unable to write pid file: ", err.Error())
+		}
+	}
+
+	username := "unknown"
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
+	selfFilePath, _ := os.Executable()
+
+	utils.Logger.Noticef("%s %s agent started by user %s (pid %d, binary %s). This process relays SOCKS traffic over an SSH session. See %s",
+		version.ToolName, version.VersionTag, username, os.Getpid(), selfFilePath, version.RepoURL)
+}
+
+func (a *agent) disableTransparency() {
+	options := a.currentOptions()
+
+	if options.PidFile != "" {
+		os.Remove(options.PidFile)
+	}
+}
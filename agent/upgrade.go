@@ -0,0 +1,160 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// isUpgradeClient tells if clientId sends a new agent binary. Only the
+// operator who started the agent can upgrade it.
+func (a *agent) isUpgradeClient(clientId string) bool {
+	outQueue, id := a.route(clientId)
+	return outQueue == a.OutQueue && strings.HasPrefix(id, common.UpgradeClientPrefix)
+}
+
+// receiveUpgrade reads a new agent binary from conn, preceded by a line with
+// its size and SHA-256, and answers OK or ERROR with the reason. The binary
+// replaces the agent at the next restart.
+func (a *agent) receiveUpgrade(conn net.Conn) {
+	defer conn.Close()
+
+	path, err := a.writeUpgrade(bufio.NewReader(conn))
+	if err != nil {
+		utils.Logger.Error("Agent upgrade failed:", err.Error())
+		fmt.Fprintln(conn, "ERROR "+err.Error())
+		return
+	}
+
+	a.upgradeLock.Lock()
+	if a.upgradePath != "" {
+		os.Remove(a.upgradePath)
+	}
+	a.upgradePath = path
+	a.upgradeLock.Unlock()
+
+	utils.Logger.Notice("New agent binary received, waiting for restart")
+	fmt.Fprintln(conn, "OK")
+}
+
+func (a *agent) writeUpgrade(reader *bufio.Reader) (string, error) {
+	var size int64
+	var sum string
+
+	_, err := fmt.Fscanf(reader, "%d %s\n", &size, &sum)
+	if err != nil {
+		return "", fmt.Errorf("invalid upgrade header: %w", err)
+	}
+
+	if utils.RelayOnly {
+		return "", errors.New("upgrades are disabled in relay-only builds")
+	}
+	if !a.restartable {
+		return "", errors.New("this agent cannot be restarted")
+	}
+	if a.currentOptions().Sandbox {
+		return "", errors.New("the sandboxed agent cannot write nor run a new binary")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(executable), "."+filepath.Base(executable)+".")
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(temp, hash), reader, size)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hex.EncodeToString(hash.Sum(nil)) != sum {
+		err = errors.New("SHA-256 mismatch")
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0700)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+
+	return temp.Name(), nil
+}
+
+// restart replaces the agent process with the upgraded binary, or the same
+// one, on the same channel. Connections are closed, the server sends the
+// setup again to the new process.
+func (a *agent) restart() {
+	utils.Logger.Notice("Restarting agent")
+
+	a.ClientsLock.Lock()
+	for id, client := range a.Clients {
+		client.Terminate()
+		delete(a.Clients, id)
+	}
+	a.ClientsLock.Unlock()
+
+	executable, err := os.Executable()
+	if err == nil && !a.restartable {
+		err = errors.New("this agent cannot be restarted")
+	}
+	if err != nil {
+		utils.Logger.Error("Failed to restart agent:", err.Error())
+		a.Close()
+		return
+	}
+
+	a.OutQueue.Push(common.NewRestartMessage())
+	select {
+	case <-a.RestartWritten():
+	case <-time.After(10 * time.Second):
+		utils.Logger.Error("Failed to restart agent: restart message not written")
+		a.Close()
+		return
+	}
+
+	a.removeFiles()
+
+	a.upgradeLock.Lock()
+	if a.upgradePath != "" {
+		err = os.Rename(a.upgradePath, executable)
+	}
+	a.upgradeLock.Unlock()
+
+	if err == nil {
+		err = execAgent(executable)
+	}
+
+	// The channel cannot be used anymore
+	utils.Logger.Error("Failed to restart agent:", err.Error())
+	os.Exit(1)
+}
@@ -0,0 +1,157 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit records operator actions into a tamper-evident session log.
+// Every entry carries the hash of the previous one, so removing or editing an
+// entry breaks the chain and is detected by Verify.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"os"
+	"sync"
+	"time"
+)
+
+type Entry struct {
+	Time    time.Time         `json:"time"`
+	Event   string            `json:"event"`
+	Details map[string]string `json:"details,omitempty"`
+	Prev    string            `json:"prev"`
+	Hash    string            `json:"hash"`
+}
+
+func (e Entry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type recorder struct {
+	path     string
+	file     *os.File
+	lastHash string
+	lock     sync.Mutex
+}
+
+var current *recorder
+
+// Enable starts recording into the session log at path. New entries are
+// chained to the ones already present in the file.
+func Enable(path string) error {
+	entries, err := Verify(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	rec := &recorder{path: path, file: file}
+	if len(entries) > 0 {
+		rec.lastHash = entries[len(entries)-1].Hash
+	}
+
+	current = rec
+	return nil
+}
+
+// Path returns the path of the session log, or an empty string if recording
+// is not enabled.
+func Path() string {
+	if current == nil {
+		return ""
+	}
+	return current.path
+}
+
+// Record appends an event to the session log. It does nothing if recording
+// is not enabled.
+func Record(event string, details map[string]string) {
+	rec := current
+	if rec == nil {
+		return
+	}
+
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	entry := Entry{
+		Time:    time.Now().UTC(),
+		Event:   event,
+		Details: details,
+		Prev:    rec.lastHash,
+	}
+	entry.Hash = entry.computeHash()
+
+	data, _ := json.Marshal(entry)
+	_, err := rec.file.Write(append(data, '\n'))
+	if err != nil {
+		utils.Logger.Error("Failed to write session log: ", err.Error())
+		return
+	}
+	rec.file.Sync()
+
+	rec.lastHash = entry.Hash
+}
+
+// Verify reads the session log at path and checks its hash chain. The
+// entries read before the first inconsistency are always returned.
+func Verify(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	var prevHash string
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		var entry Entry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return entries, fmt.Errorf("malformed entry at line %d: %s", line, err.Error())
+		}
+
+		if entry.Prev != prevHash {
+			return entries, fmt.Errorf("hash chain broken at line %d: entry does not follow previous one", line)
+		}
+
+		if entry.computeHash() != entry.Hash {
+			return entries, fmt.Errorf("hash chain broken at line %d: entry was modified", line)
+		}
+
+		entries = append(entries, entry)
+		prevHash = entry.Hash
+	}
+
+	if err := scanner.Err(); err != nil {
+		return entries, errors.New("failed to read session log: " + err.Error())
+	}
+
+	return entries, nil
+}
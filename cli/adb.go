@@ -0,0 +1,70 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var devicePath string
+
+// adbCmd represents the adb command
+var adbCmd = &cobra.Command{
+	Use:   "adb [serial]",
+	Short: "Run local server tunneling through an Android device with adb",
+	Long: `Push the agent built for the Android device with adb, run it with adb shell
+and use its standard input and output as channel, like the transparent command.
+The device is selected by its serial when more than one is connected. Build
+the agent of the device first, like build-agent --os linux --arch arm64.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		subv := viper.GetViper()
+		setTunnelDefaults(subv)
+		subv.SetDefault("RemoteExecutable", remoteExecutable)
+		subv.SetDefault("AgentCache", agentCache)
+		subv.SetDefault("DevicePath", devicePath)
+
+		serial := ""
+		if len(args) == 1 {
+			serial = args[0]
+		}
+
+		command, err := server.PrepareAdb(subv, serial)
+		if err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+
+		server.RunTransparent(subv, command, bindAddress)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(adbCmd)
+
+	adbCmd.Flags().StringVar(&bindAddress, "bind", "127.0.0.1:1080", "Set local bind address and port")
+	adbCmd.Flags().StringVar(&remoteExecutable, "remote_executable", "", "Path to the agent pushed to the device (default: the one built for the device in the agent cache)")
+	adbCmd.Flags().StringVar(&agentCache, "agent-cache", "", "Directory of the agents made by build-agent (default: user cache directory)")
+	adbCmd.Flags().StringVar(&devicePath, "device-path", server.DefaultDevicePath, "Directory of the device where the agent is pushed")
+	addTunnelFlags(adbCmd)
+	addHealthFlag(adbCmd)
+	addIdleFlag(adbCmd)
+	addExposeFlag(adbCmd)
+	addPprofFlag(adbCmd)
+	addPipeFlag(adbCmd)
+	addAcceptFlags(adbCmd)
+}
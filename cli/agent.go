@@ -15,25 +15,144 @@
 package cli
 
 import (
+	"fmt"
 	"github.com/rsrdesarrollo/SaSSHimi/agent"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"strings"
 )
 
-var useHttpProxy bool
-var keepBinary bool
+var agentOptions agent.Options
+var agentMaxMemory int
+var agentEnv []string
+var agentRewrites []string
+var agentFingerprint bool
 
 // agentCmd represents the agent command
 var agentCmd = &cobra.Command{
 	Use:   "agent",
 	Short: "Run as remote agent process",
 	Run: func(cmd *cobra.Command, args []string) {
-		agent.Run(useHttpProxy, keepBinary)
+		if agentFingerprint {
+			err := agent.PrintFingerprint(os.Stdout)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		agentOptions.MaxMemory = uint64(agentMaxMemory) * 1024 * 1024
+		agentOptions.Rewrites = strings.Join(agentRewrites, "\n")
+		agent.Run(agentOptions)
+	},
+}
+
+// attachCmd is run by the server to join an agent shared by another operator
+var attachCmd = &cobra.Command{
+	Use:    "attach",
+	Short:  "Relay stdin and stdout to the shared agent of the current directory",
+	Hidden: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		agent.RunAttach()
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(agentCmd)
+	rootCmd.AddCommand(attachCmd)
+
+	agentCmd.Flags().BoolVar(&agentOptions.UseHttpProxy, "use-http", false, "Use HTTP proxy instead of HTTP")
+	agentCmd.Flags().BoolVarP(&agentOptions.KeepBinary, "keep-binary", "k", false, "Do not remove binary when closing")
+	agentCmd.Flags().IntVar(&agentOptions.MaxClients, "max-clients", 0, "Maximum number of simultaneous connections (0 for unlimited)")
+	agentCmd.Flags().IntVar(&agentOptions.MaxGoroutines, "max-goroutines", 0, "Refuse new connections above this number of goroutines (0 for unlimited)")
+	agentCmd.Flags().IntVar(&agentMaxMemory, "max-memory", 0, "Refuse new connections above this heap size in MB (0 for unlimited)")
+	agentCmd.Flags().IntVar(&agentOptions.Nice, "nice", 0, "Nice value to apply to the agent process")
+	agentCmd.Flags().StringVar(&agentOptions.IONice, "ionice", "", "I/O scheduling class (idle or best-effort)")
+	agentCmd.Flags().StringVar(&agentOptions.CPUs, "cpus", "", "Comma separated list of CPUs the agent is allowed to run on")
+	agentCmd.Flags().IntVar(&agentOptions.MaxProcs, "max-procs", 0, "Maximum number of CPUs executing the agent simultaneously")
+	agentCmd.Flags().BoolVar(&agentOptions.TransparentMode, "transparent-mode", false, "Write a pid file, log to syslog and set a descriptive process title")
+	agentCmd.Flags().StringVar(&agentOptions.PidFile, "pid-file", "sasshimi-agent.pid", "Pid file written in transparent mode")
+	agentCmd.Flags().BoolVar(&agentOptions.Shared, "shared", false, "Let other operators attach to this agent")
+	agentCmd.Flags().BoolVar(&agentOptions.DisableSocks4, "disable-socks4", false, "Refuse SOCKS4 and SOCKS4a clients, only accept SOCKS5")
+	agentCmd.Flags().IntVar(&agentOptions.DialConcurrency, "dial-concurrency", 0, "Maximum number of connections opened at the same time (0 for unlimited)")
+	agentCmd.Flags().DurationVar(&agentOptions.DialInterval, "dial-interval", 0, "Minimum delay between two new connections")
+	agentCmd.Flags().BoolVar(&agentOptions.FastOpen, "fast-open", false, "Open connections with TCP Fast Open where supported")
+	agentCmd.Flags().BoolVar(&agentOptions.DisableDNSCache, "disable-dns-cache", false, "Resolve every SOCKS host name again instead of caching answers for their TTL")
+	agentCmd.Flags().StringVar(&agentOptions.DNSServers, "dns-servers", "", "DNS servers resolving SOCKS host names, comma separated server[:port] or domain=server[:port] (default: system ones)")
+	agentCmd.Flags().StringArrayVar(&agentRewrites, "rewrite", nil, "Rewrite the destinations of SOCKS requests, like *.corp.local:443=10.1.2.3:8443 (repeatable)")
+	agentCmd.Flags().DurationVar(&agentOptions.DialFailureCache, "dial-failure-cache", 0, "Fail new connections to a destination at once for this long after a connection to it failed")
+	agentCmd.Flags().IntVar(&agentOptions.MaxPorts, "max-ports", 0, "Hold new connections while dials in progress and TIME_WAIT sockets reach this number (0 for unlimited)")
+	agentCmd.Flags().IntVar(&agentOptions.HandshakeWorkers, "handshake-workers", 0, "Number of SOCKS negotiations run at the same time (default 64)")
+	agentCmd.Flags().IntVar(&agentOptions.FrameSize, "frame-size", common.DefaultFrameSize, "Most bytes of connection data in one message")
+	agentCmd.Flags().DurationVar(&agentOptions.ClientIdleTimeout, "client-idle-timeout", 0, "Close connections without traffic in either direction for this long (default: never)")
+	agentCmd.Flags().DurationVar(&agentOptions.CoalesceDelay, "coalesce-delay", 0, "Wait up to this long for more messages to send them in a single write on the channel, like 1ms")
+	agentCmd.Flags().BoolVar(&agentOptions.Sandbox, "sandbox", false, "Restrict the agent system calls once it is running (seccomp on Linux amd64, pledge on OpenBSD)")
+	agentCmd.Flags().StringVar(&agentOptions.FileDrop, "file-drop", "", "Serve the files of this directory over HTTP, each one only once")
+	agentCmd.Flags().StringVar(&agentOptions.FileDropBind, "file-drop-bind", common.DefaultFileDropBind, "Bind address and port of the file drop (random port on the loopback by default)")
+	agentCmd.Flags().DurationVar(&agentOptions.FileDropExpiry, "file-drop-expiry", common.DefaultFileDropExpiry, "Stop the file drop this long after it started")
+	agentCmd.Flags().BoolVar(&agentOptions.Preamble, "preamble", false, "Write a marker before the first message, for the server to skip the login shell output")
+	agentCmd.Flags().MarkHidden("preamble")
+	agentCmd.Flags().BoolVar(&agentFingerprint, "fingerprint", false, "Print the engagement identifier and the SHA-256 of this binary, then exit")
+}
+
+// setAgentDefaults fills subv with the agent options given on the command line
+func setAgentDefaults(subv *viper.Viper) {
+	subv.SetDefault("AgentMaxClients", agentOptions.MaxClients)
+	subv.SetDefault("AgentMaxGoroutines", agentOptions.MaxGoroutines)
+	subv.SetDefault("AgentMaxMemory", agentMaxMemory)
+	subv.SetDefault("AgentNice", agentOptions.Nice)
+	subv.SetDefault("AgentIONice", agentOptions.IONice)
+	subv.SetDefault("AgentCPUs", agentOptions.CPUs)
+	subv.SetDefault("AgentMaxProcs", agentOptions.MaxProcs)
+	subv.SetDefault("AgentTransparentMode", agentOptions.TransparentMode)
+	subv.SetDefault("AgentShared", agentOptions.Shared)
+	subv.SetDefault("AgentDisableSocks4", agentOptions.DisableSocks4)
+	subv.SetDefault("AgentDialConcurrency", agentOptions.DialConcurrency)
+	subv.SetDefault("AgentDialInterval", agentOptions.DialInterval)
+	subv.SetDefault("AgentFastOpen", agentOptions.FastOpen)
+	subv.SetDefault("AgentMaxPorts", agentOptions.MaxPorts)
+	subv.SetDefault("AgentDisableDNSCache", agentOptions.DisableDNSCache)
+	subv.SetDefault("AgentDNSServers", agentOptions.DNSServers)
+	subv.SetDefault("AgentRewrites", agentRewrites)
+	subv.SetDefault("AgentDialFailureCache", agentOptions.DialFailureCache)
+	subv.SetDefault("AgentHandshakeWorkers", agentOptions.HandshakeWorkers)
+	subv.SetDefault("AgentCoalesceDelay", agentOptions.CoalesceDelay)
+	subv.SetDefault("AgentSandbox", agentOptions.Sandbox)
+	subv.SetDefault("AgentFileDrop", agentOptions.FileDrop)
+	subv.SetDefault("AgentFileDropBind", agentOptions.FileDropBind)
+	subv.SetDefault("AgentFileDropExpiry", agentOptions.FileDropExpiry)
+	subv.SetDefault("AgentEnv", agentEnv)
+}
 
-	agentCmd.Flags().BoolVar(&useHttpProxy, "use-http", false, "Use HTTP proxy instead of HTTP")
-	agentCmd.Flags().BoolVarP(&keepBinary, "keep-binary", "k",  false, "Do not remove binary when closing")
+// addAgentFlags registers on cmd the flags used by setAgentDefaults
+func addAgentFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&agentOptions.MaxClients, "agent-max-clients", 0, "Maximum number of simultaneous connections on the agent (0 for unlimited)")
+	cmd.Flags().IntVar(&agentOptions.MaxGoroutines, "agent-max-goroutines", 0, "Agent refuses new connections above this number of goroutines (0 for unlimited)")
+	cmd.Flags().IntVar(&agentMaxMemory, "agent-max-memory", 0, "Agent refuses new connections above this heap size in MB (0 for unlimited)")
+	cmd.Flags().IntVar(&agentOptions.Nice, "agent-nice", 0, "Nice value to apply to the agent process")
+	cmd.Flags().StringVar(&agentOptions.IONice, "agent-ionice", "", "Agent I/O scheduling class (idle or best-effort)")
+	cmd.RegisterFlagCompletionFunc("agent-ionice", completeValues("idle", "best-effort"))
+	cmd.Flags().StringVar(&agentOptions.CPUs, "agent-cpus", "", "Comma separated list of CPUs the agent is allowed to run on")
+	cmd.Flags().IntVar(&agentOptions.MaxProcs, "agent-max-procs", 0, "Maximum number of CPUs executing the agent simultaneously")
+	cmd.Flags().BoolVar(&agentOptions.TransparentMode, "agent-transparent-mode", false, "Make the agent auditable: pid file, syslog and descriptive process title")
+	cmd.Flags().BoolVar(&agentOptions.Shared, "agent-shared", false, "Let other operators attach to the agent with --attach")
+	cmd.Flags().BoolVar(&agentOptions.DisableSocks4, "agent-disable-socks4", false, "Refuse SOCKS4 and SOCKS4a clients, only accept SOCKS5")
+	cmd.Flags().IntVar(&agentOptions.DialConcurrency, "agent-dial-concurrency", 0, "Maximum number of connections the agent opens at the same time (0 for unlimited)")
+	cmd.Flags().DurationVar(&agentOptions.DialInterval, "agent-dial-interval", 0, "Minimum delay between two new connections opened by the agent")
+	cmd.Flags().BoolVar(&agentOptions.FastOpen, "agent-fast-open", false, "Open the agent connections with TCP Fast Open where supported")
+	cmd.Flags().BoolVar(&agentOptions.DisableDNSCache, "agent-disable-dns-cache", false, "Resolve every SOCKS host name again instead of caching answers for their TTL")
+	cmd.Flags().StringVar(&agentOptions.DNSServers, "agent-dns-servers", "", "DNS servers resolving SOCKS host names on the agent, comma separated server[:port] or domain=server[:port] (default: system ones)")
+	cmd.Flags().StringArrayVar(&agentRewrites, "agent-rewrite", nil, "Rewrite the destinations of SOCKS requests on the agent, like *.corp.local:443=10.1.2.3:8443 or ~(.*)\\.lab:(.*)=$1.prod:$2 (repeatable)")
+	cmd.Flags().DurationVar(&agentOptions.DialFailureCache, "agent-dial-failure-cache", 0, "Fail new connections to a destination at once for this long after a connection to it failed")
+	cmd.Flags().IntVar(&agentOptions.MaxPorts, "agent-max-ports", 0, "Agent holds new connections while its dials in progress and TIME_WAIT sockets reach this number (0 for unlimited)")
+	cmd.Flags().IntVar(&agentOptions.HandshakeWorkers, "agent-handshake-workers", 0, "Number of SOCKS negotiations the agent runs at the same time (default 64)")
+	cmd.Flags().DurationVar(&agentOptions.CoalesceDelay, "agent-coalesce-delay", 0, "Agent waits up to this long for more messages to send them in a single write on the channel, like 1ms")
+	cmd.Flags().BoolVar(&agentOptions.Sandbox, "agent-sandbox", false, "Restrict the agent system calls once it is running (seccomp on Linux amd64, pledge on OpenBSD)")
+	cmd.Flags().StringVar(&agentOptions.FileDrop, "agent-file-drop", "", "Serve the files of this remote directory over HTTP from the agent, each one only once, to move tools to other hosts")
+	cmd.Flags().StringVar(&agentOptions.FileDropBind, "agent-file-drop-bind", common.DefaultFileDropBind, "Bind address and port of the agent file drop, on the remote loopback by default (random port)")
+	cmd.Flags().DurationVar(&agentOptions.FileDropExpiry, "agent-file-drop-expiry", common.DefaultFileDropExpiry, "Stop the agent file drop this long after it started")
+	cmd.Flags().StringArrayVar(&agentEnv, "agent-env", nil, "Environment variable NAME=VALUE, or NAME to pass the local value, set on the agent through the channel (repeatable)")
 }
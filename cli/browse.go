@@ -0,0 +1,55 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/cobra"
+)
+
+var browserPath string
+
+// browseCmd represents the browse command
+var browseCmd = &cobra.Command{
+	Use:   "browse [url]",
+	Short: "Open a throwaway browser profile using the tunnel proxy",
+	Long: `Start Chromium, Chrome or Firefox with a temporary profile sending all
+traffic and DNS resolution through the proxy bound with the same --bind
+address. The profile is removed when the browser exits.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		host, port, err := proxyAddress(bindAddress)
+		if err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+
+		url := "about:blank"
+		if len(args) > 0 {
+			url = args[0]
+		}
+
+		if err := server.Browse(browserPath, host, port, url); err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(browseCmd)
+
+	browseCmd.Flags().StringVar(&bindAddress, "bind", "127.0.0.1:1080", "Bind address and port of the proxy")
+	browseCmd.Flags().StringVar(&browserPath, "browser", "", "Browser to run (default: first Chromium, Chrome or Firefox found)")
+}
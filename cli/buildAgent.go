@@ -0,0 +1,129 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/cobra"
+	"os"
+	"runtime"
+)
+
+var agentBuild server.AgentBuild
+var buildRouters bool
+
+// buildAgentCmd represents the build-agent command
+var buildAgentCmd = &cobra.Command{
+	Use:   "build-agent",
+	Short: "Build a stripped agent for a remote platform into the agent cache",
+	Long: `Build a trimmed and stripped agent binary from the SaSSHimi sources,
+optionally packed with upx. Only the agent is built, without the client code,
+unless --full is given. The server command uploads the agent built for the
+remote platform when it is found in the agent cache, instead of the client
+binary itself.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		agentBuild.CacheDir = agentCache
+		if agentBuild.CacheDir == "" {
+			agentBuild.CacheDir = server.DefaultAgentCache()
+		}
+
+		builds := []server.AgentBuild{agentBuild}
+		if buildRouters {
+			builds = nil
+			for _, router := range server.RouterBuilds {
+				build := agentBuild
+				build.GOOS, build.GOARCH = router.GOOS, router.GOARCH
+				build.GOARM, build.GOMIPS = router.GOARM, router.GOMIPS
+				builds = append(builds, build)
+			}
+		}
+
+		asJSON := jsonOutput()
+		built := []builtAgent{}
+		for _, build := range builds {
+			agent, err := buildAgent(build)
+			if err != nil {
+				if asJSON {
+					fmt.Fprintln(os.Stderr, err)
+				} else {
+					fmt.Println(err)
+				}
+				os.Exit(1)
+			}
+
+			if asJSON {
+				built = append(built, agent)
+			} else {
+				fmt.Printf("%s (%d bytes)\n", agent.Path, agent.Size)
+				fmt.Printf("SHA-256: %s\n", agent.SHA256)
+			}
+		}
+
+		if asJSON {
+			printJSON(built)
+		}
+	},
+}
+
+// builtAgent describes an agent written into the cache, printed as a list
+// with --output json
+type builtAgent struct {
+	Path   string `json:"path"`
+	OS     string `json:"os"`
+	Arch   string `json:"arch"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// buildAgent builds an agent into the cache and returns its path, size and
+// hash
+func buildAgent(build server.AgentBuild) (builtAgent, error) {
+	agentFile, err := server.BuildAgent(build, os.Stderr)
+	if err != nil {
+		return builtAgent{}, err
+	}
+
+	info, err := os.Stat(agentFile)
+	if err != nil {
+		return builtAgent{}, err
+	}
+
+	sum, err := utils.FileSHA256(agentFile)
+	if err != nil {
+		return builtAgent{}, err
+	}
+
+	return builtAgent{Path: agentFile, OS: build.GOOS, Arch: build.GOARCH, Size: info.Size(), SHA256: sum}, nil
+}
+
+func init() {
+	rootCmd.AddCommand(buildAgentCmd)
+
+	buildAgentCmd.Flags().StringVar(&agentBuild.GOOS, "os", runtime.GOOS, "Target operating system, as GOOS")
+	buildAgentCmd.Flags().StringVar(&agentBuild.GOARCH, "arch", runtime.GOARCH, "Target architecture, as GOARCH")
+	buildAgentCmd.Flags().StringVar(&agentBuild.GOARM, "goarm", "", "ARM version, as GOARM, like 5 for old devices")
+	buildAgentCmd.Flags().StringVar(&agentBuild.GOMIPS, "gomips", "", "MIPS floating point instructions, as GOMIPS, like softfloat for devices without FPU")
+	buildAgentCmd.Flags().BoolVar(&buildRouters, "routers", false, "Build the agents of common router and IoT devices instead: mips and mipsle softfloat, ARMv5, ARMv7 and arm64 Linux")
+	buildAgentCmd.Flags().StringVar(&agentBuild.Source, "source", ".", "Directory of the SaSSHimi sources")
+	buildAgentCmd.Flags().StringVar(&agentBuild.Tags, "tags", "", "Go build tags, like relayonly")
+	buildAgentCmd.Flags().BoolVar(&agentBuild.Upx, "upx", false, "Pack the agent with upx")
+	buildAgentCmd.Flags().StringVar(&agentBuild.Engagement, "engagement", "", "Engagement identifier embedded in the agent, printed by agent --fingerprint")
+	buildAgentCmd.Flags().BoolVar(&agentBuild.Full, "full", false, "Build the whole client instead of the agent alone")
+	buildAgentCmd.Flags().StringVar(&agentCache, "agent-cache", "", "Agent cache directory (default: user cache directory)")
+	addOutputFlag(buildAgentCmd)
+}
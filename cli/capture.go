@@ -0,0 +1,80 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/agent"
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var captureIface string
+var captureFilter string
+var captureOutput string
+
+// captureCmd represents the capture command
+var captureCmd = &cobra.Command{
+	Use:   "capture <user@host:port|host_id>",
+	Short: "Capture packets on the remote host",
+	Long: `Run a packet capture on the remote host and stream pcap data back
+through the SSH channel. Use "-w -" to pipe it into Wireshark:
+
+  SaSSHimi capture user@host --iface eth0 --filter 'port 445' -w - | wireshark -k -i -`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		subv := hostViper(args[0])
+
+		output := os.Stdout
+		if captureOutput != "-" {
+			file, err := os.OpenFile(utils.ArtifactPath(captureOutput), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				utils.Logger.Fatal("Failed to create capture file ", err.Error())
+			}
+			defer file.Close()
+			output = file
+		}
+
+		err := server.RunCapture(subv, captureIface, captureFilter, output)
+		if err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+	},
+}
+
+// rawCaptureCmd is run by the uploaded agent when tcpdump is not available
+var rawCaptureCmd = &cobra.Command{
+	Use:    "capture-raw",
+	Short:  "Capture packets using raw sockets and write pcap to stdout",
+	Hidden: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		agent.RunCapture(captureIface, agentOptions.KeepBinary)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(captureCmd)
+	captureCmd.ValidArgsFunction = completeHostIds
+	rootCmd.AddCommand(rawCaptureCmd)
+
+	captureCmd.Flags().StringVar(&captureIface, "iface", "any", "Remote interface to capture on")
+	captureCmd.Flags().StringVar(&captureFilter, "filter", "", "Capture filter in tcpdump syntax")
+	captureCmd.Flags().StringVarP(&captureOutput, "output", "w", "-", "Write pcap data to file (- for stdout)")
+	addHostFlags(captureCmd)
+
+	rawCaptureCmd.Flags().StringVar(&captureIface, "iface", "any", "Interface to capture on")
+	rawCaptureCmd.Flags().BoolVarP(&agentOptions.KeepBinary, "keep-binary", "k", false, "Do not remove binary when closing")
+}
@@ -0,0 +1,70 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"sort"
+	"strings"
+)
+
+// completing tells if the command line asks for shell completions, through
+// the hidden command of the scripts made by the completion command
+func completing() bool {
+	return len(os.Args) > 1 && (os.Args[1] == cobra.ShellCompRequestCmd || os.Args[1] == cobra.ShellCompNoDescRequestCmd)
+}
+
+// completeHostIds completes the <user@host:port|host_id> argument with the
+// hosts of the config file.
+func completeHostIds(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	// The config file was read before --config was parsed
+	if cfgFile != "" {
+		readConfig()
+	}
+
+	user := ""
+	if at := strings.LastIndex(toComplete, "@"); at >= 0 {
+		user = toComplete[:at+1]
+	}
+
+	// Hosts are the sections of the config file, their settings are keys
+	// like "hostid.password"
+	seen := map[string]bool{}
+	var hosts []string
+	for _, key := range viper.AllKeys() {
+		hostId := strings.SplitN(key, ".", 2)[0]
+		if hostId == key || seen[hostId] || !strings.HasPrefix(user+hostId, toComplete) {
+			continue
+		}
+		seen[hostId] = true
+		hosts = append(hosts, user+hostId)
+	}
+	sort.Strings(hosts)
+
+	return hosts, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeValues completes a flag with a fixed list of values
+func completeValues(values ...string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return values, cobra.ShellCompDirectiveNoFileComp
+	}
+}
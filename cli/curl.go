@@ -0,0 +1,83 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/cobra"
+	"net"
+	"os"
+	"strings"
+)
+
+var fetchRequest server.FetchRequest
+var fetchData string
+var fetchOutput string
+
+// curlCmd represents the curl command
+var curlCmd = &cobra.Command{
+	Use:   "curl <url>",
+	Short: "Make an HTTP request from the agent side",
+	Long: `Send an HTTP(S) request through the proxy bound with the same --bind
+address, so it is made from the remote host. The status line and headers
+are written to stderr and the body to stdout or --output.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		host, port, err := proxyAddress(bindAddress)
+		if err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+
+		fetchRequest.URL = args[0]
+		if !strings.Contains(fetchRequest.URL, "://") {
+			fetchRequest.URL = "http://" + fetchRequest.URL
+		}
+
+		if fetchData != "" {
+			fetchRequest.Body = strings.NewReader(fetchData)
+			if fetchRequest.Method == "" {
+				fetchRequest.Method = "POST"
+			}
+		}
+
+		output := os.Stdout
+		if fetchOutput != "-" {
+			file, err := os.OpenFile(utils.ArtifactPath(fetchOutput), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				utils.Logger.Fatal("Failed to create output file ", err.Error())
+			}
+			defer file.Close()
+			output = file
+		}
+
+		err = server.Fetch(net.JoinHostPort(host, port), fetchRequest, os.Stderr, output)
+		if err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(curlCmd)
+
+	curlCmd.Flags().StringVar(&bindAddress, "bind", "127.0.0.1:1080", "Bind address and port of the proxy")
+	curlCmd.Flags().StringVarP(&fetchRequest.Method, "request", "X", "", "Request method (default GET, or POST with --data)")
+	curlCmd.Flags().StringArrayVarP(&fetchRequest.Headers, "header", "H", nil, "Extra header, e.g. 'Authorization: Basic ...'")
+	curlCmd.Flags().StringVarP(&fetchData, "data", "d", "", "Request body")
+	curlCmd.Flags().BoolVarP(&fetchRequest.Insecure, "insecure", "k", false, "Do not verify TLS certificates")
+	curlCmd.Flags().BoolVarP(&fetchRequest.FollowRedirects, "location", "L", false, "Follow redirections")
+	curlCmd.Flags().StringVarP(&fetchOutput, "output", "o", "-", "Write the body to file (- for stdout)")
+}
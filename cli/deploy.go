@@ -0,0 +1,115 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/deploy"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+)
+
+var deployTargets string
+var deployConcurrency int
+
+// deployCmd represents the deploy command
+var deployCmd = &cobra.Command{
+	Use:   "deploy --targets <targets_file> | --inventory <inventory_file>",
+	Short: "Deploy agents to many hosts at once, with a proxy for each one",
+	Long: `Upload and start agents on every target of the targets file, or of the
+--group of an Ansible inventory, in parallel, at most --concurrency at a
+time, then serve one SOCKS proxy per target.
+
+The targets file has one "<user@host:port|host_id> [bind]" per line, blank
+lines and lines starting with # are skipped. Inventory hosts take their
+address and credentials from the Ansible variables, and any other variable
+is a setting of the host, like Bind or RemoteAgentPath. Targets without a
+bind address take the ports following the one of --bind. Host ids take their
+settings from the configuration file, like with the server command.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var targets []deploy.Target
+		var hostConfig deploy.HostConfig = targetViper
+		var err error
+
+		switch {
+		case inventoryFile != "" && deployTargets != "":
+			utils.Logger.Fatal("--targets and --inventory cannot be used together")
+		case inventoryFile != "":
+			targets, hostConfig, err = inventoryTargets()
+		case deployTargets != "":
+			targets, err = readTargetsFile(deployTargets)
+		default:
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+
+		err = deploy.Run(targets, bindAddress, deployConcurrency, hostConfig, verboseLevel)
+		if err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+	},
+}
+
+// readTargetsFile reads the targets file at path
+func readTargetsFile(path string) ([]deploy.Target, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New("Failed to open targets file " + err.Error())
+	}
+	defer file.Close()
+
+	return deploy.ReadTargets(file)
+}
+
+// targetViper is hostViper for commands opening tunnels to several targets:
+// the targets that are not host ids get their own copy of the configuration
+// instead of sharing the global one.
+func targetViper(target string) *viper.Viper {
+	user, remoteHost := splitTarget(target)
+
+	subv := viper.Sub(remoteHost)
+	if subv == nil {
+		subv = viper.New()
+		subv.MergeConfigMap(viper.AllSettings())
+	}
+
+	setHostDefaults(subv, user, remoteHost)
+	setTunnelDefaults(subv)
+	setAgentDefaults(subv)
+	if tunnelName == "" {
+		subv.SetDefault("Name", target)
+	}
+	return subv
+}
+
+func init() {
+	rootCmd.AddCommand(deployCmd)
+
+	deployCmd.Flags().StringVar(&deployTargets, "targets", "", "File listing the targets, one per line")
+	deployCmd.Flags().IntVar(&deployConcurrency, "concurrency", 8, "Most agents deployed at the same time")
+	deployCmd.Flags().StringVar(&bindAddress, "bind", "127.0.0.1:1080", "Local bind address and port of the proxy of the first target")
+	addInventoryFlags(deployCmd)
+	addHostFlags(deployCmd)
+	addTunnelFlags(deployCmd)
+	addAcceptFlags(deployCmd)
+	addExposeFlag(deployCmd)
+	addAgentFlags(deployCmd)
+}
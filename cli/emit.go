@@ -0,0 +1,109 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/cobra"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// emitters print the configuration of a client tool using the SOCKS5 proxy
+// at host:port. The proxy has no authentication, and names are resolved on
+// the remote side.
+var emitters = map[string]func(w io.Writer, host, port string){
+	"proxychains": func(w io.Writer, host, port string) {
+		fmt.Fprintln(w, "# proxychains.conf")
+		fmt.Fprintln(w, "strict_chain")
+		fmt.Fprintln(w, "proxy_dns")
+		fmt.Fprintln(w, "tcp_read_time_out 15000")
+		fmt.Fprintln(w, "tcp_connect_time_out 8000")
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, "[ProxyList]")
+		fmt.Fprintf(w, "socks5 %s %s\n", host, port)
+	},
+	"curl": func(w io.Writer, host, port string) {
+		fmt.Fprintln(w, "# ~/.curlrc, or: export ALL_PROXY=socks5h://"+net.JoinHostPort(host, port))
+		fmt.Fprintf(w, "proxy = \"socks5h://%s\"\n", net.JoinHostPort(host, port))
+	},
+	"git": func(w io.Writer, host, port string) {
+		fmt.Fprintln(w, "# ~/.gitconfig, or the .git/config of a single repository")
+		fmt.Fprintln(w, "[http]")
+		fmt.Fprintf(w, "\tproxy = socks5h://%s\n", net.JoinHostPort(host, port))
+		fmt.Fprintln(w, "[core]")
+		fmt.Fprintf(w, "\tsshCommand = ssh -o ProxyCommand='nc -X 5 -x %s %%h %%p'\n", net.JoinHostPort(host, port))
+	},
+	"ssh-config": func(w io.Writer, host, port string) {
+		fmt.Fprintln(w, "# ~/.ssh/config, replace * with the hosts to reach through the tunnel")
+		fmt.Fprintln(w, "Host *")
+		fmt.Fprintf(w, "    ProxyCommand nc -X 5 -x %s %%h %%p\n", net.JoinHostPort(host, port))
+	},
+}
+
+// emitterNames returns the sorted names of the emitters
+func emitterNames() []string {
+	names := make([]string, 0, len(emitters))
+	for name := range emitters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// proxyAddress returns the host and port clients connect to for the proxy
+// bound at bindAddress: the first address of the list, with loopback in
+// place of unspecified addresses.
+func proxyAddress(bindAddress string) (string, string, error) {
+	address, err := utils.NormalizeBindAddress(strings.Split(bindAddress, ",")[0])
+	if err != nil {
+		return "", "", err
+	}
+
+	host, port, _ := net.SplitHostPort(address)
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	return host, port, nil
+}
+
+// emitCmd represents the emit command
+var emitCmd = &cobra.Command{
+	Use:       "emit <" + strings.Join(emitterNames(), "|") + ">",
+	Short:     "Print client tool configuration using the tunnel proxy",
+	Long:      `Print a ready to paste configuration snippet for a client tool, pointing at the proxy bound with the same --bind address.`,
+	Args:      cobra.ExactValidArgs(1),
+	ValidArgs: emitterNames(),
+	Run: func(cmd *cobra.Command, args []string) {
+		host, port, err := proxyAddress(bindAddress)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		emitters[args[0]](os.Stdout, host, port)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(emitCmd)
+
+	emitCmd.Flags().StringVar(&bindAddress, "bind", "127.0.0.1:1080", "Bind address and port of the proxy")
+}
@@ -0,0 +1,95 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+// example is a common pivot scenario and the commands for it. SaSSHimi at the
+// start of a command is replaced with the name of the executable.
+type example struct {
+	title    string
+	commands []string
+}
+
+var examples = []example{
+	{"Open a SOCKS proxy through a host without TCP forwarding", []string{
+		"SaSSHimi server user@10.0.0.5:22 --bind 127.0.0.1:1080",
+	}},
+	{"Use a host of the config file, with its own user, key and settings", []string{
+		"SaSSHimi server dmz --config ~/.SaSSHimi.yaml",
+	}},
+	{"Run nmap and other tools through the proxy with proxychains", []string{
+		"SaSSHimi emit proxychains --bind 127.0.0.1:1080 > proxychains.conf",
+		"proxychains4 -f proxychains.conf nmap -sT -Pn -p 22,80,445 192.168.1.0/24",
+	}},
+	{"Browse the internal network, or fetch a single page", []string{
+		"SaSSHimi browse http://intranet.corp.local/",
+		"SaSSHimi curl -k https://intranet.corp.local/server-status",
+	}},
+	{"Check the remote commands before touching the host", []string{
+		"SaSSHimi server user@host --dry-run",
+	}},
+	{"Pivot through a restricted shell or a host without writable /tmp", []string{
+		"SaSSHimi server user@host --upload-method sftp --remote_agent_path /dev/shm",
+	}},
+	{"Deploy a small agent to a router", []string{
+		"SaSSHimi build-agent --routers",
+		"SaSSHimi server root@192.168.1.1",
+	}},
+	{"Capture packets on the remote host into Wireshark", []string{
+		"SaSSHimi capture user@host --iface eth0 --filter 'port 445' -w - | wireshark -k -i -",
+	}},
+	{"Run the agent as root to reach low ports or capture packets", []string{
+		"SaSSHimi server user@host --elevate sudo",
+	}},
+	{"Share a tunnel with the other operators of the engagement", []string{
+		"SaSSHimi teamserver --listen 0.0.0.0:7443 --cert server.crt --key server.key --ca operators-ca.crt",
+		"SaSSHimi operator teamserver:7443 host_id --cert alice.crt --key alice.key --ca server-ca.crt",
+	}},
+	{"Pivot through an Android device plugged with adb", []string{
+		"SaSSHimi build-agent --os linux --arch arm64",
+		"SaSSHimi adb",
+	}},
+}
+
+// examplesCmd represents the examples command
+var examplesCmd = &cobra.Command{
+	Use:   "examples",
+	Short: "Print ready-made invocations for common pivot scenarios",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		name := rootCmd.Name()
+		for i, example := range examples {
+			if i > 0 {
+				fmt.Println("")
+			}
+			fmt.Println("# " + example.title)
+			for _, command := range example.commands {
+				if strings.HasPrefix(command, "SaSSHimi ") {
+					command = name + strings.TrimPrefix(command, "SaSSHimi")
+				}
+				fmt.Println(command)
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(examplesCmd)
+}
@@ -0,0 +1,173 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// initCmd represents the init command
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Add a host to the config file, asking for its settings",
+	Long: `Ask for the target, the authentication method, the proxy bind address and
+the remote agent path of a host, test the connection with them and add the
+host to the config file, to be used as "server <host_id>".`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := runInit(bufio.NewReader(os.Stdin))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+// ask prints question with the default answer and returns the line read, or
+// the default answer for an empty line
+func ask(input *bufio.Reader, question string, answer string) string {
+	if answer != "" {
+		fmt.Printf("%s [%s]: ", question, answer)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+
+	line, _ := input.ReadString('\n')
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return answer
+}
+
+func runInit(input *bufio.Reader) error {
+	configFile := cfgFile
+	if configFile == "" {
+		configFile = viper.ConfigFileUsed()
+	}
+	if configFile == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			return err
+		}
+		configFile = filepath.Join(home, ".SaSSHimi.yaml")
+	}
+	fmt.Println("Adding a host to", configFile)
+
+	target := ask(input, "Target (user@host:port)", "")
+	if target == "" {
+		return errors.New("A target is required")
+	}
+	tokens := strings.Split(target, "@")
+	user, remoteHost := strings.Join(tokens[:len(tokens)-1], "@"), tokens[len(tokens)-1]
+
+	hostId := ask(input, "Host id", strings.Split(remoteHost, ":")[0])
+	if strings.ContainsAny(hostId, ".@: ") {
+		return errors.New("Host id " + hostId + " must not contain dots, colons, spaces or @")
+	}
+	if viper.IsSet(hostId) {
+		return errors.New("Host " + hostId + " is already in " + configFile)
+	}
+
+	host := viper.New()
+	host.Set("RemoteHost", remoteHost)
+	if user != "" {
+		host.Set("User", user)
+	}
+	settings := []string{"User", "RemoteHost"}
+
+	switch ask(input, "Authentication (key or password)", "key") {
+	case "key":
+		privateKey, err := homedir.Expand(ask(input, "Private key", "~/.ssh/id_rsa"))
+		if err != nil {
+			return err
+		}
+		key, err := ioutil.ReadFile(privateKey)
+		if err != nil {
+			return errors.New("Unable to read private key: " + err.Error())
+		}
+		if _, err := ssh.ParsePrivateKey(key); err != nil {
+			return errors.New("Unable to parse private key, encrypted keys are not supported: " + err.Error())
+		}
+		host.Set("PrivateKey", privateKey)
+		settings = append(settings, "PrivateKey")
+
+	case "password":
+		if strings.HasPrefix(strings.ToLower(ask(input, "Store the password in the config file (y/N)", "n")), "y") {
+			fmt.Print("Password: ")
+			password, _ := terminal.ReadPassword(int(syscall.Stdin))
+			fmt.Println("")
+			host.Set("Password", string(password))
+			settings = append(settings, "Password")
+		}
+
+	default:
+		return errors.New("Unknown authentication method, use key or password")
+	}
+
+	host.Set("Bind", ask(input, "Proxy bind address", "127.0.0.1:1080"))
+	host.Set("RemoteAgentPath", ask(input, "Remote agent path", "."))
+	settings = append(settings, "Bind", "RemoteAgentPath")
+
+	fmt.Println("Testing the connection...")
+	description, err := server.CheckConnection(host)
+	if err != nil {
+		fmt.Println("Connection test failed:", err)
+		if !strings.HasPrefix(strings.ToLower(ask(input, "Add the host anyway (y/N)", "n")), "y") {
+			return errors.New("Host not added")
+		}
+	} else {
+		fmt.Println("Connection OK:", description)
+	}
+
+	// The section is appended to keep the comments and layout of the file
+	section := "\n" + hostId + ":\n"
+	for _, setting := range settings {
+		if host.IsSet(setting) {
+			section += "  " + setting + ": " + strconv.Quote(host.GetString(setting)) + "\n"
+		}
+	}
+
+	file, err := os.OpenFile(configFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(section)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Host %s added, run: %s server %s\n", hostId, rootCmd.Name(), hostId)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+}
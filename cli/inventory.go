@@ -0,0 +1,68 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/deploy"
+	"github.com/rsrdesarrollo/SaSSHimi/inventory"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+var inventoryFile string
+var inventoryGroup string
+
+// addInventoryFlags registers on cmd the flags selecting hosts of an
+// inventory, used by inventoryTargets
+func addInventoryFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&inventoryFile, "inventory", "", "Ansible inventory file, in INI or YAML (.yml, .yaml) format")
+	cmd.Flags().StringVar(&inventoryGroup, "group", inventory.All, "Group or host of the inventory to operate on")
+}
+
+// inventoryTargets returns the targets of the inventory group, and their
+// configuration: targetViper with the settings of the inventory host on top
+func inventoryTargets() ([]deploy.Target, deploy.HostConfig, error) {
+	inv, err := inventory.Read(inventoryFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hosts, err := inv.Hosts(inventoryGroup)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	settings := make(map[string]map[string]interface{})
+	targets := make([]deploy.Target, len(hosts))
+	for index, host := range hosts {
+		settings[host.Name] = host.Settings()
+		targets[index].Host = host.Name
+		for key, value := range settings[host.Name] {
+			if strings.EqualFold(key, "Bind") {
+				targets[index].Bind, _ = value.(string)
+			}
+		}
+	}
+
+	hostConfig := func(target string) *viper.Viper {
+		subv := targetViper(target)
+		for key, value := range settings[target] {
+			subv.Set(key, value)
+		}
+		return subv
+	}
+	return targets, hostConfig, nil
+}
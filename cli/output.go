@@ -0,0 +1,52 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// outputFormat is the --output flag of the commands printing results that
+// scripts may want to read
+var outputFormat string
+
+func addOutputFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&outputFormat, "output", "text", "Output format: text or json, with stable field names for scripts")
+	cmd.RegisterFlagCompletionFunc("output", completeValues("text", "json"))
+}
+
+// jsonOutput tells if the results must be printed as JSON, and exits on an
+// unknown output format
+func jsonOutput() bool {
+	switch outputFormat {
+	case "text":
+		return false
+	case "json":
+		return true
+	}
+	fmt.Fprintln(os.Stderr, "Unknown output format "+outputFormat+", use text or json")
+	os.Exit(1)
+	return false
+}
+
+// printJSON prints value as indented JSON on stdout
+func printJSON(value interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
@@ -0,0 +1,102 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/cobra"
+	"net"
+	"os"
+	"time"
+)
+
+var replayClients []string
+var replayList bool
+var replayWait time.Duration
+
+// replayCmd represents the replay command
+var replayCmd = &cobra.Command{
+	Use:   "replay <mirror_file>",
+	Short: "Send again connections recorded by --mirror through the tunnel",
+	Long: `Read a mirror file written by the --mirror option of a tunnel and send
+again the data each client sent to its destination, through the proxy
+bound with the same --bind address. What the destinations answer is written
+to stdout. Use --list to show the recorded clients and --client to choose
+which ones to replay.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		file, err := os.Open(utils.ArtifactPath(args[0]))
+		if err != nil {
+			utils.Logger.Fatal("Failed to open mirror file ", err.Error())
+		}
+
+		records, err := server.ReadMirror(file)
+		file.Close()
+		if err != nil {
+			utils.Logger.Warning("Mirror file", args[0], "read partially:", err.Error())
+		}
+
+		sessions := server.ReplaySessions(records)
+
+		if replayList {
+			for _, session := range sessions {
+				var sent, received int
+				for _, record := range session.Records {
+					if record.Direction == ">" {
+						sent += len(record.Data)
+					} else {
+						received += len(record.Data)
+					}
+				}
+				fmt.Printf("%s\t%s\t%s\tsent %d\treceived %d\n", session.Records[0].Time.Format(time.RFC3339),
+					session.Client, session.Destination, sent, received)
+			}
+			return
+		}
+
+		host, port, err := proxyAddress(bindAddress)
+		if err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+
+		selected := make(map[string]bool)
+		for _, client := range replayClients {
+			selected[client] = true
+		}
+
+		for _, session := range sessions {
+			if len(selected) > 0 && !selected[session.Client] {
+				continue
+			}
+
+			utils.Logger.Notice("Replaying client", session.Client, "to", session.Destination)
+			err := server.Replay(net.JoinHostPort(host, port), session, os.Stdout, replayWait)
+			if err != nil {
+				utils.Logger.Error("Replay of client " + session.Client + " failed: " + err.Error())
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	replayCmd.Flags().StringVar(&bindAddress, "bind", "127.0.0.1:1080", "Bind address and port of the proxy")
+	replayCmd.Flags().StringArrayVar(&replayClients, "client", nil, "Only replay this client, as shown by --list, repeatable (default: all)")
+	replayCmd.Flags().BoolVar(&replayList, "list", false, "List the clients recorded in the mirror file instead of replaying them")
+	replayCmd.Flags().DurationVar(&replayWait, "wait", 2*time.Second, "Longest wait for the destination to answer before sending the next data")
+}
@@ -0,0 +1,84 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+)
+
+// reportOutput is the report printed with --output json
+type reportOutput struct {
+	Entries  []audit.Entry `json:"entries"`
+	Verified bool          `json:"verified"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// reportCmd represents the report command
+var reportCmd = &cobra.Command{
+	Use:   "report <session_log>",
+	Short: "Verify a session log and print the engagement timeline",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := audit.Verify(utils.ArtifactPath(args[0]))
+
+		if jsonOutput() {
+			report := reportOutput{Entries: entries, Verified: err == nil}
+			if report.Entries == nil {
+				report.Entries = []audit.Entry{}
+			}
+			if err != nil {
+				report.Error = err.Error()
+			}
+			printJSON(report)
+			if err != nil {
+				os.Exit(1)
+			}
+			return
+		}
+
+		for _, entry := range entries {
+			keys := make([]string, 0, len(entry.Details))
+			for key := range entry.Details {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			details := make([]string, 0, len(keys))
+			for _, key := range keys {
+				details = append(details, key+"="+entry.Details[key])
+			}
+
+			fmt.Printf("%s  %-18s %s\n", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Event, strings.Join(details, " "))
+		}
+
+		fmt.Println("")
+		if err != nil {
+			fmt.Println("INTEGRITY CHECK FAILED:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Integrity verified: %d entries\n", len(entries))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reportCmd)
+	addOutputFlag(reportCmd)
+}
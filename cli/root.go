@@ -16,8 +16,12 @@ package cli
 
 import (
 	"fmt"
-	"github.com/op/go-logging"
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/state"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
@@ -26,11 +30,17 @@ import (
 
 var cfgFile string
 var verboseLevel int
+var quiet bool
 var bindAddress string
+var exposeProxy bool
+var sessionLog string
+var debugLeaks time.Duration
+var engagementDir string
+var stateFile string
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   os.Args[0],
+	Use:   filepath.Base(os.Args[0]),
 	Short: "Generate SSH Dynamic Tunnels when AllowTcpForwarding is off",
 	Long: `This tool aims to create a Dynamic Tunnel trougth a shell channel 
 of SSH using stdin and stdout to transmiti information`,
@@ -53,11 +63,81 @@ func init() {
 	// will be global for your application.
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.SaSSHimi.yaml)")
 	rootCmd.PersistentFlags().CountVarP(&verboseLevel, "verbose", "v", "verbose level")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Only log errors")
+	rootCmd.PersistentFlags().StringVar(&engagementDir, "engagement-dir", "", "Directory, only readable by you, holding session logs, captures, mirrors, cached agents and other files written with a relative path")
+	rootCmd.PersistentFlags().StringVar(&sessionLog, "session-log", "", "Record operator actions into a tamper-evident session log")
+	rootCmd.PersistentFlags().StringVar(&stateFile, "state-file", "", "File listing the deployed agents (default is sasshimi-state.json in the engagement directory, or $HOME/.SaSSHimi-state.json)")
+	rootCmd.PersistentFlags().DurationVar(&debugLeaks, "debug-leaks", 0, "Log goroutine, open file and client counts at this interval and warn when they keep growing")
+	rootCmd.PersistentFlags().Lookup("debug-leaks").NoOptDefVal = "1m"
 }
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
+	readConfig()
 
+	if completing() {
+		// Completions must not open the session log nor log anything
+		return
+	}
+
+	if engagementDir == "" {
+		engagementDir = viper.GetString("EngagementDir")
+	}
+
+	if engagementDir != "" {
+		engagementDir, _ = homedir.Expand(engagementDir)
+		if err := utils.SetEngagementDir(engagementDir); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if sessionLog == "" {
+		sessionLog = viper.GetString("SessionLog")
+	}
+
+	if sessionLog != "" {
+		err := audit.Enable(utils.ArtifactPath(sessionLog))
+		if err != nil {
+			fmt.Println("Unable to open session log:", err)
+			os.Exit(1)
+		}
+	}
+
+	if stateFile == "" {
+		stateFile = viper.GetString("StateFile")
+	}
+	if stateFile == "" {
+		stateFile = defaultStateFile()
+	}
+	stateFile, _ = homedir.Expand(stateFile)
+	state.Enable(utils.ArtifactPath(stateFile))
+
+	if quiet || (verboseLevel == 0 && viper.GetBool("Quiet")) {
+		verboseLevel = -1
+	}
+
+	utils.SetVerbosity(verboseLevel)
+	utils.SetLeakInterval(debugLeaks)
+}
+
+// defaultStateFile returns the state file used without --state-file: in the
+// engagement directory if one is set, in the home directory otherwise
+func defaultStateFile() string {
+	if engagementDir != "" {
+		return "sasshimi-state.json"
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return ".SaSSHimi-state.json"
+	}
+	return filepath.Join(home, ".SaSSHimi-state.json")
+}
+
+// readConfig reads the config file given with --config, or the default one,
+// and the ENV variables.
+func readConfig() {
 	if cfgFile != "" {
 		// Use config file from the flag.
 		viper.SetConfigFile(cfgFile)
@@ -75,12 +155,4 @@ func initConfig() {
 
 	viper.AutomaticEnv() // read in environment variables that match
 	viper.ReadInConfig()
-
-	if verboseLevel == 0 {
-		logging.SetLevel(logging.NOTICE, "SaSSHimi")
-	} else if verboseLevel == 1 {
-		logging.SetLevel(logging.INFO, "SaSSHimi")
-	} else {
-		logging.SetLevel(logging.DEBUG, "SaSSHimi")
-	}
 }
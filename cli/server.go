@@ -15,16 +15,124 @@
 package cli
 
 import (
+	"github.com/rsrdesarrollo/SaSSHimi/common"
 	"github.com/rsrdesarrollo/SaSSHimi/server"
 	"github.com/rsrdesarrollo/SaSSHimi/utils"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"os"
 	"strings"
+	"time"
 )
 
 var idFile string
 var remoteExecutable string
 var remoteAgentPath string
+var restrictedCrypto bool
+var uploadMethod string
+var uploadCompression string
+var elevate string
+var forwardAgent bool
+var noAgentForwarding bool
+var upgradeAgent string
+var agentCache string
+var runTemplate string
+var keepRemoteEnv bool
+var fallbackAgentPaths []string
+var agentInterpreter string
+var attachAgent bool
+var dryRun bool
+var keepAliveInterval time.Duration
+var keepAliveJitter time.Duration
+var keepAlivePadding int
+var coalesceDelay time.Duration
+var clientIdleTimeout time.Duration
+var frameSize int
+var tunnelName string
+var healthBind string
+var idleTimeout time.Duration
+var pprofBind string
+var proxyPipe string
+var listenBacklog int
+var acceptQueue int
+var priorityRules []string
+var earlyReply bool
+var geoIPDatabases []string
+var scope []string
+var scopeWebhook string
+var mirrorRules []string
+var probeInterval time.Duration
+var probeFailures int
+var handshakeTimeout time.Duration
+var strictChannel bool
+var sshBind string
+var sshAuthorizedKeys string
+var sshHostKey string
+var tlsForwardSpecs []string
+var tlsClientCert string
+var tlsClientKey string
+var tlsCA string
+var tlsInsecure bool
+var sniBind string
+var sniRoutes []string
+var webBind string
+var webTarget string
+var webInsecure bool
+var hostsEntries []string
+var hostsFromRoutes bool
+
+// hostViper returns the configuration for a <user@host:port|host_id> target,
+// filled with the defaults given on the command line.
+func hostViper(target string) *viper.Viper {
+	user, remoteHost := splitTarget(target)
+
+	subv := viper.Sub(remoteHost)
+
+	if subv == nil {
+		subv = viper.GetViper()
+	}
+
+	setHostDefaults(subv, user, remoteHost)
+	return subv
+}
+
+// splitTarget returns the user, empty if none, and the host of a
+// <user@host:port|host_id> target
+func splitTarget(target string) (string, string) {
+	tokens := strings.Split(target, "@")
+	return strings.Join(tokens[:len(tokens)-1], "@"), tokens[len(tokens)-1]
+}
+
+// setHostDefaults fills subv with the user and host of a target and the host
+// options given on the command line
+func setHostDefaults(subv *viper.Viper, user string, remoteHost string) {
+	utils.Logger.Debug("Parsed User:", user)
+	utils.Logger.Debug("Parsed Remote Host:", remoteHost)
+
+	if user != "" {
+		subv.Set("User", user)
+	}
+
+	subv.SetDefault("RemoteHost", remoteHost)
+	subv.SetDefault("PrivateKey", idFile)
+	subv.SetDefault("RemoteExecutable", remoteExecutable)
+	subv.SetDefault("RemoteAgentPath", remoteAgentPath)
+	subv.SetDefault("RestrictedCrypto", restrictedCrypto)
+	subv.SetDefault("UploadMethod", uploadMethod)
+	subv.SetDefault("UploadCompression", uploadCompression)
+	subv.SetDefault("AgentCache", agentCache)
+	subv.SetDefault("RunTemplate", runTemplate)
+	subv.SetDefault("KeepRemoteEnv", keepRemoteEnv)
+	subv.SetDefault("FallbackAgentPaths", fallbackAgentPaths)
+	subv.SetDefault("AgentInterpreter", agentInterpreter)
+	subv.SetDefault("AttachAgent", attachAgent)
+	subv.SetDefault("Elevate", elevate)
+	subv.SetDefault("ForwardAgent", forwardAgent)
+	if noAgentForwarding {
+		// Not a default, so the configuration file cannot allow it back
+		subv.Set("NoAgentForwarding", true)
+	}
+}
 
 // serverCmd represents the server command
 var serverCmd = &cobra.Command{
@@ -33,27 +141,47 @@ var serverCmd = &cobra.Command{
 	Long:  ``,
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		tokens := strings.Split(args[0], "@")
-
-		user, remoteHost := strings.Join(tokens[:len(tokens)-1], "@"), tokens[len(tokens)-1]
-
-		subv := viper.Sub(remoteHost)
+		subv := hostViper(args[0])
+		setTunnelDefaults(subv)
+		setAgentDefaults(subv)
 
-		if subv == nil {
-			subv = viper.GetViper()
+		if dryRun {
+			server.DryRun(subv, verboseLevel, os.Stdout)
+			return
 		}
 
-		utils.Logger.Debug("Parsed User:", user)
-		utils.Logger.Debug("Parsed Remote Host:", remoteHost)
+		subv.SetDefault("UpgradeAgent", upgradeAgent)
+		subv.SetDefault("SSHBind", sshBind)
+		subv.SetDefault("SSHAuthorizedKeys", sshAuthorizedKeys)
+		subv.SetDefault("SSHHostKey", sshHostKey)
+		subv.SetDefault("TLSForward", tlsForwardSpecs)
+		subv.SetDefault("TLSClientCert", tlsClientCert)
+		subv.SetDefault("TLSClientKey", tlsClientKey)
+		subv.SetDefault("TLSCA", tlsCA)
+		subv.SetDefault("TLSInsecure", tlsInsecure)
+		subv.SetDefault("SNIBind", sniBind)
+		subv.SetDefault("SNIRoute", sniRoutes)
+		subv.SetDefault("WebBind", webBind)
+		subv.SetDefault("WebTarget", webTarget)
+		subv.SetDefault("WebInsecure", webInsecure)
+		subv.SetDefault("Hosts", hostsEntries)
+		subv.SetDefault("HostsFromRoutes", hostsFromRoutes)
+		subv.SetDefault("ProbeInterval", probeInterval)
+		subv.SetDefault("ProbeFailures", probeFailures)
+		subv.SetDefault("HandshakeTimeout", handshakeTimeout)
+		subv.SetDefault("StrictChannel", strictChannel)
 
-		if user != "" {
-			subv.Set("User", user)
+		if !cmd.Flags().Changed("bind") && subv.IsSet("Bind") {
+			bindAddress = subv.GetString("Bind")
 		}
 
-		subv.SetDefault("RemoteHost", remoteHost)
-		subv.SetDefault("PrivateKey", idFile)
-		subv.SetDefault("RemoteExecutable", remoteExecutable)
-		subv.SetDefault("RemoteAgentPath", remoteAgentPath)
+		server.ReloadConfig = func() *viper.Viper {
+			readConfig()
+			subv := hostViper(args[0])
+			setTunnelDefaults(subv)
+			setAgentDefaults(subv)
+			return subv
+		}
 
 		server.Run(subv, bindAddress, verboseLevel)
 	},
@@ -61,9 +189,133 @@ var serverCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(serverCmd)
+	serverCmd.ValidArgsFunction = completeHostIds
 
 	serverCmd.Flags().StringVar(&bindAddress, "bind", "127.0.0.1:1080", "Set local bind address and port")
-	serverCmd.Flags().StringVarP(&idFile, "identity_file", "i", "", "Path to private key")
-	serverCmd.Flags().StringVarP(&remoteExecutable, "remote_executable", "", "", "Path to SaSSHimi executable to be run on the remote machine")
-	serverCmd.Flags().StringVarP(&remoteAgentPath, "remote_agent_path", "", "", "Path on remote machine where to run SaSSHimi agent")
+	serverCmd.Flags().StringVar(&agentInterpreter, "agent-interpreter", "", "Run a Python agent script with this remote interpreter instead of uploading the agent binary")
+	serverCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the remote commands and settings without connecting")
+	serverCmd.Flags().BoolVar(&attachAgent, "attach", false, "Attach to the agent shared by another operator instead of deploying a new one")
+	serverCmd.Flags().StringVar(&upgradeAgent, "upgrade-agent", "", "Send this agent binary through the channel once the tunnel is open and restart the agent with it")
+	serverCmd.Flags().StringVar(&sshBind, "ssh-bind", "", "Bind address and port of an SSH server only allowing port forwarding through the tunnel, for ssh -D")
+	serverCmd.Flags().StringVar(&sshAuthorizedKeys, "ssh-authorized-keys", "", "Public keys accepted by the SSH server, in authorized_keys format")
+	serverCmd.Flags().StringVar(&sshHostKey, "ssh-host-key", "", "Private host key of the SSH server (default: new key on each run)")
+	serverCmd.Flags().StringArrayVar(&tlsForwardSpecs, "tls-forward", nil, "Local port whose plaintext connections reach a TLS service through the tunnel, like 127.0.0.1:8443=intranet:443 (repeatable)")
+	serverCmd.Flags().StringVar(&tlsClientCert, "tls-client-cert", "", "PEM client certificate presented by the --tls-forward connections")
+	serverCmd.Flags().StringVar(&tlsClientKey, "tls-client-key", "", "PEM private key of --tls-client-cert")
+	serverCmd.Flags().StringVar(&tlsCA, "tls-ca", "", "PEM authorities trusted for the --tls-forward targets (default: system ones)")
+	serverCmd.Flags().BoolVar(&tlsInsecure, "tls-insecure", false, "Do not verify the certificates of the --tls-forward targets")
+	serverCmd.Flags().StringVar(&sniBind, "sni-bind", "", "Bind address and port accepting TLS connections forwarded by their server name to the --sni-route destinations")
+	serverCmd.Flags().StringArrayVar(&sniRoutes, "sni-route", nil, "Destination of a TLS server name on the --sni-bind port, like intranet.corp=10.0.0.5:443, *.corp=10.0.0.6:443 or *=10.0.0.7:443 (repeatable)")
+	serverCmd.Flags().StringVar(&webBind, "web-bind", "", "Bind address and port serving the --web-target application as if it was hosted there")
+	serverCmd.Flags().StringVar(&webTarget, "web-target", "", "Internal web application reverse proxied on --web-bind through the tunnel, like https://intranet.corp")
+	serverCmd.Flags().BoolVar(&webInsecure, "web-insecure", false, "Do not verify the certificate of an https --web-target")
+	serverCmd.Flags().StringArrayVar(&hostsEntries, "hosts", nil, "Internal name added to the hosts file until the tunnel is closed, as name or name=address (default address 127.0.0.1, repeatable)")
+	serverCmd.Flags().BoolVar(&hostsFromRoutes, "hosts-from-routes", false, "Add the names of the --sni-route destinations to the hosts file, pointing at 127.0.0.1")
+	serverCmd.Flags().DurationVar(&probeInterval, "probe-interval", time.Minute, "Check the agent answers through the channel at this interval, and open a new session when it stopped (0 to disable)")
+	serverCmd.Flags().DurationVar(&handshakeTimeout, "handshake-timeout", 30*time.Second, "Fail when no message came from the agent this long after it started, showing what the remote host sent instead (0 to wait forever)")
+	serverCmd.Flags().BoolVar(&strictChannel, "strict-channel", false, "Fail showing what the remote host sent before the agent started, instead of skipping it")
+	serverCmd.Flags().IntVar(&probeFailures, "probe-failures", 3, "Unanswered probes in a row before opening a new session")
+	addHostFlags(serverCmd)
+	addTunnelFlags(serverCmd)
+	addHealthFlag(serverCmd)
+	addIdleFlag(serverCmd)
+	addExposeFlag(serverCmd)
+	addPprofFlag(serverCmd)
+	addPipeFlag(serverCmd)
+	addAcceptFlags(serverCmd)
+	addAgentFlags(serverCmd)
+}
+
+// setTunnelDefaults fills subv with the tunnel options given on the command line
+func setTunnelDefaults(subv *viper.Viper) {
+	subv.SetDefault("KeepAliveInterval", keepAliveInterval)
+	subv.SetDefault("KeepAliveJitter", keepAliveJitter)
+	subv.SetDefault("KeepAlivePadding", keepAlivePadding)
+	subv.SetDefault("CoalesceDelay", coalesceDelay)
+	subv.SetDefault("ClientIdleTimeout", clientIdleTimeout)
+	subv.SetDefault("FrameSize", frameSize)
+	subv.SetDefault("Name", tunnelName)
+	subv.SetDefault("HealthBind", healthBind)
+	subv.SetDefault("IdleTimeout", idleTimeout)
+	subv.SetDefault("Expose", exposeProxy)
+	subv.SetDefault("PprofBind", pprofBind)
+	subv.SetDefault("Pipe", proxyPipe)
+	subv.SetDefault("ListenBacklog", listenBacklog)
+	subv.SetDefault("AcceptQueue", acceptQueue)
+	subv.SetDefault("Priority", priorityRules)
+	subv.SetDefault("EarlyReply", earlyReply)
+	subv.SetDefault("GeoIPDatabases", geoIPDatabases)
+	subv.SetDefault("Scope", scope)
+	subv.SetDefault("ScopeWebhook", scopeWebhook)
+	subv.SetDefault("Mirror", mirrorRules)
+}
+
+// addTunnelFlags registers on cmd the flags used by setTunnelDefaults
+func addTunnelFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&keepAliveInterval, "keepalive-interval", 30*time.Second, "Mean time between keepalive messages, skipped while other messages are sent")
+	cmd.Flags().DurationVar(&keepAliveJitter, "keepalive-jitter", 0, "Maximum random deviation applied to each keepalive interval")
+	cmd.Flags().IntVar(&keepAlivePadding, "keepalive-padding", 0, "Maximum number of random padding bytes sent in keepalive messages")
+	cmd.Flags().DurationVar(&clientIdleTimeout, "client-idle-timeout", 0, "Close connections without traffic in either direction for this long, on both sides of the tunnel (default: never)")
+	cmd.Flags().IntVar(&frameSize, "frame-size", common.DefaultFrameSize, "Most bytes of connection data in one message, both sides use it; lower it for transports with a small MTU like serial lines")
+	cmd.Flags().DurationVar(&coalesceDelay, "coalesce-delay", 0, "Wait up to this long for more messages to send them in a single write on the channel, like 1ms")
+	cmd.Flags().StringVar(&tunnelName, "name", "", "Label identifying the tunnel in logs and session logs (default: remote host)")
+	cmd.Flags().StringArrayVar(&priorityRules, "priority", nil, "Scheduling class of matching connections, like interactive=*:3389 or bulk=bind:127.0.0.1:1081 (interactive, normal or bulk)")
+	cmd.Flags().BoolVar(&earlyReply, "early-reply", false, "Answer SOCKS connect requests at once without waiting for the agent, failed connections are then closed instead of refused")
+	cmd.Flags().StringArrayVar(&geoIPDatabases, "geoip-db", nil, "MaxMind database (.mmdb) used to tag public destinations with their AS and country in the session log, repeatable")
+	cmd.Flags().StringArrayVar(&scope, "scope", nil, "CIDR, IP address or domain (with its subdomains) in the engagement scope, connections to anything else raise an alert, repeatable")
+	cmd.Flags().StringVar(&scopeWebhook, "scope-webhook", "", "URL receiving a JSON POST the first time each out of scope destination is reached")
+	cmd.Flags().StringArrayVar(&mirrorRules, "mirror", nil, "Copy the traffic of the connections to matching destinations into a file or a local TCP port, like *:6379=tcp:127.0.0.1:9000 or 10.0.0.5=smtp.mirror, repeatable")
+}
+
+// addHealthFlag registers on cmd the health port flag used by setTunnelDefaults
+func addHealthFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&healthBind, "health-bind", "", "Bind address and port answering the tunnel state in one line")
+}
+
+// addExposeFlag registers on cmd the flag allowing to bind the proxy on
+// addresses reachable from the network
+func addExposeFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&exposeProxy, "expose", false, "Allow binding the proxy on addresses reachable from the network, it has no authentication")
+}
+
+// addPprofFlag registers on cmd the profiling port flag used by setTunnelDefaults
+func addPprofFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&pprofBind, "pprof-bind", "", "Bind address and port serving pprof profiles of the client, and of the agent under /agent/")
+}
+
+// addPipeFlag registers on cmd the named pipe flag used by setTunnelDefaults
+func addPipeFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&proxyPipe, "pipe", "", "Also serve the proxy on this Windows named pipe, e.g. \\\\.\\pipe\\sasshimi")
+}
+
+// addAcceptFlags registers on cmd the accept queue flags used by setTunnelDefaults
+func addAcceptFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&listenBacklog, "listen-backlog", 0, "Connections the system queues on the proxy port before they are accepted, capped by net.core.somaxconn on Linux (default: system default)")
+	cmd.Flags().IntVar(&acceptQueue, "accept-queue", 128, "Connections accepted in the background while the proxy is busy, 0 to accept them one at a time")
+}
+
+// addIdleFlag registers on cmd the idle timeout flag used by setTunnelDefaults
+func addIdleFlag(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&idleTimeout, "idle-timeout", 0, "Close the tunnel and exit after this long without any connection (default: never)")
+}
+
+// addHostFlags registers on cmd the flags used by hostViper
+func addHostFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&idFile, "identity_file", "i", "", "Path to private key")
+	cmd.Flags().StringVarP(&remoteExecutable, "remote_executable", "", "", "Path to SaSSHimi executable to be run on the remote machine")
+	cmd.Flags().StringVarP(&remoteAgentPath, "remote_agent_path", "", "", "Path on remote machine where to run SaSSHimi agent")
+	cmd.Flags().BoolVar(&restrictedCrypto, "restricted-crypto", false, "Only negotiate FIPS approved SSH algorithms")
+	cmd.Flags().StringVar(&uploadMethod, "upload-method", "", "Agent upload method: shell or sftp (default: sftp only for restricted shells)")
+	cmd.Flags().StringVar(&agentCache, "agent-cache", "", "Directory of the agents made by build-agent (default: user cache directory)")
+	cmd.Flags().StringVar(&uploadCompression, "upload-compression", "auto", "Agent upload compression: auto, zstd, gzip or none. Not used with sftp")
+	cmd.Flags().StringVar(&elevate, "elevate", "", "Run the agent and captures as root with sudo or doas, the sudo password is ElevatePassword or asked, and sent on stdin")
+	cmd.Flags().BoolVarP(&forwardAgent, "forward-agent", "A", false, "Forward the local ssh-agent to the agent session, for ssh commands run on the remote host")
+	cmd.Flags().BoolVar(&noAgentForwarding, "no-agent-forwarding", false, "Never forward the local ssh-agent, whatever the configuration file says")
+	cmd.Flags().StringVar(&runTemplate, "run-template", "", "Remote command starting the agent, with {dir}, {agent}, {args} and {cmd} placeholders (default: \"cd {dir} && exec {cmd}\")")
+	cmd.Flags().BoolVar(&keepRemoteEnv, "keep-remote-env", false, "Run the agent with the environment of the login shell, instead of only PATH and SSH_AUTH_SOCK")
+	cmd.Flags().StringArrayVar(&fallbackAgentPaths, "fallback-agent-path", nil, "Upload the agent to this directory when the remote agent path has no room for it, like /dev/shm (repeatable)")
+
+	cmd.RegisterFlagCompletionFunc("upload-method", completeValues("shell", "sftp"))
+	cmd.RegisterFlagCompletionFunc("upload-compression", completeValues("auto", "zstd", "gzip", "none"))
+	cmd.RegisterFlagCompletionFunc("elevate", completeValues("sudo", "doas"))
 }
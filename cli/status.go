@@ -0,0 +1,68 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/state"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/cobra"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "List the agents deployed and not cleaned up yet",
+	Long: `List the agents recorded in the state file: every upload adds the
+remote host, user, path, SHA-256 of the agent, time and local operator, and
+the teardown command drops the paths it cleaned.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		asJSON := jsonOutput()
+
+		agents, err := state.Load(state.Path())
+		if err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+
+		if asJSON {
+			printJSON(agents)
+			return
+		}
+
+		if len(agents) == 0 {
+			fmt.Println("No deployed agent in", state.Path())
+			return
+		}
+
+		for _, agent := range agents {
+			hash := agent.SHA256
+			if len(hash) > 16 {
+				hash = hash[:16]
+			}
+			fmt.Printf("%s  %-12s %s@%s  %s  sha256:%s  (%s)\n", agent.Time.Local().Format("2006-01-02 15:04:05"), agent.Operator,
+				agent.User, agent.Host, agent.Path, hash, agent.Tunnel)
+		}
+
+		fmt.Println("")
+		fmt.Printf("%d deployed agents in %s\n", len(agents), state.Path())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+
+	addOutputFlag(statusCmd)
+}
@@ -0,0 +1,112 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/teamserver"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+)
+
+var teamListen string
+var teamFiles teamserver.TLSFiles
+var operatorAudit bool
+var operatorStats bool
+
+// teamServerCmd represents the teamserver command
+var teamServerCmd = &cobra.Command{
+	Use:   "teamserver",
+	Short: "Share tunnels with operators authenticated by TLS client certificates",
+	Long: `Run a team server owning the tunnels. Operators connect with the operator
+command and a client certificate signed by --ca. Only host ids defined in the
+configuration file can be requested.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		hostConfig := func(target string) *viper.Viper {
+			if viper.Sub(target) == nil {
+				return nil
+			}
+
+			subv := hostViper(target)
+			setTunnelDefaults(subv)
+			setAgentDefaults(subv)
+			if tunnelName == "" {
+				subv.SetDefault("Name", target)
+			}
+			return subv
+		}
+
+		err := teamserver.Run(teamListen, teamFiles, hostConfig, verboseLevel)
+		if err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+	},
+}
+
+// operatorCmd represents the operator command
+var operatorCmd = &cobra.Command{
+	Use:   "operator <team_server:port> [host_id]",
+	Short: "Use a tunnel owned by a team server",
+	Long: `Bind a local SOCKS proxy going through the tunnel to host_id owned by the
+team server, print the shared session log with --audit or the traffic of
+every operator with --stats.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+
+		if operatorAudit {
+			err = teamserver.FetchAudit(args[0], teamFiles, os.Stdout)
+		} else if operatorStats {
+			err = teamserver.FetchStats(args[0], teamFiles, os.Stdout)
+		} else if len(args) == 2 {
+			err = teamserver.RunOperator(args[0], teamFiles, args[1], bindAddress, exposeProxy)
+		} else {
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		if err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+	},
+}
+
+func addTeamFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&teamFiles.Cert, "cert", "", "PEM certificate")
+	cmd.Flags().StringVar(&teamFiles.Key, "key", "", "PEM private key of the certificate")
+	cmd.Flags().StringVar(&teamFiles.CA, "ca", "", "PEM CA certificate signing the certificates of the other end")
+	cmd.MarkFlagRequired("cert")
+	cmd.MarkFlagRequired("key")
+	cmd.MarkFlagRequired("ca")
+}
+
+func init() {
+	rootCmd.AddCommand(teamServerCmd)
+	rootCmd.AddCommand(operatorCmd)
+
+	teamServerCmd.Flags().StringVar(&teamListen, "listen", "0.0.0.0:7443", "Address and port operators connect to")
+	addTeamFlags(teamServerCmd)
+	addHostFlags(teamServerCmd)
+	addTunnelFlags(teamServerCmd)
+	addAgentFlags(teamServerCmd)
+
+	operatorCmd.Flags().StringVar(&bindAddress, "bind", "127.0.0.1:1080", "Set local bind address and port")
+	addExposeFlag(operatorCmd)
+	operatorCmd.Flags().BoolVar(&operatorAudit, "audit", false, "Print the session log of the team server")
+	operatorCmd.Flags().BoolVar(&operatorStats, "stats", false, "Print the traffic of every operator of the team server")
+	addTeamFlags(operatorCmd)
+}
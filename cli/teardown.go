@@ -0,0 +1,167 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/deploy"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var teardownTargets string
+var teardownConcurrency int
+var teardownReport string
+
+// teardownCmd represents the teardown command
+var teardownCmd = &cobra.Command{
+	Use:   "teardown --targets <targets_file> | --inventory <inventory_file>",
+	Short: "Stop the agents and remove their files from every target",
+	Long: `Connect to every target of the targets file, or of the --group of an
+Ansible inventory, stop the agents run from the agent path, fallback agent
+paths and paths of the state file, and remove the agent binaries, sockets and
+other files they left. Cleaned paths are dropped from the state file.
+
+Targets are read like with the deploy command. The cleanup report lists, per
+target and directory, the agents killed, the files removed and the files that
+could not be; --report also writes it as JSON to a file, as evidence of the
+cleanup. Every cleanup is recorded in the session log. Agents run with
+--agent-interpreter or from another directory are not found.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var targets []deploy.Target
+		var hostConfig deploy.HostConfig = targetViper
+		var err error
+
+		switch {
+		case inventoryFile != "" && teardownTargets != "":
+			utils.Logger.Fatal("--targets and --inventory cannot be used together")
+		case inventoryFile != "":
+			targets, hostConfig, err = inventoryTargets()
+		case teardownTargets != "":
+			targets, err = readTargetsFile(teardownTargets)
+		default:
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if err != nil {
+			utils.Logger.Fatal(err.Error())
+		}
+
+		asJSON := jsonOutput()
+		cleanups := deploy.Teardown(targets, teardownConcurrency, hostConfig)
+
+		if teardownReport != "" {
+			err = writeTeardownReport(utils.ArtifactPath(teardownReport), cleanups)
+			if err != nil {
+				utils.Logger.Error(err.Error())
+			}
+		}
+
+		if asJSON {
+			printJSON(cleanups)
+		} else {
+			printTeardown(cleanups)
+		}
+
+		if err != nil || !teardownComplete(cleanups) {
+			os.Exit(1)
+		}
+	},
+}
+
+// printTeardown prints the cleanup report as text
+func printTeardown(cleanups []deploy.Cleanup) {
+	for _, cleanup := range cleanups {
+		fmt.Println(cleanup.Target)
+		if cleanup.Error != "" {
+			fmt.Println("  FAILED:", cleanup.Error)
+		}
+
+		for _, result := range cleanup.Directories {
+			if result.Missing {
+				fmt.Printf("  %s: no such directory\n", result.Directory)
+				continue
+			}
+
+			fmt.Printf("  %s\n", result.Directory)
+			if len(result.Killed) > 0 {
+				fmt.Printf("    killed:  %s\n", strings.Join(result.Killed, ", "))
+			}
+			for _, path := range result.Removed {
+				fmt.Printf("    removed: %s\n", path)
+			}
+			for _, path := range result.Left {
+				fmt.Printf("    LEFT:    %s\n", path)
+			}
+			if len(result.Killed) == 0 && len(result.Removed) == 0 && len(result.Left) == 0 {
+				fmt.Println("    nothing to clean")
+			}
+		}
+	}
+
+	fmt.Println("")
+	if teardownComplete(cleanups) {
+		fmt.Printf("Cleanup complete: %d targets\n", len(cleanups))
+	} else {
+		fmt.Println("CLEANUP INCOMPLETE")
+	}
+}
+
+// teardownComplete tells if every target was cleaned without leaving files
+func teardownComplete(cleanups []deploy.Cleanup) bool {
+	for _, cleanup := range cleanups {
+		if cleanup.Error != "" {
+			return false
+		}
+		for _, result := range cleanup.Directories {
+			if len(result.Left) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// writeTeardownReport writes the cleanup report as JSON to path
+func writeTeardownReport(path string, cleanups []deploy.Cleanup) error {
+	data, err := json.MarshalIndent(cleanups, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path, append(data, '\n'), 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write cleanup report: %s", err)
+	}
+
+	utils.Logger.Notice("Cleanup report written to", path)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(teardownCmd)
+
+	teardownCmd.Flags().StringVar(&teardownTargets, "targets", "", "File listing the targets, one per line")
+	teardownCmd.Flags().IntVar(&teardownConcurrency, "concurrency", 8, "Most targets cleaned up at the same time")
+	teardownCmd.Flags().StringVar(&teardownReport, "report", "", "Also write the cleanup report as JSON to this file")
+	addOutputFlag(teardownCmd)
+	addInventoryFlags(teardownCmd)
+	addHostFlags(teardownCmd)
+}
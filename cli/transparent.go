@@ -17,6 +17,7 @@ package cli
 import (
 	"github.com/rsrdesarrollo/SaSSHimi/server"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 
@@ -26,8 +27,10 @@ var transparentCmd = &cobra.Command{
 	Long:  ``,
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		subv := viper.GetViper()
+		setTunnelDefaults(subv)
 
-		server.RunTransparent(args, bindAddress)
+		server.RunTransparent(subv, args, bindAddress)
 	},
 }
 
@@ -36,4 +39,11 @@ func init() {
 
 	transparentCmd.Flags().StringVar(&bindAddress, "bind", "127.0.0.1:1080", "Set local bind address and port")
 	transparentCmd.Flags().StringVarP(&idFile, "identity_file", "i", "", "Path to private key")
+	addTunnelFlags(transparentCmd)
+	addHealthFlag(transparentCmd)
+	addIdleFlag(transparentCmd)
+	addExposeFlag(transparentCmd)
+	addPprofFlag(transparentCmd)
+	addPipeFlag(transparentCmd)
+	addAcceptFlags(transparentCmd)
 }
@@ -0,0 +1,142 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/rsrdesarrollo/SaSSHimi/update"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/rsrdesarrollo/SaSSHimi/version"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var updateKey string
+var updateCheck bool
+var updateForce bool
+
+// updateCmd represents the update command
+var updateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Install the latest release and refresh the cached agents",
+	Long: `Download the latest release for this platform, verify the signature of its
+checksums with the release key and the checksum of the binary, and replace the
+running executable. The agents of the agent cache published in the release are
+replaced the same way, the others must be built again with build-agent.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := runUpdate()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func runUpdate() error {
+	release, err := update.Latest()
+	if err != nil {
+		return err
+	}
+
+	if release.Tag == version.VersionTag && !updateForce {
+		fmt.Println(version.ToolName, version.VersionTag, "is up to date")
+		return nil
+	}
+
+	// Refuse downgrades, an older signed release may have known flaws
+	newer, err := update.IsNewer(release.Tag, version.VersionTag)
+	if err != nil && !updateForce {
+		return errors.New("Failed to compare release " + release.Tag + " with " + version.VersionTag + ": " + err.Error() +
+			", give --force to install it anyway")
+	}
+	if !newer && !updateForce && updateCheck {
+		fmt.Println("No release is newer than", version.VersionTag+", the latest is", release.Tag)
+		return nil
+	}
+	if !newer && !updateForce {
+		return errors.New("Release " + release.Tag + " is not newer than " + version.VersionTag + ", give --force to install it anyway")
+	}
+	if updateCheck {
+		fmt.Println(version.ToolName, release.Tag, "is available, this is", version.VersionTag)
+		return nil
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(updateKey)
+	if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+		return errors.New("A base64 ed25519 release key is required, give it with --key")
+	}
+
+	checksums, err := release.Checksums(ed25519.PublicKey(keyBytes))
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err == nil {
+		executable, err = filepath.EvalSymlinks(executable)
+	}
+	if err != nil {
+		return errors.New("Failed to find the running executable: " + err.Error())
+	}
+
+	err = release.Install(update.BinaryAsset(runtime.GOOS, runtime.GOARCH, utils.RelayOnly), checksums, executable)
+	if err != nil {
+		return err
+	}
+	fmt.Println(executable, "updated to", release.Tag)
+
+	cacheDir := agentCache
+	if cacheDir == "" {
+		cacheDir = server.DefaultAgentCache()
+	}
+
+	files, _ := ioutil.ReadDir(cacheDir)
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), "agent-") {
+			continue
+		}
+
+		if _, prs := checksums[file.Name()]; !prs {
+			fmt.Println(file.Name(), "is not published in", release.Tag+", build it again with build-agent")
+			continue
+		}
+
+		err = release.Install(file.Name(), checksums, filepath.Join(cacheDir, file.Name()))
+		if err != nil {
+			return err
+		}
+		fmt.Println(file.Name(), "updated to", release.Tag)
+	}
+
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(updateCmd)
+
+	updateCmd.Flags().StringVar(&updateKey, "key", version.UpdateKey, "Base64 ed25519 public key of the releases")
+	updateCmd.Flags().BoolVar(&updateCheck, "check", false, "Only tell if a newer release is available")
+	updateCmd.Flags().BoolVar(&updateForce, "force", false, "Install the latest release even if it is not newer than this version")
+	updateCmd.Flags().StringVar(&agentCache, "agent-cache", "", "Agent cache directory (default: user cache directory)")
+}
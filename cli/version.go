@@ -16,12 +16,23 @@ package cli
 
 import (
 	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
 	"github.com/rsrdesarrollo/SaSSHimi/version"
 	"github.com/spf13/cobra"
 )
 
 func init() {
 	rootCmd.AddCommand(versionCmd)
+	addOutputFlag(versionCmd)
+}
+
+// versionOutput is the version printed with --output json
+type versionOutput struct {
+	Tool      string `json:"tool"`
+	Version   string `json:"version"`
+	RelayOnly bool   `json:"relay_only"`
+	Author    string `json:"author"`
+	URL       string `json:"url"`
 }
 
 var versionCmd = &cobra.Command{
@@ -29,7 +40,22 @@ var versionCmd = &cobra.Command{
 	Short: "Print the version number of SaSSHimi",
 	Long:  `All software has versions. This is SaSSHimi's`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println(version.ToolName, version.VersionTag)
+		if jsonOutput() {
+			printJSON(versionOutput{
+				Tool:      version.ToolName,
+				Version:   version.VersionTag,
+				RelayOnly: utils.RelayOnly,
+				Author:    version.Author,
+				URL:       version.RepoURL,
+			})
+			return
+		}
+
+		if utils.RelayOnly {
+			fmt.Println(version.ToolName, version.VersionTag, "(relay-only build)")
+		} else {
+			fmt.Println(version.ToolName, version.VersionTag)
+		}
 		fmt.Println("Created by", version.Author)
 		fmt.Println(version.RepoURL)
 	},
@@ -0,0 +1,103 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command sasshimi-agent is the agent alone, without the client code and
+// its dependencies, to reduce what is uploaded to the remote host. It
+// accepts the agent, attach and version subcommands of the full binary.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/agent"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/rsrdesarrollo/SaSSHimi/version"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "agent|attach|version [flags]")
+		os.Exit(1)
+	}
+
+	utils.SetVerbosity(0)
+
+	switch os.Args[1] {
+	case "agent":
+		runAgent(os.Args[2:])
+	case "attach":
+		agent.RunAttach()
+	case "version":
+		if utils.RelayOnly {
+			fmt.Println(version.ToolName, version.VersionTag, "(agent, relay-only build)")
+		} else {
+			fmt.Println(version.ToolName, version.VersionTag, "(agent)")
+		}
+		fmt.Println("Created by", version.Author)
+		fmt.Println(version.RepoURL)
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown command", os.Args[1])
+		os.Exit(1)
+	}
+}
+
+// runAgent parses the flags of the agent command of the full binary
+func runAgent(args []string) {
+	var options agent.Options
+	var maxMemory int
+	var fingerprint bool
+
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	flags.BoolVar(&options.UseHttpProxy, "use-http", false, "Use HTTP proxy instead of HTTP")
+	flags.BoolVar(&options.KeepBinary, "keep-binary", false, "Do not remove binary when closing")
+	flags.BoolVar(&options.KeepBinary, "k", false, "Do not remove binary when closing")
+	flags.IntVar(&options.MaxClients, "max-clients", 0, "Maximum number of simultaneous connections (0 for unlimited)")
+	flags.IntVar(&options.MaxGoroutines, "max-goroutines", 0, "Refuse new connections above this number of goroutines (0 for unlimited)")
+	flags.IntVar(&maxMemory, "max-memory", 0, "Refuse new connections above this heap size in MB (0 for unlimited)")
+	flags.IntVar(&options.Nice, "nice", 0, "Nice value to apply to the agent process")
+	flags.StringVar(&options.IONice, "ionice", "", "I/O scheduling class (idle or best-effort)")
+	flags.StringVar(&options.CPUs, "cpus", "", "Comma separated list of CPUs the agent is allowed to run on")
+	flags.IntVar(&options.MaxProcs, "max-procs", 0, "Maximum number of CPUs executing the agent simultaneously")
+	flags.BoolVar(&options.TransparentMode, "transparent-mode", false, "Write a pid file, log to syslog and set a descriptive process title")
+	flags.StringVar(&options.PidFile, "pid-file", "sasshimi-agent.pid", "Pid file written in transparent mode")
+	flags.BoolVar(&options.Shared, "shared", false, "Let other operators attach to this agent")
+	flags.BoolVar(&options.DisableSocks4, "disable-socks4", false, "Refuse SOCKS4 and SOCKS4a clients, only accept SOCKS5")
+	flags.IntVar(&options.DialConcurrency, "dial-concurrency", 0, "Maximum number of connections opened at the same time (0 for unlimited)")
+	flags.DurationVar(&options.DialInterval, "dial-interval", 0, "Minimum delay between two new connections")
+	flags.BoolVar(&options.FastOpen, "fast-open", false, "Open connections with TCP Fast Open where supported")
+	flags.BoolVar(&options.DisableDNSCache, "disable-dns-cache", false, "Resolve every SOCKS host name again instead of caching answers for their TTL")
+	flags.DurationVar(&options.DialFailureCache, "dial-failure-cache", 0, "Fail new connections to a destination at once for this long after a connection to it failed")
+	flags.IntVar(&options.MaxPorts, "max-ports", 0, "Hold new connections while dials in progress and TIME_WAIT sockets reach this number (0 for unlimited)")
+	flags.IntVar(&options.HandshakeWorkers, "handshake-workers", 0, "Number of SOCKS negotiations run at the same time (default 64)")
+	flags.BoolVar(&options.Sandbox, "sandbox", false, "Restrict the agent system calls once it is running (seccomp on Linux amd64, pledge on OpenBSD)")
+	flags.IntVar(&options.FrameSize, "frame-size", common.DefaultFrameSize, "Most bytes of connection data in one message")
+	flags.DurationVar(&options.ClientIdleTimeout, "client-idle-timeout", 0, "Close connections without traffic in either direction for this long (default: never)")
+	flags.DurationVar(&options.CoalesceDelay, "coalesce-delay", 0, "Wait up to this long for more messages to send them in a single write on the channel, like 1ms")
+	flags.BoolVar(&fingerprint, "fingerprint", false, "Print the engagement identifier and the SHA-256 of this binary, then exit")
+	flags.Parse(args)
+
+	if fingerprint {
+		err := agent.PrintFingerprint(os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	options.MaxMemory = uint64(maxMemory) * 1024 * 1024
+	agent.Run(options)
+}
@@ -0,0 +1,151 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// PprofClientPrefix starts the id of the clients connecting to the agent
+// profiler instead of its SOCKS server
+const PprofClientPrefix = "pprof:"
+
+// UpgradeClientPrefix starts the id of the clients sending a new agent
+// binary, see NewRestartMessage
+const UpgradeClientPrefix = "upgrade:"
+
+// DefaultFileDropBind and DefaultFileDropExpiry are used when the file drop
+// options do not set them
+const DefaultFileDropBind = "127.0.0.1:0"
+const DefaultFileDropExpiry = time.Hour
+
+// AgentOptions are the agent settings the server can change
+type AgentOptions struct {
+	// Resource limits, zero means unlimited. MaxMemory is in bytes.
+	MaxClients    int
+	MaxGoroutines int
+	MaxMemory     uint64
+
+	// Scheduling options to reduce the impact on the remote host
+	Nice     int
+	IONice   string
+	CPUs     string
+	MaxProcs int
+
+	// TransparentMode makes the agent auditable by the remote host admins
+	TransparentMode bool
+
+	// Shared lets other operators attach to the agent
+	Shared bool
+
+	// DisableSocks4 refuses SOCKS4 and SOCKS4a clients
+	DisableSocks4 bool
+
+	// Dials to destinations: at most DialConcurrency in progress, started
+	// at least DialInterval apart, zero means unlimited. FastOpen uses TCP
+	// Fast Open where supported.
+	DialConcurrency int
+	DialInterval    time.Duration
+	FastOpen        bool
+
+	// MaxPorts holds new dials while the dials in progress and the TCP
+	// sockets in TIME_WAIT reach it, zero means unlimited
+	MaxPorts int
+
+	// DialFailureCache fails dials to destinations that failed less than
+	// this long ago with the same error, zero disables it
+	DialFailureCache time.Duration
+
+	// DisableDNSCache resolves every SOCKS host name again instead of
+	// reusing answers for their TTL
+	DisableDNSCache bool
+
+	// DNSServers are the DNS servers resolving SOCKS host names instead of
+	// the system ones, comma separated: server[:port] for every name and
+	// domain=server[:port] for the names under domain
+	DNSServers string
+
+	// Rewrites are the rules rewriting the destinations of SOCKS requests,
+	// one pattern=target per line
+	Rewrites string
+
+	// HandshakeWorkers is the number of SOCKS negotiations run at the same
+	// time, zero means the default
+	HandshakeWorkers int
+
+	// CoalesceDelay is how long the agent waits for more messages to send
+	// them in a single write on the channel
+	CoalesceDelay time.Duration
+
+	// ClientIdleTimeout terminates connections without traffic in either
+	// direction for this long, zero keeps them forever
+	ClientIdleTimeout time.Duration
+
+	// FrameSize is the most bytes of connection data carried by one message,
+	// zero means DefaultFrameSize. The server sends its own so both sides fit
+	// the transport.
+	FrameSize int
+
+	// Sandbox restricts the system calls of the agent once it is running,
+	// with seccomp on Linux and pledge on OpenBSD. It cannot be disabled.
+	Sandbox bool
+
+	// FileDrop is a directory of the remote host whose files are served
+	// over HTTP on FileDropBind, each one only once, until FileDropExpiry
+	// after the drop started. Zero values mean the defaults.
+	FileDrop       string
+	FileDropBind   string
+	FileDropExpiry time.Duration
+}
+
+// AgentSetup is sent by the server in the handshake message, so settings do
+// not have to be given on the agent command line, which is visible in ps.
+// The agent applies any later setup message too.
+type AgentSetup struct {
+	Env        map[string]string `json:",omitempty"`
+	Verbosity  int
+	DebugLeaks time.Duration `json:",omitempty"`
+	Pprof      bool          `json:",omitempty"`
+	Options    AgentOptions
+
+	// Protocol versions of the server, zero for servers older than
+	// versioning, and its release version
+	Protocol    int    `json:",omitempty"`
+	MinProtocol int    `json:",omitempty"`
+	Version     string `json:",omitempty"`
+}
+
+// NewSetupMessage returns the handshake message carrying setup
+func NewSetupMessage(setup AgentSetup) *DataMessage {
+	data, _ := json.Marshal(setup)
+
+	msg := NewMessage("", data)
+	msg.Setup = true
+	return msg
+}
+
+// ParseSetup reads the agent setup of a setup message
+func ParseSetup(msg *DataMessage) (AgentSetup, error) {
+	var setup AgentSetup
+
+	err := json.Unmarshal(msg.Data, &setup)
+	if err != nil {
+		return setup, fmt.Errorf("Invalid agent setup: %w", err)
+	}
+
+	return setup, nil
+}
@@ -0,0 +1,135 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Binary framing is a simple alternative to gob used to talk with agents
+// written in other languages. Every frame is:
+//
+//	flags u8 | Seq u64 | ClientSeq u64 | Checksum u32 | len(ClientId) u16 |
+//	ClientId | len(Data) u32 | Data
+//
+// with big endian integers and flags bits set in this order: CloseClient,
+// DeadClient, CloseChannel, KeepAlive, Setup, then two bits of Priority and
+// Reset.
+
+const binaryHeaderSize = 1 + 8 + 8 + 4 + 2
+const binaryMaxDataSize = 16 * 1024 * 1024
+
+type messageEncoder interface {
+	Encode(e interface{}) error
+}
+
+type messageDecoder interface {
+	Decode(e interface{}) error
+}
+
+type binaryEncoder struct {
+	writer io.Writer
+}
+
+type binaryDecoder struct {
+	reader io.Reader
+}
+
+func (m *DataMessage) flags() byte {
+	var flags byte
+	for i, flag := range []bool{m.CloseClient, m.DeadClient, m.CloseChannel, m.KeepAlive, m.Setup} {
+		if flag {
+			flags |= 1 << uint(i)
+		}
+	}
+	if m.Reset {
+		flags |= 1 << 7
+	}
+	return flags | byte(m.Priority&3)<<5
+}
+
+func (m *DataMessage) setFlags(flags byte) {
+	m.CloseClient = flags&1 != 0
+	m.DeadClient = flags&2 != 0
+	m.CloseChannel = flags&4 != 0
+	m.KeepAlive = flags&8 != 0
+	m.Setup = flags&16 != 0
+	m.Priority = Priority(flags >> 5 & 3)
+	m.Reset = flags&128 != 0
+}
+
+func (e *binaryEncoder) Encode(value interface{}) error {
+	msg, ok := value.(*DataMessage)
+	if !ok {
+		return errors.New("binary framing only encodes data messages")
+	}
+
+	frame := make([]byte, binaryHeaderSize, binaryHeaderSize+len(msg.ClientId)+4+len(msg.Data))
+	frame[0] = msg.flags()
+	binary.BigEndian.PutUint64(frame[1:], msg.Seq)
+	binary.BigEndian.PutUint64(frame[9:], msg.ClientSeq)
+	binary.BigEndian.PutUint32(frame[17:], msg.Checksum)
+	binary.BigEndian.PutUint16(frame[21:], uint16(len(msg.ClientId)))
+
+	frame = append(frame, msg.ClientId...)
+	frame = append(frame, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(frame[len(frame)-4:], uint32(len(msg.Data)))
+	frame = append(frame, msg.Data...)
+
+	_, err := e.writer.Write(frame)
+	return err
+}
+
+func (d *binaryDecoder) Decode(value interface{}) error {
+	msg, ok := value.(*DataMessage)
+	if !ok {
+		return errors.New("binary framing only decodes data messages")
+	}
+
+	header := make([]byte, binaryHeaderSize)
+	_, err := io.ReadFull(d.reader, header)
+	if err != nil {
+		return err
+	}
+
+	msg.setFlags(header[0])
+	msg.Seq = binary.BigEndian.Uint64(header[1:])
+	msg.ClientSeq = binary.BigEndian.Uint64(header[9:])
+	msg.Checksum = binary.BigEndian.Uint32(header[17:])
+
+	clientId := make([]byte, binary.BigEndian.Uint16(header[21:]))
+	_, err = io.ReadFull(d.reader, clientId)
+	if err != nil {
+		return err
+	}
+	msg.ClientId = string(clientId)
+
+	var length [4]byte
+	_, err = io.ReadFull(d.reader, length[:])
+	if err != nil {
+		return err
+	}
+
+	dataSize := binary.BigEndian.Uint32(length[:])
+	if dataSize > binaryMaxDataSize {
+		return errors.New("frame too big")
+	}
+
+	msg.Data = make([]byte, dataSize)
+	_, err = io.ReadFull(d.reader, msg.Data)
+	return err
+}
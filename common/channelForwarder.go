@@ -1,16 +1,26 @@
 package common
 
 import (
+	"bufio"
+	"crypto/rand"
 	"encoding/gob"
 	"github.com/rsrdesarrollo/SaSSHimi/utils"
 	"io"
+	mathrand "math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const defaultKeepAliveInterval = 30 * time.Second
+
+// coalesceSize is the most data written on the channel at once when
+// coalescing messages, the largest SSH packet
+const coalesceSize = 32 * 1024
+
 type ChannelForwarder struct {
 	InChannel   chan *DataMessage
-	OutChannel  chan *DataMessage
+	OutQueue    *FairQueue
 	Reader      io.Reader
 	Writer      io.Writer
 	ChannelOpen bool
@@ -19,13 +29,129 @@ type ChannelForwarder struct {
 
 	Clients     map[string]*Client
 	ClientsLock *sync.Mutex
+
+	// KeepAliveInterval is the mean time between keepalive messages. Each
+	// delay is randomly moved up to KeepAliveJitter in both directions and
+	// keepalives carry up to KeepAlivePadding random bytes. No keepalive is
+	// sent while other messages are written.
+	KeepAliveInterval time.Duration
+	KeepAliveJitter   time.Duration
+	KeepAlivePadding  int
+
+	// Clock times the keepalives, RealClock when nil
+	Clock Clock
+
+	// BinaryFraming replaces gob with the binary framing on the channel
+	BinaryFraming bool
+
+	// Handshake is written before any message of OutQueue
+	Handshake *DataMessage
+
+	inSeq  uint64
+	outSeq uint64
+
+	// coalesceDelay is the time.Duration set by SetCoalesceDelay
+	coalesceDelay atomic.Value
+
+	// lastPayload is the time.Time of the last message written other than
+	// a keepalive
+	lastPayload atomic.Value
+
+	// inLimit is the adaptive limit of messages waiting in InChannel
+	inLimit queueLimit
+
+	// inRoom wakes up the reader waiting for room in InChannel, once a
+	// message is taken or the forwarder is closed
+	inRoom     chan struct{}
+	inRoomOnce sync.Once
+
+	// Stream restart state, see NewRestartMessage
+	restart streamRestart
+}
+
+func (c *ChannelForwarder) newDecoder(reader io.Reader) messageDecoder {
+	if c.BinaryFraming {
+		return &binaryDecoder{reader: reader}
+	}
+	return gob.NewDecoder(reader)
+}
+
+func (c *ChannelForwarder) newEncoder(writer io.Writer) messageEncoder {
+	if c.BinaryFraming {
+		return &binaryEncoder{writer: writer}
+	}
+	return gob.NewEncoder(writer)
+}
+
+// SetQueueMemory sets the budget of bytes the InChannel and OutQueue limits
+// adapt to, zero for DefaultQueueMemory
+func (c *ChannelForwarder) SetQueueMemory(memory int64) {
+	c.inLimit.setMemory(memory)
+	c.OutQueue.SetMemory(memory)
+}
+
+// Reopen prepares a closed forwarder for a new channel, like a new session
+// with another agent: the queues and NotifyClosure are replaced, keeping the
+// memory budget, and the sequence numbers start again from 0. The clients
+// of the previous channel were terminated by Close.
+func (c *ChannelForwarder) Reopen() {
+	c.inLimit.lock.Lock()
+	memory := c.inLimit.memory
+	c.inLimit.lock.Unlock()
+
+	c.inLimit = queueLimit{memory: memory}
+	c.OutQueue = NewFairQueue()
+	c.OutQueue.SetMemory(memory)
+	c.InChannel = make(chan *DataMessage, cap(c.InChannel))
+	c.NotifyClosure = make(chan struct{})
+	c.inSeq = 0
+	c.outSeq = 0
+	c.restart = streamRestart{}
+	c.ChannelOpen = true
+}
+
+// InputTaken tells the reader a message was taken from InChannel, the
+// consumers of InChannel call it so a reader waiting for room goes on
+func (c *ChannelForwarder) InputTaken() {
+	select {
+	case c.roomSignal() <- struct{}{}:
+	default:
+	}
+}
+
+func (c *ChannelForwarder) roomSignal() chan struct{} {
+	c.inRoomOnce.Do(func() {
+		c.inRoom = make(chan struct{}, 1)
+	})
+	return c.inRoom
+}
+
+// InDepth returns the number of messages waiting in InChannel and the
+// current limit
+func (c *ChannelForwarder) InDepth() (int, int) {
+	return len(c.InChannel), c.inLimit.get()
+}
+
+// SetCoalesceDelay makes the writer wait up to delay for more messages to
+// send them in a single write, zero only coalesces the messages already
+// queued. It can change while the writer runs.
+func (c *ChannelForwarder) SetCoalesceDelay(delay time.Duration) {
+	c.coalesceDelay.Store(delay)
+}
+
+func (c *ChannelForwarder) getCoalesceDelay() time.Duration {
+	delay, _ := c.coalesceDelay.Load().(time.Duration)
+	return delay
 }
 
 func (c *ChannelForwarder) ReadInputData() {
-	decoder := gob.NewDecoder(c.Reader)
+	// Decoders of a restarted stream go on with the data already buffered
+	reader := bufio.NewReader(c.Reader)
+	decoder := c.newDecoder(reader)
 
 	utils.Logger.Debug("Reading from io.Reader to InChannel")
 
+	var sent uint64
 	for c.ChannelOpen {
 		var inMsg DataMessage
 		err := decoder.Decode(&inMsg)
@@ -33,20 +159,88 @@ func (c *ChannelForwarder) ReadInputData() {
 			utils.Logger.Error("Read ERROR: ", err)
 			break
 		}
+
+		c.verifyMessage(&inMsg)
+
+		if inMsg.Restart && !inMsg.IsCorrupted() {
+			if !c.restart.sent() {
+				// The other side asks this one to restart, nothing more
+				// is sent on its stream
+				c.InChannel <- &inMsg
+				return
+			}
+
+			// The other side restarted its stream after this one
+			decoder = c.newDecoder(reader)
+			c.inSeq = 0
+			c.restart.peerRestarted()
+			continue
+		}
+
+		c.inLimit.pushed(len(inMsg.Data))
+
+		// Stop reading while the consumer is behind by more than the
+		// adaptive limit, the channel capacity is only the upper bound
+		for {
+			depth := len(c.InChannel)
+			c.inLimit.consumed(sent - uint64(depth))
+			if depth < c.inLimit.get() || !c.ChannelOpen {
+				break
+			}
+			<-c.roomSignal()
+		}
+
 		c.InChannel <- &inMsg
+		sent++
 	}
 
 	c.Close()
 }
 
 func (c *ChannelForwarder) WriteOutputData() {
-	encoder := gob.NewEncoder(c.Writer)
+	writer := bufio.NewWriterSize(c.Writer, coalesceSize)
+	encoder := c.newEncoder(writer)
 
-	utils.Logger.Debug("Writing from OutChannel to io.Writer")
+	utils.Logger.Debug("Writing from OutQueue to io.Writer")
+
+	if c.Handshake != nil {
+		err := c.writeMessage(encoder, c.Handshake)
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			utils.Logger.Error("Write ERROR: ", err)
+			c.Close()
+			return
+		}
+	}
 
 	for c.ChannelOpen {
-		outMsg := <-c.OutChannel
-		err := encoder.Encode(outMsg)
+		outMsg := c.OutQueue.Pop()
+		if outMsg == nil {
+			break
+		}
+
+		err := c.writeMessage(encoder, outMsg)
+
+		// Messages following within the delay go in the same write
+		delay := c.getCoalesceDelay()
+		for err == nil && !outMsg.Restart && writer.Buffered() < coalesceSize {
+			next := c.OutQueue.PopWithin(delay)
+			if next == nil {
+				break
+			}
+			outMsg = next
+			err = c.writeMessage(encoder, outMsg)
+		}
+
+		if err == nil {
+			err = writer.Flush()
+		}
+
+		if err == nil && outMsg.Restart {
+			encoder, err = c.restartStream(writer)
+		}
 
 		if err != nil {
 			utils.Logger.Error("Write ERROR: ", err)
@@ -57,27 +251,124 @@ func (c *ChannelForwarder) WriteOutputData() {
 	c.Close()
 }
 
+func (c *ChannelForwarder) writeMessage(encoder messageEncoder, msg *DataMessage) error {
+	if msg.Restart {
+		c.restart.sending()
+	}
+
+	msg.Seq = c.outSeq
+	msg.Checksum = msg.computeChecksum()
+	c.outSeq++
+
+	if !msg.KeepAlive {
+		c.lastPayload.Store(c.clock().Now())
+	}
+
+	return encoder.Encode(msg)
+}
+
+// verifyMessage flags msg as corrupted if it does not have the expected
+// sequence number or its checksum does not match.
+func (c *ChannelForwarder) verifyMessage(msg *DataMessage) {
+	if msg.Seq != c.inSeq {
+		utils.Logger.Errorf("Out of sequence message for client %s: expected %d, got %d", msg.ClientId, c.inSeq, msg.Seq)
+		msg.corrupted = true
+	} else if msg.Checksum != msg.computeChecksum() {
+		utils.Logger.Errorf("Checksum mismatch on message %d for client %s", msg.Seq, msg.ClientId)
+		msg.corrupted = true
+	}
+
+	c.inSeq = msg.Seq + 1
+}
+
+// Close stops the forwarder and terminates its clients, nothing they send
+// can reach the other side anymore
 func (c *ChannelForwarder) Close() {
 	c.ChannelOpen = false
+	c.OutQueue.Close()
+	c.InputTaken()
+
+	if c.ClientsLock == nil {
+		return
+	}
+
+	c.ClientsLock.Lock()
+	for id, client := range c.Clients {
+		client.Terminate()
+		delete(c.Clients, id)
+	}
+	c.ClientsLock.Unlock()
 }
 
 func (c *ChannelForwarder) Terminate() {
 	msg := NewMessage("", nil)
 	msg.CloseChannel = true
 
-	c.OutChannel <- msg
+	c.OutQueue.Push(msg)
 }
 
-func (c *ChannelForwarder) KeepAlive(){
-	for c.ChannelOpen {
-		c.sendKeepAlive()
-		time.Sleep(30 * time.Second)
+// KeepAlive sends keepalives until the channel is closed. A forwarder
+// reopened meanwhile gets a new KeepAlive loop, this one stops.
+func (c *ChannelForwarder) KeepAlive() {
+	delay := c.nextKeepAliveDelay()
+	closure := c.NotifyClosure
+
+	for c.ChannelOpen && !isClosed(closure) {
+		// Messages written since the last keepalive already tell the other
+		// side the channel is alive
+		if last, ok := c.lastPayload.Load().(time.Time); !ok || c.clock().Now().Sub(last) >= delay {
+			c.sendKeepAlive()
+		}
+
+		delay = c.nextKeepAliveDelay()
+		c.clock().Sleep(delay)
+	}
+}
+
+// isClosed tells if the channel ch was closed, nil is never closed
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *ChannelForwarder) clock() Clock {
+	if c.Clock == nil {
+		return RealClock
 	}
+	return c.Clock
+}
+
+func (c *ChannelForwarder) nextKeepAliveDelay() time.Duration {
+	delay := c.KeepAliveInterval
+	if delay <= 0 {
+		delay = defaultKeepAliveInterval
+	}
+
+	if c.KeepAliveJitter > 0 {
+		delay += time.Duration(mathrand.Int63n(int64(2*c.KeepAliveJitter))) - c.KeepAliveJitter
+	}
+
+	if delay < time.Second {
+		delay = time.Second
+	}
+
+	return delay
 }
 
 func (c *ChannelForwarder) sendKeepAlive() {
-	msg := NewMessage("", nil)
+	var padding []byte
+
+	if c.KeepAlivePadding > 0 {
+		padding = make([]byte, mathrand.Intn(c.KeepAlivePadding+1))
+		rand.Read(padding)
+	}
+
+	msg := NewMessage("", padding)
 	msg.KeepAlive = true
 
-	c.OutChannel <- msg
+	c.OutQueue.Push(msg)
 }
@@ -0,0 +1,87 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/gob"
+	"io"
+	"testing"
+	"time"
+)
+
+// waitDepth waits until c has depth messages waiting in InChannel
+func waitDepth(t *testing.T, c *ChannelForwarder, depth int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.InChannel) != depth {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages waiting, expected %d", len(c.InChannel), depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReaderWaitsForInputTaken(t *testing.T) {
+	reader, writer := io.Pipe()
+	c := &ChannelForwarder{
+		InChannel:   make(chan *DataMessage, MaxQueueLimit),
+		OutQueue:    NewFairQueue(),
+		Reader:      reader,
+		ChannelOpen: true,
+	}
+	_, limit := c.InDepth()
+
+	done := make(chan struct{})
+	go func() {
+		c.ReadInputData()
+		close(done)
+	}()
+
+	sender := &ChannelForwarder{}
+	go func() {
+		encoder := gob.NewEncoder(writer)
+		for i := 0; i < 2*limit; i++ {
+			if sender.writeMessage(encoder, NewMessage("client", []byte{byte(i)})) != nil {
+				break
+			}
+		}
+		writer.Close()
+	}()
+
+	// The reader stops at the limit, and reads one more message for each
+	// one taken
+	waitDepth(t, c, limit)
+	<-c.InChannel
+	c.InputTaken()
+	waitDepth(t, c, limit)
+
+	// The reader gets the other messages as they are taken
+	received := 1
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case <-c.InChannel:
+			received++
+			c.InputTaken()
+		case <-done:
+			received += len(c.InChannel)
+			if received != 2*limit {
+				t.Errorf("received %d messages, expected %d", received, 2*limit)
+			}
+			return
+		case <-timeout:
+			t.Fatal("reader did not return")
+		}
+	}
+}
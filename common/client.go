@@ -15,23 +15,70 @@
 package common
 
 import (
+	"context"
+	"errors"
 	"github.com/rsrdesarrollo/SaSSHimi/utils"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// DefaultFrameSize is the most bytes of connection data carried by one
+// message, unless changed with SetFrameSize within MinFrameSize and
+// MaxFrameSize
+const DefaultFrameSize = 1024
+const MinFrameSize = 64
+const MaxFrameSize = 256 * 1024
+
+// CheckFrameSize returns an error if size is not a valid frame size, zero
+// stands for DefaultFrameSize
+func CheckFrameSize(size int) error {
+	if size != 0 && (size < MinFrameSize || size > MaxFrameSize) {
+		return errors.New("invalid frame size " + strconv.Itoa(size) + ", it must be between " +
+			strconv.Itoa(MinFrameSize) + " and " + strconv.Itoa(MaxFrameSize))
+	}
+	return nil
+}
+
+// ErrClientClosed is returned when writing to a client that was terminated
+// or closed
+var ErrClientClosed = errors.New("client closed")
+
 type Client struct {
+	// Traffic counters and time of the last read or write in nanoseconds,
+	// first in the struct to be 64-bit aligned for atomic
+	bytesSent     uint64
+	bytesReceived uint64
+	lastActivity  int64
+
 	Id           string
 	conn         net.Conn
-	outChann     chan *DataMessage
+	outQueue     *FairQueue
 	inChann      chan *DataMessage
 	readyToClose bool
-	isDead       bool
 	clientMutex  *sync.Mutex
+
+	outSeq        uint64
+	lastDelivered uint64
+	priority      uint32
+	resetOnEOF    uint32
+
+	// Operator is the identity of who opened the connection
+	Operator string
+
+	// ctx is done once the client is terminated or closed
+	ctx         context.Context
+	cancel      context.CancelFunc
+	idleTimeout time.Duration
+	frameSize   int
 }
 
+// IsDead tells if the client was terminated or closed, nothing is read from
+// nor written to its connection anymore
 func (c *Client) IsDead() bool {
-	return c.isDead
+	return c.ctx.Err() != nil
 }
 
 func (c *Client) ReadyToClose() bool {
@@ -42,22 +89,60 @@ func (c *Client) SetReadyToClose(readyToClose bool) {
 	c.readyToClose = readyToClose
 }
 
-func NewClient(id string, conn net.Conn, outChannel chan *DataMessage) *Client {
+func NewClient(id string, conn net.Conn, outQueue *FairQueue) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Client{
 		Id:           id,
 		conn:         conn,
-		outChann:     outChannel,
+		outQueue:     outQueue,
 		readyToClose: false,
 		clientMutex:  &sync.Mutex{},
+		lastActivity: time.Now().UnixNano(),
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
+// Context is done once the client is terminated or its connection closed
+func (c *Client) Context() context.Context {
+	return c.ctx
+}
+
+// SetIdleTimeout makes ReadFromClientToChannel terminate the client after
+// timeout without reading or writing anything, zero waits forever. It must
+// be called before ReadFromClientToChannel.
+func (c *Client) SetIdleTimeout(timeout time.Duration) {
+	c.idleTimeout = timeout
+}
+
+// SetFrameSize sets the most bytes read from the connection in one message,
+// zero for DefaultFrameSize. It must be called before ReadFromClientToChannel.
+func (c *Client) SetFrameSize(size int) {
+	c.frameSize = size
+}
+
 func (c *Client) Terminate() {
-	c.isDead = true
+	c.cancel()
 	c.conn.Close()
 }
 
-func (c *Client) Close() {
+// Reset terminates the client so the peer of the connection sees it reset
+// instead of closed
+func (c *Client) Reset() {
+	c.cancel()
+	utils.ResetConn(c.conn)
+}
+
+// ResetOnEOF makes the end of the connection reported as a reset, for
+// connections relaying a socket that was reset
+func (c *Client) ResetOnEOF() {
+	atomic.StoreUint32(&c.resetOnEOF, 1)
+}
+
+// Close closes the connection on the second call, once both the client and
+// the other side finished sending. It returns true if it was closed.
+func (c *Client) Close() bool {
 	var mustBeClosed bool
 
 	c.clientMutex.Lock()
@@ -73,16 +158,52 @@ func (c *Client) Close() {
 
 	if mustBeClosed {
 		utils.Logger.Debug("Really closing", c.Id)
+		c.cancel()
 		c.conn.Close()
 	}
 
+	return mustBeClosed
+}
+
+// CloseWrite handles the end of the data sent by the other side. The peer of
+// the connection reads EOF but can still send until it finishes too, when
+// the connection is closed.
+func (c *Client) CloseWrite() bool {
+	if !c.ReadyToClose() && utils.CloseWrite(c.conn) == nil {
+		utils.Logger.Debug("Half-closed", c.Id)
+	}
+
+	return c.Close()
+}
+
+// Priority returns the scheduling class of the messages of the client
+func (c *Client) Priority() Priority {
+	return Priority(atomic.LoadUint32(&c.priority))
+}
+
+// SetPriority changes the scheduling class of the next messages of the
+// client
+func (c *Client) SetPriority(priority Priority) {
+	atomic.StoreUint32(&c.priority, uint32(priority))
+}
+
+// Traffic returns the number of bytes sent to and received from the
+// connection.
+func (c *Client) Traffic() (sent uint64, received uint64) {
+	return atomic.LoadUint64(&c.bytesSent), atomic.LoadUint64(&c.bytesReceived)
 }
 
 func (c *Client) Write(data []byte) error {
+	if c.IsDead() {
+		return ErrClientClosed
+	}
+
 	var writed = 0
 	for writed < len(data) {
 		wn, err := c.conn.Write(data)
 		writed += wn
+		atomic.AddUint64(&c.bytesSent, uint64(wn))
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
 
 		if writed < len(data) {
 			utils.Logger.Debugf("******* Need second write of %d bytes on client %s", len(data)-writed, c.Id)
@@ -95,26 +216,118 @@ func (c *Client) Write(data []byte) error {
 	return nil
 }
 
+// Deliver writes the payload of msg to the connection, ignoring messages
+// that were already delivered.
+func (c *Client) Deliver(msg *DataMessage) error {
+	if msg.ClientSeq != 0 {
+		if msg.ClientSeq <= c.lastDelivered {
+			utils.Logger.Debugf("Dropping duplicated message %d on client %s", msg.ClientSeq, c.Id)
+			return nil
+		}
+		c.lastDelivered = msg.ClientSeq
+	}
+
+	return c.Write(msg.Data)
+}
+
 func (c *Client) NotifyEOF(isDead bool) {
 	msg := NewMessage(c.Id, []byte{})
+	msg.Priority = c.Priority()
 	if !isDead {
 		msg.CloseClient = true
 	} else {
 		msg.DeadClient = isDead
 	}
-	c.outChann <- msg
+	c.outQueue.Push(msg)
+}
+
+// NotifyReset tells the other side the connection was reset by its peer
+func (c *Client) NotifyReset() {
+	msg := NewMessage(c.Id, []byte{})
+	msg.Priority = c.Priority()
+	msg.DeadClient = true
+	msg.Reset = true
+	c.outQueue.Push(msg)
+}
+
+// NotifyError terminates the client after err on its connection and tells
+// the other side, as a reset if the peer reset the connection
+func (c *Client) NotifyError(err error) {
+	c.Terminate()
+
+	if utils.IsConnReset(err) {
+		c.NotifyReset()
+	} else {
+		c.NotifyEOF(true)
+	}
 }
 
 func (c *Client) ReadFromClientToChannel() {
-	for {
-		data := make([]byte, 1024)
+	frameSize := c.frameSize
+	if frameSize == 0 {
+		frameSize = DefaultFrameSize
+	}
+
+	for c.ctx.Err() == nil {
+		if c.idleTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		}
+
+		data := make([]byte, frameSize)
 		readed, err := c.conn.Read(data)
+		if err != nil && c.readTimedOut(err) {
+			if c.ctx.Err() == nil && !c.isIdle() {
+				// Data was written to the client meanwhile
+				continue
+			}
+
+			if !c.IsDead() {
+				utils.Logger.Debug("Terminating idle client", c.Id)
+				c.Terminate()
+				c.NotifyEOF(true)
+			}
+			break
+		}
 		if err != nil {
-			c.Close()
-			c.NotifyEOF(false)
+			// Terminated clients were already notified to the other side
+			switch {
+			case c.IsDead():
+			case utils.IsConnReset(err) || atomic.LoadUint32(&c.resetOnEOF) != 0:
+				c.Terminate()
+				c.NotifyReset()
+			default:
+				c.Close()
+				c.NotifyEOF(false)
+			}
 			break
 		}
 
-		c.outChann <- NewMessage(c.Id, data[:readed])
+		select {
+		case <-c.ctx.Done():
+			// Terminated while reading, the other side was already told
+			return
+		default:
+		}
+
+		atomic.AddUint64(&c.bytesReceived, uint64(readed))
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+		c.outSeq++
+		msg := NewMessage(c.Id, data[:readed])
+		msg.ClientSeq = c.outSeq
+		msg.Priority = c.Priority()
+
+		c.outQueue.Push(msg)
 	}
 }
+
+// readTimedOut tells whether err comes from the idle read deadline
+func (c *Client) readTimedOut(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout() && c.idleTimeout > 0
+}
+
+// isIdle tells whether nothing was read or written for the idle timeout
+func (c *Client) isIdle() bool {
+	lastActivity := time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+	return time.Since(lastActivity) >= c.idleTimeout
+}
@@ -0,0 +1,136 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// startClient runs the reader of a new client of one end of a pipe, and
+// returns the other end and a channel closed when the reader returns
+func startClient(idleTimeout time.Duration) (*Client, net.Conn, *FairQueue, chan struct{}) {
+	local, remote := net.Pipe()
+	queue := NewFairQueue()
+
+	client := NewClient("test", local, queue)
+	client.SetIdleTimeout(idleTimeout)
+
+	done := make(chan struct{})
+	go func() {
+		client.ReadFromClientToChannel()
+		close(done)
+	}()
+
+	return client, remote, queue, done
+}
+
+func waitReader(t *testing.T, done chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reader did not return")
+	}
+}
+
+func TestIdleDeadlineTerminatesClient(t *testing.T) {
+	client, remote, queue, done := startClient(50 * time.Millisecond)
+	defer remote.Close()
+
+	waitReader(t, done)
+
+	if !client.IsDead() {
+		t.Error("idle client is not dead")
+	}
+	select {
+	case <-client.Context().Done():
+	default:
+		t.Error("context of the idle client is not done")
+	}
+
+	msg := queue.PopWithin(time.Second)
+	if msg == nil || !msg.DeadClient {
+		t.Errorf("expected a DeadClient message, got %+v", msg)
+	}
+}
+
+func TestActivityDelaysIdleDeadline(t *testing.T) {
+	client, remote, queue, done := startClient(200 * time.Millisecond)
+	defer remote.Close()
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := remote.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if msg := queue.PopWithin(time.Second); msg == nil || string(msg.Data) != "ping" {
+			t.Fatalf("expected the data of the client, got %+v", msg)
+		}
+	}
+
+	if client.IsDead() {
+		t.Error("active client was terminated")
+	}
+
+	client.Terminate()
+	waitReader(t, done)
+}
+
+func TestReaderExitsAfterTerminate(t *testing.T) {
+	client, remote, queue, done := startClient(0)
+	defer remote.Close()
+
+	client.Terminate()
+	waitReader(t, done)
+
+	if msg := queue.PopWithin(100 * time.Millisecond); msg != nil {
+		t.Errorf("terminated client sent %+v", msg)
+	}
+	if err := client.Write([]byte("late")); err != ErrClientClosed {
+		t.Errorf("expected ErrClientClosed writing to a terminated client, got %v", err)
+	}
+}
+
+func TestNoGoroutineAfterClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		client, remote, queue, done := startClient(0)
+
+		// The connection ends, then the other side acknowledges it
+		remote.Close()
+		waitReader(t, done)
+		if msg := queue.PopWithin(time.Second); msg == nil || !msg.CloseClient {
+			t.Fatalf("expected a CloseClient message, got %+v", msg)
+		}
+		if !client.CloseWrite() {
+			t.Fatal("client was not closed by the acknowledgement")
+		}
+		if !client.IsDead() {
+			t.Error("closed client is not dead")
+		}
+		queue.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines left after closing the clients", after-before)
+	}
+}
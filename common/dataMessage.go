@@ -14,6 +14,11 @@
 
 package common
 
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
 func NewMessage(clientId string, data []byte) *DataMessage {
 	return &DataMessage{
 		ClientId:     clientId,
@@ -31,4 +36,56 @@ type DataMessage struct {
 	Data         []byte
 	CloseChannel bool
 	KeepAlive    bool
+
+	// Setup messages carry the agent setup in Data, see AgentSetup
+	Setup bool
+
+	// Reset marks the DeadClient message of a connection reset by its
+	// peer, the other side resets its connection too instead of closing it
+	Reset bool
+
+	// Priority is the scheduling class of the client, both sides write
+	// higher classes first
+	Priority Priority
+
+	// Seq is the per direction sequence number of the message on the channel
+	// and Checksum covers the whole message. Both are set when the message is
+	// written and checked when it is read.
+	Seq      uint64
+	Checksum uint32
+
+	// ClientSeq numbers the data messages of a client, starting at 1, so a
+	// message retransmitted after a reconnect is only delivered once.
+	ClientSeq uint64
+
+	// Restart messages end the stream of their sender, see
+	// NewRestartMessage. The binary framing does not carry them.
+	Restart bool
+
+	// Ping messages are answered by the agent with its hello, see
+	// NewPingMessage. The binary framing does not carry them.
+	Ping bool
+
+	corrupted bool
+}
+
+// IsCorrupted reports if the message failed the sequence or checksum
+// verification when it was read from the channel.
+func (m *DataMessage) IsCorrupted() bool {
+	return m.corrupted
+}
+
+func (m *DataMessage) computeChecksum() uint32 {
+	var header [17]byte
+
+	binary.BigEndian.PutUint64(header[0:], m.Seq)
+	binary.BigEndian.PutUint64(header[8:], m.ClientSeq)
+	header[16] = m.flags()
+
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[:])
+	checksum.Write([]byte(m.ClientId))
+	checksum.Write(m.Data)
+
+	return checksum.Sum32()
 }
@@ -0,0 +1,284 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// flowQueueSize is the number of messages a client can have waiting when its
+// share of the queue limit is smaller, as long as the whole queue is under
+// the limit
+const flowQueueSize = 8
+
+// fairQuantum is the number of bytes a client can send in its turn, every
+// message is charged messageOverhead bytes on top of its data
+const fairQuantum = 4096
+const messageOverhead = 64
+
+// FairQueue holds the messages waiting to be written on the channel, in a
+// queue per client. Clients get their turn in deficit round robin by bytes
+// so a bulk transfer does not starve small request/response clients, and
+// higher priority classes always go first. The clients share a limit of
+// messages adapted to the rate the writer consumes them.
+//
+// Control messages, with an empty ClientId, have their own interactive flow
+// written in order. The ones ending the channel or the stream, CloseChannel
+// and Restart, also wait for the messages of the clients queued before them.
+type FairQueue struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	flows  map[string]*flow
+	active [3][]*flow
+	closed bool
+
+	limit  queueLimit
+	queued int
+	pushed uint64
+	popped uint64
+}
+
+// flow is the queue of messages of a client
+type flow struct {
+	id       string
+	class    Priority
+	messages []queuedMessage
+	deficit  int
+}
+
+// queuedMessage is a message waiting in its flow, order numbers the pushes
+// so the messages ending the channel wait for the ones queued before them
+type queuedMessage struct {
+	msg   *DataMessage
+	order uint64
+}
+
+func NewFairQueue() *FairQueue {
+	q := &FairQueue{flows: make(map[string]*flow)}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// Push queues msg after the other messages of its client. It waits while
+// the queue or the client has no room for it, and drops msg once the queue
+// is closed.
+func (q *FairQueue) Push(msg *DataMessage) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		if q.closed {
+			return
+		}
+
+		f, prs := q.flows[msg.ClientId]
+		if !prs {
+			class := msg.Priority
+			if msg.ClientId == "" {
+				class = PriorityInteractive
+			} else if int(class) >= len(q.active) {
+				class = PriorityNormal
+			}
+
+			f = &flow{id: msg.ClientId, class: class}
+			q.flows[f.id] = f
+			q.active[class] = append(q.active[class], f)
+		}
+
+		if q.hasRoom(f) {
+			q.pushed++
+			f.messages = append(f.messages, queuedMessage{msg: msg, order: q.pushed})
+			q.queued++
+			q.limit.pushed(len(msg.Data))
+			q.cond.Broadcast()
+			return
+		}
+
+		q.cond.Wait()
+	}
+}
+
+// hasRoom tells if f can queue one more message. The whole queue stays
+// under its limit, so the memory budget holds with many clients, and f gets
+// its share of the limit or flowQueueSize when the share is smaller. A
+// client can always queue one message. Must be called with lock held.
+func (q *FairQueue) hasRoom(f *flow) bool {
+	if len(f.messages) == 0 {
+		return true
+	}
+
+	limit := q.limit.get()
+	share := limit / len(q.flows)
+	if share < flowQueueSize {
+		share = flowQueueSize
+	}
+	return q.queued < limit && len(f.messages) < share
+}
+
+// Depth returns the number of messages queued and the current limit
+func (q *FairQueue) Depth() (int, int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.queued, q.limit.get()
+}
+
+// SetMemory sets the budget of bytes the queue adapts its limit to, zero
+// for DefaultQueueMemory
+func (q *FairQueue) SetMemory(memory int64) {
+	q.limit.setMemory(memory)
+}
+
+// Pop waits for the next message to write and returns it, or nil once the
+// queue is closed
+func (q *FairQueue) Pop() *DataMessage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for !q.closed {
+		if msg := q.next(); msg != nil {
+			return msg
+		}
+
+		q.cond.Wait()
+	}
+
+	return nil
+}
+
+// PopWithin is like Pop but waits at most timeout, it returns nil if no
+// message was queued in time
+func (q *FairQueue) PopWithin(timeout time.Duration) *DataMessage {
+	deadline := time.Now().Add(timeout)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var timer *time.Timer
+	for !q.closed {
+		if msg := q.next(); msg != nil {
+			return msg
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+
+		if timer == nil {
+			timer = time.AfterFunc(timeout, func() {
+				q.lock.Lock()
+				q.cond.Broadcast()
+				q.lock.Unlock()
+			})
+			defer timer.Stop()
+		}
+
+		q.cond.Wait()
+	}
+
+	return nil
+}
+
+// next takes the next message in class order, or returns nil if there is
+// none. Must be called with lock held.
+func (q *FairQueue) next() *DataMessage {
+	for _, class := range []Priority{PriorityInteractive, PriorityNormal, PriorityBulk} {
+		if msg := q.popClass(class); msg != nil {
+			q.cond.Broadcast()
+			return msg
+		}
+	}
+
+	return nil
+}
+
+// popClass takes the next message of the client at the head of the round of
+// class. The client gets a quantum when its turn starts and keeps the turn
+// until it is spent or it has no more messages. The control flow is skipped
+// while its next message waits for the clients, nil is returned when no
+// flow of class can be served.
+func (q *FairQueue) popClass(class Priority) *DataMessage {
+	round := q.active[class]
+	for i, f := range round {
+		if q.waitsForClients(f) {
+			continue
+		}
+
+		// The served flow takes the turn of the skipped control flow
+		if i > 0 {
+			copy(round[1:i+1], round[:i])
+			round[0] = f
+		}
+		return q.popFlow(class, f)
+	}
+
+	return nil
+}
+
+// waitsForClients tells if the next message of f ends the channel or the
+// stream while messages of clients queued before it are still waiting.
+// Must be called with lock held.
+func (q *FairQueue) waitsForClients(f *flow) bool {
+	head := f.messages[0]
+	if f.id != "" || !(head.msg.CloseChannel || head.msg.Restart) {
+		return false
+	}
+
+	for _, other := range q.flows {
+		if other != f && len(other.messages) > 0 && other.messages[0].order < head.order {
+			return true
+		}
+	}
+	return false
+}
+
+// popFlow takes the next message of f, which must be at the head of the
+// round of class. Must be called with lock held.
+func (q *FairQueue) popFlow(class Priority, f *flow) *DataMessage {
+	if f.deficit <= 0 {
+		f.deficit += fairQuantum
+	}
+
+	msg := f.messages[0].msg
+	f.messages[0] = queuedMessage{}
+	f.messages = f.messages[1:]
+	f.deficit -= len(msg.Data) + messageOverhead
+
+	q.queued--
+	q.popped++
+	q.limit.consumed(q.popped)
+
+	switch {
+	case len(f.messages) == 0:
+		q.active[class] = q.active[class][1:]
+		delete(q.flows, f.id)
+	case f.deficit <= 0:
+		q.active[class] = append(q.active[class][1:], f)
+	}
+
+	return msg
+}
+
+// Close drops the queued messages and wakes up everyone waiting on the queue
+func (q *FairQueue) Close() {
+	q.lock.Lock()
+	q.closed = true
+	q.flows = nil
+	q.active = [3][]*flow{}
+	q.queued = 0
+	q.cond.Broadcast()
+	q.lock.Unlock()
+}
@@ -0,0 +1,127 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func clientMessage(clientId string, priority Priority) *DataMessage {
+	msg := NewMessage(clientId, []byte(clientId))
+	msg.Priority = priority
+	return msg
+}
+
+// popAll pops the messages queued in q, in the order they are written
+func popAll(q *FairQueue) []*DataMessage {
+	var messages []*DataMessage
+	for {
+		msg := q.PopWithin(time.Millisecond)
+		if msg == nil {
+			return messages
+		}
+		messages = append(messages, msg)
+	}
+}
+
+func TestControlMessagesAreInteractive(t *testing.T) {
+	q := NewFairQueue()
+
+	keepAlive := NewMessage("", nil)
+	keepAlive.KeepAlive = true
+	ping := NewPingMessage()
+
+	q.Push(clientMessage("bulk", PriorityBulk))
+	q.Push(keepAlive)
+	q.Push(clientMessage("normal", PriorityNormal))
+	q.Push(ping)
+
+	messages := popAll(q)
+	if len(messages) != 4 {
+		t.Fatalf("popped %d messages, expected 4", len(messages))
+	}
+	if messages[0] != keepAlive || messages[1] != ping {
+		t.Errorf("control messages were not written first and in order: %q, %q", messages[0].ClientId, messages[1].ClientId)
+	}
+	if messages[2].ClientId != "normal" || messages[3].ClientId != "bulk" {
+		t.Errorf("client messages were written in order %q, %q", messages[2].ClientId, messages[3].ClientId)
+	}
+}
+
+func TestCloseChannelWaitsForQueuedClients(t *testing.T) {
+	for _, end := range []*DataMessage{{CloseChannel: true}, NewRestartMessage()} {
+		q := NewFairQueue()
+
+		before := clientMessage("before", PriorityBulk)
+		ping := NewPingMessage()
+		after := clientMessage("after", PriorityBulk)
+
+		q.Push(before)
+		q.Push(end)
+		q.Push(ping)
+		q.Push(after)
+
+		messages := popAll(q)
+		if len(messages) != 4 {
+			t.Fatalf("popped %d messages, expected 4", len(messages))
+		}
+
+		// The ping stays behind the end of the channel, which does not wait
+		// for the client queued after it
+		expected := []*DataMessage{before, end, ping, after}
+		for i, msg := range messages {
+			if msg != expected[i] {
+				t.Errorf("message %d is %+v, expected %+v", i, msg, expected[i])
+			}
+		}
+	}
+}
+
+func TestQueueLimitHoldsWithManyClients(t *testing.T) {
+	q := NewFairQueue()
+	_, limit := q.Depth()
+
+	// Every client can queue one message, the others wait for room
+	clients := 2 * limit
+	for i := 0; i < clients; i++ {
+		q.Push(clientMessage(string(rune('a'+i)), PriorityNormal))
+	}
+
+	pushed := make(chan struct{})
+	go func() {
+		q.Push(clientMessage("a", PriorityNormal))
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("message queued over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The first message of a is written, it can queue the next one
+	q.Pop()
+	select {
+	case <-pushed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not queued once the client had room")
+	}
+
+	if depth, _ := q.Depth(); depth != clients {
+		t.Errorf("depth is %d, expected %d", depth, clients)
+	}
+	q.Close()
+}
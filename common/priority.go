@@ -0,0 +1,49 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"errors"
+)
+
+// Priority is the scheduling class of the messages of a client on the
+// channel. Interactive messages are written before normal ones, and normal
+// ones before bulk ones.
+type Priority uint8
+
+const (
+	PriorityNormal Priority = iota
+	PriorityInteractive
+	PriorityBulk
+)
+
+var priorityNames = []string{"normal", "interactive", "bulk"}
+
+func (p Priority) String() string {
+	if int(p) < len(priorityNames) {
+		return priorityNames[p]
+	}
+	return "unknown"
+}
+
+// ParsePriority returns the priority class called name
+func ParsePriority(name string) (Priority, error) {
+	for i, className := range priorityNames {
+		if name == className {
+			return Priority(i), nil
+		}
+	}
+	return PriorityNormal, errors.New("unknown priority class " + name + ", expected interactive, normal or bulk")
+}
@@ -0,0 +1,95 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ProtocolVersion numbers the channel protocol: the messages, their
+// encoding and their meaning. It is increased with every change an older
+// peer would not understand.
+//
+// 2: agent upgrade clients and restart messages
+// 3: ping messages
+const ProtocolVersion = 3
+
+// MinProtocolVersion is the oldest protocol version of a peer this side
+// still works with
+const MinProtocolVersion = 1
+
+// Preamble is written by an agent started with --preamble before its first
+// message, so the server can skip what the login shell printed on stdout
+var Preamble = []byte("\x00\x00SaSSHimi-preamble\x00\x00")
+
+// AgentHello is sent by the agent in reply to the setup message, so the
+// server knows the version of an agent left on the remote host by an older
+// client
+type AgentHello struct {
+	Protocol    int
+	MinProtocol int
+	Version     string
+
+	// AuthSock is the forwarded ssh-agent socket on the remote host
+	AuthSock string
+}
+
+// NewHelloMessage returns the setup message the agent replies with
+func NewHelloMessage(hello AgentHello) *DataMessage {
+	data, _ := json.Marshal(hello)
+
+	msg := NewMessage("", data)
+	msg.Setup = true
+	return msg
+}
+
+// NewPingMessage returns the message the agent answers with its hello, to
+// check data still makes round trips through the channel. It is also a
+// keepalive, so agents older than protocol 3 ignore it.
+func NewPingMessage() *DataMessage {
+	msg := NewMessage("", nil)
+	msg.KeepAlive = true
+	msg.Ping = true
+	return msg
+}
+
+// ParseHello reads the agent hello of a setup message sent by the agent
+func ParseHello(msg *DataMessage) (AgentHello, error) {
+	var hello AgentHello
+
+	err := json.Unmarshal(msg.Data, &hello)
+	if err != nil {
+		return hello, fmt.Errorf("Invalid agent hello: %w", err)
+	}
+
+	return hello, nil
+}
+
+// CheckProtocol returns an error when a peer speaking protocol, and
+// accepting peers down to minProtocol, cannot work with this side
+func CheckProtocol(protocol int, minProtocol int) error {
+	if protocol < MinProtocolVersion {
+		return errors.New("protocol " + strconv.Itoa(protocol) + " of the other side is older than " +
+			strconv.Itoa(MinProtocolVersion) + ", the oldest supported")
+	}
+	if ProtocolVersion < minProtocol {
+		return errors.New("the other side requires protocol " + strconv.Itoa(minProtocol) +
+			" or newer, this side speaks " + strconv.Itoa(ProtocolVersion))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// Bounds of the adaptive queue limits, in messages. MaxQueueLimit is the
+// capacity to give to the InChannel of a ChannelForwarder.
+const minQueueLimit = 10
+const MaxQueueLimit = 1024
+
+// queueTarget is how long the queued messages should last at the rate
+// they are consumed
+const queueTarget = 100 * time.Millisecond
+
+// DefaultQueueMemory is the default budget of bytes held in a queue
+const DefaultQueueMemory = 64 * 1024 * 1024
+
+// queueLimit adapts the number of messages a queue holds to the rate they
+// are consumed: enough for queueTarget of traffic so a fast link does not
+// stall on a full queue, and no more than the memory budget allows so a slow
+// link does not pile up data. The zero value is ready to use.
+type queueLimit struct {
+	lock   sync.Mutex
+	memory int64
+	limit  int
+
+	// Moving averages of the messages consumed per second and of their size
+	rate    float64
+	avgSize float64
+
+	windowStart time.Time
+	windowTotal uint64
+	total       uint64
+}
+
+// setMemory sets the budget of bytes, zero for DefaultQueueMemory
+func (l *queueLimit) setMemory(memory int64) {
+	l.lock.Lock()
+	l.memory = memory
+	l.lock.Unlock()
+}
+
+// pushed records the size of a message entering the queue
+func (l *queueLimit) pushed(size int) {
+	l.lock.Lock()
+	l.avgSize += (float64(size+messageOverhead) - l.avgSize) / 16
+	l.lock.Unlock()
+}
+
+// consumed records the total number of messages that left the queue
+func (l *queueLimit) consumed(total uint64) {
+	l.lock.Lock()
+	l.total = total
+	l.lock.Unlock()
+}
+
+// get returns the current limit, updated once per queueTarget
+func (l *queueLimit) get() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(l.windowStart)
+
+	if l.limit == 0 || elapsed >= queueTarget {
+		if !l.windowStart.IsZero() {
+			rate := float64(l.total-l.windowTotal) / elapsed.Seconds()
+			l.rate += (rate - l.rate) / 4
+		}
+		l.windowStart = now
+		l.windowTotal = l.total
+
+		l.limit = int(l.rate * queueTarget.Seconds())
+
+		memory := l.memory
+		if memory <= 0 {
+			memory = DefaultQueueMemory
+		}
+		if l.avgSize > 0 && float64(l.limit) > float64(memory)/l.avgSize {
+			l.limit = int(float64(memory) / l.avgSize)
+		}
+
+		if l.limit < minQueueLimit {
+			l.limit = minQueueLimit
+		} else if l.limit > MaxQueueLimit {
+			l.limit = MaxQueueLimit
+		}
+	}
+
+	return l.limit
+}
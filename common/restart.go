@@ -0,0 +1,126 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bufio"
+	"errors"
+	"sync"
+	"time"
+)
+
+// NewRestartMessage returns the message restarting the channel streams, so
+// the agent can be replaced by another process on the same channel. The side
+// starting the restart writes nothing more until the other side answered
+// with its own restart message, then both streams start again from sequence
+// 0 with new encoders, and the handshake is written again.
+func NewRestartMessage() *DataMessage {
+	msg := NewMessage("", nil)
+	msg.Restart = true
+	return msg
+}
+
+// streamRestart synchronizes the reader and the writer of a ChannelForwarder
+// during a restart
+type streamRestart struct {
+	lock       sync.Mutex
+	inProgress bool
+	written    chan struct{}
+	peer       chan struct{}
+}
+
+func (r *streamRestart) init() {
+	if r.written == nil {
+		r.written = make(chan struct{}, 1)
+		r.peer = make(chan struct{}, 1)
+	}
+}
+
+// sending is called when a restart message is written
+func (r *streamRestart) sending() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.init()
+	r.inProgress = true
+}
+
+// sent tells if this side wrote a restart message the other side has not
+// answered yet
+func (r *streamRestart) sent() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.inProgress
+}
+
+// peerRestarted is called when the other side answered the restart
+func (r *streamRestart) peerRestarted() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.inProgress = false
+	select {
+	case r.peer <- struct{}{}:
+	default:
+	}
+}
+
+func (r *streamRestart) signals() (written chan struct{}, peer chan struct{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.init()
+	return r.written, r.peer
+}
+
+// RestartWritten returns a channel signaled once a restart message pushed on
+// OutQueue is written, after which nothing else is
+func (c *ChannelForwarder) RestartWritten() <-chan struct{} {
+	written, _ := c.restart.signals()
+	return written
+}
+
+// restartStream waits for the other side to restart its stream once a
+// restart message was written, and starts a new stream
+func (c *ChannelForwarder) restartStream(writer *bufio.Writer) (messageEncoder, error) {
+	written, peer := c.restart.signals()
+	select {
+	case written <- struct{}{}:
+	default:
+	}
+
+	for restarted := false; !restarted; {
+		select {
+		case <-peer:
+			restarted = true
+		case <-time.After(time.Second):
+			if !c.ChannelOpen {
+				return nil, errors.New("channel closed during restart")
+			}
+		}
+	}
+
+	c.outSeq = 0
+	encoder := c.newEncoder(writer)
+
+	if c.Handshake != nil {
+		err := c.writeMessage(encoder, c.Handshake)
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return encoder, nil
+}
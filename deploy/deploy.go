@@ -0,0 +1,166 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"strconv"
+	"sync"
+)
+
+// HostConfig returns the configuration of the host of a target
+type HostConfig func(target string) *viper.Viper
+
+// deployment is the tunnel of a target
+type deployment struct {
+	target   Target
+	endpoint *server.Endpoint
+	err      error
+}
+
+// serve waits for the agent of the deployment and serves its proxy
+func (d *deployment) serve() {
+	d.err = d.endpoint.WaitReady()
+	if d.err != nil {
+		return
+	}
+
+	address, err := d.endpoint.ListenProxy(d.target.Bind)
+	if err != nil {
+		d.err = errors.New("Failed to bind local port " + err.Error())
+		d.endpoint.Close()
+		return
+	}
+
+	utils.Logger.Notice("Proxy bind at", address.String(), "for tunnel", d.endpoint.Name())
+	audit.Record("deploy_target", map[string]string{"tunnel": d.endpoint.Name(), "target": d.target.Host, "bind": address.String()})
+}
+
+// fleet is the set of deployments of a Run
+type fleet struct {
+	lock        sync.Mutex
+	closing     bool
+	deployments []*deployment
+}
+
+// open starts the tunnel of target, unless the fleet is closing
+func (f *fleet) open(target Target, hostConfig HostConfig, verboseLevel int) *deployment {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closing {
+		return nil
+	}
+
+	d := &deployment{
+		target:   target,
+		endpoint: server.OpenEndpoint(hostConfig(target.Host), verboseLevel),
+	}
+	f.deployments = append(f.deployments, d)
+	return d
+}
+
+// close stops every agent deployed or being deployed
+func (f *fleet) close() {
+	f.lock.Lock()
+	f.closing = true
+	deployments := f.deployments
+	f.lock.Unlock()
+
+	var wait sync.WaitGroup
+	for _, d := range deployments {
+		wait.Add(1)
+		go func(d *deployment) {
+			defer wait.Done()
+			utils.Logger.Notice("Closing tunnel", d.endpoint.Name(), "to", d.target.Host)
+			d.endpoint.Close()
+		}(d)
+	}
+	wait.Wait()
+}
+
+// Run deploys agents to targets, at most concurrency at a time, and serves
+// the proxy of each one until interrupted. Targets without a proxy address
+// take the ports following the one of firstBind. The targets that failed are
+// reported and left out, Run only fails if all did.
+func Run(targets []Target, firstBind string, concurrency int, hostConfig HostConfig, verboseLevel int) error {
+	err := assignBinds(targets, firstBind)
+	if err != nil {
+		return err
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	utils.RaiseFileLimit()
+
+	f := &fleet{}
+	utils.ExitCallback(f.close)
+
+	deployments := make([]*deployment, len(targets))
+	slots := make(chan struct{}, concurrency)
+	var wait sync.WaitGroup
+
+	for i, target := range targets {
+		wait.Add(1)
+		go func(i int, target Target) {
+			defer wait.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			d := f.open(target, hostConfig, verboseLevel)
+			if d != nil {
+				d.serve()
+				deployments[i] = d
+			}
+		}(i, target)
+	}
+	wait.Wait()
+
+	var ready []*deployment
+	for _, d := range deployments {
+		switch {
+		case d == nil:
+		case d.err != nil:
+			utils.Logger.Error("Failed to deploy to", d.target.Host+":", d.err.Error())
+		default:
+			ready = append(ready, d)
+		}
+	}
+
+	utils.Logger.Notice(strconv.Itoa(len(ready)), "of", strconv.Itoa(len(targets)), "targets deployed")
+	if len(ready) == 0 {
+		return errors.New("No agent could be deployed")
+	}
+
+	for _, d := range ready {
+		<-d.endpoint.Done()
+	}
+
+	f.lock.Lock()
+	closing := f.closing
+	f.lock.Unlock()
+	if closing {
+		// The tunnels were closed on purpose, the exit callback ends
+		select {}
+	}
+	return errors.New("Every tunnel closed")
+}
@@ -0,0 +1,95 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Target is a host to deploy an agent to, and the local address of the
+// proxy going through it
+type Target struct {
+	// Host is a <user@host:port|host_id> target, like server accepts
+	Host string
+
+	// Bind is the proxy address, empty to take the next free one
+	Bind string
+}
+
+// ReadTargets reads a targets file: one "<user@host:port|host_id> [bind]"
+// per line. Blank lines and lines starting with # are skipped.
+func ReadTargets(reader io.Reader) ([]Target, error) {
+	var targets []Target
+
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) > 2 {
+			return nil, errors.New("Invalid target on line " + strconv.Itoa(line) + ": " + text)
+		}
+
+		target := Target{Host: fields[0]}
+		if len(fields) == 2 {
+			target.Bind = fields[1]
+		}
+		targets = append(targets, target)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New("Failed to read targets: " + err.Error())
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("No target to deploy to")
+	}
+
+	return targets, nil
+}
+
+// assignBinds gives the targets without a proxy address the ports following
+// the one of firstBind, in order
+func assignBinds(targets []Target, firstBind string) error {
+	host, port, err := net.SplitHostPort(firstBind)
+	if err != nil {
+		return errors.New("Invalid bind address " + firstBind + ": " + err.Error())
+	}
+
+	next, err := strconv.Atoi(port)
+	if err != nil {
+		return errors.New("Invalid bind port " + port)
+	}
+
+	for i := range targets {
+		if targets[i].Bind != "" {
+			continue
+		}
+		targets[i].Bind = net.JoinHostPort(host, strconv.Itoa(next))
+		if next != 0 {
+			// Port 0 takes a random port for each target
+			next++
+		}
+	}
+
+	return nil
+}
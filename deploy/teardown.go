@@ -0,0 +1,66 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"sync"
+)
+
+// Cleanup is the teardown report of a target
+type Cleanup struct {
+	Target      string                  `json:"target"`
+	Directories []server.TeardownResult `json:"directories"`
+	Error       string                  `json:"error,omitempty"`
+}
+
+// Teardown stops the agents and removes their files on every target, at
+// most concurrency at a time. The report has one Cleanup per target, in the
+// order of targets, failed targets included.
+func Teardown(targets []Target, concurrency int, hostConfig HostConfig) []Cleanup {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	cleanups := make([]Cleanup, len(targets))
+	slots := make(chan struct{}, concurrency)
+	var wait sync.WaitGroup
+
+	for i, target := range targets {
+		wait.Add(1)
+		go func(i int, target Target) {
+			defer wait.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			utils.Logger.Notice("Cleaning up", target.Host)
+			results, err := server.Teardown(hostConfig(target.Host))
+
+			cleanups[i] = Cleanup{Target: target.Host, Directories: results}
+			if cleanups[i].Directories == nil {
+				cleanups[i].Directories = []server.TeardownResult{}
+			}
+			if err != nil {
+				utils.Logger.Error("Failed to clean up", target.Host+":", err.Error())
+				cleanups[i].Error = err.Error()
+			}
+		}(i, target)
+	}
+	wait.Wait()
+
+	return cleanups
+}
@@ -0,0 +1,116 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package events publishes the life cycle of tunnels and of their clients to
+// programs embedding SaSSHimi, so they can build their own interfaces and
+// automation. Nothing is published until someone subscribes.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is one of TunnelUp, TunnelDown, ClientOpened or ClientClosed
+type Event interface {
+	event()
+}
+
+// TunnelUp is published when the tunnel named Tunnel is open
+type TunnelUp struct {
+	Time   time.Time
+	Tunnel string
+}
+
+// TunnelDown is published when the tunnel named Tunnel is closed
+type TunnelDown struct {
+	Time   time.Time
+	Tunnel string
+}
+
+// ClientOpened is published when the SOCKS destination of a client is known,
+// Destination is empty if the client is not a SOCKS connect or closed before
+// sending it
+type ClientOpened struct {
+	Time        time.Time
+	Tunnel      string
+	Client      string
+	Operator    string
+	Destination string
+}
+
+// ClientClosed is published when a client is closed, with the bytes it
+// uploaded to and downloaded from the tunnel
+type ClientClosed struct {
+	Time     time.Time
+	Tunnel   string
+	Client   string
+	Operator string
+	Upload   uint64
+	Download uint64
+}
+
+func (TunnelUp) event()     {}
+func (TunnelDown) event()   {}
+func (ClientOpened) event() {}
+func (ClientClosed) event() {}
+
+var subscribers = make(map[<-chan Event]chan Event)
+var subscribersLock sync.RWMutex
+
+// Subscribe returns a channel receiving the events published from now on.
+// Events are dropped rather than slowing the tunnels down when size of them
+// are waiting to be received.
+func Subscribe(size int) <-chan Event {
+	events := make(chan Event, size)
+
+	subscribersLock.Lock()
+	subscribers[events] = events
+	subscribersLock.Unlock()
+
+	return events
+}
+
+// Unsubscribe stops publishing to events and closes it
+func Unsubscribe(events <-chan Event) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+
+	if channel, prs := subscribers[events]; prs {
+		delete(subscribers, events)
+		close(channel)
+	}
+}
+
+// Active tells if anyone is subscribed, to skip the work of building events
+// nobody receives
+func Active() bool {
+	subscribersLock.RLock()
+	defer subscribersLock.RUnlock()
+
+	return len(subscribers) > 0
+}
+
+// Publish sends event to every subscriber with room for it
+func Publish(event Event) {
+	subscribersLock.RLock()
+	defer subscribersLock.RUnlock()
+
+	for _, channel := range subscribers {
+		select {
+		case channel <- event:
+		default:
+		}
+	}
+}
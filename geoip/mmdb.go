@@ -0,0 +1,320 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package geoip reads offline MaxMind DB files, like GeoLite2-ASN and
+// GeoLite2-Country, to tell who owns the public addresses reached through
+// the tunnel.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Reader looks up addresses in a MaxMind DB file loaded in memory
+type Reader struct {
+	buffer     []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+
+	// DatabaseType is the kind of database, like GeoLite2-ASN
+	DatabaseType string
+}
+
+// Open loads the MaxMind DB file at path
+func Open(path string) (*Reader, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromBytes(buffer)
+}
+
+// FromBytes reads a MaxMind DB from buffer
+func FromBytes(buffer []byte) (*Reader, error) {
+	markerAt := bytes.LastIndex(buffer, metadataMarker)
+	if markerAt < 0 {
+		return nil, errors.New("not a MaxMind DB file: metadata not found")
+	}
+
+	metadataSection := buffer[markerAt+len(metadataMarker):]
+	value, _, err := decoder{data: metadataSection}.decode(0)
+	if err != nil {
+		return nil, errors.New("invalid MaxMind DB metadata: " + err.Error())
+	}
+
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid MaxMind DB metadata: not a map")
+	}
+
+	reader := &Reader{buffer: buffer}
+	reader.nodeCount = uint(toUint(metadata["node_count"]))
+	reader.recordSize = uint(toUint(metadata["record_size"]))
+	reader.ipVersion = uint(toUint(metadata["ip_version"]))
+	reader.DatabaseType, _ = metadata["database_type"].(string)
+
+	if reader.recordSize != 24 && reader.recordSize != 28 && reader.recordSize != 32 {
+		return nil, errors.New("unsupported MaxMind DB record size")
+	}
+
+	treeSize := reader.nodeCount * reader.recordSize / 4
+	if treeSize+16 > uint(markerAt) {
+		return nil, errors.New("invalid MaxMind DB: search tree larger than the file")
+	}
+	reader.data = buffer[treeSize+16 : markerAt]
+
+	return reader, nil
+}
+
+func toUint(value interface{}) uint64 {
+	number, _ := value.(uint64)
+	return number
+}
+
+// Lookup returns the record of ip, nil if the database has none
+func (r *Reader) Lookup(ip net.IP) (map[string]interface{}, error) {
+	var bits []byte
+	if ipv4 := ip.To4(); ipv4 != nil && r.ipVersion == 6 {
+		bits = append(make([]byte, 12), ipv4...)
+	} else if ipv4 != nil {
+		bits = ipv4
+	} else if r.ipVersion == 6 {
+		bits = ip.To16()
+	} else {
+		return nil, nil
+	}
+
+	node := uint(0)
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := (bits[i/8] >> uint(7-i%8)) & 1
+		node = r.readRecord(node, uint(bit))
+	}
+
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+
+	offset := node - r.nodeCount - 16
+	if offset >= uint(len(r.data)) {
+		return nil, errors.New("invalid MaxMind DB: record outside of the data section")
+	}
+
+	value, _, err := decoder{data: r.data}.decode(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	record, _ := value.(map[string]interface{})
+	return record, nil
+}
+
+// readRecord returns the left or right record of node
+func (r *Reader) readRecord(node uint, right uint) uint {
+	nodeSize := r.recordSize / 4
+	b := r.buffer[node*nodeSize : (node+1)*nodeSize]
+
+	switch r.recordSize {
+	case 24:
+		b = b[right*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if right == 1 {
+			return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+		}
+		return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	default:
+		return uint(binary.BigEndian.Uint32(b[right*4:]))
+	}
+}
+
+// decoder reads the values of a MaxMind DB data section
+type decoder struct {
+	data []byte
+}
+
+const (
+	typeExtended = 0
+	typePointer  = 1
+	typeString   = 2
+	typeDouble   = 3
+	typeBytes    = 4
+	typeUint16   = 5
+	typeUint32   = 6
+	typeMap      = 7
+	typeInt32    = 8
+	typeUint64   = 9
+	typeUint128  = 10
+	typeArray    = 11
+	typeBoolean  = 14
+	typeFloat    = 15
+)
+
+var errTruncated = errors.New("truncated MaxMind DB data")
+
+// decode returns the value at offset and the offset following it
+func (d decoder) decode(offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(d.data)) {
+		return nil, 0, errTruncated
+	}
+
+	control := d.data[offset]
+	offset++
+
+	kind := uint(control >> 5)
+	if kind == typePointer {
+		pointer, next, err := d.pointer(control, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer)
+		return value, next, err
+	}
+
+	if kind == typeExtended {
+		if offset >= uint(len(d.data)) {
+			return nil, 0, errTruncated
+		}
+		kind = 7 + uint(d.data[offset])
+		offset++
+	}
+
+	size := uint(control & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint(len(d.data)) {
+			return nil, 0, errTruncated
+		}
+		value := uint(0)
+		for _, b := range d.data[offset : offset+extra] {
+			value = value<<8 | uint(b)
+		}
+		offset += extra
+		switch size {
+		case 29:
+			size = 29 + value
+		case 30:
+			size = 285 + value
+		default:
+			size = 65821 + value
+		}
+	}
+
+	switch kind {
+	case typeMap:
+		record := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, _ := key.(string)
+			record[name] = value
+			offset = next
+		}
+		return record, offset, nil
+
+	case typeArray:
+		array := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			array = append(array, value)
+			offset = next
+		}
+		return array, offset, nil
+
+	case typeBoolean:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.data)) {
+		return nil, 0, errTruncated
+	}
+	payload := d.data[offset : offset+size]
+	offset += size
+
+	switch kind {
+	case typeString:
+		return string(payload), offset, nil
+	case typeBytes, typeUint128:
+		return payload, offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid MaxMind DB double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid MaxMind DB float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(payload))), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		value := uint64(0)
+		for _, b := range payload {
+			value = value<<8 | uint64(b)
+		}
+		return value, offset, nil
+	case typeInt32:
+		value := uint32(0)
+		for _, b := range payload {
+			value = value<<8 | uint32(b)
+		}
+		return int64(int32(value)), offset, nil
+	}
+
+	// Data cache containers and end markers are not used in records
+	return nil, offset, nil
+}
+
+// pointer returns the data section offset of the pointer whose control
+// byte was read before offset, and the offset following the pointer
+func (d decoder) pointer(control byte, offset uint) (uint, uint, error) {
+	size := uint(control>>3)&0x3 + 1
+	if offset+size > uint(len(d.data)) {
+		return 0, 0, errTruncated
+	}
+
+	value := uint(0)
+	if size < 4 {
+		value = uint(control & 0x7)
+	}
+	for _, b := range d.data[offset : offset+size] {
+		value = value<<8 | uint(b)
+	}
+
+	switch size {
+	case 2:
+		value += 2048
+	case 3:
+		value += 526336
+	}
+
+	return value, offset + size, nil
+}
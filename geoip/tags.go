@@ -0,0 +1,71 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package geoip
+
+import (
+	"net"
+	"strconv"
+)
+
+var nonPublicNetworks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		nonPublicNetworks = append(nonPublicNetworks, network)
+	}
+}
+
+// IsPublic tells if ip is reachable on the internet, not a private,
+// loopback, link-local or multicast address
+func IsPublic(ip net.IP) bool {
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Tags returns the autonomous system and country of ip found in readers,
+// as the asn, as_org and country keys
+func Tags(readers []*Reader, ip net.IP) map[string]string {
+	tags := make(map[string]string)
+
+	for _, reader := range readers {
+		record, err := reader.Lookup(ip)
+		if err != nil || record == nil {
+			continue
+		}
+
+		if asn, ok := record["autonomous_system_number"].(uint64); ok {
+			tags["asn"] = "AS" + strconv.FormatUint(asn, 10)
+		}
+		if org, ok := record["autonomous_system_organization"].(string); ok {
+			tags["as_org"] = org
+		}
+		if country, ok := record["country"].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				tags["country"] = code
+			}
+		}
+	}
+
+	return tags
+}
@@ -1,6 +1,6 @@
 module github.com/rsrdesarrollo/SaSSHimi
 
-go 1.10
+go 1.13
 
 require (
 	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5
@@ -10,5 +10,7 @@ require (
 	github.com/spf13/cobra v1.4.0
 	github.com/spf13/viper v1.10.1
 	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
 	golang.org/x/sys v0.0.0-20220405052023-b1e9470b6e64
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,173 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// hostRange matches host names with a numeric range, like web[01:20].corp
+var hostRange = regexp.MustCompile(`^(.*)\[(\d+):(\d+)\](.*)$`)
+
+// readINI reads an inventory in the Ansible INI format: [group] sections of
+// "host key=value..." lines, [group:vars] sections of "key=value" lines and
+// [group:children] sections of group names
+func readINI(reader io.Reader) (*Inventory, error) {
+	inventory := newInventory()
+
+	section, kind := ungrouped, ""
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			section, kind = text[1:len(text)-1], ""
+			if index := strings.LastIndex(section, ":"); index >= 0 {
+				section, kind = section[:index], section[index+1:]
+			}
+			if kind != "" && kind != "vars" && kind != "children" {
+				return nil, fmt.Errorf("Invalid inventory section on line %d: %s", line, text)
+			}
+			inventory.group(section)
+			continue
+		}
+
+		fields, err := splitFields(text)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid inventory line %d: %s", line, err.Error())
+		}
+
+		switch kind {
+		case "vars":
+			key, value, err := splitVar(text)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid inventory line %d: %s", line, err.Error())
+			}
+			inventory.group(section).vars[key] = value
+		case "children":
+			inventory.addChild(section, fields[0])
+		default:
+			vars := make(map[string]string)
+			for _, field := range fields[1:] {
+				key, value, err := splitVar(field)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid inventory line %d: %s", line, err.Error())
+				}
+				vars[key] = value
+			}
+
+			hosts, err := expandHosts(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid inventory line %d: %s", line, err.Error())
+			}
+			for _, host := range hosts {
+				inventory.addHost(section, host, vars)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New("Failed to read inventory: " + err.Error())
+	}
+
+	return inventory, nil
+}
+
+// splitFields splits a line on spaces outside of quotes, removing the
+// quotes
+func splitFields(text string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	var quote rune
+	inField := false
+
+	for _, char := range text {
+		switch {
+		case quote != 0 && char == quote:
+			quote = 0
+		case quote != 0:
+			field.WriteRune(char)
+		case char == '"' || char == '\'':
+			quote = char
+			inField = true
+		case char == ' ' || char == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(char)
+			inField = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// splitVar splits a key=value field, the value being unquoted
+func splitVar(field string) (string, string, error) {
+	tokens := strings.SplitN(field, "=", 2)
+	if len(tokens) != 2 || strings.TrimSpace(tokens[0]) == "" {
+		return "", "", errors.New("expected key=value, got " + field)
+	}
+
+	value := strings.TrimSpace(tokens[1])
+	if unquoted, err := splitFields(value); err == nil && len(unquoted) == 1 {
+		value = unquoted[0]
+	}
+	return strings.TrimSpace(tokens[0]), value, nil
+}
+
+// expandHosts expands a numeric range in a host name, keeping the width of
+// the first bound like web[01:20]
+func expandHosts(pattern string) ([]string, error) {
+	match := hostRange.FindStringSubmatch(pattern)
+	if match == nil {
+		return []string{pattern}, nil
+	}
+
+	start, _ := strconv.Atoi(match[2])
+	end, err := strconv.Atoi(match[3])
+	if err != nil || end < start {
+		return nil, errors.New("invalid host range " + pattern)
+	}
+
+	format := "%s%d%s"
+	if len(match[2]) > 1 && strings.HasPrefix(match[2], "0") {
+		format = "%s%0" + strconv.Itoa(len(match[2])) + "d%s"
+	}
+
+	hosts := make([]string, 0, end-start+1)
+	for n := start; n <= end; n++ {
+		hosts = append(hosts, fmt.Sprintf(format, match[1], n, match[4]))
+	}
+	return hosts, nil
+}
@@ -0,0 +1,289 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// All is the group every host of an inventory belongs to
+const All = "all"
+
+// ungrouped holds the hosts listed outside of any group
+const ungrouped = "ungrouped"
+
+// group is a group of an inventory, with its own hosts, its child groups
+// and the variables applying to all of them
+type group struct {
+	hosts    []string
+	children []string
+	vars     map[string]string
+}
+
+// Inventory is a set of hosts organized in groups, read from an Ansible
+// inventory file
+type Inventory struct {
+	groups   map[string]*group
+	hostVars map[string]map[string]string
+	hosts    []string
+}
+
+// Host is a host of an inventory with the variables of its groups and its
+// own merged, the most specific ones winning
+type Host struct {
+	Name string
+	Vars map[string]string
+}
+
+func newInventory() *Inventory {
+	return &Inventory{
+		groups:   map[string]*group{All: {vars: make(map[string]string)}},
+		hostVars: make(map[string]map[string]string),
+	}
+}
+
+// Read reads an Ansible inventory, in YAML when its extension is .yml or
+// .yaml and in INI otherwise
+func Read(path string) (*Inventory, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New("Failed to open inventory: " + err.Error())
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		return readYAML(file)
+	default:
+		return readINI(file)
+	}
+}
+
+func (i *Inventory) group(name string) *group {
+	g, prs := i.groups[name]
+	if !prs {
+		g = &group{vars: make(map[string]string)}
+		i.groups[name] = g
+	}
+	return g
+}
+
+// addHost adds host to the group with its variables
+func (i *Inventory) addHost(groupName string, host string, vars map[string]string) {
+	g := i.group(groupName)
+	if !contains(g.hosts, host) {
+		g.hosts = append(g.hosts, host)
+	}
+
+	hostVars, prs := i.hostVars[host]
+	if !prs {
+		hostVars = make(map[string]string)
+		i.hostVars[host] = hostVars
+		i.hosts = append(i.hosts, host)
+	}
+	for key, value := range vars {
+		hostVars[key] = value
+	}
+}
+
+// addChild makes child a child group of parent
+func (i *Inventory) addChild(parent string, child string) {
+	g := i.group(parent)
+	i.group(child)
+	if !contains(g.children, child) {
+		g.children = append(g.children, child)
+	}
+}
+
+// Hosts returns the hosts of pattern, a group or a host name, in the order
+// they appear in the inventory
+func (i *Inventory) Hosts(pattern string) ([]Host, error) {
+	var names []string
+
+	switch {
+	case pattern == All:
+		names = i.hosts
+	case i.groups[pattern] != nil:
+		members := make(map[string]bool)
+		i.collect(pattern, members, make(map[string]bool))
+		for _, name := range i.hosts {
+			if members[name] {
+				names = append(names, name)
+			}
+		}
+	case i.hostVars[pattern] != nil:
+		names = []string{pattern}
+	default:
+		return nil, errors.New("No group or host " + pattern + " in the inventory")
+	}
+
+	if len(names) == 0 {
+		return nil, errors.New("No host in " + pattern)
+	}
+
+	hosts := make([]Host, len(names))
+	for index, name := range names {
+		hosts[index] = Host{Name: name, Vars: i.vars(name)}
+	}
+	return hosts, nil
+}
+
+// collect adds the hosts of a group and of its child groups to members
+func (i *Inventory) collect(name string, members map[string]bool, seen map[string]bool) {
+	if seen[name] {
+		return
+	}
+	seen[name] = true
+
+	g := i.groups[name]
+	for _, host := range g.hosts {
+		members[host] = true
+	}
+	for _, child := range g.children {
+		i.collect(child, members, seen)
+	}
+}
+
+// depths returns the distance of every group from the top of the inventory.
+// Variables of deeper groups win, like with Ansible.
+func (i *Inventory) depths() map[string]int {
+	depths := map[string]int{All: 0}
+
+	var visit func(name string, depth int, path map[string]bool)
+	visit = func(name string, depth int, path map[string]bool) {
+		if path[name] {
+			return
+		}
+		if current, prs := depths[name]; prs && current >= depth {
+			return
+		}
+		depths[name] = depth
+
+		path[name] = true
+		for _, child := range i.groups[name].children {
+			visit(child, depth+1, path)
+		}
+		delete(path, name)
+	}
+
+	for name := range i.groups {
+		if name != All {
+			visit(name, 1, make(map[string]bool))
+		}
+	}
+	return depths
+}
+
+// vars returns the variables of host: those of all, of its groups from the
+// least to the most deep, then its own
+func (i *Inventory) vars(host string) map[string]string {
+	depths := i.depths()
+
+	var groups []string
+	for name := range i.groups {
+		members := make(map[string]bool)
+		i.collect(name, members, make(map[string]bool))
+		if name == All || members[host] {
+			groups = append(groups, name)
+		}
+	}
+	sort.Slice(groups, func(a, b int) bool {
+		if depths[groups[a]] != depths[groups[b]] {
+			return depths[groups[a]] < depths[groups[b]]
+		}
+		return groups[a] < groups[b]
+	})
+
+	vars := make(map[string]string)
+	for _, name := range groups {
+		for key, value := range i.groups[name].vars {
+			vars[key] = value
+		}
+	}
+	for key, value := range i.hostVars[host] {
+		vars[key] = value
+	}
+	return vars
+}
+
+// Settings returns the SaSSHimi settings of the host: the Ansible
+// connection variables are translated, the variables not starting with
+// ansible_ are settings given as they are, like RemoteAgentPath or Bind.
+func (h Host) Settings() map[string]interface{} {
+	settings := make(map[string]interface{})
+	for key, value := range h.Vars {
+		if !strings.HasPrefix(key, "ansible_") {
+			settings[key] = value
+		}
+	}
+
+	address := first(h.Vars, "ansible_host", "ansible_ssh_host")
+	if address == "" {
+		address = h.Name
+	}
+	if port := first(h.Vars, "ansible_port", "ansible_ssh_port"); port != "" {
+		address = net.JoinHostPort(address, port)
+	} else if strings.Contains(address, ":") {
+		address = net.JoinHostPort(address, "22")
+	}
+	settings["RemoteHost"] = address
+
+	if user := first(h.Vars, "ansible_user", "ansible_ssh_user"); user != "" {
+		settings["User"] = user
+	}
+	if password := first(h.Vars, "ansible_password", "ansible_ssh_pass"); password != "" {
+		settings["Password"] = password
+	}
+	if key := h.Vars["ansible_ssh_private_key_file"]; key != "" {
+		settings["PrivateKey"] = key
+	}
+
+	if become := strings.ToLower(h.Vars["ansible_become"]); become == "true" || become == "yes" || become == "1" {
+		method := h.Vars["ansible_become_method"]
+		if method == "" {
+			method = "sudo"
+		}
+		settings["Elevate"] = method
+	}
+	if password := first(h.Vars, "ansible_become_password", "ansible_become_pass"); password != "" {
+		settings["ElevatePassword"] = password
+	}
+
+	return settings
+}
+
+// first returns the first non empty variable of keys
+func first(vars map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if value := vars[key]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
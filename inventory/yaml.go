@@ -0,0 +1,109 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// yamlGroup is a group of a YAML inventory. Hosts and children are kept in
+// the order of the file.
+type yamlGroup struct {
+	Hosts    yaml.MapSlice          `yaml:"hosts"`
+	Vars     map[string]interface{} `yaml:"vars"`
+	Children yaml.MapSlice          `yaml:"children"`
+}
+
+// readYAML reads an inventory in the Ansible YAML format: groups, all at
+// the top, with hosts, vars and children groups
+func readYAML(reader io.Reader) (*Inventory, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.New("Failed to read inventory: " + err.Error())
+	}
+
+	var groups yaml.MapSlice
+	err = yaml.Unmarshal(data, &groups)
+	if err != nil {
+		return nil, errors.New("Invalid inventory: " + err.Error())
+	}
+
+	inventory := newInventory()
+	for _, item := range groups {
+		err = inventory.addYAMLGroup(fmt.Sprint(item.Key), item.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inventory, nil
+}
+
+// addYAMLGroup adds the group name, decoded as value, and its children
+func (i *Inventory) addYAMLGroup(name string, value interface{}) error {
+	var g yamlGroup
+	if value != nil {
+		// Decode the generic value again with the group layout
+		data, _ := yaml.Marshal(value)
+		if err := yaml.Unmarshal(data, &g); err != nil {
+			return errors.New("Invalid inventory group " + name + ": " + err.Error())
+		}
+	}
+
+	group := i.group(name)
+	for key, value := range g.Vars {
+		group.vars[key] = yamlString(value)
+	}
+
+	for _, item := range g.Hosts {
+		vars := make(map[string]string)
+		if hostVars, ok := item.Value.(yaml.MapSlice); ok {
+			for _, variable := range hostVars {
+				vars[fmt.Sprint(variable.Key)] = yamlString(variable.Value)
+			}
+		}
+		i.addHost(name, fmt.Sprint(item.Key), vars)
+	}
+
+	for _, item := range g.Children {
+		child := fmt.Sprint(item.Key)
+		i.addChild(name, child)
+		if err := i.addYAMLGroup(child, item.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// yamlString returns a variable value as a setting string, lists being
+// separated with spaces
+func yamlString(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		items := make([]string, len(value))
+		for index, item := range value {
+			items[index] = yamlString(item)
+		}
+		return strings.Join(items, " ")
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sasshimitest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a deterministic common.Clock: its time only moves with Advance,
+// which wakes up the goroutines sleeping until then.
+type Clock struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	now      time.Time
+	sleepers []*sleeper
+	stopped  bool
+}
+
+type sleeper struct {
+	until time.Time
+	wake  chan struct{}
+}
+
+// NewClock returns a clock stopped at start
+func NewClock(start time.Time) *Clock {
+	c := &Clock{now: start}
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+// Now returns the time of the clock
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+// Sleep waits until the clock is advanced by d
+func (c *Clock) Sleep(d time.Duration) {
+	c.lock.Lock()
+	if d <= 0 || c.stopped {
+		c.lock.Unlock()
+		return
+	}
+
+	s := &sleeper{until: c.now.Add(d), wake: make(chan struct{})}
+	c.sleepers = append(c.sleepers, s)
+	c.cond.Broadcast()
+	c.lock.Unlock()
+
+	<-s.wake
+}
+
+// Advance moves the clock forward by d and wakes up the goroutines sleeping
+// until then
+func (c *Clock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+
+	sleeping := c.sleepers[:0]
+	for _, s := range c.sleepers {
+		if s.until.After(c.now) {
+			sleeping = append(sleeping, s)
+		} else {
+			close(s.wake)
+		}
+	}
+	c.sleepers = sleeping
+}
+
+// WaitSleepers waits until n goroutines sleep on the clock, so a test
+// advances it once the timers it drives are waiting
+func (c *Clock) WaitSleepers(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(c.sleepers) < n && !c.stopped {
+		c.cond.Wait()
+	}
+}
+
+// stop wakes up every sleeping goroutine and makes the next sleeps return
+// at once, so the goroutines of a closed tunnel can exit
+func (c *Clock) stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stopped = true
+	for _, s := range c.sleepers {
+		close(s.wake)
+	}
+	c.sleepers = nil
+	c.cond.Broadcast()
+}
@@ -0,0 +1,126 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sasshimitest runs a tunnel and its agent in the same process over
+// an in-memory transport, so programs embedding SaSSHimi can test their
+// pivot logic without an SSH server. The keepalives of the tunnel follow a
+// deterministic Clock moved by the test, the other timeouts, like the idle
+// timeout of the clients, use the real clock.
+package sasshimitest
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/agent"
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/spf13/viper"
+	"net"
+	"time"
+)
+
+// Operator is the operator of the clients of the tunnel
+const Operator = "sasshimitest"
+
+// Tunnel is a tunnel to an agent running in this process, connected by a
+// pipe instead of SSH. Its SOCKS proxy listens on a loopback port.
+type Tunnel struct {
+	endpoint  *server.Endpoint
+	clock     *Clock
+	agentDone chan struct{}
+	listener  net.Listener
+}
+
+// NewTransport returns the two ends of an in-memory transport, to run a
+// server.OpenTransportEndpoint tunnel and an agent.Serve agent on
+func NewTransport() (serverSide, agentSide net.Conn) {
+	return net.Pipe()
+}
+
+// NewTunnel starts a tunnel configured by config, nil for the defaults, and
+// its agent. The tunnel sends its agent options in the setup message like
+// through SSH. Its clock starts at the current time.
+func NewTunnel(config *viper.Viper) (*Tunnel, error) {
+	if config == nil {
+		config = viper.New()
+	}
+	config.SetDefault("Name", "sasshimitest")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	serverSide, agentSide := NewTransport()
+
+	t := &Tunnel{
+		clock:     NewClock(time.Now()),
+		agentDone: make(chan struct{}),
+		listener:  listener,
+	}
+
+	go func() {
+		agent.Serve(agent.Options{KeepBinary: true}, agentSide)
+		agentSide.Close()
+		close(t.agentDone)
+	}()
+
+	t.endpoint = server.OpenTransportEndpoint(config, serverSide, 0, t.clock)
+	go t.serve()
+
+	return t, nil
+}
+
+func (t *Tunnel) serve() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		if err := t.endpoint.Serve(conn, Operator); err != nil {
+			conn.Close()
+		}
+	}
+}
+
+// Addr returns the address of the SOCKS proxy of the tunnel
+func (t *Tunnel) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Dial opens a client of the tunnel, speaking SOCKS to the agent
+func (t *Tunnel) Dial() (net.Conn, error) {
+	return net.Dial("tcp", t.listener.Addr().String())
+}
+
+// Clock returns the clock timing the keepalives of the tunnel
+func (t *Tunnel) Clock() *Clock {
+	return t.clock
+}
+
+// Alive tells if the tunnel can still serve clients
+func (t *Tunnel) Alive() bool {
+	return t.endpoint.Alive()
+}
+
+// Err returns why the tunnel closed, or nil while it is alive
+func (t *Tunnel) Err() error {
+	return t.endpoint.Err()
+}
+
+// Close closes the tunnel and waits for its agent to stop
+func (t *Tunnel) Close() {
+	t.listener.Close()
+	t.endpoint.Close()
+	t.clock.stop()
+	<-t.agentDone
+}
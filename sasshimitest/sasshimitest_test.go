@@ -0,0 +1,187 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sasshimitest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rsrdesarrollo/SaSSHimi/agent"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/spf13/viper"
+)
+
+// echoServer accepts connections on a loopback port and sends back what
+// they send
+func echoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// socksConnect opens a client of tunnel connected to address with SOCKS5
+func socksConnect(t *testing.T, tunnel *Tunnel, address *net.TCPAddr) net.Conn {
+	conn, err := tunnel.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	request := []byte{5, 1, 0, 5, 1, 0, 1}
+	request = append(request, address.IP.To4()...)
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(address.Port))
+	request = append(request, port...)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0 || reply[3] != 0 {
+		t.Fatalf("SOCKS connect failed: %v", reply)
+	}
+
+	return conn
+}
+
+func TestTunnelForwardsClients(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	tunnel, err := NewTunnel(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	for i := 0; i < 3; i++ {
+		conn := socksConnect(t, tunnel, echo.Addr().(*net.TCPAddr))
+
+		message := []byte("hello through the tunnel")
+		if _, err := conn.Write(message); err != nil {
+			t.Fatal(err)
+		}
+
+		answer := make([]byte, len(message))
+		if _, err := io.ReadFull(conn, answer); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(answer, message) {
+			t.Errorf("echo server answered %q", answer)
+		}
+		conn.Close()
+	}
+
+	if !tunnel.Alive() || tunnel.Err() != nil {
+		t.Errorf("tunnel closed: %v", tunnel.Err())
+	}
+}
+
+func TestClockTimesKeepAlives(t *testing.T) {
+	config := viper.New()
+	config.Set("KeepAliveInterval", time.Minute)
+
+	tunnel, err := NewTunnel(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	clock := tunnel.Clock()
+	start := clock.Now()
+
+	for i := 1; i <= 3; i++ {
+		// The keepalive loop waits on the clock, not on the real time
+		clock.WaitSleepers(1)
+		if !clock.Now().Equal(start.Add(time.Duration(i-1) * time.Minute)) {
+			t.Fatalf("clock moved by itself to %s", clock.Now())
+		}
+
+		clock.Advance(time.Minute)
+	}
+
+	clock.WaitSleepers(1)
+	if !tunnel.Alive() {
+		t.Errorf("tunnel closed: %v", tunnel.Err())
+	}
+}
+
+func TestClockWakesSleepersInOrder(t *testing.T) {
+	clock := NewClock(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	woken := make(chan time.Duration, 2)
+	for _, d := range []time.Duration{2 * time.Second, time.Second} {
+		d := d
+		go func() {
+			clock.Sleep(d)
+			woken <- d
+		}()
+	}
+	clock.WaitSleepers(2)
+
+	clock.Advance(time.Second)
+	if d := <-woken; d != time.Second {
+		t.Errorf("woke up the %s sleeper first", d)
+	}
+
+	select {
+	case d := <-woken:
+		t.Fatalf("woke up the %s sleeper before its time", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	if d := <-woken; d != 2*time.Second {
+		t.Errorf("woke up the %s sleeper", d)
+	}
+}
+
+func TestServeRefusesProcessOptions(t *testing.T) {
+	for _, options := range []agent.Options{
+		{AgentOptions: common.AgentOptions{Sandbox: true}},
+		{AgentOptions: common.AgentOptions{Shared: true}},
+		{AgentOptions: common.AgentOptions{TransparentMode: true}},
+	} {
+		serverSide, agentSide := NewTransport()
+		if err := agent.Serve(options, agentSide); err == nil {
+			t.Errorf("Serve accepted %+v", options.AgentOptions)
+		}
+		serverSide.Close()
+		agentSide.Close()
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// DefaultDevicePath is where the agent is pushed on Android devices, it is
+// writable and executable by the adb shell user
+const DefaultDevicePath = "/data/local/tmp"
+
+type androidABI struct {
+	goarch string
+	// machine is the uname -m equivalent, for agentVariants
+	machine string
+}
+
+// androidABIs maps the ro.product.cpu.abi property of devices
+var androidABIs = map[string]androidABI{
+	"arm64-v8a":   {"arm64", "aarch64"},
+	"armeabi-v7a": {"arm", "armv7l"},
+	"armeabi":     {"arm", "armv5tel"},
+	"x86_64":      {"amd64", "x86_64"},
+	"x86":         {"386", "i686"},
+}
+
+// adbOutput runs adb with args and returns its trimmed output
+func adbOutput(adb []string, args ...string) (string, error) {
+	output, err := exec.Command(adb[0], append(adb[1:], args...)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// PrepareAdb pushes the agent built for the Android device serial, or the
+// only connected device if serial is empty, into DevicePath. It returns
+// the command running the agent through adb, with its standard input and
+// output as channel, for RunTransparent.
+func PrepareAdb(viper *viper.Viper, serial string) ([]string, error) {
+	adb := []string{"adb"}
+	if serial != "" {
+		adb = append(adb, "-s", serial)
+	}
+
+	devicePath := viper.GetString("DevicePath")
+	if devicePath == "" {
+		devicePath = DefaultDevicePath
+	}
+	deviceAgent := path.Join(devicePath, ".daemon")
+
+	if utils.RelayOnly {
+		// Relay-only builds never push themselves, the agent must already be there
+		if _, err := adbOutput(adb, "shell", "test -x "+utils.EscapeBashArgument(deviceAgent)); err != nil {
+			return nil, errors.New("No executable agent in " + deviceAgent + " and agent upload is disabled in relay-only builds")
+		}
+		return adbAgentCommand(adb, devicePath), nil
+	}
+
+	abi, err := adbOutput(adb, "shell", "getprop", "ro.product.cpu.abi")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query the device with adb: %w", err)
+	}
+
+	arch, ok := androidABIs[abi]
+	if !ok {
+		return nil, errors.New("Unsupported device ABI " + abi)
+	}
+
+	agentFile := viper.GetString("RemoteExecutable")
+	if agentFile == "" {
+		agentFile = findCachedAgent(agentCacheDir(viper), "linux", arch.goarch, arch.machine)
+	}
+	if agentFile == "" {
+		return nil, errors.New("No agent built for linux/" + arch.goarch + ", build one with build-agent --os linux --arch " + arch.goarch)
+	}
+
+	utils.Logger.Info("Pushing", agentFile, "to", deviceAgent)
+	if _, err := adbOutput(adb, "push", agentFile, deviceAgent); err != nil {
+		return nil, fmt.Errorf("Failed to push the agent: %w", err)
+	}
+	if _, err := adbOutput(adb, "shell", "chmod 700 "+utils.EscapeBashArgument(deviceAgent)); err != nil {
+		return nil, fmt.Errorf("Failed to make the agent executable: %w", err)
+	}
+
+	audit.Record("agent_upload", map[string]string{"device": serial, "abi": abi, "path": devicePath})
+
+	return adbAgentCommand(adb, devicePath), nil
+}
+
+// adbAgentCommand returns the command running the agent pushed in devicePath
+func adbAgentCommand(adb []string, devicePath string) []string {
+	// -T disables the pseudo terminal, which would alter the channel data
+	return append(adb, "shell", "-T", "cd "+utils.EscapeBashArgument(devicePath)+" && exec ./.daemon agent")
+}
@@ -0,0 +1,255 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// AgentBuild describes a minimized agent binary built by BuildAgent
+type AgentBuild struct {
+	GOOS     string
+	GOARCH   string
+	Source   string
+	Tags     string
+	CacheDir string
+	Upx      bool
+
+	// Engagement is embedded in the agent and printed by agent --fingerprint
+	Engagement string
+
+	// Full builds the whole client instead of the agent alone
+	Full bool
+
+	// GOARM and GOMIPS select the ARM version and the MIPS floating point
+	// instructions, like 5 and softfloat for routers without FPU
+	GOARM  string
+	GOMIPS string
+}
+
+// RouterBuilds are the agents for common router and IoT devices built by
+// build-agent --routers: the MIPS ones without FPU instructions and ARMv5
+// for the oldest ARM devices
+var RouterBuilds = []AgentBuild{
+	{GOOS: "linux", GOARCH: "mips", GOMIPS: "softfloat"},
+	{GOOS: "linux", GOARCH: "mipsle", GOMIPS: "softfloat"},
+	{GOOS: "linux", GOARCH: "arm", GOARM: "5"},
+	{GOOS: "linux", GOARCH: "arm", GOARM: "7"},
+	{GOOS: "linux", GOARCH: "arm64"},
+}
+
+// variant names the GOARM or GOMIPS setting of the build in its cache file
+func (build AgentBuild) variant() string {
+	if build.GOARM != "" {
+		return "v" + build.GOARM
+	}
+	return build.GOMIPS
+}
+
+// Package of the agent alone, relative to the sources
+const slimAgentPackage = "./cmd/sasshimi-agent"
+
+// Variable holding the engagement identifier in the agent
+const engagementSymbol = "github.com/rsrdesarrollo/SaSSHimi/version.Engagement"
+
+// DefaultAgentCache returns the directory where built agents are stored,
+// under the engagement directory if one is set
+func DefaultAgentCache() string {
+	if dir := utils.EngagementDir(); dir != "" {
+		return filepath.Join(dir, "agents")
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "SaSSHimi", "agents")
+}
+
+// agentCacheFile returns the path of the cached agent for goos/goarch and
+// the variant of the build if any, the agent alone when slim is set, or the
+// whole client otherwise.
+func agentCacheFile(cacheDir string, goos string, goarch string, variant string, slim bool) string {
+	name := "agent-" + goos + "-" + goarch
+	if slim {
+		name = "agent-slim-" + goos + "-" + goarch
+	}
+	if variant != "" {
+		name += "-" + variant
+	}
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return filepath.Join(cacheDir, name)
+}
+
+// BuildAgent builds a trimmed and stripped agent from the sources in
+// build.Source into the agent cache, optionally packed with upx, and
+// returns its path. Unless build.Full is set, only the agent is built,
+// without the client code. The go and upx output is copied to output.
+func BuildAgent(build AgentBuild, output io.Writer) (string, error) {
+	if _, err := os.Stat(filepath.Join(build.Source, "go.mod")); err != nil {
+		return "", errors.New("No go.mod in " + build.Source + ", run from the SaSSHimi sources or use --source")
+	}
+
+	err := os.MkdirAll(build.CacheDir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create agent cache: %w", err)
+	}
+
+	agentFile, err := filepath.Abs(agentCacheFile(build.CacheDir, build.GOOS, build.GOARCH, build.variant(), !build.Full))
+	if err != nil {
+		return "", err
+	}
+
+	// Builds are reproducible: same sources, toolchain, target and
+	// engagement give the same binary
+	ldflags := "-s -w -buildid="
+	if build.Engagement != "" {
+		if strings.ContainsAny(build.Engagement, "'\"") {
+			return "", errors.New("The engagement identifier cannot contain quotes")
+		}
+		ldflags += " -X '" + engagementSymbol + "=" + build.Engagement + "'"
+	}
+
+	args := []string{"build", "-trimpath", "-buildvcs=false", "-ldflags", ldflags, "-o", agentFile}
+	if build.Tags != "" {
+		args = append(args, "-tags", build.Tags)
+	}
+	if build.Full {
+		args = append(args, ".")
+	} else {
+		args = append(args, slimAgentPackage)
+	}
+
+	cmd := exec.Command("go", args...)
+	cmd.Dir = build.Source
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS="+build.GOOS, "GOARCH="+build.GOARCH)
+	if build.GOARM != "" {
+		cmd.Env = append(cmd.Env, "GOARM="+build.GOARM)
+	}
+	if build.GOMIPS != "" {
+		if strings.HasPrefix(build.GOARCH, "mips64") {
+			cmd.Env = append(cmd.Env, "GOMIPS64="+build.GOMIPS)
+		} else {
+			cmd.Env = append(cmd.Env, "GOMIPS="+build.GOMIPS)
+		}
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	utils.Logger.Info("Running go", strings.Join(args, " "))
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("Agent build failed: %w", err)
+	}
+
+	if build.Upx {
+		cmd = exec.Command("upx", "-q", "--best", agentFile)
+		cmd.Stdout = output
+		cmd.Stderr = output
+
+		err = cmd.Run()
+		if err != nil {
+			return "", fmt.Errorf("upx failed: %w", err)
+		}
+	}
+
+	return agentFile, nil
+}
+
+// cachedAgent returns the agent built for the remote platform, or an empty
+// string if the platform is unknown or no agent was built for it.
+func (t *tunnel) cachedAgent() string {
+	if t.remote == nil || t.remote.os == "" || t.remote.arch == "" {
+		return ""
+	}
+
+	goos := unameOS(t.remote.os)
+
+	goarch, ok := unameArch[t.remote.arch]
+	if !ok {
+		return ""
+	}
+	if t.remote.littleEndian && strings.HasPrefix(goarch, "mips") {
+		// uname -m does not tell the byte order of MIPS CPUs
+		goarch += "le"
+	}
+
+	return findCachedAgent(agentCacheDir(t.viper), goos, goarch, t.remote.arch)
+}
+
+// agentCacheDir returns the agent cache directory configured in viper
+func agentCacheDir(viper *viper.Viper) string {
+	if cacheDir := viper.GetString("AgentCache"); cacheDir != "" {
+		return cacheDir
+	}
+	return DefaultAgentCache()
+}
+
+// findCachedAgent returns the best agent of cacheDir for a goos/goarch CPU
+// named machine by uname -m, or an empty string if none was built
+func findCachedAgent(cacheDir string, goos string, goarch string, machine string) string {
+	// Prefer the agent alone, it is smaller
+	for _, variant := range agentVariants(goarch, machine) {
+		for _, slim := range []bool{true, false} {
+			agentFile := agentCacheFile(cacheDir, goos, goarch, variant, slim)
+			if _, err := os.Stat(agentFile); err == nil {
+				utils.Logger.Info(fmt.Sprintf("Using the agent built for %s/%s: %s", goos, goarch, agentFile))
+				return agentFile
+			}
+		}
+	}
+
+	return ""
+}
+
+// agentVariants returns the build variants able to run on a goarch CPU
+// named machine by uname -m, best first
+func agentVariants(goarch string, machine string) []string {
+	switch goarch {
+	case "arm":
+		// An ARM CPU runs the agents built for older versions, the default
+		// build is for ARMv7
+		version := 5
+		if strings.HasPrefix(machine, "armv") && len(machine) > 4 && machine[4] >= '5' && machine[4] <= '7' {
+			version = int(machine[4] - '0')
+		}
+
+		var variants []string
+		for ; version >= 5; version-- {
+			variants = append(variants, "v"+strconv.Itoa(version))
+		}
+		if strings.HasPrefix(machine, "armv7") {
+			variants = append(variants, "")
+		}
+		return variants
+
+	case "mips", "mipsle", "mips64", "mips64le":
+		// Routers seldom have an FPU
+		return []string{"softfloat", ""}
+	}
+
+	return []string{""}
+}
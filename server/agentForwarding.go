@@ -0,0 +1,63 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"os"
+)
+
+// agentForwarding tells whether the local ssh-agent is forwarded to the
+// agent session. NoAgentForwarding wins over ForwardAgent, wherever each
+// one is set.
+func (t *tunnel) agentForwarding() bool {
+	return t.viper.GetBool("ForwardAgent") && !t.viper.GetBool("NoAgentForwarding")
+}
+
+// forwardAgent forwards the local ssh-agent to session, so ssh commands run
+// on the remote host can use the operator keys. The remote host may refuse
+// it, the tunnel is then opened without forwarding.
+func (t *tunnel) forwardAgent(session *ssh.Session) error {
+	if !t.agentForwarding() {
+		return nil
+	}
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return errors.New("agent forwarding: SSH_AUTH_SOCK is not set, no local ssh-agent to forward")
+	}
+
+	err := agent.ForwardToRemote(t.sshClient, socket)
+	if err != nil {
+		return fmt.Errorf("agent forwarding: %w", err)
+	}
+
+	err = agent.RequestAgentForwarding(session)
+	if err != nil {
+		utils.Logger.Warning("Agent forwarding refused by the remote host:", err.Error())
+		return nil
+	}
+
+	t.agentForwarded = true
+	utils.Logger.Notice("Local ssh-agent forwarded to", t.getName())
+	audit.Record("agent_forwarding", map[string]string{"tunnel": t.getName(), "remote": t.getRemoteHost()})
+
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// browserCandidates are the browsers looked up, in order, when none is given
+var browserCandidates = []string{
+	"chromium", "chromium-browser", "google-chrome", "google-chrome-stable", "firefox",
+	"/Applications/Chromium.app/Contents/MacOS/Chromium",
+	"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+	"/Applications/Firefox.app/Contents/MacOS/firefox",
+	`C:\Program Files\Google\Chrome\Application\chrome.exe`,
+	`C:\Program Files (x86)\Google\Chrome\Application\chrome.exe`,
+	`C:\Program Files\Mozilla Firefox\firefox.exe`,
+}
+
+// findBrowser returns the path of browser, or of the first installed
+// candidate if browser is empty
+func findBrowser(browser string) (string, error) {
+	if browser != "" {
+		return exec.LookPath(browser)
+	}
+
+	for _, candidate := range browserCandidates {
+		if path, err := exec.LookPath(candidate); err == nil {
+			return path, nil
+		}
+	}
+
+	return "", errors.New("no Chromium, Chrome or Firefox found, use --browser")
+}
+
+// isFirefox tells whether the browser at path is Firefox, anything else is
+// expected to take Chromium flags
+func isFirefox(path string) bool {
+	return strings.Contains(strings.ToLower(filepath.Base(path)), "firefox")
+}
+
+// firefoxPrefs are written to user.js to send everything, DNS included,
+// through the SOCKS proxy and keep the profile quiet
+const firefoxPrefs = `user_pref("network.proxy.type", 1);
+user_pref("network.proxy.socks", "%s");
+user_pref("network.proxy.socks_port", %s);
+user_pref("network.proxy.socks_version", 5);
+user_pref("network.proxy.socks_remote_dns", true);
+user_pref("network.proxy.no_proxies_on", "");
+user_pref("network.proxy.allow_hijacking_localhost", true);
+user_pref("network.trr.mode", 5);
+user_pref("network.dns.disablePrefetch", true);
+user_pref("network.prefetch-next", false);
+user_pref("browser.shell.checkDefaultBrowser", false);
+user_pref("browser.aboutwelcome.enabled", false);
+user_pref("datareporting.policy.dataSubmissionEnabled", false);
+user_pref("app.update.auto", false);
+`
+
+// browserArgs prepares the profile directory for the browser at path and
+// returns its arguments to use the SOCKS proxy at host:port
+func browserArgs(path, profile, host, port, url string) ([]string, error) {
+	if isFirefox(path) {
+		prefs := fmt.Sprintf(firefoxPrefs, host, port)
+		if err := ioutil.WriteFile(filepath.Join(profile, "user.js"), []byte(prefs), 0600); err != nil {
+			return nil, err
+		}
+		return []string{"-profile", profile, "-no-remote", "-new-instance", url}, nil
+	}
+
+	return []string{
+		"--user-data-dir=" + profile,
+		"--proxy-server=socks5://" + net.JoinHostPort(host, port),
+		// Loopback is not bypassed, it reaches the remote host
+		"--proxy-bypass-list=<-loopback>",
+		// Nothing is resolved locally, the proxy resolves names
+		"--host-resolver-rules=MAP * ~NOTFOUND , EXCLUDE " + host,
+		"--no-first-run",
+		"--no-default-browser-check",
+		"--disable-background-networking",
+		url,
+	}, nil
+}
+
+// Browse runs browser, or the first Chromium or Firefox found, with a
+// throwaway profile using the SOCKS proxy at host:port and removes the
+// profile when the browser exits.
+func Browse(browser, host, port, url string) error {
+	path, err := findBrowser(browser)
+	if err != nil {
+		return err
+	}
+
+	profile, err := ioutil.TempDir(utils.EngagementDir(), "sasshimi-browse-")
+	if err != nil {
+		return fmt.Errorf("Failed to create browser profile: %w", err)
+	}
+	defer os.RemoveAll(profile)
+
+	args, err := browserArgs(path, profile, host, port, url)
+	if err != nil {
+		return fmt.Errorf("Failed to configure browser profile: %w", err)
+	}
+
+	utils.Logger.Notice("Starting", path, "through the proxy at", net.JoinHostPort(host, port))
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
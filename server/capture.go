@@ -0,0 +1,119 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const remoteTcpdumpLookup = "PATH=$PATH:/usr/sbin:/sbin; command -v tcpdump"
+
+func (t *tunnel) captureCommand(iface string, filter string) (string, error) {
+	if t.remoteCommandSucceeds(remoteTcpdumpLookup + " > /dev/null 2>&1") {
+		command := fmt.Sprintf("PATH=$PATH:/usr/sbin:/sbin; exec %stcpdump -i %s -U -s 0 -w -", t.elevatePrefix, utils.EscapeBashArgument(iface))
+		if filter != "" {
+			command += " " + utils.EscapeBashArgument(filter)
+		}
+		return command, nil
+	}
+
+	if utils.RelayOnly {
+		return "", errors.New("tcpdump not found on remote host and agent upload is disabled in relay-only builds")
+	}
+
+	utils.Logger.Warning("tcpdump not found on remote host, falling back to raw socket capture")
+	if filter != "" {
+		utils.Logger.Warning("Capture filter is not supported by raw socket capture and will be ignored")
+	}
+
+	remoteAgentPath, err := t.deployAgent(t.getRemoteAgentPath())
+	if err != nil {
+		return "", err
+	}
+
+	return t.agentRunCommand(remoteAgentPath, "capture-raw", "--iface "+utils.EscapeBashArgument(iface)), nil
+}
+
+// RunCapture captures packets on the remote interface iface and streams them
+// in pcap format to output. tcpdump is used if the remote host has it,
+// otherwise the agent is uploaded and captures using raw sockets.
+func RunCapture(viper *viper.Viper, iface string, filter string, output io.Writer) error {
+	t := newTunnel(viper)
+
+	err := t.dialSSH()
+	if err != nil {
+		return err
+	}
+	defer t.sshClient.Close()
+
+	err = t.prepareElevation()
+	if err != nil {
+		return err
+	}
+
+	command, err := t.captureCommand(iface, filter)
+	if err != nil {
+		return err
+	}
+
+	session, err := t.sshClient.NewSession()
+	if err != nil {
+		return fmt.Errorf("Failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	session.Stdout = output
+	session.Stderr = os.Stderr
+	if t.elevatePassword != "" {
+		session.Stdin = strings.NewReader(t.elevatePassword + "\n")
+		t.elevatePassword = ""
+	}
+
+	captureDetails := map[string]string{"tunnel": t.getName(), "remote": t.getRemoteHost(), "iface": iface, "filter": filter}
+
+	// The capture is stopped by a signal or ends on its own, possibly both
+	// at once: its end is recorded once
+	var stopOnce sync.Once
+	recordStop := func() {
+		stopOnce.Do(func() { audit.Record("capture_stop", captureDetails) })
+	}
+
+	utils.ExitCallback(func() {
+		utils.Logger.Notice("Stopping remote capture")
+		recordStop()
+		session.Signal(ssh.SIGINT)
+		session.Close()
+	})
+
+	utils.Logger.Notice("Remote capture started on interface", iface)
+	audit.Record("capture_start", captureDetails)
+
+	err = session.Run(t.shellCommand(command))
+	recordStop()
+	if err != nil {
+		return fmt.Errorf("Remote capture error: %w", err)
+	}
+
+	return nil
+}
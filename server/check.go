@@ -0,0 +1,55 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+// CheckConnection connects to the host configured in viper, and checks the
+// remote agent path can be written, without deploying the agent. It returns
+// a description of the remote environment.
+func CheckConnection(viper *viper.Viper) (string, error) {
+	t := newTunnel(viper)
+
+	err := t.dialSSH()
+	if err != nil {
+		return "", err
+	}
+	defer t.sshClient.Close()
+
+	if t.remote.restricted {
+		return "restricted shell " + t.remote.shell + ", the agent will be uploaded with SFTP", nil
+	}
+
+	remoteAgentPath := t.getRemoteAgentPath()
+	if err := checkRemotePath(remoteAgentPath); err != nil {
+		return "", err
+	}
+	if !t.remoteCommandSucceeds("test -w " + quoteRemotePath(remoteAgentPath)) {
+		return "", errors.New("Remote agent path " + remoteAgentPath + " is not writable")
+	}
+
+	description := []string{t.remote.shell + " shell"}
+	if t.remote.os != "" {
+		description = append(description, t.remote.os+"/"+t.remote.arch)
+	}
+	if t.remote.busyBox {
+		description = append(description, "BusyBox")
+	}
+	return strings.Join(description, ", "), nil
+}
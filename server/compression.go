@@ -0,0 +1,138 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
+	"io/ioutil"
+	"os/exec"
+)
+
+const (
+	compressionZstd = "zstd"
+	compressionGzip = "gzip"
+)
+
+// decompressCommands are the remote commands decompressing stdin to stdout
+var decompressCommands = map[string]string{
+	compressionZstd: "zstd -dcq",
+	compressionGzip: "gzip -dc",
+}
+
+// uploadCompression returns the compression used to upload the agent, or an
+// empty string to upload it as is. zstd needs the zstd command on both
+// hosts, gzip only on the remote host. Tools are only used when the remote
+// probe found them.
+func (t *tunnel) uploadCompression() string {
+	requested := t.viper.GetString("UploadCompression")
+	if requested == "none" {
+		return ""
+	}
+
+	remoteHas := func(tool string) bool {
+		return t.remote != nil && t.remote.tools[tool]
+	}
+
+	_, err := exec.LookPath("zstd")
+	zstdAvailable := err == nil && remoteHas("zstd")
+
+	switch requested {
+	case compressionZstd:
+		if zstdAvailable {
+			return compressionZstd
+		}
+		utils.Logger.Warning("zstd is not available on both hosts, trying gzip")
+	case compressionGzip, "", "auto":
+		if requested != compressionGzip && zstdAvailable {
+			return compressionZstd
+		}
+	default:
+		utils.Logger.Warning("Unknown upload compression", requested, "trying gzip")
+	}
+
+	if remoteHas("gzip") {
+		return compressionGzip
+	}
+
+	if requested != "" && requested != "auto" {
+		utils.Logger.Warning("gzip is not available on the remote host, uploading the agent uncompressed")
+	}
+	return ""
+}
+
+// compressReader returns reader compressed with compression. The result must
+// be closed to release the compressor.
+func compressReader(reader io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case compressionZstd:
+		cmd := exec.Command("zstd", "-q", "-c", "-19", "-T0")
+		cmd.Stdin = reader
+
+		output, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to run zstd: %w", err)
+		}
+
+		err = cmd.Start()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to run zstd: %w", err)
+		}
+
+		return &commandReader{output, cmd}, nil
+
+	case compressionGzip:
+		pipeReader, pipeWriter := io.Pipe()
+
+		go func() {
+			compressor, _ := gzip.NewWriterLevel(pipeWriter, gzip.BestCompression)
+			_, err := io.Copy(compressor, reader)
+			if err == nil {
+				err = compressor.Close()
+			}
+			pipeWriter.CloseWithError(err)
+		}()
+
+		return pipeReader, nil
+
+	default:
+		return ioutil.NopCloser(reader), nil
+	}
+}
+
+// countingReader counts the bytes read from Reader
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (r *countingReader) Read(data []byte) (int, error) {
+	n, err := r.Reader.Read(data)
+	r.count += int64(n)
+	return n, err
+}
+
+// commandReader reads the output of a command and waits for it on close
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *commandReader) Close() error {
+	r.ReadCloser.Close()
+	return r.cmd.Wait()
+}
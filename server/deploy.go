@@ -0,0 +1,232 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/state"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// useSftp tells if the agent must be deployed through the SFTP subsystem,
+// either because it was requested or because the remote shell is restricted.
+func (t *tunnel) useSftp() bool {
+	if t.viper.GetString("UploadMethod") == "sftp" {
+		return true
+	}
+	return t.remote != nil && t.remote.restricted
+}
+
+func (t *tunnel) uploadForwarderSftp(remoteAgentPath string) error {
+	client, err := newSftpClient(t.sshClient)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	selfFile, err := os.Open(t.getRemoteExecutable())
+	if err != nil {
+		return fmt.Errorf("Failed to open current binary %w", err)
+	}
+	defer selfFile.Close()
+
+	absolutePath, err := client.RealPath(sftpRemotePath(remoteAgentPath))
+	if err != nil {
+		return fmt.Errorf("Failed to resolve remote agent path: %w", err)
+	}
+
+	agentFile := path.Join(absolutePath, ".daemon")
+
+	err = client.WriteFile(agentFile, selfFile, 0700)
+	if err == nil {
+		// The permissions given on open are ignored when the file exists
+		err = client.Chmod(agentFile, 0700)
+	}
+	if err != nil {
+		return err
+	}
+
+	t.agentPath = agentFile
+	return nil
+}
+
+// deployAgent uploads the agent to remoteAgentPath, or to a fallback agent
+// path when it has no room for it, makes sure it can be run there and
+// returns the directory it was uploaded to.
+func (t *tunnel) deployAgent(remoteAgentPath string) (string, error) {
+	if err := checkRemotePath(remoteAgentPath); err != nil {
+		return "", err
+	}
+
+	if utils.RelayOnly {
+		if t.useSftp() {
+			return remoteAgentPath, nil
+		}
+		return remoteAgentPath, t.checkAgentExecutable(remoteAgentPath)
+	}
+
+	remoteAgentPath, err := t.agentDirectory(remoteAgentPath)
+	if err != nil {
+		return "", err
+	}
+
+	if t.useSftp() {
+		utils.Logger.Info("Deploying agent through SFTP")
+		err = t.uploadForwarderSftp(remoteAgentPath)
+	} else {
+		err = t.uploadForwarder(remoteAgentPath)
+	}
+
+	if err != nil {
+		return "", &UploadError{Path: remoteAgentPath, Cause: err}
+	}
+
+	audit.Record("agent_upload", map[string]string{"tunnel": t.getName(), "remote": t.getRemoteHost(), "path": remoteAgentPath})
+	t.recordDeployment(remoteAgentPath)
+
+	if t.useSftp() {
+		// There is no usable shell to run checks
+		if t.remote != nil && t.remote.restricted {
+			return remoteAgentPath, t.checkRestrictedPath()
+		}
+		return remoteAgentPath, nil
+	}
+
+	t.resolveAgentPath(remoteAgentPath)
+	return remoteAgentPath, t.checkAgentExecutable(remoteAgentPath)
+}
+
+// recordDeployment adds the agent uploaded to remoteAgentPath to the state
+// file, so teardown and status know about it
+func (t *tunnel) recordDeployment(remoteAgentPath string) {
+	hash, err := utils.FileSHA256(t.getRemoteExecutable())
+	if err != nil {
+		utils.Logger.Warning("Failed to hash the agent binary:", err.Error())
+	}
+
+	err = state.Add(state.Agent{
+		Host:     t.getRemoteHost(),
+		User:     t.getUsername(),
+		Tunnel:   t.getName(),
+		Path:     remoteAgentPath,
+		SHA256:   hash,
+		Time:     time.Now().UTC(),
+		Operator: localOperator(),
+	})
+	if err != nil {
+		utils.Logger.Error("Failed to record the agent in the state file:", err.Error())
+	}
+}
+
+// quotedAgentPath returns the quoted path of the agent executable in
+// remoteAgentPath, absolute once it is resolved. Relative paths start with
+// ./ so the shell does not look for the agent in PATH.
+func (t *tunnel) quotedAgentPath(remoteAgentPath string) string {
+	if t.agentPath != "" {
+		return utils.EscapeBashArgument(t.agentPath)
+	}
+
+	agentPath := path.Join(remoteAgentPath, ".daemon")
+	if !path.IsAbs(agentPath) && !strings.HasPrefix(agentPath, "~/") {
+		agentPath = "./" + agentPath
+	}
+	return quoteRemotePath(agentPath)
+}
+
+// resolveAgentPath sets the absolute path of the agent in remoteAgentPath,
+// which is left relative when the remote shell cannot resolve it
+func (t *tunnel) resolveAgentPath(remoteAgentPath string) {
+	output, err := t.remoteOutput("cd " + quoteRemotePath(remoteAgentPath) + " && pwd -P")
+	directory := strings.TrimSpace(output)
+	if err != nil || !path.IsAbs(directory) || checkRemotePath(directory) != nil {
+		utils.Logger.Debug("Failed to resolve the remote agent path, running the agent by its relative path")
+		return
+	}
+
+	t.agentPath = path.Join(directory, ".daemon")
+}
+
+// checkRestrictedPath makes sure the restricted remote shell can start the
+// agent uploaded through SFTP. It is run by its bare name, as restricted
+// shells refuse command names containing /, so its directory must be on
+// their PATH.
+func (t *tunnel) checkRestrictedPath() error {
+	if t.remote.path == nil {
+		utils.Logger.Warning("Failed to get the PATH of the restricted remote shell, the agent may not be found")
+		return nil
+	}
+
+	directory := path.Dir(t.agentPath)
+	if !t.remote.onPath(directory) {
+		return errors.New("The restricted remote shell only runs commands from its PATH (" + strings.Join(t.remote.path, ":") +
+			"), " + directory + " is not part of it. Set the remote agent path to a writable directory of the PATH.")
+	}
+	return nil
+}
+
+// agentRunCommand returns the command running the agent subcommand with the
+// given options. The agent is run with a single command without shell
+// operators, by its quoted path or by its bare name from the PATH of
+// restricted shells, and the other shells exec it so it replaces the login
+// shell instead of running as its child. Relay-only builds run the installed
+// binary from the agent path.
+//
+// The RunTemplate setting replaces the command, with the placeholders {dir}
+// for the agent path, {agent} for the agent executable, {args} for the
+// subcommand and its options and {cmd} for "{agent} {args}".
+func (t *tunnel) agentRunCommand(remoteAgentPath string, subcommand string, options string) string {
+	var agentCommand string
+	var command string
+
+	args := strings.TrimSpace(subcommand + " " + options)
+
+	switch {
+	case utils.RelayOnly && t.useSftp():
+		agentCommand = t.getRemoteAgentCommand()
+		command = t.execPrefix() + "{cmd}"
+	case utils.RelayOnly:
+		agentCommand = t.getRemoteAgentCommand()
+		command = "cd {dir} && " + t.execPrefix() + "{cmd}"
+	case t.remote != nil && t.remote.restricted:
+		agentCommand = ".daemon"
+		command = "{cmd}"
+	default:
+		agentCommand = t.quotedAgentPath(remoteAgentPath)
+		command = t.execPrefix() + "{cmd}"
+	}
+	agentCommand = t.elevatePrefix + t.envPrefix() + agentCommand
+
+	if template := t.viper.GetString("RunTemplate"); template != "" {
+		if !strings.Contains(template, "{cmd}") && !strings.Contains(template, "{agent}") {
+			utils.Logger.Warning("Run template does not contain {cmd} nor {agent}, the agent will not be started")
+		}
+		command = template
+	}
+
+	replacer := strings.NewReplacer(
+		"{dir}", quoteRemotePath(remoteAgentPath),
+		"{cmd}", agentCommand+" "+args,
+		"{agent}", agentCommand,
+		"{args}", args,
+	)
+
+	return strings.TrimSpace(replacer.Replace(command))
+}
@@ -0,0 +1,128 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// remoteSpaceScript prints the file system and the free space of a remote
+// directory, and the disk quotas of the user, in KB. quota is only found on
+// hosts enforcing quotas.
+const remoteSpaceScript = `cd %s || exit 1
+df -Pk . 2>/dev/null | awk 'NR==2 {print "device=" $1; print "available=" $4}'
+quota -v -w 2>/dev/null | awk '{print "quota=" $0}'`
+
+// parseSpace returns the KB that can be written according to the output of
+// remoteSpaceScript, the lowest of the free space and the quota left, and
+// whether it is the quota. ok is false when the free space is unknown.
+func parseSpace(output string) (free int64, quota bool, ok bool) {
+	diagnostics := parseDiagnostics(output)
+	free, err := strconv.ParseInt(diagnostics["available"], 10, 64)
+	if err != nil {
+		return 0, false, false
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "quota=") {
+			continue
+		}
+
+		// Filesystem, blocks used, soft limit, hard limit, grace...
+		fields := strings.Fields(strings.TrimPrefix(line, "quota="))
+		if len(fields) < 4 || fields[0] != diagnostics["device"] {
+			continue
+		}
+
+		used, err := strconv.ParseInt(strings.TrimSuffix(fields[1], "*"), 10, 64)
+		if err != nil {
+			continue
+		}
+		limit, _ := strconv.ParseInt(fields[3], 10, 64)
+		if limit == 0 {
+			limit, _ = strconv.ParseInt(fields[2], 10, 64)
+		}
+		if limit > 0 && limit-used < free {
+			free = limit - used
+			quota = true
+			if free < 0 {
+				free = 0
+			}
+		}
+	}
+
+	return free, quota, true
+}
+
+// checkSpace returns an NoSpaceError when the agent binary does not fit in
+// remoteAgentPath. The check is skipped when the free space cannot be found
+// out, like on restricted shells.
+func (t *tunnel) checkSpace(remoteAgentPath string) error {
+	if t.remote == nil || t.remote.restricted {
+		return nil
+	}
+
+	info, err := os.Stat(t.getRemoteExecutable())
+	if err != nil {
+		return nil
+	}
+	needed := (info.Size() + 1023) / 1024
+
+	output, _ := t.remoteOutput(fmt.Sprintf(remoteSpaceScript, quoteRemotePath(remoteAgentPath)))
+	free, quota, ok := parseSpace(output)
+	if !ok {
+		utils.Logger.Debug("Failed to find out the free space in", remoteAgentPath)
+		return nil
+	}
+
+	if free < needed {
+		return &NoSpaceError{Path: remoteAgentPath, Needed: needed, Free: free, Quota: quota}
+	}
+	return nil
+}
+
+// agentDirectory returns remoteAgentPath, or the first fallback agent path
+// with room for the agent binary when it has not
+func (t *tunnel) agentDirectory(remoteAgentPath string) (string, error) {
+	err := t.checkSpace(remoteAgentPath)
+	if err == nil {
+		return remoteAgentPath, nil
+	}
+
+	for _, fallback := range t.viper.GetStringSlice("FallbackAgentPaths") {
+		if checkRemotePath(fallback) != nil || !t.remoteCommandSucceeds("test -w "+quoteRemotePath(fallback)) {
+			continue
+		}
+		if t.checkSpace(fallback) == nil {
+			utils.Logger.Warningf("%s, using %s instead", err.Error(), fallback)
+			return fallback, nil
+		}
+	}
+
+	return "", err
+}
+
+// dryRunSpaceCheck prints the free space check done before the upload
+func (t *tunnel) dryRunSpaceCheck(output io.Writer, remoteAgentPath string) {
+	fmt.Fprintf(output, "  free space and quota check of %s, for %s\n", remoteAgentPath, t.dryRunExecutable())
+	if fallbacks := t.viper.GetStringSlice("FallbackAgentPaths"); len(fallbacks) > 0 {
+		fmt.Fprintf(output, "    or upload to the first of %s with room for it\n", strings.Join(fallbacks, ", "))
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/agent"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// DryRun prints what Run would do on the remote host without connecting to
+// it. The remote login shell is assumed to be a POSIX shell with the usual
+// tools, the commands actually sent are adapted to it after detection.
+func DryRun(viper *viper.Viper, verboseLevel int, output io.Writer) {
+	t := newTunnel(viper)
+	remoteAgentPath := t.getRemoteAgentPath()
+
+	fmt.Fprintf(output, "Tunnel:            %s\n", t.getName())
+	fmt.Fprintf(output, "Remote host:       %s\n", t.getRemoteHost())
+	fmt.Fprintf(output, "User:              %s\n", t.getUsername())
+	fmt.Fprintf(output, "Authentication:    %s\n", strings.Join(t.dryRunAuthMethods(), ", "))
+	fmt.Fprintf(output, "Host key:          not verified\n")
+	if viper.GetBool("RestrictedCrypto") {
+		fmt.Fprintf(output, "Ciphers:           %s\n", strings.Join(restrictedCiphers, ", "))
+		fmt.Fprintf(output, "Key exchanges:     %s\n", strings.Join(restrictedKeyExchanges, ", "))
+		fmt.Fprintf(output, "MACs:              %s\n", strings.Join(restrictedMACs, ", "))
+	}
+	fmt.Fprintf(output, "Remote agent path: %s\n", remoteAgentPath)
+	if t.agentForwarding() {
+		fmt.Fprintf(output, "Agent forwarding:  local ssh-agent forwarded to the agent session\n")
+	}
+
+	fmt.Fprintf(output, "\nRemote environment detection:\n")
+	fmt.Fprintf(output, "  echo $SHELL\n")
+	fmt.Fprintf(output, "  %s\n", strings.Replace(remoteProbeScript, "\n", "\n  ", -1))
+
+	switch viper.GetString("Elevate") {
+	case elevateSudo:
+		fmt.Fprintf(output, "\nElevation:\n  sudo -n true\n  %strue\n    with stdin: the sudo password, when sudo -n fails\n", sudoPasswordPrefix)
+		t.elevatePrefix = sudoPasswordPrefix
+	case elevateDoas:
+		fmt.Fprintf(output, "\nElevation:\n  doas -n true\n")
+		t.elevatePrefix = "doas -n "
+	}
+
+	interpreter := viper.GetString("AgentInterpreter")
+	setup := t.getAgentSetup(verboseLevel)
+	var runCommand string
+
+	fmt.Fprintf(output, "\nAgent deployment:\n")
+	switch {
+	case viper.GetBool("AttachAgent"):
+		fmt.Fprintf(output, "  none, attaching to the shared agent\n")
+		runCommand = t.agentRunCommand(remoteAgentPath, "attach", "")
+	case interpreter != "" && utils.RelayOnly:
+		fmt.Fprintf(output, "  refused, %s\n", errInterpreterRelayOnly.Error())
+		return
+	case interpreter != "":
+		fmt.Fprintf(output, "  none, agent script (%d bytes) sent to the interpreter stdin\n", len(pythonAgentScript))
+		runCommand = t.execPrefix() + t.elevatePrefix + t.envPrefix() + interpreterCommand(interpreter)
+	case utils.RelayOnly:
+		fmt.Fprintf(output, "  none, relay-only build\n")
+		fmt.Fprintf(output, "  %s\n", t.agentCheckCommand(remoteAgentPath))
+		runCommand = t.agentRunCommand(remoteAgentPath, "agent", preambleArgs)
+	case t.useSftp():
+		fmt.Fprintf(output, "  SFTP upload of %s to %s (mode 0700, path made absolute by the SFTP server)\n", t.dryRunExecutable(), path.Join(remoteAgentPath, ".daemon"))
+		t.dryRunSpaceCheck(output, remoteAgentPath)
+		t.agentPath = path.Join(remoteAgentPath, ".daemon")
+		runCommand = t.agentRunCommand(remoteAgentPath, "agent", preambleArgs)
+	default:
+		compression := viper.GetString("UploadCompression")
+		stdin := t.dryRunExecutable()
+
+		switch compression {
+		case "none":
+			compression = ""
+		case compressionZstd, compressionGzip:
+			stdin += " compressed with " + compression + " when available"
+		default:
+			// Assume the usual tools, gzip is found on most hosts
+			compression = compressionGzip
+			stdin += " compressed with zstd or gzip when available"
+		}
+
+		t.dryRunSpaceCheck(output, remoteAgentPath)
+		uploadCommand, _ := t.uploadCommand(remoteAgentPath, compression)
+		fmt.Fprintf(output, "  %s\n    with stdin: %s\n", uploadCommand, stdin)
+		fmt.Fprintf(output, "  %s\n", t.agentCheckCommand(remoteAgentPath))
+		runCommand = t.agentRunCommand(remoteAgentPath, "agent", preambleArgs)
+	}
+
+	fmt.Fprintf(output, "\nAgent command:\n  %s\n", runCommand)
+
+	if !viper.GetBool("AttachAgent") {
+		setupData, _ := json.MarshalIndent(setup, "  ", "  ")
+		fmt.Fprintf(output, "\nAgent setup, sent through the channel:\n  %s\n", setupData)
+	}
+
+	fmt.Fprintf(output, "\nCleanup, done by the agent when it exits:\n")
+	switch {
+	case viper.GetBool("AttachAgent"):
+		fmt.Fprintf(output, "  none, the shared agent is left running\n")
+	case interpreter != "":
+		fmt.Fprintf(output, "  none, nothing is written on the remote host\n")
+	default:
+		files := []string{"daemon_XXXXXXXXXX"}
+		if !utils.RelayOnly {
+			files = append(files, ".daemon")
+		}
+		if viper.GetBool("AgentShared") {
+			files = append(files, agent.ShareSocket)
+		}
+		if viper.GetBool("AgentTransparentMode") {
+			files = append(files, "sasshimi-agent.pid")
+		}
+		for i, file := range files {
+			files[i] = quoteRemotePath(path.Join(remoteAgentPath, file))
+		}
+		fmt.Fprintf(output, "  rm -f %s\n", strings.Join(files, " "))
+	}
+}
+
+func (t *tunnel) dryRunAuthMethods() []string {
+	var methods []string
+
+	if privateKey := t.viper.GetString("PrivateKey"); privateKey != "" {
+		methods = append(methods, "publickey ("+privateKey+")")
+	}
+
+	if t.viper.GetString("Password") != "" {
+		methods = append(methods, "password (from configuration)")
+	} else {
+		methods = append(methods, "password (prompted)")
+	}
+
+	return methods
+}
+
+func (t *tunnel) dryRunExecutable() string {
+	executable := t.getRemoteExecutable()
+	if info, err := os.Stat(executable); err == nil {
+		return fmt.Sprintf("%s (%d bytes)", executable, info.Size())
+	}
+	return executable
+}
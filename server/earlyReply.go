@@ -0,0 +1,205 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"net"
+	"sync"
+)
+
+// socks5Success and socks4Success are sent to the client before the agent
+// has dialed the destination, with an unspecified bound address
+var socks5Success = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+var socks4Success = []byte{0, 0x5a, 0, 0, 0, 0, 0, 0}
+
+// earlyReplyConn answers the SOCKS greeting and CONNECT request of a client
+// locally, so the client starts sending its data without waiting for the
+// agent to dial. The replies of the agent are removed from the stream sent
+// back to the client, and the client is closed if the agent failed.
+type earlyReplyConn struct {
+	net.Conn
+	lock    sync.Mutex
+	request []byte
+	done    bool
+
+	// Replies of the agent still to remove from the stream
+	skipMethod  bool
+	skipConnect byte
+	pending     []byte
+}
+
+func (c *earlyReplyConn) Read(data []byte) (int, error) {
+	n, err := c.Conn.Read(data)
+
+	if n > 0 {
+		c.lock.Lock()
+		if !c.done {
+			c.request = append(c.request, data[:n]...)
+			c.handshake()
+		}
+		c.lock.Unlock()
+	}
+
+	return n, err
+}
+
+// handshake sends the local replies once the client request read so far
+// allows it
+func (c *earlyReplyConn) handshake() {
+	switch c.request[0] {
+	case 5:
+		if len(c.request) < 2 || len(c.request) < 2+int(c.request[1]) {
+			return
+		}
+		if !c.skipMethod {
+			if bytes.IndexByte(c.request[2:2+int(c.request[1])], 0) < 0 {
+				// Let the agent reject the authentication methods
+				c.finish()
+				return
+			}
+			c.skipMethod = true
+			c.Conn.Write([]byte{5, 0})
+		}
+
+		request := c.request[2+int(c.request[1]):]
+		if len(request) < 2 {
+			return
+		}
+		if request[1] != 1 {
+			c.finish()
+			return
+		}
+		if _, complete := socksDestination(c.request); complete {
+			c.skipConnect = 5
+			c.Conn.Write(socks5Success)
+			c.finish()
+		}
+
+	case 4:
+		if c.request[1] != 1 {
+			c.finish()
+			return
+		}
+		if _, complete := socksDestination(c.request); complete {
+			c.skipConnect = 4
+			c.Conn.Write(socks4Success)
+			c.finish()
+		}
+
+	default:
+		c.finish()
+	}
+}
+
+func (c *earlyReplyConn) finish() {
+	c.done = true
+	c.request = nil
+}
+
+func (c *earlyReplyConn) Write(data []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.skipMethod && c.skipConnect == 0 {
+		return c.Conn.Write(data)
+	}
+
+	c.pending = append(c.pending, data...)
+
+	if c.skipMethod {
+		if len(c.pending) < 2 {
+			return len(data), nil
+		}
+		if c.pending[1] != 0 {
+			c.Conn.Close()
+			return 0, errors.New("agent refused the SOCKS authentication")
+		}
+		c.pending = c.pending[2:]
+		c.skipMethod = false
+	}
+
+	if c.skipConnect != 0 {
+		size, ok := connectReplySize(c.skipConnect, c.pending)
+		if len(c.pending) < size {
+			return len(data), nil
+		}
+		if !ok {
+			c.Conn.Close()
+			return 0, errors.New("agent failed to connect the SOCKS destination")
+		}
+		c.pending = c.pending[size:]
+		c.skipConnect = 0
+	}
+
+	rest := c.pending
+	c.pending = nil
+	if len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
+
+func (c *earlyReplyConn) CloseWrite() error {
+	return utils.CloseWrite(c.Conn)
+}
+
+func (c *earlyReplyConn) SetLinger(sec int) error {
+	return utils.SetLinger(c.Conn, sec)
+}
+
+// connectReplySize returns how many bytes the SOCKS version CONNECT reply
+// of the agent takes, or more than buffered while unknown, and whether it is
+// a success
+func connectReplySize(version byte, reply []byte) (int, bool) {
+	if version == 4 {
+		return 8, len(reply) >= 2 && reply[1] == 0x5a
+	}
+
+	if len(reply) < 2 {
+		return 2, false
+	}
+	if reply[1] != 0 {
+		// Failures are not followed by data, no need to wait for the address
+		return 2, false
+	}
+	if len(reply) < 5 {
+		return 5, true
+	}
+
+	switch reply[3] {
+	case 3:
+		return 4 + 1 + int(reply[4]) + 2, true
+	case 4:
+		return 4 + 16 + 2, true
+	default:
+		return 4 + 4 + 2, true
+	}
+}
+
+// earlyReplyConn wraps conn to answer SOCKS requests locally when the
+// EarlyReply option is set
+func (t *tunnel) earlyReplyConn(conn net.Conn) net.Conn {
+	if !t.earlyReply {
+		return conn
+	}
+
+	return &earlyReplyConn{Conn: conn}
+}
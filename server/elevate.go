@@ -0,0 +1,116 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"strings"
+	"syscall"
+)
+
+const (
+	elevateSudo = "sudo"
+	elevateDoas = "doas"
+)
+
+// sudoPasswordPrefix runs a command with sudo reading the password on
+// stdin, without prompt and ignoring credentials cached by earlier commands
+const sudoPasswordPrefix = "sudo -k -S -p '' "
+
+// prepareElevation checks the remote account can run commands with the
+// Elevate method, and sets the prefix of the agent command and the password
+// sent before the channel if one is needed.
+func (t *tunnel) prepareElevation() error {
+	method := t.viper.GetString("Elevate")
+
+	switch method {
+	case "":
+		return nil
+
+	case elevateDoas:
+		// doas only reads passwords from a terminal
+		if !t.remoteCommandSucceeds("doas -n true") {
+			return errors.New("doas requires a password on the remote host, only nopass rules are supported")
+		}
+		t.elevatePrefix = "doas -n "
+		return nil
+
+	case elevateSudo:
+		if t.remoteCommandSucceeds("sudo -n true") {
+			t.elevatePrefix = "sudo -n "
+			return nil
+		}
+
+		password := t.getElevatePassword()
+		err := t.checkSudoPassword(password)
+		if err != nil {
+			return err
+		}
+
+		t.elevatePrefix = sudoPasswordPrefix
+		t.elevatePassword = password
+		return nil
+	}
+
+	return errors.New("Unknown elevation method " + method + ", use sudo or doas")
+}
+
+func (t *tunnel) getElevatePassword() string {
+	password := t.viper.GetString("ElevatePassword")
+	if password == "" {
+		fmt.Printf("[sudo] password for %s@%s: ", t.getUsername(), t.getRemoteHost())
+		bytePassword, _ := terminal.ReadPassword(int(syscall.Stdin))
+		fmt.Println("")
+		password = string(bytePassword)
+	}
+	return password
+}
+
+// checkSudoPassword makes sure sudo accepts password before it is sent in
+// front of the channel, where a refused password would consume channel data
+func (t *tunnel) checkSudoPassword(password string) error {
+	session, err := t.sshClient.NewSession()
+	if err != nil {
+		return fmt.Errorf("Failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	session.Stdin = strings.NewReader(password + "\n")
+	err = session.Run(t.shellCommand(sudoPasswordPrefix + "true"))
+	if err != nil {
+		return fmt.Errorf("sudo refused the password: %w", err)
+	}
+
+	return nil
+}
+
+// sendElevatePassword writes the sudo password to the agent command. It
+// must be written before any channel frame, sudo reads it one byte at a
+// time and leaves the rest to the agent.
+func (t *tunnel) sendElevatePassword() error {
+	if t.elevatePassword == "" {
+		return nil
+	}
+
+	_, err := io.WriteString(t.Writer, t.elevatePassword+"\n")
+	t.elevatePassword = ""
+	if err != nil {
+		return fmt.Errorf("Failed to send sudo password: %w", err)
+	}
+	return nil
+}
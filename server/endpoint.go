@@ -0,0 +1,203 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"io"
+	"net"
+	"time"
+)
+
+// Endpoint is a tunnel fed with connections accepted by another component,
+// like the team server, instead of its own local listener.
+type Endpoint struct {
+	tunnel *tunnel
+	done   chan struct{}
+	err    error
+}
+
+// OpenEndpoint starts a tunnel to the host configured in viper. The tunnel is
+// opened in background, connections can be served right away.
+func OpenEndpoint(viper *viper.Viper, verboseLevel int) *Endpoint {
+	t := newTunnel(viper)
+	return startEndpoint(t, func() error {
+		return t.openTunnel(verboseLevel)
+	})
+}
+
+// OpenTransportEndpoint starts a tunnel configured in viper to an agent
+// already running at the other end of transport, like one started with
+// agent.Serve, instead of deploying one through SSH. Its keepalives are
+// timed by clock, nil for common.RealClock.
+func OpenTransportEndpoint(viper *viper.Viper, transport io.ReadWriteCloser, verboseLevel int, clock common.Clock) *Endpoint {
+	t := newTunnel(viper)
+	t.transport = transport
+	t.Clock = clock
+	return startEndpoint(t, func() error {
+		return t.openTransport(transport, verboseLevel)
+	})
+}
+
+func startEndpoint(t *tunnel, open func() error) *Endpoint {
+	endpoint := &Endpoint{
+		tunnel: t,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		go func() {
+			select {
+			case <-t.NotifyClosure:
+			case <-endpoint.done:
+			}
+		}()
+
+		err := open()
+		if err != nil {
+			utils.Logger.Error("Tunnel", t.getName(), "closed:", err.Error())
+		}
+
+		endpoint.err = err
+		t.Close()
+		close(endpoint.done)
+	}()
+
+	go t.handleClients()
+	go t.KeepAlive()
+
+	return endpoint
+}
+
+// Name returns the label of the tunnel
+func (e *Endpoint) Name() string {
+	return e.tunnel.getName()
+}
+
+// Alive tells if the tunnel can still serve connections
+func (e *Endpoint) Alive() bool {
+	select {
+	case <-e.done:
+		return false
+	default:
+		return e.tunnel.ChannelOpen
+	}
+}
+
+// Done returns a channel closed once the tunnel is closed
+func (e *Endpoint) Done() <-chan struct{} {
+	return e.done
+}
+
+// Err returns why the tunnel closed, like ErrAuthFailed, *UploadError
+// or *AgentDiedError, or nil while it is alive
+func (e *Endpoint) Err() error {
+	select {
+	case <-e.done:
+		return e.err
+	default:
+		return nil
+	}
+}
+
+// WaitReady waits until the agent answered through the tunnel. It returns
+// why the tunnel closed if it did first.
+func (e *Endpoint) WaitReady() error {
+	select {
+	case <-e.tunnel.received:
+		return nil
+	case <-e.done:
+		if e.err != nil {
+			return e.err
+		}
+		return errors.New("tunnel " + e.tunnel.getName() + " is closed")
+	}
+}
+
+// ListenProxy serves the SOCKS proxy of the tunnel on bindAddress, like the
+// server command does, until the tunnel is closed
+func (e *Endpoint) ListenProxy(bindAddress string) (net.Addr, error) {
+	ln, err := listenProxy(e.tunnel.viper, bindAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-e.done
+		ln.Close()
+	}()
+
+	go func() {
+		operator := localOperator()
+		for {
+			conn, err := utils.Accept(ln)
+			if err != nil {
+				return
+			}
+			if e.Serve(conn, operator) != nil {
+				conn.Close()
+			}
+		}
+	}()
+
+	return ln.Addr(), nil
+}
+
+// Serve forwards conn, opened by operator, through the tunnel as a new SOCKS
+// client.
+func (e *Endpoint) Serve(conn net.Conn, operator string) error {
+	if !e.Alive() {
+		return errors.New("tunnel " + e.tunnel.getName() + " is closed")
+	}
+
+	e.tunnel.addClient(conn, operator)
+	return nil
+}
+
+// UpgradeAgent sends the agent binary at path through the tunnel and
+// restarts the agent with it, without deploying it again through SSH.
+// Connections are closed, the tunnel stays open.
+func (e *Endpoint) UpgradeAgent(path string) error {
+	if !e.Alive() {
+		return errors.New("tunnel " + e.tunnel.getName() + " is closed")
+	}
+	return e.tunnel.upgradeAgent(path)
+}
+
+// Close stops the remote agent and waits for the tunnel to be closed
+func (e *Endpoint) Close() {
+	if !e.Alive() {
+		return
+	}
+
+	e.tunnel.Terminate()
+
+	select {
+	case <-e.done:
+	case <-time.After(5 * time.Second):
+		if e.tunnel.transport != nil {
+			utils.Logger.Warning("Remote close timeout, closing transport of", e.tunnel.getName())
+			e.tunnel.transport.Close()
+		} else {
+			utils.Logger.Warning("Remote close timeout, closing SSH connection to", e.tunnel.getRemoteHost())
+			if e.tunnel.sshClient != nil {
+				e.tunnel.sshClient.Close()
+			}
+		}
+	}
+}
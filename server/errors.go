@@ -0,0 +1,158 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"golang.org/x/crypto/ssh"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrAuthFailed is returned when the SSH server refused every configured
+// authentication method.
+var ErrAuthFailed = errors.New("SSH authentication failed")
+
+// UploadError is returned when the agent could not be uploaded to Path on
+// the remote host.
+type UploadError struct {
+	Path  string
+	Cause error
+}
+
+func (e *UploadError) Error() string {
+	return "Failed to upload forwarder to " + e.Path + ": " + e.Cause.Error()
+}
+
+// Unwrap returns the error that made the upload fail
+func (e *UploadError) Unwrap() error {
+	return e.Cause
+}
+
+// NoSpaceError is returned when the agent binary, Needed KB, does not fit in
+// the Free KB left in Path on the remote host. Quota is set when the user
+// quota is what leaves no room.
+type NoSpaceError struct {
+	Path   string
+	Needed int64
+	Free   int64
+	Quota  bool
+}
+
+func (e *NoSpaceError) Error() string {
+	limit := "free space"
+	if e.Quota {
+		limit = "disk quota"
+	}
+	return "Agent needs " + strconv.FormatInt(e.Needed, 10) + " KB in " + e.Path + " but the " + limit + " leaves " +
+		strconv.FormatInt(e.Free, 10) + " KB"
+}
+
+// AgentDiedError is returned when the remote agent process exited and the
+// tunnel closed. ExitStatus is -1 when the remote host did not report it.
+// Cause is the error of the command that ran the agent, nil when it exited
+// normally.
+type AgentDiedError struct {
+	ExitStatus int
+	Cause      error
+}
+
+func (e *AgentDiedError) Error() string {
+	return "Remote process is dead, exit status " + strconv.Itoa(e.ExitStatus)
+}
+
+// Unwrap returns the error of the command that ran the agent
+func (e *AgentDiedError) Unwrap() error {
+	return e.Cause
+}
+
+// HandshakeTimeoutError is returned when no message came from the agent within
+// Timeout of the session start. Output holds the first bytes the remote
+// host sent instead.
+type HandshakeTimeoutError struct {
+	Timeout time.Duration
+	Output  []byte
+}
+
+func (e *HandshakeTimeoutError) Error() string {
+	if len(e.Output) == 0 {
+		return "Agent did not answer within " + e.Timeout.String() + ", the remote host sent nothing"
+	}
+	return "Agent did not answer within " + e.Timeout.String() + ", the remote host sent instead: " +
+		strconv.Quote(string(e.Output))
+}
+
+// dialError wraps the error of an SSH dial, returning ErrAuthFailed when
+// the handshake failed on authentication.
+func dialError(err error) error {
+	// x/crypto has no error type for authentication failures
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		return ErrAuthFailed
+	}
+	return fmt.Errorf("Dial error: %w", err)
+}
+
+// agentDied returns the AgentDiedError for the error of the command that ran
+// the agent, either a SSH session or a local process.
+func agentDied(err error) *AgentDiedError {
+	switch err := err.(type) {
+	case nil:
+		return &AgentDiedError{ExitStatus: 0}
+	case *ssh.ExitError:
+		return &AgentDiedError{ExitStatus: err.ExitStatus(), Cause: err}
+	case *exec.ExitError:
+		if status, ok := err.Sys().(syscall.WaitStatus); ok {
+			return &AgentDiedError{ExitStatus: status.ExitStatus(), Cause: err}
+		}
+	}
+	return &AgentDiedError{ExitStatus: -1, Cause: err}
+}
+
+// errorHint returns advice for the operator about err or the error it
+// wraps, or an empty string
+func errorHint(err error) string {
+	var upload *UploadError
+	var handshake *HandshakeTimeoutError
+	var noSpace *NoSpaceError
+	var noise *ChannelNoiseError
+
+	switch {
+	case errors.As(err, &upload):
+		return "check RemoteAgentPath is writable, or try --upload-method sftp"
+	case errors.As(err, &handshake):
+		return "check the agent matches the remote OS and CPU (see --dry-run) and the login shell prints nothing " +
+			"on stdout, or raise --handshake-timeout"
+	case errors.As(err, &noSpace):
+		return "free some space, set RemoteAgentPath to another directory or give candidates with --fallback-agent-path"
+	case errors.As(err, &noise):
+		return "silence the login shell output, or leave out --strict-channel to skip it"
+	case errors.Is(err, ErrAuthFailed):
+		return "check the user, Password and PrivateKey settings"
+	}
+	return ""
+}
+
+// failTunnel logs why the tunnel could not be kept open and exits
+func failTunnel(err error) {
+	if hint := errorHint(err); hint != "" {
+		utils.Logger.Error(hint)
+	}
+	utils.Logger.Fatal("Failed to open tunnel ", err.Error())
+}
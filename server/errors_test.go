@@ -0,0 +1,54 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestDialErrorUnwraps(t *testing.T) {
+	err := dialError(io.ErrUnexpectedEOF)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("%v does not unwrap to its cause", err)
+	}
+
+	err = dialError(errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none]"))
+	if err != ErrAuthFailed {
+		t.Errorf("authentication failure gave %v", err)
+	}
+}
+
+func TestErrorHintOfWrappedErrors(t *testing.T) {
+	tests := []error{
+		&UploadError{Path: "/tmp", Cause: io.ErrShortWrite},
+		fmt.Errorf("strict channel: %w", &ChannelNoiseError{Skipped: 4, Output: []byte("motd")}),
+		fmt.Errorf("deploy: %w", &NoSpaceError{Path: "/tmp", Needed: 2048, Free: 10}),
+		&HandshakeTimeoutError{},
+		fmt.Errorf("tunnel: %w", ErrAuthFailed),
+	}
+
+	for _, err := range tests {
+		if errorHint(err) == "" {
+			t.Errorf("no hint for %v", err)
+		}
+	}
+
+	if hint := errorHint(io.EOF); hint != "" {
+		t.Errorf("hint %q for %v", hint, io.EOF)
+	}
+}
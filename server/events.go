@@ -0,0 +1,76 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/events"
+	"sync"
+	"time"
+)
+
+func (t *tunnel) publishTunnel(up bool) {
+	if up {
+		events.Publish(events.TunnelUp{Time: time.Now(), Tunnel: t.getName()})
+	} else {
+		events.Publish(events.TunnelDown{Time: time.Now(), Tunnel: t.getName()})
+	}
+}
+
+// openingClient returns the function publishing ClientOpened for client with
+// the destination it is first called with, nil if nobody is subscribed. It
+// must be called with ClientsLock held.
+func (t *tunnel) openingClient(client *common.Client) func(destination string) {
+	if !events.Active() {
+		return nil
+	}
+
+	var once sync.Once
+	announce := func(destination string) {
+		once.Do(func() {
+			events.Publish(events.ClientOpened{
+				Time:        time.Now(),
+				Tunnel:      t.getName(),
+				Client:      client.Id,
+				Operator:    client.Operator,
+				Destination: destination,
+			})
+		})
+	}
+
+	t.opening[client.Id] = announce
+	return announce
+}
+
+// publishClosed publishes ClientClosed for client, after ClientOpened if its
+// destination was never known. It must be called with ClientsLock held.
+func (t *tunnel) publishClosed(client *common.Client) {
+	if announce, prs := t.opening[client.Id]; prs {
+		announce("")
+		delete(t.opening, client.Id)
+	} else if !events.Active() {
+		return
+	}
+
+	download, upload := client.Traffic()
+	events.Publish(events.ClientClosed{
+		Time:     time.Now(),
+		Tunnel:   t.getName(),
+		Client:   client.Id,
+		Operator: client.Operator,
+		Upload:   upload,
+		Download: download,
+	})
+}
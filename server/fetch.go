@@ -0,0 +1,90 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// FetchRequest is an HTTP request made from the agent side through the
+// SOCKS proxy
+type FetchRequest struct {
+	Method  string
+	URL     string
+	Headers []string
+	Body    io.Reader
+
+	// Insecure skips TLS certificate verification
+	Insecure bool
+
+	// FollowRedirects follows redirections instead of returning them
+	FollowRedirects bool
+}
+
+// Fetch sends request through the SOCKS proxy at proxyAddress, names are
+// resolved by the agent. The status line and headers are written to
+// headers and the body is streamed to body.
+func Fetch(proxyAddress string, request FetchRequest, headers, body io.Writer) error {
+	httpRequest, err := http.NewRequest(request.Method, request.URL, request.Body)
+	if err != nil {
+		return fmt.Errorf("invalid request: %w", err)
+	}
+
+	for _, header := range request.Headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return errors.New("invalid header " + header + ", expected Name: value")
+		}
+
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if strings.EqualFold(name, "Host") {
+			httpRequest.Host = value
+		} else {
+			httpRequest.Header.Add(name, value)
+		}
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(&url.URL{Scheme: "socks5", Host: proxyAddress}),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: request.Insecure},
+		},
+	}
+
+	if !request.FollowRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	response, err := client.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	fmt.Fprintf(headers, "%s %s\r\n", response.Proto, response.Status)
+	response.Header.Write(headers)
+	fmt.Fprint(headers, "\r\n")
+
+	_, err = io.Copy(body, response.Body)
+	return err
+}
@@ -0,0 +1,68 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/geoip"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"net"
+)
+
+// loadGeoIP opens the MaxMind DB files of the GeoIPDatabases option
+func loadGeoIP(viper *viper.Viper) []*geoip.Reader {
+	var readers []*geoip.Reader
+
+	for _, path := range viper.GetStringSlice("GeoIPDatabases") {
+		reader, err := geoip.Open(path)
+		if err != nil {
+			utils.Logger.Error("Failed to open GeoIP database " + path + ": " + err.Error())
+			continue
+		}
+
+		utils.Logger.Info("GeoIP database", reader.DatabaseType, "loaded from", path)
+		readers = append(readers, reader)
+	}
+
+	return readers
+}
+
+// tagDestination returns announce, also recording in the session log the
+// autonomous system and country of the destination of client when it is a
+// public IP address
+func (t *tunnel) tagDestination(client *common.Client, announce func(destination string)) func(destination string) {
+	if len(t.geoip) == 0 || audit.Path() == "" {
+		return announce
+	}
+
+	return func(destination string) {
+		if host, _, err := net.SplitHostPort(destination); err == nil {
+			if ip := net.ParseIP(host); ip != nil && geoip.IsPublic(ip) {
+				details := geoip.Tags(t.geoip, ip)
+				details["tunnel"] = t.getName()
+				details["client"] = client.Id
+				details["operator"] = client.Operator
+				details["destination"] = destination
+				audit.Record("connection_destination", details)
+			}
+		}
+
+		if announce != nil {
+			announce(destination)
+		}
+	}
+}
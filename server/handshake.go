@@ -0,0 +1,91 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// firstBytesSize is how much of the channel output is kept to diagnose an
+// agent that never answers
+const firstBytesSize = 256
+
+// firstBytesReader keeps the first bytes read from the channel
+type firstBytesReader struct {
+	io.Reader
+	lock  sync.Mutex
+	first []byte
+}
+
+func (r *firstBytesReader) Read(data []byte) (int, error) {
+	n, err := r.Reader.Read(data)
+
+	r.lock.Lock()
+	if missing := firstBytesSize - len(r.first); missing > 0 && n > 0 {
+		if missing > n {
+			missing = n
+		}
+		r.first = append(r.first, data[:missing]...)
+	}
+	r.lock.Unlock()
+
+	return n, err
+}
+
+func (r *firstBytesReader) bytes() []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]byte(nil), r.first...)
+}
+
+// handshakeFailure holds the error openTunnel returns instead of the exit
+// status of the agent
+type handshakeFailure struct {
+	err error
+}
+
+// failHandshake closes the session, making openTunnel return err. Only the
+// first failure is kept.
+func (t *tunnel) failHandshake(err error) {
+	t.handshakeOnce.Do(func() {
+		t.handshakeErr.Store(handshakeFailure{err: err})
+		t.sshSession.Close()
+	})
+}
+
+// messageReceived records that a valid message came through the channel
+func (t *tunnel) messageReceived() {
+	t.receivedOnce.Do(func() { close(t.received) })
+}
+
+// expectHandshake closes the session when no message came through the
+// channel within timeout, making openTunnel return an HandshakeTimeoutError
+// with the first bytes of output. Every agent sends a keepalive or its
+// hello at once, so only garbage or silence reach the timeout.
+func (t *tunnel) expectHandshake(timeout time.Duration, output *firstBytesReader) {
+	if timeout <= 0 {
+		return
+	}
+
+	select {
+	case <-t.received:
+	case <-time.After(timeout):
+		if t.ChannelOpen {
+			t.failHandshake(&HandshakeTimeoutError{Timeout: timeout, Output: output.bytes()})
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// healSession closes the SSH connection of a wedged session, so openTunnel
+// returns and a new session is opened by Run. The local listeners, and the
+// sockets inherited from systemd with them, stay open.
+func (t *tunnel) healSession() {
+	atomic.StoreInt32(&t.restarting, 1)
+	t.wedgedPath = t.deployedPath
+	t.sshClient.Close()
+}
+
+// reopenSession prepares the tunnel for the session replacing a wedged one.
+// The clients of the wedged session are gone, the new ones wait in the
+// queue until the new agent is started.
+func (t *tunnel) reopenSession() {
+	t.Reopen()
+
+	t.hello = make(chan struct{})
+	t.helloOnce = sync.Once{}
+	t.agentHello = atomic.Value{}
+	t.received = make(chan struct{})
+	t.receivedOnce = sync.Once{}
+	t.handshakeErr = atomic.Value{}
+	t.handshakeOnce = sync.Once{}
+	t.openedAt = atomic.Value{}
+	t.agentPath = ""
+	t.deployedPath = ""
+}
+
+// stopWedgedAgent stops the agent of the wedged session before a new one is
+// deployed: its channel stopped working, the agent may still run.
+func (t *tunnel) stopWedgedAgent() {
+	directory := t.wedgedPath
+	if directory == "" {
+		return
+	}
+	t.wedgedPath = ""
+
+	if t.remote != nil && t.remote.restricted {
+		utils.Logger.Warning("Restricted shell " + t.remote.shell + " cannot stop the agent of the wedged session in " + directory)
+		return
+	}
+
+	result, err := t.teardownDirectory(directory)
+	if err != nil {
+		utils.Logger.Warning("Failed to stop the agent of the wedged session: ", err.Error())
+		return
+	}
+
+	utils.Logger.Notice("Stopped the agent of the wedged session in", directory, "killed:", strings.Join(result.Killed, ", "))
+	audit.Record("agent_teardown", map[string]string{
+		"tunnel":    t.getName(),
+		"remote":    t.getRemoteHost(),
+		"directory": directory,
+		"killed":    strings.Join(result.Killed, ","),
+		"removed":   strings.Join(result.Removed, ","),
+		"left":      strings.Join(result.Left, ","),
+	})
+}
@@ -0,0 +1,101 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"time"
+)
+
+// markOpen records the time the remote agent was started
+func (t *tunnel) markOpen() {
+	t.openedAt.Store(time.Now())
+}
+
+// state returns "connecting" until the remote agent is started, then "up"
+// until the tunnel is closed.
+func (t *tunnel) state() string {
+	openedAt, _ := t.openedAt.Load().(time.Time)
+
+	switch {
+	case !t.ChannelOpen:
+		return "down"
+	case openedAt.IsZero():
+		return "connecting"
+	default:
+		return "up"
+	}
+}
+
+// clientCount returns the number of connected clients
+func (t *tunnel) clientCount() int {
+	t.ClientsLock.Lock()
+	defer t.ClientsLock.Unlock()
+	return len(t.Clients)
+}
+
+// leakCounters returns the tunnel values watched by --debug-leaks
+func (t *tunnel) leakCounters() []utils.LeakCounter {
+	return []utils.LeakCounter{
+		{Name: "clients", Count: t.clientCount},
+		{Name: "in_queue", Count: func() int { depth, _ := t.InDepth(); return depth }},
+		{Name: "out_queue", Count: func() int { depth, _ := t.OutQueue.Depth(); return depth }},
+	}
+}
+
+// healthLine describes the tunnel state in a single line, like
+// "acme-dmz up clients=2 in_queue=0/10 out_queue=3/64 uptime=1h2m3s", with
+// the messages waiting in the channel queues and their current limits.
+func (t *tunnel) healthLine() string {
+	clients := t.clientCount()
+
+	inDepth, inLimit := t.InDepth()
+	outDepth, outLimit := t.OutQueue.Depth()
+
+	line := fmt.Sprintf("%s %s clients=%d in_queue=%d/%d out_queue=%d/%d",
+		t.getName(), t.state(), clients, inDepth, inLimit, outDepth, outLimit)
+
+	if openedAt, _ := t.openedAt.Load().(time.Time); !openedAt.IsZero() && t.ChannelOpen {
+		line += fmt.Sprintf(" uptime=%s", time.Since(openedAt).Truncate(time.Second))
+	}
+
+	return line + "\n"
+}
+
+// serveHealth writes the health line to every connection accepted on
+// bindAddress, so scripts can check the tunnel without parsing logs.
+func (t *tunnel) serveHealth(bindAddress string) {
+	ln, err := utils.Listen(bindAddress)
+	if err != nil {
+		utils.Logger.Error("Failed to bind health port " + err.Error())
+		return
+	}
+	defer ln.Close()
+
+	utils.Logger.Notice("Health port bind at", ln.Addr().String())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			utils.Logger.Error("Error in health connection accept: ", err.Error())
+			return
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(t.healthLine()))
+		conn.Close()
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/rsrdesarrollo/SaSSHimi/version"
+	"sync/atomic"
+	"time"
+)
+
+// helloTimeout is how long the agent has to reply to the setup message
+// before it is assumed to be older than protocol versioning
+const helloTimeout = 10 * time.Second
+
+// receiveHello checks the agent protocol is compatible with this client,
+// and terminates the tunnel otherwise
+func (t *tunnel) receiveHello(msg *common.DataMessage) {
+	hello, err := common.ParseHello(msg)
+	if err != nil {
+		utils.Logger.Error(err.Error())
+		return
+	}
+	t.agentHello.Store(hello)
+	atomic.AddInt32(&t.helloCount, 1)
+	t.helloOnce.Do(func() { close(t.hello) })
+
+	err = common.CheckProtocol(hello.Protocol, hello.MinProtocol)
+	if err != nil {
+		utils.Logger.Errorf("Agent %s is not compatible with this client %s: %s. Remove the agent from the remote host "+
+			"to deploy this version, or use a matching client", hello.Version, version.VersionTag, err.Error())
+		t.Terminate()
+		return
+	}
+
+	if hello.Version != version.VersionTag {
+		utils.Logger.Warningf("Agent version %s differs from this client %s, they speak compatible protocols %d and %d",
+			hello.Version, version.VersionTag, hello.Protocol, common.ProtocolVersion)
+	} else {
+		utils.Logger.Debug("Agent version", hello.Version, "protocol", hello.Protocol)
+	}
+
+	if hello.AuthSock != "" && t.agentForwarded {
+		utils.Logger.Notice("Forwarded ssh-agent socket on the remote host:", hello.AuthSock)
+	}
+}
+
+// expectHello warns when the agent does not reply to the setup message,
+// which agents older than protocol versioning never do
+func (t *tunnel) expectHello() {
+	select {
+	case <-t.hello:
+	case <-time.After(helloTimeout):
+		if t.ChannelOpen {
+			utils.Logger.Warning("Agent did not report its version, it may have been left on the remote host by an " +
+				"older client: channel errors are likely, remove it to deploy this version")
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// hostsFilePath returns the hosts file of the HostsFile option, or the one
+// of the system
+func (t *tunnel) hostsFilePath() string {
+	if path := t.viper.GetString("HostsFile"); path != "" {
+		return path
+	}
+
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+	}
+
+	return "/etc/hosts"
+}
+
+// validHostsName tells if name can be written in the hosts file without
+// adding other names, lines or comments
+func validHostsName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, char := range name {
+		if unicode.IsSpace(char) || unicode.IsControl(char) || char == '#' {
+			return false
+		}
+	}
+	return true
+}
+
+// hostsEntries returns the "address name" lines of the Hosts option, whose
+// items are name or name=address (default 127.0.0.1), and of the exact SNI
+// route names when HostsFromRoutes is set
+func (t *tunnel) hostsEntries() ([]string, error) {
+	var entries []string
+
+	for _, item := range t.viper.GetStringSlice("Hosts") {
+		parts := strings.SplitN(item, "=", 2)
+		address := "127.0.0.1"
+		if len(parts) == 2 {
+			address = parts[1]
+		}
+
+		if !validHostsName(parts[0]) || net.ParseIP(address) == nil {
+			return nil, errors.New("invalid hosts entry " + strconv.Quote(item) + ", expected name or name=address with an IP address")
+		}
+
+		entries = append(entries, address+" "+parts[0])
+	}
+
+	if t.viper.GetBool("HostsFromRoutes") {
+		routes, err := t.getSNIRoutes()
+		if err != nil {
+			return nil, err
+		}
+
+		for name := range routes {
+			if strings.Contains(name, "*") {
+				continue
+			}
+			if !validHostsName(name) {
+				return nil, errors.New("invalid SNI route name " + strconv.Quote(name) + " for the hosts file")
+			}
+			entries = append(entries, "127.0.0.1 "+name)
+		}
+	}
+
+	return entries, nil
+}
+
+// hostsMarkers returns the comments around the lines added to the hosts
+// file for this tunnel
+func (t *tunnel) hostsMarkers() (string, string) {
+	return "# BEGIN SaSSHimi " + t.getName(), "# END SaSSHimi " + t.getName()
+}
+
+// rewriteHosts replaces the lines of the tunnel in the hosts file by
+// entries, removing them when entries is empty. Line endings of the file
+// are kept. A begin marker without its end marker, after a hand edit, leaves
+// the file untouched rather than dropping the lines after it.
+func (t *tunnel) rewriteHosts(entries []string) error {
+	path := t.hostsFilePath()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read hosts file: %w", err)
+	}
+
+	newline := "\n"
+	if strings.Contains(string(content), "\r\n") {
+		newline = "\r\n"
+	}
+
+	begin, end := t.hostsMarkers()
+
+	var lines []string
+	inBlock := false
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		switch strings.TrimRight(line, "\r\n") {
+		case begin:
+			if inBlock {
+				return errors.New("hosts file has two " + strconv.Quote(begin) + " lines in a row, not rewritten")
+			}
+			inBlock = true
+		case end:
+			inBlock = false
+		default:
+			if !inBlock && line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+
+	if inBlock {
+		return errors.New("hosts file has no " + strconv.Quote(end) + " line after " + strconv.Quote(begin) + ", not rewritten")
+	}
+
+	if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+		lines[len(lines)-1] += newline
+	}
+
+	if len(entries) > 0 {
+		lines = append(lines, begin+newline)
+		for _, entry := range entries {
+			lines = append(lines, entry+newline)
+		}
+		lines = append(lines, end+newline)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	// Written in place, the hosts file may be a bind mount
+	err = ioutil.WriteFile(path, []byte(strings.Join(lines, "")), info.Mode())
+	if err != nil {
+		return fmt.Errorf("failed to write hosts file: %w", err)
+	}
+
+	return nil
+}
+
+// addHosts adds the hosts entries of the tunnel to the hosts file, they are
+// removed by restoreHosts
+func (t *tunnel) addHosts() {
+	entries, err := t.hostsEntries()
+	if err != nil {
+		utils.Logger.Error(err.Error())
+		return
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+
+	err = t.rewriteHosts(entries)
+	if err != nil {
+		utils.Logger.Error(err.Error())
+		return
+	}
+
+	t.hostsAdded = true
+	utils.Logger.Noticef("Added %d entries to %s until the tunnel is closed", len(entries), t.hostsFilePath())
+}
+
+// restoreHosts removes the entries added by addHosts
+func (t *tunnel) restoreHosts() {
+	t.hostsOnce.Do(func() {
+		if !t.hostsAdded {
+			return
+		}
+
+		err := t.rewriteHosts(nil)
+		if err != nil {
+			utils.Logger.Error(err.Error(), "- remove the SaSSHimi lines by hand")
+			return
+		}
+
+		utils.Logger.Notice("Removed the entries added to", t.hostsFilePath())
+	})
+}
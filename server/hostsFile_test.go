@@ -0,0 +1,95 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// hostsTunnel returns a tunnel named test using a new hosts file with
+// content, to remove with its directory
+func hostsTunnel(t *testing.T, content string) (*tunnel, string) {
+	dir, err := ioutil.TempDir("", "sasshimi-hosts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tun := &tunnel{viper: viper.New()}
+	tun.viper.Set("Name", "test")
+	tun.viper.Set("HostsFile", path)
+	return tun, path
+}
+
+func TestRewriteHosts(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		entries  []string
+		expected string
+	}{
+		{"add", "127.0.0.1 localhost\n", []string{"127.0.0.1 intranet"},
+			"127.0.0.1 localhost\n# BEGIN SaSSHimi test\n127.0.0.1 intranet\n# END SaSSHimi test\n"},
+		{"replace", "127.0.0.1 localhost\n# BEGIN SaSSHimi test\n127.0.0.1 old\n# END SaSSHimi test\n::1 localhost\n", []string{"127.0.0.1 intranet"},
+			"127.0.0.1 localhost\n::1 localhost\n# BEGIN SaSSHimi test\n127.0.0.1 intranet\n# END SaSSHimi test\n"},
+		{"remove", "127.0.0.1 localhost\r\n# BEGIN SaSSHimi test\r\n127.0.0.1 intranet\r\n# END SaSSHimi test\r\n", nil,
+			"127.0.0.1 localhost\r\n"},
+		{"other tunnel", "# BEGIN SaSSHimi other\n127.0.0.1 other\n# END SaSSHimi other\n", nil,
+			"# BEGIN SaSSHimi other\n127.0.0.1 other\n# END SaSSHimi other\n"},
+	}
+
+	for _, test := range tests {
+		tun, path := hostsTunnel(t, test.content)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		if err := tun.rewriteHosts(test.entries); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		content, _ := ioutil.ReadFile(path)
+		if string(content) != test.expected {
+			t.Errorf("%s: hosts file is %q, expected %q", test.name, content, test.expected)
+		}
+	}
+}
+
+func TestRewriteHostsWithoutEndMarker(t *testing.T) {
+	for _, content := range []string{
+		"127.0.0.1 localhost\n# BEGIN SaSSHimi test\n127.0.0.1 intranet\n::1 localhost\n",
+		"# BEGIN SaSSHimi test\n127.0.0.1 hand\n# BEGIN SaSSHimi test\n127.0.0.1 intranet\n# END SaSSHimi test\n",
+	} {
+		tun, path := hostsTunnel(t, content)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		if err := tun.rewriteHosts(nil); err == nil {
+			t.Errorf("hosts file %q rewritten", content)
+		}
+
+		written, _ := ioutil.ReadFile(path)
+		if string(written) != content {
+			t.Errorf("hosts file changed to %q", written)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"os"
+	"time"
+)
+
+// exitWhenIdle calls onExit and exits once no client has been connected for
+// timeout, so a socket activated tunnel stops when it is not used anymore.
+func (t *tunnel) exitWhenIdle(timeout time.Duration, onExit func()) {
+	idleSince := time.Now()
+
+	for t.ChannelOpen {
+		time.Sleep(time.Second)
+
+		if t.clientCount() > 0 {
+			idleSince = time.Now()
+			continue
+		}
+
+		if lastClientAt, _ := t.lastClientAt.Load().(time.Time); lastClientAt.After(idleSince) {
+			idleSince = lastClientAt
+		}
+
+		if time.Since(idleSince) >= timeout {
+			utils.Logger.Notice("No connection for", timeout, "closing tunnel", t.getName())
+			onExit()
+			os.Exit(0)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+)
+
+// pythonAgentScript is a minimal SOCKS5 agent speaking the binary framing of
+// the channel. It runs on both Python 2 and Python 3 and is used on hosts
+// where no binary can be executed.
+const pythonAgentScript = `
+import json, os, socket, struct, sys, threading, zlib
+
+CLOSE_CLIENT, DEAD_CLIENT, CLOSE_CHANNEL, KEEP_ALIVE, SETUP, RESET = 1, 2, 4, 8, 16, 128
+HEADER = struct.Struct(">BQQIH")
+
+out_lock = threading.Lock()
+out_seq = [0]
+frame_size = [32768]
+clients = {}
+clients_lock = threading.Lock()
+
+
+def read_exact(size):
+    buf = b""
+    while len(buf) < size:
+        chunk = os.read(0, size - len(buf))
+        if not chunk:
+            raise EOFError()
+        buf += chunk
+    return buf
+
+
+def checksum(seq, cseq, flags, cid, data):
+    return zlib.crc32(struct.pack(">QQB", seq, cseq, flags) + cid + data) & 0xffffffff
+
+
+def send(cid, data=b"", flags=0, cseq=0):
+    with out_lock:
+        seq = out_seq[0]
+        out_seq[0] += 1
+        frame = HEADER.pack(flags, seq, cseq, checksum(seq, cseq, flags, cid, data), len(cid))
+        frame += cid + struct.pack(">I", len(data)) + data
+        while frame:
+            frame = frame[os.write(1, frame):]
+
+
+def socks_reply(code):
+    return b"\x05" + struct.pack("B", code) + b"\x00\x01\x00\x00\x00\x00\x00\x00"
+
+
+class Client(object):
+    def __init__(self, cid):
+        self.cid = cid
+        self.buf = b""
+        self.state = "greeting"
+        self.version = 5
+        self.sock = None
+        self.seq = 0
+        self.delivered = 0
+        self.read_closed = False
+        self.write_closed = False
+        self.lock = threading.Lock()
+
+    def reply(self, data):
+        self.seq += 1
+        send(self.cid, data, 0, self.seq)
+
+    def fail(self):
+        self.state = "dead"
+        send(self.cid, b"", DEAD_CLIENT)
+
+    def close(self, reset=False):
+        self.state = "dead"
+        if self.sock is not None:
+            try:
+                if reset:
+                    self.sock.setsockopt(socket.SOL_SOCKET, socket.SO_LINGER, struct.pack("ii", 1, 0))
+                self.sock.close()
+            except socket.error:
+                pass
+
+    def close_write(self):
+        # The other side finished sending: half-close the destination and
+        # keep the client until it finishes too. Returns True once closed.
+        with self.lock:
+            if self.state == "connected" and not self.read_closed:
+                self.write_closed = True
+                try:
+                    self.sock.shutdown(socket.SHUT_WR)
+                except socket.error:
+                    pass
+                return False
+            if self.state != "dead" and self.state != "connected":
+                # Nothing was connected yet, acknowledge the close
+                send(self.cid, b"", CLOSE_CLIENT)
+            self.close()
+            return True
+
+    def feed(self, data):
+        with self.lock:
+            if self.state == "connected":
+                try:
+                    self.sock.sendall(data)
+                except socket.error:
+                    self.close()
+                    self.fail()
+                return
+            if self.state == "dead":
+                return
+            self.buf += data
+            if self.state == "greeting":
+                self.greeting()
+            if self.state == "request":
+                self.request()
+            if self.state == "socks4":
+                self.socks4()
+
+    def connect_reply(self, code):
+        if self.version == 4:
+            return b"\x00" + (b"\x5a" if code == 0 else b"\x5b") + b"\x00" * 6
+        return socks_reply(code)
+
+    def greeting(self):
+        if self.buf[:1] == b"\x04":
+            self.version = 4
+            self.state = "socks4"
+            return
+        if len(self.buf) < 2 or len(self.buf) < 2 + ord(self.buf[1:2]):
+            return
+        size = 2 + ord(self.buf[1:2])
+        methods, self.buf = self.buf[2:size], self.buf[size:]
+        if b"\x00" not in methods:
+            self.reply(b"\x05\xff")
+            self.fail()
+            return
+        self.reply(b"\x05\x00")
+        self.state = "request"
+
+    def request(self):
+        if len(self.buf) < 5:
+            return
+        command, atyp = ord(self.buf[1:2]), ord(self.buf[3:4])
+        if atyp == 1:
+            size = 4 + 4
+            host = socket.inet_ntoa(self.buf[4:8])
+        elif atyp == 3:
+            size = 5 + ord(self.buf[4:5])
+            host = self.buf[5:size].decode("idna")
+        elif atyp == 4:
+            size = 4 + 16
+            host = socket.inet_ntop(socket.AF_INET6, self.buf[4:20]) if len(self.buf) >= 20 else None
+        else:
+            self.reply(socks_reply(8))
+            self.fail()
+            return
+        if len(self.buf) < size + 2:
+            return
+        port = struct.unpack(">H", self.buf[size:size + 2])[0]
+        self.buf = self.buf[size + 2:]
+        if command != 1:
+            self.reply(socks_reply(7))
+            self.fail()
+            return
+        self.state = "connecting"
+        thread = threading.Thread(target=self.connect, args=(host, port))
+        thread.daemon = True
+        thread.start()
+
+    def socks4(self):
+        end = self.buf.find(b"\x00", 8)
+        if len(self.buf) < 9 or end < 0:
+            return
+        command, port, ip = ord(self.buf[1:2]), struct.unpack(">H", self.buf[2:4])[0], self.buf[4:8]
+        size = end + 1
+        if ip[:3] == b"\x00\x00\x00" and ip[3:4] != b"\x00":
+            end = self.buf.find(b"\x00", size)
+            if end < 0:
+                return
+            host = self.buf[size:end].decode("idna")
+            size = end + 1
+        else:
+            host = socket.inet_ntoa(ip)
+        self.buf = self.buf[size:]
+        if command != 1:
+            self.reply(self.connect_reply(7))
+            self.fail()
+            return
+        self.state = "connecting"
+        thread = threading.Thread(target=self.connect, args=(host, port))
+        thread.daemon = True
+        thread.start()
+
+    def connect(self, host, port):
+        try:
+            sock = socket.create_connection((host, port), 10)
+            sock.settimeout(None)
+        except socket.error as error:
+            code = 5 if getattr(error, "errno", None) == 111 else 4
+            with self.lock:
+                if self.state != "dead":
+                    self.reply(self.connect_reply(code))
+                    self.fail()
+            return
+        with self.lock:
+            if self.state == "dead":
+                sock.close()
+                return
+            self.sock = sock
+            self.reply(self.connect_reply(0))
+            self.state = "connected"
+            if self.buf:
+                try:
+                    sock.sendall(self.buf)
+                except socket.error:
+                    pass
+                self.buf = b""
+        flags = CLOSE_CLIENT
+        while True:
+            try:
+                data = sock.recv(frame_size[0])
+            except socket.error as error:
+                if getattr(error, "errno", None) == 104:
+                    flags = DEAD_CLIENT | RESET
+                data = b""
+            if not data:
+                break
+            with self.lock:
+                self.reply(data)
+        with self.lock:
+            if self.state != "connected":
+                return
+            send(self.cid, b"", flags)
+            self.read_closed = True
+            if not flags & DEAD_CLIENT and not self.write_closed:
+                # The other side can still send until it closes too
+                return
+            self.close()
+        if self.write_closed:
+            with clients_lock:
+                if clients.get(self.cid) is self:
+                    del clients[self.cid]
+
+
+def main():
+    in_seq = 0
+    while True:
+        try:
+            flags, seq, cseq, crc, size = HEADER.unpack(read_exact(HEADER.size))
+            cid = read_exact(size)
+            data = read_exact(struct.unpack(">I", read_exact(4))[0])
+        except EOFError:
+            break
+        corrupted = seq != in_seq or crc != checksum(seq, cseq, flags, cid, data)
+        in_seq = seq + 1
+        if flags & KEEP_ALIVE and not corrupted:
+            continue
+        if flags & SETUP and not corrupted:
+            setup = json.loads(data.decode("utf-8"))
+            os.environ.update(setup.get("Env") or {})
+            frame_size[0] = (setup.get("Options") or {}).get("FrameSize") or frame_size[0]
+            continue
+        if flags & CLOSE_CHANNEL and not corrupted:
+            break
+        with clients_lock:
+            client = clients.get(cid)
+            if client is None:
+                if flags & CLOSE_CLIENT:
+                    send(cid, b"", CLOSE_CLIENT)
+                if flags & (CLOSE_CLIENT | DEAD_CLIENT):
+                    continue
+                client = clients[cid] = Client(cid)
+            if flags & DEAD_CLIENT:
+                del clients[cid]
+        if corrupted:
+            with client.lock:
+                client.close()
+                client.fail()
+        elif flags & DEAD_CLIENT:
+            with client.lock:
+                client.close(flags & RESET)
+            # ACK for client termination
+            send(cid, b"", CLOSE_CLIENT)
+        elif flags & CLOSE_CLIENT:
+            if client.close_write():
+                with clients_lock:
+                    if clients.get(cid) is client:
+                        del clients[cid]
+        elif cseq == 0 or cseq > client.delivered:
+            client.delivered = max(client.delivered, cseq)
+            client.feed(data)
+
+
+main()
+`
+
+// errInterpreterRelayOnly is returned when the interpreter agent is used
+// with a relay-only build, which never sends an agent to the remote host
+var errInterpreterRelayOnly = errors.New("the interpreter agent is disabled in relay-only builds")
+
+// interpreterCommand returns the command starting interpreter so that it
+// reads the agent script from its standard input, without writing anything
+// to the remote disk.
+func interpreterCommand(interpreter string) string {
+	bootstrap := fmt.Sprintf(`import os;exec(b"".join(os.read(0,1) for _ in range(%d)))`, len(pythonAgentScript))
+	return fmt.Sprintf("%s -u -c %s", utils.EscapeBashArgument(interpreter), utils.EscapeBashArgument(bootstrap))
+}
+
+// sendInterpreterAgent writes the agent script to the remote interpreter.
+// It must be written before any channel frame.
+func (t *tunnel) sendInterpreterAgent() error {
+	if utils.RelayOnly {
+		return errInterpreterRelayOnly
+	}
+
+	_, err := t.Writer.Write([]byte(pythonAgentScript))
+	if err != nil {
+		return fmt.Errorf("Failed to send agent script: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorRule copies the traffic of the clients connecting to a destination
+// matching a host:port glob pattern to sink
+type mirrorRule struct {
+	pattern string
+	sink    *mirrorSink
+}
+
+// mirrorSink is a file, or a TCP port when target starts with "tcp:",
+// receiving the mirrored traffic as records of a header line followed by
+// the data
+type mirrorSink struct {
+	target string
+	lock   sync.Mutex
+	writer io.WriteCloser
+	failed bool
+}
+
+// parseMirrorRules parses rules like "*:6379=tcp:127.0.0.1:9000" or
+// "10.0.0.5=smtp.mirror", a destination pattern like the priority rules and
+// the sink of the matching clients
+func parseMirrorRules(specs []string) ([]mirrorRule, error) {
+	var rules []mirrorRule
+	sinks := make(map[string]*mirrorSink)
+
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("invalid mirror rule " + spec + ", expected pattern=file or pattern=tcp:host:port")
+		}
+
+		pattern := hostPortPattern(parts[0])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid mirror rule %s: %w", spec, err)
+		}
+
+		sink, prs := sinks[parts[1]]
+		if !prs {
+			sink = &mirrorSink{target: parts[1]}
+			sinks[parts[1]] = sink
+		}
+
+		rules = append(rules, mirrorRule{pattern: pattern, sink: sink})
+	}
+
+	return rules, nil
+}
+
+// record writes a record of data sent by client in direction, ">" to the
+// destination or "<" from it. The sink is opened on first use, and again
+// after a failure.
+func (s *mirrorSink) record(client, direction, destination string, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.writer == nil {
+		var err error
+		if strings.HasPrefix(s.target, "tcp:") {
+			s.writer, err = net.DialTimeout("tcp", strings.TrimPrefix(s.target, "tcp:"), 5*time.Second)
+		} else {
+			s.writer, err = os.OpenFile(utils.ArtifactPath(s.target), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		}
+		if err != nil {
+			s.writer = nil
+			s.fail("Failed to open mirror " + s.target + ": " + err.Error())
+			return
+		}
+	}
+
+	header := fmt.Sprintf("%s %s %s %s %d\n", time.Now().UTC().Format(time.RFC3339Nano), client, direction, destination, len(data))
+	record := append(append([]byte(header), data...), '\n')
+
+	if _, err := s.writer.Write(record); err != nil {
+		s.writer.Close()
+		s.writer = nil
+		s.fail("Failed to write mirror " + s.target + ": " + err.Error())
+		return
+	}
+
+	if s.failed {
+		utils.Logger.Notice("Mirror", s.target, "restored")
+		s.failed = false
+	}
+}
+
+// fail logs message the first time the sink fails, traffic is dropped until
+// it works again
+func (s *mirrorSink) fail(message string) {
+	if !s.failed {
+		utils.Logger.Error(message)
+		s.failed = true
+	}
+}
+
+// mirroringConn copies the data of a client past its SOCKS handshake to the
+// sink of the first mirror rule matching its destination
+type mirroringConn struct {
+	net.Conn
+	rules []mirrorRule
+
+	lock        sync.Mutex
+	client      *common.Client
+	destination string
+	sink        *mirrorSink
+	// CONNECT reply still to remove from the data sent to the client
+	reply     []byte
+	skipReply bool
+}
+
+func (c *mirroringConn) Read(data []byte) (int, error) {
+	c.lock.Lock()
+	sink, destination := c.sink, c.destination
+	c.lock.Unlock()
+
+	// The read giving the destination holds the SOCKS request, it is not
+	// mirrored as sink is still nil
+	n, err := c.Conn.Read(data)
+	if sink != nil && n > 0 {
+		sink.record(c.client.Id, ">", destination, data[:n])
+	}
+
+	return n, err
+}
+
+func (c *mirroringConn) Write(data []byte) (int, error) {
+	n, err := c.Conn.Write(data)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.sink == nil || n == 0 {
+		return n, err
+	}
+
+	mirrored := data[:n]
+	if c.skipReply {
+		c.reply = append(c.reply, mirrored...)
+
+		version := byte(5)
+		if c.reply[0] == 0 {
+			version = 4
+		}
+		size, _ := connectReplySize(version, c.reply)
+		if len(c.reply) < size {
+			return n, err
+		}
+
+		mirrored = c.reply[size:]
+		c.reply = nil
+		c.skipReply = false
+	}
+
+	if len(mirrored) > 0 {
+		c.sink.record(c.client.Id, "<", c.destination, mirrored)
+	}
+
+	return n, err
+}
+
+func (c *mirroringConn) CloseWrite() error {
+	return utils.CloseWrite(c.Conn)
+}
+
+func (c *mirroringConn) SetLinger(sec int) error {
+	return utils.SetLinger(c.Conn, sec)
+}
+
+// mirrorConn wraps conn to mirror its traffic when the tunnel has mirror
+// rules, the returned mirroringConn is nil otherwise
+func (t *tunnel) mirrorConn(conn net.Conn) (net.Conn, *mirroringConn) {
+	if len(t.mirrorRules) == 0 {
+		return conn, nil
+	}
+
+	mirror := &mirroringConn{Conn: conn, rules: t.mirrorRules}
+	return mirror, mirror
+}
+
+// mirrorDestination returns announce, also starting the mirroring of client
+// when its destination matches a mirror rule
+func (t *tunnel) mirrorDestination(mirror *mirroringConn, client *common.Client, announce func(destination string)) func(destination string) {
+	if mirror == nil {
+		return announce
+	}
+
+	mirror.client = client
+	return func(destination string) {
+		for _, rule := range mirror.rules {
+			if matched, _ := path.Match(rule.pattern, destination); matched && destination != "" {
+				mirror.lock.Lock()
+				mirror.destination = destination
+				mirror.sink = rule.sink
+				mirror.skipReply = true
+				mirror.lock.Unlock()
+
+				utils.Logger.Debug("Mirroring client", client.Id, "to", destination, "into", rule.sink.target)
+				break
+			}
+		}
+
+		if announce != nil {
+			announce(destination)
+		}
+	}
+}
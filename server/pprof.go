@@ -0,0 +1,63 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+)
+
+// servePprof serves the profiles of this process under /debug/pprof/ and
+// the ones of the agent, fetched through the channel, under
+// /agent/debug/pprof/.
+func (t *tunnel) servePprof(bindAddress string) {
+	ln, err := utils.Listen(bindAddress)
+	if err != nil {
+		utils.Logger.Error("Failed to bind profiling port " + err.Error())
+		return
+	}
+	defer ln.Close()
+
+	agentProxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: "agent"})
+	agentProxy.Transport = &http.Transport{
+		Dial:              t.dialPprof,
+		DisableKeepAlives: true,
+	}
+
+	mux := utils.PprofHandler()
+	mux.Handle("/agent/", http.StripPrefix("/agent", agentProxy))
+
+	utils.Logger.Notice("Profiling port bind at", ln.Addr().String())
+
+	err = http.Serve(ln, mux)
+	if err != nil {
+		utils.Logger.Error("Error in profiling port: ", err.Error())
+	}
+}
+
+// dialPprof opens a connection to the agent profiler through the channel
+func (t *tunnel) dialPprof(network, address string) (net.Conn, error) {
+	local, remote := net.Pipe()
+	id := fmt.Sprintf("%s%d", common.PprofClientPrefix, atomic.AddUint64(&t.pprofClients, 1))
+
+	t.addClientId(id, local, localOperator())
+	return remote, nil
+}
@@ -0,0 +1,125 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
+	"strconv"
+)
+
+// preambleArgs are the agent options making it write common.Preamble
+const preambleArgs = "--preamble"
+
+// noiseShown is how much of the output skipped before the preamble is shown
+const noiseShown = 256
+
+// preambleReader discards what the remote host sent before common.Preamble,
+// like a banner or a motd printed by the login shell, and passes the
+// channel through once it was found
+type preambleReader struct {
+	io.Reader
+
+	// noise is called once with the skipped output, the reader fails with
+	// its error if any
+	noise func(shown []byte, skipped int) error
+
+	synced  bool
+	pending []byte
+	shown   []byte
+	skipped int
+}
+
+func (r *preambleReader) Read(data []byte) (int, error) {
+	for !r.synced {
+		err := r.sync()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(r.pending) > 0 {
+		n := copy(data, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+
+	return r.Reader.Read(data)
+}
+
+// sync reads the output once more, looking for the preamble
+func (r *preambleReader) sync() error {
+	buffer := make([]byte, 4096)
+	n, err := r.Reader.Read(buffer)
+	r.pending = append(r.pending, buffer[:n]...)
+
+	if index := bytes.Index(r.pending, common.Preamble); index >= 0 {
+		r.skip(r.pending[:index])
+		r.pending = r.pending[index+len(common.Preamble):]
+		r.synced = true
+
+		if r.skipped > 0 && r.noise != nil {
+			return r.noise(r.shown, r.skipped)
+		}
+		return nil
+	}
+
+	// Keep what could be the start of the preamble
+	if keep := len(common.Preamble) - 1; len(r.pending) > keep {
+		r.skip(r.pending[:len(r.pending)-keep])
+		r.pending = r.pending[len(r.pending)-keep:]
+	}
+
+	return err
+}
+
+func (r *preambleReader) skip(data []byte) {
+	if missing := noiseShown - len(r.shown); missing > 0 {
+		if missing > len(data) {
+			missing = len(data)
+		}
+		r.shown = append(r.shown, data[:missing]...)
+	}
+	r.skipped += len(data)
+}
+
+// ChannelNoiseError is returned in strict channel mode when the remote host
+// sent something else than the channel. Output holds the first bytes of it.
+type ChannelNoiseError struct {
+	Skipped int
+	Output  []byte
+}
+
+func (e *ChannelNoiseError) Error() string {
+	return "Remote host sent " + strconv.Itoa(e.Skipped) + " bytes before the agent started: " +
+		strconv.Quote(string(e.Output))
+}
+
+// channelNoise handles the output skipped before the preamble: it is logged,
+// or in strict mode the session is closed and openTunnel fails with it
+func (t *tunnel) channelNoise(shown []byte, skipped int) error {
+	if !t.viper.GetBool("StrictChannel") {
+		utils.Logger.Warningf("Skipped %d bytes sent by the remote host before the agent started: %s",
+			skipped, strconv.Quote(string(shown)))
+		return nil
+	}
+
+	err := &ChannelNoiseError{Skipped: skipped, Output: shown}
+	t.failHandshake(err)
+	return fmt.Errorf("strict channel: %w", err)
+}
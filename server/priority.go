@@ -0,0 +1,240 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/events"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxSniffSize is how much of the beginning of a client stream is kept to
+// find its SOCKS destination
+const maxSniffSize = 1024
+
+// priorityRule gives the class of the clients accepted on a local address,
+// or connecting to a destination, matching a host:port glob pattern
+type priorityRule struct {
+	class   common.Priority
+	bind    bool
+	pattern string
+}
+
+// parsePriorityRules parses rules like "interactive=*:3389" matching the
+// SOCKS destination, or "bulk=bind:127.0.0.1:1081" matching the listener.
+// A host without port matches every port, a port alone every host.
+func parsePriorityRules(specs []string) ([]priorityRule, error) {
+	var rules []priorityRule
+
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.New("invalid priority rule " + spec + ", expected class=pattern")
+		}
+
+		class, err := common.ParsePriority(parts[0])
+		if err != nil {
+			return nil, err
+		}
+
+		rule := priorityRule{class: class, pattern: parts[1]}
+		if strings.HasPrefix(rule.pattern, "bind:") {
+			rule.bind = true
+			rule.pattern = strings.TrimPrefix(rule.pattern, "bind:")
+		}
+
+		rule.pattern = hostPortPattern(rule.pattern)
+
+		if _, err := path.Match(rule.pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid priority rule %s: %w", spec, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// hostPortPattern completes pattern into a host:port glob, a host without
+// port matching every port and a port alone every host
+func hostPortPattern(pattern string) string {
+	switch {
+	case strings.HasPrefix(pattern, ":"):
+		return "*" + pattern
+	case !strings.Contains(pattern, ":") || strings.HasSuffix(pattern, "]"):
+		return pattern + ":*"
+	}
+	return pattern
+}
+
+// classify returns the class of the first rule matching the local address
+// or the destination of a client, destination is empty until known
+func classify(rules []priorityRule, local, destination string) common.Priority {
+	for _, rule := range rules {
+		address := destination
+		if rule.bind {
+			address = local
+		}
+
+		if matched, _ := path.Match(rule.pattern, address); matched && address != "" {
+			return rule.class
+		}
+	}
+
+	return common.PriorityNormal
+}
+
+// socksDestination returns the host:port requested at the beginning of a
+// SOCKS4, SOCKS4a or SOCKS5 stream. complete is false while more data is
+// needed, destination is empty if the stream is not a SOCKS connect.
+func socksDestination(data []byte) (destination string, complete bool) {
+	if len(data) < 2 {
+		return "", false
+	}
+
+	switch data[0] {
+	case 4:
+		if len(data) < 9 {
+			return "", false
+		}
+		userEnd := bytes.IndexByte(data[8:], 0)
+		if userEnd < 0 {
+			return "", false
+		}
+
+		port := strconv.Itoa(int(binary.BigEndian.Uint16(data[2:4])))
+		ip := net.IP(data[4:8])
+		if ip[0] != 0 || ip[1] != 0 || ip[2] != 0 || ip[3] == 0 {
+			return net.JoinHostPort(ip.String(), port), true
+		}
+
+		host := data[8+userEnd+1:]
+		hostEnd := bytes.IndexByte(host, 0)
+		if hostEnd < 0 {
+			return "", false
+		}
+		return net.JoinHostPort(string(host[:hostEnd]), port), true
+
+	case 5:
+		// The request follows the greeting and its list of methods
+		if len(data) < 2+int(data[1]) {
+			return "", false
+		}
+		request := data[2+int(data[1]):]
+		if len(request) < 5 {
+			return "", len(data) >= maxSniffSize
+		}
+
+		var host string
+		var rest []byte
+		switch request[3] {
+		case 1:
+			if len(request) < 4+4+2 {
+				return "", false
+			}
+			host, rest = net.IP(request[4:8]).String(), request[8:]
+		case 3:
+			if len(request) < 5+int(request[4])+2 {
+				return "", false
+			}
+			host, rest = string(request[5:5+int(request[4])]), request[5+int(request[4]):]
+		case 4:
+			if len(request) < 4+16+2 {
+				return "", false
+			}
+			host, rest = net.IP(request[4:20]).String(), request[20:]
+		default:
+			return "", true
+		}
+
+		return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(rest)))), true
+	}
+
+	return "", true
+}
+
+// classifyingConn watches the beginning of a client stream for its SOCKS
+// destination and sets the class of the client from the priority rules
+type classifyingConn struct {
+	net.Conn
+	client *common.Client
+	rules  []priorityRule
+	sniff  []byte
+	done   bool
+	// announce, if not nil, is called with the destination once known
+	announce func(destination string)
+}
+
+func (c *classifyingConn) Read(data []byte) (int, error) {
+	n, err := c.Conn.Read(data)
+
+	if !c.done && n > 0 {
+		c.sniff = append(c.sniff, data[:n]...)
+
+		destination, complete := socksDestination(c.sniff)
+		if complete || len(c.sniff) >= maxSniffSize {
+			c.done = true
+			c.sniff = nil
+
+			if destination != "" && len(c.rules) > 0 {
+				class := classify(c.rules, c.LocalAddr().String(), destination)
+				c.client.SetPriority(class)
+				utils.Logger.Debug("Client", c.client.Id, "to", destination, "is", class.String())
+			}
+			if c.announce != nil {
+				c.announce(destination)
+			}
+		}
+	}
+
+	if !c.done && err != nil {
+		c.done = true
+		c.sniff = nil
+		if c.announce != nil {
+			c.announce("")
+		}
+	}
+
+	return n, err
+}
+
+func (c *classifyingConn) CloseWrite() error {
+	return utils.CloseWrite(c.Conn)
+}
+
+func (c *classifyingConn) SetLinger(sec int) error {
+	return utils.SetLinger(c.Conn, sec)
+}
+
+// classifyConn wraps conn so the class of its client follows the priority
+// rules of the tunnel, and its destination is published to the events
+// subscribers, tagged with GeoIP, checked against the scope and mirrored.
+// The client and announce must be set before reading.
+func (t *tunnel) classifyConn(conn net.Conn) (net.Conn, *classifyingConn) {
+	if len(t.priorityRules) == 0 && !events.Active() && len(t.geoip) == 0 && t.scope == nil && len(t.mirrorRules) == 0 {
+		return conn, nil
+	}
+
+	classifier := &classifyingConn{Conn: conn, rules: t.priorityRules}
+	return classifier, classifier
+}
@@ -0,0 +1,86 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// probeChannel sends a ping every interval, which the agent answers with its
+// hello, to detect a channel still open where data
+// does not make round trips anymore. After failures probes in a row without
+// an answer within interval, heal is called.
+func (t *tunnel) probeChannel(interval time.Duration, failures int, heal func()) {
+	if interval <= 0 || t.viper.GetBool("AttachAgent") || t.viper.GetString("AgentInterpreter") != "" {
+		return
+	}
+
+	// Agents older than protocol versioning never answer
+	<-t.hello
+
+	if hello, ok := t.agentHello.Load().(common.AgentHello); !ok || hello.Protocol < 3 {
+		utils.Logger.Info("Agent does not answer pings, the channel is not probed")
+		return
+	}
+
+	missed := 0
+	for t.ChannelOpen {
+		time.Sleep(interval)
+		if !t.ChannelOpen {
+			return
+		}
+
+		answers := atomic.LoadInt32(&t.helloCount)
+		probe := common.NewPingMessage()
+		probe.Priority = common.PriorityInteractive
+		t.OutQueue.Push(probe)
+
+		if t.waitHello(answers, interval) {
+			if missed > 0 {
+				utils.Logger.Notice("Agent answers again after", missed, "missed probes")
+			}
+			missed = 0
+			continue
+		}
+
+		missed++
+		utils.Logger.Warningf("Agent did not answer probe within %s (%d/%d)", interval, missed, failures)
+
+		if missed >= failures {
+			utils.Logger.Error("Channel is wedged, no data made a round trip for " + (time.Duration(missed) * interval).String() +
+				": opening a new session")
+			audit.Record("tunnel_wedged", map[string]string{"tunnel": t.getName(), "missed_probes": strconv.Itoa(missed)})
+			heal()
+			return
+		}
+	}
+}
+
+// waitHello waits up to timeout for more than answers agent hellos
+func (t *tunnel) waitHello(answers int32, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt32(&t.helloCount) > answers {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"runtime"
+	"strings"
+)
+
+func (t *tunnel) remoteCommandSucceeds(command string) bool {
+	session, err := t.sshClient.NewSession()
+	if err != nil {
+		return false
+	}
+	defer session.Close()
+
+	return session.Run(t.shellCommand(command)) == nil
+}
+
+func (t *tunnel) remoteOutput(command string) (string, error) {
+	session, err := t.sshClient.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("Failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	output, err := session.CombinedOutput(t.shellCommand(command))
+	return strings.TrimSpace(string(output)), err
+}
+
+// remoteDiagnosticScript prints the remote host properties that commonly
+// prevent the agent from being executed, one key=value per line.
+const remoteDiagnosticScript = `cd %s || exit 1
+echo "os=$(uname -s 2>/dev/null)"
+echo "arch=` + remoteArchScript + `"
+echo "selinux=$(getenforce 2>/dev/null)"
+echo "apparmor=$(cat /proc/self/attr/apparmor/current 2>/dev/null || { [ -d /sys/module/apparmor ] && cat /proc/self/attr/current 2>/dev/null; })"
+echo "apparmor_denied=$(dmesg 2>/dev/null | grep 'apparmor="DENIED"' | tail -n 1)"
+mountpoint=$(df -P . 2>/dev/null | awk 'NR==2 {print $6}')
+echo "mountpoint=$mountpoint"
+echo "mountopts=$({ cat /proc/mounts /etc/mnttab 2>/dev/null | awk -v mp="$mountpoint" '$2 == mp {print $4}'; mount 2>/dev/null | awk -v mp="$mountpoint" '$2 == "on" && $3 == mp && /\(/ {sub(/.*\(/, ""); sub(/\).*/, ""); gsub(/, /, ","); print}'; } | tail -n 1)"
+`
+
+// remoteArchScript prints the CPU architecture of the remote host. uname -m
+// is the machine class on Solaris, isainfo gives the instruction set.
+const remoteArchScript = `$( [ "$(uname -s 2>/dev/null)" = SunOS ] && isainfo -k 2>/dev/null || uname -m 2>/dev/null)`
+
+// unameOS returns the GOOS of the uname -s output of a remote host
+func unameOS(name string) string {
+	goos := strings.ToLower(name)
+	if goos == "sunos" {
+		// The Solaris agent runs on illumos too
+		return "solaris"
+	}
+	return goos
+}
+
+var unameArch = map[string]string{
+	"x86_64":    "amd64",
+	"amd64":     "amd64",
+	"i386":      "386",
+	"i86pc":     "amd64",
+	"i686":      "386",
+	"aarch64":   "arm64",
+	"arm64":     "arm64",
+	"armv5l":    "arm",
+	"armv5tel":  "arm",
+	"armv5tejl": "arm",
+	"armv6l":    "arm",
+	"armv7l":    "arm",
+	"armv7":     "arm",
+	"mips":      "mips",
+	"mips64":    "mips64",
+}
+
+func parseDiagnostics(output string) map[string]string {
+	result := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		tokens := strings.SplitN(line, "=", 2)
+		if len(tokens) == 2 {
+			result[tokens[0]] = strings.TrimSpace(tokens[1])
+		}
+	}
+	return result
+}
+
+// diagnoseExecFailure inspects the remote host and returns hints explaining
+// why a binary in remoteAgentPath cannot be executed.
+func (t *tunnel) diagnoseExecFailure(remoteAgentPath string) []string {
+	var hints []string
+
+	output, _ := t.remoteOutput(fmt.Sprintf(remoteDiagnosticScript, quoteRemotePath(remoteAgentPath)))
+	diagnostics := parseDiagnostics(output)
+
+	if remoteOS := unameOS(diagnostics["os"]); remoteOS != "" && remoteOS != runtime.GOOS {
+		hints = append(hints, fmt.Sprintf("The agent is built for %s but the remote host runs %s. Use --remote_executable with a binary built for the remote platform.", runtime.GOOS, diagnostics["os"]))
+	}
+
+	if arch, ok := unameArch[diagnostics["arch"]]; ok && arch != runtime.GOARCH {
+		hints = append(hints, fmt.Sprintf("The agent is built for %s but the remote CPU is %s. Use --remote_executable with a binary built for GOARCH=%s.", runtime.GOARCH, diagnostics["arch"], arch))
+	}
+
+	for _, option := range strings.Split(diagnostics["mountopts"], ",") {
+		if option == "noexec" {
+			hints = append(hints, fmt.Sprintf("%s is mounted noexec. Use --remote_agent_path on a filesystem allowing execution (home directory, or /dev/shm when it is not noexec).", diagnostics["mountpoint"]))
+		}
+	}
+
+	if strings.EqualFold(diagnostics["selinux"], "Enforcing") {
+		hints = append(hints, "SELinux is enforcing and may deny execution from this directory (e.g. tmp_t contexts). Try a directory in the home of the user.")
+	}
+
+	if profile := diagnostics["apparmor"]; profile != "" && !strings.HasPrefix(profile, "unconfined") {
+		hints = append(hints, "The session is confined by the AppArmor profile "+profile+", which may deny executing new binaries.")
+	}
+
+	if denied := diagnostics["apparmor_denied"]; denied != "" {
+		hints = append(hints, "Last AppArmor denial: "+denied)
+	}
+
+	if len(hints) == 0 {
+		hints = append(hints, "No obvious cause found, check the agent path permissions and free space on the remote host.")
+	}
+
+	return hints
+}
+
+// agentCheckCommand returns the command checking the agent can be run
+func (t *tunnel) agentCheckCommand(remoteAgentPath string) string {
+	if utils.RelayOnly {
+		return fmt.Sprintf("cd %s && %s version", quoteRemotePath(remoteAgentPath), t.getRemoteAgentCommand())
+	}
+	return t.quotedAgentPath(remoteAgentPath) + " version"
+}
+
+// checkAgentExecutable makes sure the agent in remoteAgentPath can be run and
+// explains why otherwise.
+func (t *tunnel) checkAgentExecutable(remoteAgentPath string) error {
+	output, err := t.remoteOutput(t.agentCheckCommand(remoteAgentPath))
+	if err == nil {
+		return nil
+	}
+
+	message := "Agent cannot be executed on remote host: " + err.Error()
+	if output != "" {
+		message += " (" + output + ")"
+	}
+
+	for _, hint := range t.diagnoseExecFailure(remoteAgentPath) {
+		message += "\n  - " + hint
+	}
+
+	return errors.New(message)
+}
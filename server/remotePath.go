@@ -0,0 +1,66 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// quoteRemotePath quotes a remote path for the POSIX commands run on the
+// remote host. A leading ~ is left out of the quotes so the shell still
+// expands it, and a leading - is made relative so it is not taken for an
+// option.
+func quoteRemotePath(remotePath string) string {
+	switch {
+	case remotePath == "~":
+		return "~"
+	case strings.HasPrefix(remotePath, "~/"):
+		return "~/" + utils.EscapeBashArgument(remotePath[2:])
+	case strings.HasPrefix(remotePath, "-"):
+		return utils.EscapeBashArgument("./" + remotePath)
+	default:
+		return utils.EscapeBashArgument(remotePath)
+	}
+}
+
+// sftpRemotePath returns the remote path for the SFTP server, which does
+// not expand ~ but resolves relative paths from the home directory
+func sftpRemotePath(remotePath string) string {
+	switch {
+	case remotePath == "~":
+		return "."
+	case strings.HasPrefix(remotePath, "~/"):
+		return "./" + remotePath[2:]
+	default:
+		return remotePath
+	}
+}
+
+// checkRemotePath returns an error for a remote path the remote commands
+// cannot carry: csh and fish do not accept newlines and other control
+// characters inside quotes. Spaces, quotes and any other UTF-8 character
+// are quoted.
+func checkRemotePath(remotePath string) error {
+	for _, char := range remotePath {
+		if unicode.IsControl(char) {
+			return errors.New("Remote agent path " + strconv.Quote(remotePath) + " contains a control character")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+)
+
+// remotePaths are agent paths with characters the remote commands must
+// quote, and the directory they stand for relative to the home directory
+var remotePaths = []struct {
+	path     string
+	fromHome string
+}{
+	{"agent dir", "agent dir"},
+	{"it's", "it's"},
+	{`say "hi"`, `say "hi"`},
+	{`back\slash`, `back\slash`},
+	{"$HOME", "$HOME"},
+	{"dossier-été/日本", "dossier-été/日本"},
+	{"~", ""},
+	{"~/x", "x"},
+	{"~/x y", "x y"},
+	{"-dash", "-dash"},
+}
+
+func TestQuoteRemotePath(t *testing.T) {
+	tests := []struct {
+		path   string
+		quoted string
+	}{
+		{"agent dir", `'agent dir'`},
+		{"it's", `'it'\''s'`},
+		{`say "hi"`, `'say "hi"'`},
+		{"dossier-été/日本", `'dossier-été/日本'`},
+		{"~", `~`},
+		{"~/x", `~/'x'`},
+		{"~user", `'~user'`},
+		{"-dash", `'./-dash'`},
+		{"/tmp/-dash", `'/tmp/-dash'`},
+	}
+
+	for _, test := range tests {
+		if quoted := quoteRemotePath(test.path); quoted != test.quoted {
+			t.Errorf("quoteRemotePath(%q) = %s, want %s", test.path, quoted, test.quoted)
+		}
+	}
+}
+
+func TestSftpRemotePath(t *testing.T) {
+	tests := []struct {
+		path     string
+		sftpPath string
+	}{
+		{"agent dir", "agent dir"},
+		{"it's", "it's"},
+		{"~", "."},
+		{"~/x", "./x"},
+		{"~/x y", "./x y"},
+		{"-dash", "-dash"},
+		{"/tmp/~", "/tmp/~"},
+	}
+
+	for _, test := range tests {
+		if sftpPath := sftpRemotePath(test.path); sftpPath != test.sftpPath {
+			t.Errorf("sftpRemotePath(%q) = %q, want %q", test.path, sftpPath, test.sftpPath)
+		}
+	}
+}
+
+// loginShellArgument emulates the login shell of family reading the single
+// argument of the sh -c command shellCommand returns for it
+func loginShellArgument(family string, argument string) string {
+	var result []rune
+	quoted := false
+	chars := []rune(argument)
+
+	for i := 0; i < len(chars); i++ {
+		char := chars[i]
+		switch {
+		case char == '\'':
+			quoted = !quoted
+		case char == '\\' && !quoted && i+1 < len(chars):
+			i++
+			result = append(result, chars[i])
+		case char == '\\' && quoted && i+1 < len(chars) && family == shellCsh && chars[i+1] == '\n':
+			i++
+			result = append(result, '\n')
+		case char == '\\' && quoted && i+1 < len(chars) && family == shellFish && (chars[i+1] == '\\' || chars[i+1] == '\''):
+			i++
+			result = append(result, chars[i])
+		default:
+			result = append(result, char)
+		}
+	}
+
+	return string(result)
+}
+
+// runRemote runs command like the login shell of family would in home
+func runRemote(t *testing.T, family string, home string, command string, stdin string) string {
+	t.Helper()
+
+	if family != shellPosix {
+		if !strings.HasPrefix(command, "sh -c ") {
+			t.Fatalf("%s command is not wrapped in sh -c: %s", family, command)
+		}
+		command = loginShellArgument(family, strings.TrimPrefix(command, "sh -c "))
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = home
+	cmd.Env = []string{"HOME=" + home, "PATH=" + os.Getenv("PATH")}
+	cmd.Stdin = strings.NewReader(stdin)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s command failed: %s: %s\n%s", family, err, output, command)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// fakeAgent is uploaded as the agent, it prints the command line it is given
+const fakeAgent = "#!/bin/sh\necho agent \"$@\"\n"
+
+func TestRemoteCommandsQuoting(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the remote commands need a POSIX shell")
+	}
+	if utils.RelayOnly {
+		t.Skip("relay-only builds do not upload the agent")
+	}
+
+	for _, family := range []string{shellPosix, shellCsh, shellFish} {
+		for _, remotePath := range remotePaths {
+			family, remotePath := family, remotePath
+			t.Run(family+"/"+remotePath.path, func(t *testing.T) {
+				t.Parallel()
+
+				home, err := ioutil.TempDir("", "sasshimi-home-")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(home)
+
+				home, err = filepath.EvalSymlinks(home)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				directory := filepath.Join(home, remotePath.fromHome)
+				if err := os.MkdirAll(directory, 0700); err != nil {
+					t.Fatal(err)
+				}
+				agentFile := filepath.Join(directory, ".daemon")
+
+				tun := &tunnel{
+					viper:  viper.New(),
+					remote: &remoteEnv{shell: family, family: family},
+				}
+
+				command, err := tun.uploadCommand(remotePath.path, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				runRemote(t, family, home, tun.shellCommand(command), fakeAgent)
+				if _, err := os.Stat(agentFile); err != nil {
+					t.Fatalf("agent not uploaded to %s: %s", agentFile, err)
+				}
+
+				output := runRemote(t, family, home, tun.shellCommand(tun.agentCheckCommand(remotePath.path)), "")
+				if output != "agent version" {
+					t.Errorf("check by relative path printed %q", output)
+				}
+
+				// Once resolved, the agent is run by its absolute path
+				tun.agentPath = agentFile
+				output = runRemote(t, family, home, tun.shellCommand(tun.agentCheckCommand(remotePath.path)), "")
+				if output != "agent version" {
+					t.Errorf("check by absolute path printed %q", output)
+				}
+
+				output = runRemote(t, family, home, tun.shellCommand(tun.agentRunCommand(remotePath.path, "agent", "--preamble")), "")
+				if output != "agent agent --preamble" {
+					t.Errorf("run printed %q", output)
+				}
+
+				output = runRemote(t, family, home, tun.shellCommand(tun.teardownCommand(remotePath.path)), "")
+				result := parseTeardown(remotePath.path, output)
+				if len(result.Removed) != 1 || result.Removed[0] != agentFile {
+					t.Errorf("teardown removed %v, want %s", result.Removed, agentFile)
+				}
+				if _, err := os.Stat(agentFile); !os.IsNotExist(err) {
+					t.Errorf("agent left after teardown: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestTeardownKillsAgent(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the agent processes are found in /proc")
+	}
+
+	tests := []struct {
+		name   string
+		script string
+		killed []string
+	}{
+		{"stopped", "while :; do sleep 0.1; done", []string{"%d"}},
+		{"ignoring SIGTERM", `trap "" TERM; while :; do sleep 0.1; done`, []string{"%d", "%d (SIGKILL)"}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			home, err := ioutil.TempDir("", "sasshimi-home-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(home)
+
+			directory := filepath.Join(home, "agent dir")
+			if err := os.MkdirAll(directory, 0700); err != nil {
+				t.Fatal(err)
+			}
+
+			// The agent is found by its executable, a copy of the shell
+			agentFile := filepath.Join(directory, ".daemon")
+			if err := exec.Command("cp", "/bin/sh", agentFile).Run(); err != nil {
+				t.Fatal(err)
+			}
+			agentProcess := exec.Command(agentFile, "-c", test.script)
+			if err := agentProcess.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer agentProcess.Wait()
+			defer agentProcess.Process.Kill()
+
+			// Let the shell set its trap
+			time.Sleep(200 * time.Millisecond)
+
+			tun := &tunnel{viper: viper.New(), remote: &remoteEnv{shell: "sh", family: shellPosix}}
+			output := runRemote(t, shellPosix, home, tun.shellCommand(tun.teardownCommand("agent dir")), "")
+			result := parseTeardown("agent dir", output)
+
+			var killed []string
+			for _, pid := range test.killed {
+				killed = append(killed, fmt.Sprintf(pid, agentProcess.Process.Pid))
+			}
+			if strings.Join(result.Killed, ",") != strings.Join(killed, ",") {
+				t.Errorf("teardown killed %v, want %v", result.Killed, killed)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"path"
+	"strings"
+)
+
+const (
+	shellPosix = "posix"
+	shellCsh   = "csh"
+	shellFish  = "fish"
+)
+
+// remoteEnv describes the remote account environment, so the commands sent
+// to the remote host can be adapted to it.
+type remoteEnv struct {
+	os      string
+	arch    string
+	shell   string
+	family  string
+	busyBox bool
+	tools   map[string]bool
+
+	// littleEndian is read from the ELF header of /bin/sh, uname -m does
+	// not tell it for MIPS
+	littleEndian bool
+
+	// restricted is set for shells refusing the usual command pipelines
+	restricted bool
+
+	// path lists the PATH directories of a restricted shell, the only place
+	// it runs commands from. It is nil when the shell did not tell it.
+	path []string
+}
+
+var restrictedShells = map[string]bool{
+	"rbash":     true,
+	"git-shell": true,
+	"rssh":      true,
+	"scponly":   true,
+	"lshell":    true,
+}
+
+// remoteProbeScript lists the tools used by the remote commands. It must be
+// run through a POSIX shell.
+const remoteProbeScript = `uname -s 2>/dev/null
+ls --help 2>&1 | head -n 1
+echo "arch=` + remoteArchScript + `"
+echo "endian=$(dd if=/bin/sh bs=1 skip=5 count=1 2>/dev/null | od -An -tx1 | tr -d ' ')"
+for tool in cat dd chmod rm gzip zstd env; do command -v $tool >/dev/null 2>&1 && echo "has=$tool"; done`
+
+func shellFamily(shell string) string {
+	switch shell {
+	case "csh", "tcsh":
+		return shellCsh
+	case "fish":
+		return shellFish
+	default:
+		return shellPosix
+	}
+}
+
+// detectRemoteEnv finds out the login shell, the OS and the available tools
+// of the remote account. "echo $SHELL" is understood by every supported shell.
+func (t *tunnel) detectRemoteEnv() error {
+	output, err := t.remoteOutput("echo $SHELL")
+	if err != nil {
+		utils.Logger.Warning("Failed to detect remote shell, assuming it is restricted: ", err.Error())
+		t.remote = &remoteEnv{restricted: true}
+		return nil
+	}
+
+	if strings.HasPrefix(output, "$SHELL") || strings.HasPrefix(output, "%") {
+		return errors.New("Unsupported remote shell, a POSIX, csh or fish compatible shell is required")
+	}
+
+	env := &remoteEnv{
+		shell: path.Base(output),
+		tools: make(map[string]bool),
+	}
+	env.family = shellFamily(env.shell)
+	env.restricted = restrictedShells[env.shell]
+	t.remote = env
+
+	if env.restricted {
+		utils.Logger.Warningf("Remote shell %s is restricted", env.shell)
+		if output, err := t.remoteOutput("echo $PATH"); err == nil && output != "" {
+			env.path = strings.Split(output, ":")
+		}
+		return nil
+	}
+
+	output, err = t.remoteOutput(remoteProbeScript)
+	if err != nil {
+		utils.Logger.Warning("Failed to probe remote host: ", err.Error())
+	}
+
+	lines := strings.Split(output, "\n")
+	if len(lines) > 0 {
+		env.os = strings.TrimSpace(lines[0])
+	}
+
+	for _, line := range lines[1:] {
+		if strings.Contains(line, "BusyBox") {
+			env.busyBox = true
+		}
+		if strings.HasPrefix(line, "arch=") {
+			env.arch = strings.TrimSpace(strings.TrimPrefix(line, "arch="))
+		}
+		if strings.HasPrefix(line, "endian=") {
+			env.littleEndian = strings.TrimSpace(strings.TrimPrefix(line, "endian=")) == "01"
+		}
+		if strings.HasPrefix(line, "has=") {
+			env.tools[strings.TrimPrefix(line, "has=")] = true
+		}
+	}
+
+	utils.Logger.Debugf("Remote environment: os=%s arch=%s little_endian=%t shell=%s busybox=%t", env.os, env.arch, env.littleEndian, env.shell, env.busyBox)
+	return nil
+}
+
+func (e *remoteEnv) posixShell() string {
+	// Solaris /bin/sh is a Bourne shell without $(...) support
+	if e.os == "SunOS" {
+		return "/usr/xpg4/bin/sh"
+	}
+	return "sh"
+}
+
+// onPath tells if directory is one of the PATH directories of the shell
+func (e *remoteEnv) onPath(directory string) bool {
+	for _, entry := range e.path {
+		if entry != "" && path.Clean(entry) == path.Clean(directory) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *remoteEnv) hasTool(tool string) bool {
+	// Assume everything is available when the probe failed
+	return len(e.tools) == 0 || e.tools[tool]
+}
+
+// cleanEnvironment starts a command with only these variables of the login
+// shell, leaving out what its rc files exported. The shells the remote
+// commands are wrapped in are not interactive and read no rc file.
+const cleanEnvironment = `env -i PATH="$PATH" SSH_AUTH_SOCK="$SSH_AUTH_SOCK" `
+
+// envPrefix returns the prefix running an agent command with a minimal
+// environment, or nothing when the remote environment is kept
+func (t *tunnel) envPrefix() string {
+	if t.viper.GetBool("KeepRemoteEnv") {
+		return ""
+	}
+	if t.remote != nil && (t.remote.restricted || !t.remote.hasTool("env")) {
+		return ""
+	}
+	return cleanEnvironment
+}
+
+// execPrefix returns the prefix replacing the shell by the command it runs,
+// removing a process between sshd and the agent. Restricted shells refuse
+// the exec builtin.
+func (t *tunnel) execPrefix() string {
+	if t.remote != nil && t.remote.restricted {
+		return ""
+	}
+	return "exec "
+}
+
+// shellCommand adapts a POSIX command line to the remote login shell.
+func (t *tunnel) shellCommand(command string) string {
+	env := t.remote
+	if env == nil || env.restricted {
+		return command
+	}
+
+	switch {
+	case env.family == shellCsh:
+		// csh only accepts newlines inside quotes when preceded by a
+		// backslash, joining the lines with ; breaks compound commands
+		command = utils.EscapeBashArgument(strings.TrimSpace(command))
+		return env.posixShell() + " -c " + strings.Replace(command, "\n", "\\\n", -1)
+	case env.family == shellFish:
+		// fish handles backslash escapes inside single quotes
+		command = strings.Replace(command, "\\", "\\\\", -1)
+		return env.posixShell() + " -c " + utils.EscapeBashArgument(command)
+	case env.os == "SunOS" && env.shell == "sh":
+		return env.posixShell() + " -c " + utils.EscapeBashArgument(command)
+	default:
+		return command
+	}
+}
+
+// uploadCommand returns the command storing stdin as the agent binary,
+// decompressing it first when compression is not empty
+func (t *tunnel) uploadCommand(remoteAgentPath string, compression string) (string, error) {
+	writeCommand := "cat > ./.daemon"
+	if decompress := decompressCommands[compression]; decompress != "" {
+		writeCommand = decompress + " > ./.daemon"
+	}
+
+	if t.remote != nil {
+		if !t.remote.hasTool("cat") {
+			if !t.remote.hasTool("dd") {
+				return "", errors.New("Neither cat nor dd are available on the remote host")
+			}
+			writeCommand = "dd of=./.daemon bs=4096 2>/dev/null"
+			if decompress := decompressCommands[compression]; decompress != "" {
+				writeCommand = decompress + " | " + writeCommand
+			}
+		}
+		if !t.remote.hasTool("chmod") {
+			return "", errors.New("chmod is not available on the remote host")
+		}
+	}
+
+	return "cd " + quoteRemotePath(remoteAgentPath) + " && " + writeCommand + " && chmod +x ./.daemon", nil
+}
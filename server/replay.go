@@ -0,0 +1,214 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MirrorRecord is a chunk of traffic written to a mirror file
+type MirrorRecord struct {
+	Time        time.Time
+	Client      string
+	Direction   string
+	Destination string
+	Data        []byte
+}
+
+// ReplaySession is the traffic of a client found in a mirror file
+type ReplaySession struct {
+	Client      string
+	Destination string
+	Records     []MirrorRecord
+}
+
+// ReadMirror reads the records of a mirror file
+func ReadMirror(reader io.Reader) ([]MirrorRecord, error) {
+	var records []MirrorRecord
+	input := bufio.NewReader(reader)
+
+	for {
+		header, err := input.ReadString('\n')
+		if err == io.EOF && header == "" {
+			return records, nil
+		}
+		if err != nil {
+			return records, errors.New("truncated mirror record header")
+		}
+
+		// The client id may hold spaces, the other fields do not
+		fields := strings.Fields(header)
+		if len(fields) < 5 {
+			return records, errors.New("invalid mirror record header " + strings.TrimSpace(header))
+		}
+		last := len(fields) - 3
+
+		recordTime, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return records, fmt.Errorf("invalid mirror record time: %w", err)
+		}
+		size, err := strconv.Atoi(fields[last+2])
+		if err != nil || size < 0 {
+			return records, errors.New("invalid mirror record size " + fields[last+2])
+		}
+
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(input, data); err != nil {
+			return records, errors.New("truncated mirror record data")
+		}
+
+		records = append(records, MirrorRecord{
+			Time:        recordTime,
+			Client:      strings.Join(fields[1:last], " "),
+			Direction:   fields[last],
+			Destination: fields[last+1],
+			Data:        data[:size],
+		})
+	}
+}
+
+// ReplaySessions groups records by client, in the order the clients appear
+func ReplaySessions(records []MirrorRecord) []*ReplaySession {
+	var sessions []*ReplaySession
+	byClient := make(map[string]*ReplaySession)
+
+	for _, record := range records {
+		session, prs := byClient[record.Client]
+		if !prs {
+			session = &ReplaySession{Client: record.Client, Destination: record.Destination}
+			byClient[record.Client] = session
+			sessions = append(sessions, session)
+		}
+		session.Records = append(session.Records, record)
+	}
+
+	return sessions
+}
+
+// Replay sends again the data the client of session sent to its destination
+// through the SOCKS proxy at proxyAddress, and writes what the destination
+// answers to output. Before each chunk, it waits for as much data as was
+// received before it in the session, or for wait without new data. It
+// returns once the destination closed the connection or stayed silent for
+// wait after the last chunk.
+func Replay(proxyAddress string, session *ReplaySession, output io.Writer, wait time.Duration) error {
+	dialer, err := proxy.SOCKS5("tcp", proxyAddress, nil, proxy.Direct)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialer.Dial("tcp", session.Destination)
+	if err != nil {
+		return fmt.Errorf("failed to connect %s: %w", session.Destination, err)
+	}
+	defer conn.Close()
+
+	var lock sync.Mutex
+	var received int
+	var readErr error
+	var closing bool
+	progress := make(chan struct{}, 1)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := conn.Read(buffer)
+			if n > 0 {
+				output.Write(buffer[:n])
+				lock.Lock()
+				received += n
+				lock.Unlock()
+				select {
+				case progress <- struct{}{}:
+				default:
+				}
+			}
+			if err != nil {
+				lock.Lock()
+				if err != io.EOF && !closing {
+					readErr = err
+				}
+				lock.Unlock()
+				return
+			}
+		}
+	}()
+
+	// awaitData waits until expected bytes were received, the connection
+	// closed or no data arrived for wait
+	awaitData := func(expected int) bool {
+		for {
+			lock.Lock()
+			enough := received >= expected
+			lock.Unlock()
+			if enough {
+				return true
+			}
+
+			select {
+			case <-progress:
+			case <-done:
+				return false
+			case <-time.After(wait):
+				return true
+			}
+		}
+	}
+
+	expected := 0
+	for _, record := range session.Records {
+		if record.Direction == "<" {
+			expected += len(record.Data)
+			continue
+		}
+
+		if !awaitData(expected) {
+			break
+		}
+		if _, err := conn.Write(record.Data); err != nil {
+			return fmt.Errorf("failed to send to %s: %w", session.Destination, err)
+		}
+	}
+
+	// Wait for the answer to the last chunk
+	for waiting := true; waiting; {
+		select {
+		case <-progress:
+		case <-done:
+			waiting = false
+		case <-time.After(wait):
+			waiting = false
+		}
+	}
+
+	lock.Lock()
+	closing = true
+	lock.Unlock()
+
+	conn.Close()
+	<-done
+
+	return readErr
+}
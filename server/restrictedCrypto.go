@@ -0,0 +1,86 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+)
+
+// FIPS approved algorithms, used when RestrictedCrypto is enabled.
+var (
+	restrictedCiphers = []string{
+		"aes128-gcm@openssh.com",
+		"aes256-ctr", "aes192-ctr", "aes128-ctr",
+	}
+	restrictedKeyExchanges = []string{
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256",
+	}
+	restrictedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256",
+	}
+	restrictedHostKeyAlgorithms = []string{
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+	}
+)
+
+func applyRestrictedCrypto(config *ssh.ClientConfig) {
+	config.Ciphers = restrictedCiphers
+	config.KeyExchanges = restrictedKeyExchanges
+	config.MACs = restrictedMACs
+	config.HostKeyAlgorithms = restrictedHostKeyAlgorithms
+}
+
+// restrictedSigner refuses to produce signatures with non approved algorithms
+// (ssh-ed25519, SHA-1 based ssh-rsa) so authentication fails instead of
+// silently downgrading.
+type restrictedSigner struct {
+	ssh.AlgorithmSigner
+}
+
+func (s restrictedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s restrictedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if algorithm == "" {
+		algorithm = s.PublicKey().Type()
+	}
+
+	for _, allowed := range restrictedHostKeyAlgorithms {
+		if algorithm == allowed {
+			return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+		}
+	}
+
+	return nil, errors.New("signature algorithm " + algorithm + " is not allowed in restricted crypto mode")
+}
+
+func restrictSigner(signer ssh.Signer) (ssh.Signer, error) {
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, errors.New("private key type " + signer.PublicKey().Type() + " is not allowed in restricted crypto mode")
+	}
+
+	switch signer.PublicKey().Type() {
+	case ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return restrictedSigner{algorithmSigner}, nil
+	default:
+		return nil, errors.New("private key type " + signer.PublicKey().Type() + " is not allowed in restricted crypto mode")
+	}
+}
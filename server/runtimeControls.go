@@ -0,0 +1,89 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"os"
+	"runtime/pprof"
+	"sort"
+)
+
+// ReloadConfig reads the configuration file again and returns the tunnel
+// configuration, as built on startup. It is set by the command starting
+// the tunnel, SIGHUP only reloads the configuration when it is.
+var ReloadConfig func() *viper.Viper
+
+// runtimeControls returns the actions of the runtime control signals
+func (t *tunnel) runtimeControls(verboseLevel int) utils.RuntimeControls {
+	controls := utils.RuntimeControls{DumpState: t.dumpState}
+	if ReloadConfig != nil {
+		controls.Reload = func() { t.reload(verboseLevel) }
+	}
+	return controls
+}
+
+// dumpState logs the tunnel state, its clients and the stacks of the
+// goroutines of this process
+func (t *tunnel) dumpState() {
+	var state bytes.Buffer
+
+	state.WriteString(t.healthLine())
+
+	t.ClientsLock.Lock()
+	ids := make([]string, 0, len(t.Clients))
+	for id := range t.Clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		client := t.Clients[id]
+		sent, received := client.Traffic()
+		fmt.Fprintf(&state, "client %s operator=%s sent=%d received=%d\n", id, client.Operator, sent, received)
+	}
+	t.ClientsLock.Unlock()
+
+	utils.Logger.Notice("Tunnel state:\n" + state.String())
+
+	pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
+}
+
+// reload applies the options of the configuration file that can change
+// while the tunnel is open: the agent options and environment, sent to the
+// agent, and the coalesce delay
+func (t *tunnel) reload(verboseLevel int) {
+	utils.Logger.Notice("Reloading configuration")
+
+	reloaded := &tunnel{viper: ReloadConfig()}
+
+	t.SetCoalesceDelay(reloaded.viper.GetDuration("CoalesceDelay"))
+
+	if t.viper.GetBool("AttachAgent") || t.viper.GetString("AgentInterpreter") != "" {
+		utils.Logger.Warning("Agent options are not reloaded for attached and interpreter agents")
+		return
+	}
+
+	setup := reloaded.getAgentSetup(verboseLevel)
+	// The agent profiler follows the profiling port, which is not reloaded
+	setup.Pprof = t.viper.GetString("PprofBind") != ""
+
+	t.Handshake = common.NewSetupMessage(setup)
+	t.OutQueue.Push(common.NewSetupMessage(setup))
+}
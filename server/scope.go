@@ -0,0 +1,175 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// engagementScope holds the networks and domains the operators may reach
+// through the tunnel
+type engagementScope struct {
+	networks []*net.IPNet
+	domains  []string
+	webhook  string
+	// Destinations already sent to the webhook
+	alerted sync.Map
+}
+
+// parseScope parses the Scope entries, CIDRs, IP addresses or domains also
+// covering their subdomains, like "10.0.0.0/8" or "corp.example.com". It
+// returns nil when no scope is defined.
+func parseScope(specs []string, webhook string) (*engagementScope, error) {
+	if len(specs) == 0 {
+		if webhook != "" {
+			return nil, errors.New("scope webhook set without a scope")
+		}
+		return nil, nil
+	}
+
+	scope := &engagementScope{webhook: webhook}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(spec); err == nil {
+			scope.networks = append(scope.networks, network)
+		} else if ip := net.ParseIP(spec); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			scope.networks = append(scope.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else if strings.ContainsAny(spec, "/:") {
+			return nil, errors.New("invalid scope entry " + spec + ", expected a CIDR, an IP address or a domain")
+		} else {
+			domain := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(spec, "*"), "."), "."))
+			scope.domains = append(scope.domains, domain)
+		}
+	}
+
+	return scope, nil
+}
+
+// contains tells if host, an IP address or a name, is in the scope
+func (s *engagementScope) contains(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range s.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range s.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadScope reads the Scope and ScopeWebhook options
+func loadScope(viper *viper.Viper) *engagementScope {
+	scope, err := parseScope(viper.GetStringSlice("Scope"), viper.GetString("ScopeWebhook"))
+	if err != nil {
+		utils.Logger.Fatal(err.Error())
+	}
+	return scope
+}
+
+// checkScope returns announce, also raising an alert when the destination of
+// client is out of the engagement scope
+func (t *tunnel) checkScope(client *common.Client, announce func(destination string)) func(destination string) {
+	if t.scope == nil {
+		return announce
+	}
+
+	return func(destination string) {
+		if host, _, err := net.SplitHostPort(destination); err == nil && !t.scope.contains(host) {
+			t.scopeAlert(client, destination)
+		}
+
+		if announce != nil {
+			announce(destination)
+		}
+	}
+}
+
+// scopeAlert reports the connection of client to the out of scope
+// destination in the logs, the session log and, once per destination, to
+// the webhook
+func (t *tunnel) scopeAlert(client *common.Client, destination string) {
+	utils.Logger.Warning("OUT OF SCOPE: client", client.Id, "of", client.Operator, "connects to", destination)
+
+	details := map[string]string{
+		"tunnel":      t.getName(),
+		"client":      client.Id,
+		"operator":    client.Operator,
+		"destination": destination,
+	}
+	audit.Record("out_of_scope", details)
+
+	if t.scope.webhook == "" {
+		return
+	}
+	if _, alerted := t.scope.alerted.LoadOrStore(destination, true); alerted {
+		return
+	}
+
+	go postScopeAlert(t.scope.webhook, details)
+}
+
+// postScopeAlert sends details as JSON to the webhook, with a text field
+// shown by chat services like Slack or Mattermost
+func postScopeAlert(webhook string, details map[string]string) {
+	alert := map[string]string{
+		"text": "SaSSHimi: " + details["operator"] + " connected to out of scope " + details["destination"] +
+			" through " + details["tunnel"],
+		"time": time.Now().UTC().Format(time.RFC3339),
+	}
+	for key, value := range details {
+		alert[key] = value
+	}
+
+	body, _ := json.Marshal(alert)
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	response, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		utils.Logger.Error("Failed to send scope alert: " + err.Error())
+		return
+	}
+	response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		utils.Logger.Error("Failed to send scope alert: webhook answered " + response.Status)
+	}
+}
@@ -17,60 +17,148 @@ package server
 import (
 	"errors"
 	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
 	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/geoip"
 	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/rsrdesarrollo/SaSSHimi/version"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
 	user2 "os/user"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 type tunnel struct {
+	// Number of profiler clients, first in the struct to be 64-bit aligned
+	// for atomic
+	pprofClients uint64
+
+	// Number of clients opened by dialThroughAgent, 64-bit aligned too
+	agentDials uint64
+
 	common.ChannelForwarder
 	sshClient      *ssh.Client
 	sshSession     *ssh.Session
 	viper          *viper.Viper
 	transparentCmd []string
+	transport      io.Closer
+	remote         *remoteEnv
+	// agentPath is the absolute path of the agent executable, resolved
+	// once it is deployed
+	agentPath      string
+	openedAt       atomic.Value
+	lastClientAt   atomic.Value
+	priorityRules  []priorityRule
+	earlyReply     bool
+	// ClientOpened publishers of the clients, guarded by ClientsLock
+	opening map[string]func(destination string)
+
+	// Prefix of the agent command running it with sudo or doas, and the
+	// password sent to sudo before the channel, then forgotten
+	elevatePrefix   string
+	elevatePassword string
+
+	// Closed once the agent replied to the setup message with its version,
+	// the last common.AgentHello and the number of replies
+	hello      chan struct{}
+	helloOnce  sync.Once
+	agentHello atomic.Value
+	helloCount int32
+
+	// Set once the remote host accepted the ssh-agent forwarding
+	agentForwarded bool
+
+	// Set once the Hosts entries are in the hosts file, removed once
+	hostsAdded bool
+	hostsOnce  sync.Once
+
+	// GeoIP databases tagging public destinations in the session log
+	geoip []*geoip.Reader
+
+	// Engagement scope raising alerts for other destinations, nil if none
+	scope *engagementScope
+
+	// Rules mirroring the traffic of the clients to a file or a TCP port
+	mirrorRules []mirrorRule
+
+	// Set to 1 while a wedged session is replaced by a new one
+	restarting int32
+
+	// Directory the agent of the session was deployed to, and the one of
+	// the wedged session to stop before deploying again
+	deployedPath string
+	wedgedPath   string
+
+	// Closed once a message came through the channel, and the
+	// handshakeFailure set when none did in time or noise came first
+	received      chan struct{}
+	receivedOnce  sync.Once
+	handshakeErr  atomic.Value
+	handshakeOnce sync.Once
 }
 
-func newTransparentTunnel(transparentCmd []string) *tunnel {
-	return &tunnel{
-		ChannelForwarder: common.ChannelForwarder{
-			OutChannel: make(chan *common.DataMessage, 10),
-			InChannel:  make(chan *common.DataMessage, 10),
+func newTransparentTunnel(viper *viper.Viper, transparentCmd []string) *tunnel {
+	t := newTunnel(viper)
+	t.transparentCmd = transparentCmd
+	return t
+}
 
-			ChannelOpen: true,
-			ClientsLock: &sync.Mutex{},
-			Clients:     make(map[string]*common.Client),
+func newTunnel(viper *viper.Viper) *tunnel {
+	priorityRules, err := parsePriorityRules(viper.GetStringSlice("Priority"))
+	if err != nil {
+		utils.Logger.Fatal(err.Error())
+	}
 
-			NotifyClosure: make(chan struct{}),
-		},
-		transparentCmd: transparentCmd,
+	if err := common.CheckFrameSize(viper.GetInt("FrameSize")); err != nil {
+		utils.Logger.Fatal(err.Error())
 	}
-}
 
-func newTunnel(viper *viper.Viper) *tunnel {
-	return &tunnel{
+	utils.AddSecret(viper.GetString("Password"))
+	utils.AddSecret(viper.GetString("ElevatePassword"))
+
+	t := &tunnel{
 		ChannelForwarder: common.ChannelForwarder{
-			OutChannel: make(chan *common.DataMessage, 10),
-			InChannel:  make(chan *common.DataMessage, 10),
+			OutQueue:  common.NewFairQueue(),
+			InChannel: make(chan *common.DataMessage, common.MaxQueueLimit),
 
 			ChannelOpen: true,
 			ClientsLock: &sync.Mutex{},
 			Clients:     make(map[string]*common.Client),
 
 			NotifyClosure: make(chan struct{}),
+
+			KeepAliveInterval: viper.GetDuration("KeepAliveInterval"),
+			KeepAliveJitter:   viper.GetDuration("KeepAliveJitter"),
+			KeepAlivePadding:  viper.GetInt("KeepAlivePadding"),
 		},
-		viper: viper,
+		viper:         viper,
+		priorityRules: priorityRules,
+		earlyReply:    viper.GetBool("EarlyReply"),
+		opening:       make(map[string]func(destination string)),
+		hello:         make(chan struct{}),
+		received:      make(chan struct{}),
 	}
+	t.SetCoalesceDelay(viper.GetDuration("CoalesceDelay"))
+	t.geoip = loadGeoIP(viper)
+	t.scope = loadScope(viper)
+
+	t.mirrorRules, err = parseMirrorRules(viper.GetStringSlice("Mirror"))
+	if err != nil {
+		utils.Logger.Fatal(err.Error())
+	}
+
+	return t
 }
 
 func (t *tunnel) getRemoteHost() string {
@@ -83,6 +171,19 @@ func (t *tunnel) getRemoteHost() string {
 	return remoteHost
 }
 
+// getName returns the label identifying the tunnel in logs and session logs
+func (t *tunnel) getName() string {
+	if name := t.viper.GetString("Name"); name != "" {
+		return name
+	}
+
+	if t.transparentCmd != nil {
+		return strings.Join(t.transparentCmd, " ")
+	}
+
+	return t.viper.GetString("RemoteHost")
+}
+
 func (t *tunnel) getUsername() string {
 	user := t.viper.GetString("User")
 	if user == "" {
@@ -95,6 +196,9 @@ func (t *tunnel) getUsername() string {
 
 func (t *tunnel) getRemoteExecutable() string {
 	remoteExecutable := t.viper.GetString("RemoteExecutable")
+	if remoteExecutable == "" {
+		remoteExecutable = t.cachedAgent()
+	}
 	if remoteExecutable == "" {
 		remoteExecutable, _ = os.Executable()
 	}
@@ -111,6 +215,80 @@ func (t *tunnel) getRemoteAgentPath() string {
 	return remoteAgentPath
 }
 
+// getRemoteAgentCommand returns the command used to start the agent from the
+// remote agent path. Relay-only builds do not upload themselves, so they run
+// the agent binary already installed on the remote host.
+func (t *tunnel) getRemoteAgentCommand() string {
+	if !utils.RelayOnly {
+		return "./.daemon"
+	}
+
+	remoteAgentBinary := t.viper.GetString("RemoteAgentBinary")
+	if remoteAgentBinary == "" {
+		remoteAgentBinary = "SaSSHimi"
+	}
+	utils.Logger.Debug("Remote agent binary:", remoteAgentBinary)
+	return utils.EscapeBashArgument(remoteAgentBinary)
+}
+
+// getAgentSetup returns the settings sent to the agent in the handshake
+// instead of its command line.
+func (t *tunnel) getAgentSetup(verboseLevel int) common.AgentSetup {
+	setup := common.AgentSetup{
+		Verbosity:  verboseLevel,
+		DebugLeaks: utils.LeakInterval(),
+		Pprof:      t.viper.GetString("PprofBind") != "",
+		Options: common.AgentOptions{
+			MaxClients:        t.viper.GetInt("AgentMaxClients"),
+			MaxGoroutines:     t.viper.GetInt("AgentMaxGoroutines"),
+			MaxMemory:         uint64(t.viper.GetInt("AgentMaxMemory")) * 1024 * 1024,
+			Nice:              t.viper.GetInt("AgentNice"),
+			IONice:            t.viper.GetString("AgentIONice"),
+			CPUs:              t.viper.GetString("AgentCPUs"),
+			MaxProcs:          t.viper.GetInt("AgentMaxProcs"),
+			TransparentMode:   t.viper.GetBool("AgentTransparentMode"),
+			Shared:            t.viper.GetBool("AgentShared"),
+			DisableSocks4:     t.viper.GetBool("AgentDisableSocks4"),
+			DialConcurrency:   t.viper.GetInt("AgentDialConcurrency"),
+			DialInterval:      t.viper.GetDuration("AgentDialInterval"),
+			FastOpen:          t.viper.GetBool("AgentFastOpen"),
+			MaxPorts:          t.viper.GetInt("AgentMaxPorts"),
+			DisableDNSCache:   t.viper.GetBool("AgentDisableDNSCache"),
+			DNSServers:        t.viper.GetString("AgentDNSServers"),
+			Rewrites:          strings.Join(t.viper.GetStringSlice("AgentRewrites"), "\n"),
+			DialFailureCache:  t.viper.GetDuration("AgentDialFailureCache"),
+			HandshakeWorkers:  t.viper.GetInt("AgentHandshakeWorkers"),
+			CoalesceDelay:     t.viper.GetDuration("AgentCoalesceDelay"),
+			ClientIdleTimeout: t.viper.GetDuration("ClientIdleTimeout"),
+			FrameSize:         t.viper.GetInt("FrameSize"),
+			Sandbox:           t.viper.GetBool("AgentSandbox"),
+			FileDrop:          t.viper.GetString("AgentFileDrop"),
+			FileDropBind:      t.viper.GetString("AgentFileDropBind"),
+			FileDropExpiry:    t.viper.GetDuration("AgentFileDropExpiry"),
+		},
+	}
+
+	setup.Protocol = common.ProtocolVersion
+	setup.MinProtocol = common.MinProtocolVersion
+	setup.Version = version.VersionTag
+
+	for _, variable := range t.viper.GetStringSlice("AgentEnv") {
+		if setup.Env == nil {
+			setup.Env = make(map[string]string)
+		}
+
+		if idx := strings.Index(variable, "="); idx >= 0 {
+			setup.Env[variable[:idx]] = variable[idx+1:]
+		} else if value, prs := os.LookupEnv(variable); prs {
+			setup.Env[variable] = value
+		} else {
+			utils.Logger.Warning("Environment variable", variable, "is not set, it will not be passed to the agent")
+		}
+	}
+
+	return setup
+}
+
 func (t *tunnel) getPassword() string {
 	password := t.viper.GetString("Password")
 	if password == "" {
@@ -147,21 +325,39 @@ func (t *tunnel) uploadForwarder(remoteAgentPath string) error {
 	session, err := t.sshClient.NewSession()
 	defer session.Close()
 	if err != nil {
-		return errors.New("Failed to create session: " + err.Error())
+		return fmt.Errorf("Failed to create session: %w", err)
 	}
 
 	var remoteExecutable string = t.getRemoteExecutable()
 
 	selfFile, err := os.Open(remoteExecutable)
-	session.Stdin = selfFile
+	if err != nil {
+		return fmt.Errorf("Failed to open current binary %w", err)
+	}
+	defer selfFile.Close()
+
+	compression := t.uploadCompression()
+	command, err := t.uploadCommand(remoteAgentPath, compression)
+	if err != nil {
+		return err
+	}
 
+	compressed, err := compressReader(selfFile, compression)
 	if err != nil {
-		return errors.New("Failed to open current binary " + err.Error())
+		return err
 	}
+	defer compressed.Close()
+
+	sent := &countingReader{Reader: compressed}
+	session.Stdin = sent
+
+	err = session.Run(t.shellCommand(command))
 
-	remoteAgentPathEscaped := utils.EscapeBashArgument(remoteAgentPath)
-	command := fmt.Sprintf("cd %s && cat > ./.daemon && chmod +x ./.daemon", remoteAgentPathEscaped)
-	err = session.Run(command)
+	if err == nil && compression != "" {
+		if info, statErr := selfFile.Stat(); statErr == nil {
+			utils.Logger.Infof("Agent uploaded with %s: %d bytes sent for %d bytes", compression, sent.count, info.Size())
+		}
+	}
 
 	return err
 }
@@ -179,28 +375,73 @@ func (t *tunnel) openTransparentTunnel() error {
 	go t.ReadInputData()
 	go t.WriteOutputData()
 
-
-	utils.Logger.Notice("Transparent Tunnel Opening")
+	utils.Logger.Notice("Transparent Tunnel Opening", t.getName())
+	t.markOpen()
+	audit.Record("tunnel_open", map[string]string{"tunnel": t.getName(), "command": strings.Join(t.transparentCmd, " ")})
+	t.publishTunnel(true)
 
 	err = cmd.Run()
 
-	if err != nil {
-		return errors.New("Run transparent command error: " + err.Error())
+	audit.Record("tunnel_close", map[string]string{"tunnel": t.getName(), "command": strings.Join(t.transparentCmd, " ")})
+	t.publishTunnel(false)
+
+	if _, exited := err.(*exec.ExitError); err != nil && !exited {
+		return fmt.Errorf("Run transparent command error: %w", err)
 	}
 
 	t.ChannelOpen = false
-	t.NotifyClosure <- struct{}{}
+	close(t.NotifyClosure)
 
-	return errors.New("Remote process is dead")
+	return agentDied(err)
 }
 
-func (t *tunnel) openTunnel(verboseLevel int) error {
+// openTransport runs the tunnel with an agent already at the other end of
+// transport, until transport is closed
+func (t *tunnel) openTransport(transport io.ReadWriteCloser, verboseLevel int) error {
+	t.Handshake = common.NewSetupMessage(t.getAgentSetup(verboseLevel))
+	go t.expectHello()
+	t.Reader = transport
+	t.Writer = transport
+
+	closed := make(chan struct{})
+	go func() {
+		t.ReadInputData()
+		close(closed)
+	}()
+	go t.WriteOutputData()
+
+	utils.Logger.Notice("Tunnel Open", t.getName())
+	t.markOpen()
+	audit.Record("tunnel_open", map[string]string{"tunnel": t.getName()})
+	t.publishTunnel(true)
+
+	<-closed
+
+	audit.Record("tunnel_close", map[string]string{"tunnel": t.getName()})
+	t.publishTunnel(false)
+	transport.Close()
+
+	t.ChannelOpen = false
+	close(t.NotifyClosure)
+
+	return errors.New("Transport is closed")
+}
+
+func (t *tunnel) dialSSH() error {
 	var err error
 
 	var authMethods = []ssh.AuthMethod{}
 
+	restricted := t.viper.GetBool("RestrictedCrypto")
+
 	pkSigner := t.getPublicKey()
 	if pkSigner != nil {
+		if restricted {
+			pkSigner, err = restrictSigner(pkSigner)
+			if err != nil {
+				return err
+			}
+		}
 		authMethods = append(authMethods, ssh.PublicKeys(pkSigner))
 	}
 	authMethods = append(authMethods, ssh.Password(t.getPassword()))
@@ -211,68 +452,233 @@ func (t *tunnel) openTunnel(verboseLevel int) error {
 		Auth:            authMethods,
 	}
 
+	if restricted {
+		utils.Logger.Info("Restricted crypto mode enabled")
+		applyRestrictedCrypto(config)
+	}
+
 	t.sshClient, err = ssh.Dial("tcp", t.getRemoteHost(), config)
 
 	if err != nil {
-		return errors.New("Dial error: " + err.Error())
+		return dialError(err)
+	}
+
+	return t.detectRemoteEnv()
+}
+
+func (t *tunnel) openTunnel(verboseLevel int) error {
+	var err error
+
+	err = t.dialSSH()
+	if err != nil {
+		return err
 	}
 
 	defer t.sshClient.Close()
 
-	remoteAgentPath := t.getRemoteAgentPath()
-	err = t.uploadForwarder(remoteAgentPath)
+	err = t.prepareElevation()
 	if err != nil {
-		return errors.New("Failed to upload forwarder " + err.Error())
+		return err
+	}
+
+	interpreter := t.viper.GetString("AgentInterpreter")
+	remoteAgentPath := t.getRemoteAgentPath()
+
+	setup := t.getAgentSetup(verboseLevel)
+
+	var runCommand string
+	var preamble bool
+	if t.viper.GetBool("AttachAgent") {
+		utils.Logger.Info("Attaching to shared agent in", remoteAgentPath)
+		runCommand = t.agentRunCommand(remoteAgentPath, "attach", "")
+	} else if interpreter != "" {
+		if utils.RelayOnly {
+			return errInterpreterRelayOnly
+		}
+
+		// The interpreter agent only follows the frame size
+		options := setup.Options
+		options.FrameSize = 0
+		if options != (common.AgentOptions{}) {
+			utils.Logger.Warning("Agent options are not supported by the interpreter agent and will be ignored")
+		}
+		utils.Logger.Info("Running agent script with remote interpreter", interpreter)
+		t.BinaryFraming = true
+		runCommand = t.execPrefix() + t.elevatePrefix + t.envPrefix() + interpreterCommand(interpreter)
+	} else {
+		t.stopWedgedAgent()
+
+		remoteAgentPath, err = t.deployAgent(remoteAgentPath)
+		if err != nil {
+			return err
+		}
+		t.deployedPath = remoteAgentPath
+		runCommand = t.agentRunCommand(remoteAgentPath, "agent", preambleArgs)
+		preamble = true
+	}
+
+	if !t.viper.GetBool("AttachAgent") {
+		// The shared agent is configured by the operator who started it
+		t.Handshake = common.NewSetupMessage(setup)
+		if interpreter == "" {
+			// The interpreter agent is sent by this client, so it matches
+			go t.expectHello()
+		}
 	}
 
 	t.sshSession, err = t.sshClient.NewSession()
 	defer t.sshSession.Close()
 
 	if err != nil {
-		return errors.New("Failed to create session: " + err.Error())
+		return fmt.Errorf("Failed to create session: %w", err)
+	}
+
+	err = t.forwardAgent(t.sshSession)
+	if err != nil {
+		return err
 	}
 
 	t.Writer, err = t.sshSession.StdinPipe()
 	if err != nil {
-		return errors.New("Failed to pipe STDIN on session: " + err.Error())
+		return fmt.Errorf("Failed to pipe STDIN on session: %w", err)
 	}
 
-	t.Reader, err = t.sshSession.StdoutPipe()
+	stdout, err := t.sshSession.StdoutPipe()
 	if err != nil {
-		return errors.New("Failed to pipe STDOUT on session: " + err.Error())
+		return fmt.Errorf("Failed to pipe STDOUT on session: %w", err)
+	}
+	output := &firstBytesReader{Reader: stdout}
+	t.Reader = output
+	if preamble {
+		t.Reader = &preambleReader{Reader: output, noise: t.channelNoise}
 	}
 
 	t.sshSession.Stderr = os.Stderr
 
 	go t.ReadInputData()
-	go t.WriteOutputData()
+	go func() {
+		if err := t.sendElevatePassword(); err != nil {
+			utils.Logger.Error(err)
+			return
+		}
+		if interpreter != "" {
+			if err := t.sendInterpreterAgent(); err != nil {
+				utils.Logger.Error(err)
+				return
+			}
+		}
+		t.WriteOutputData()
+	}()
+
+	utils.Logger.Notice("SSH Tunnel Open", t.getName())
+	t.markOpen()
+	audit.Record("tunnel_open", map[string]string{"tunnel": t.getName(), "remote": t.getRemoteHost()})
+	t.publishTunnel(true)
 
-	utils.Logger.Notice("SSH Tunnel Open")
+	go t.expectHandshake(t.viper.GetDuration("HandshakeTimeout"), output)
+	err = t.sshSession.Run(t.shellCommand(runCommand))
 
-	var commandOps = ""
+	audit.Record("tunnel_close", map[string]string{"tunnel": t.getName(), "remote": t.getRemoteHost()})
+	t.publishTunnel(false)
 
-	if verboseLevel != 0 {
-		commandOps = "-" + strings.Repeat("v", verboseLevel)
+	t.ChannelOpen = false
+	close(t.NotifyClosure)
+
+	if failure, ok := t.handshakeErr.Load().(handshakeFailure); ok {
+		return failure.err
 	}
+	return agentDied(err)
+}
 
-	remoteAgentPathEscaped := utils.EscapeBashArgument(remoteAgentPath)
-	var runCommand = fmt.Sprintf("cd %s && ./.daemon agent %s", remoteAgentPathEscaped, commandOps)
-	t.sshSession.Run(runCommand)
+// localOperator identifies the operator running this process
+func localOperator() string {
+	if current, err := user2.Current(); err == nil {
+		return current.Username
+	}
+	return "unknown"
+}
 
-	t.ChannelOpen = false
-	t.NotifyClosure <- struct{}{}
+// addClient forwards conn, opened by operator, through the tunnel
+func (t *tunnel) addClient(conn net.Conn, operator string) *common.Client {
+	return t.addClientId(conn.RemoteAddr().String(), conn, operator)
+}
+
+// addClientId is like addClient with a client id not taken from conn
+func (t *tunnel) addClientId(id string, conn net.Conn, operator string) *common.Client {
+	conn, classifier := t.classifyConn(conn)
+	conn, mirror := t.mirrorConn(conn)
+	conn = t.earlyReplyConn(conn)
+
+	client := common.NewClient(
+		id,
+		conn,
+		t.OutQueue,
+	)
+	client.Operator = operator
+	client.SetIdleTimeout(t.viper.GetDuration("ClientIdleTimeout"))
+	client.SetFrameSize(t.viper.GetInt("FrameSize"))
+
+	if classifier != nil {
+		classifier.client = client
+		client.SetPriority(classify(t.priorityRules, conn.LocalAddr().String(), ""))
+	}
+	t.lastClientAt.Store(time.Now())
+
+	t.ClientsLock.Lock()
+	t.Clients[client.Id] = client
+	announce := t.openingClient(client)
+	t.ClientsLock.Unlock()
+
+	if classifier != nil {
+		announce = t.mirrorDestination(mirror, client, announce)
+		classifier.announce = t.checkScope(client, t.tagDestination(client, announce))
+	}
 
-	return errors.New("Remote process is dead")
+	audit.Record("connection_open", map[string]string{"tunnel": t.getName(), "client": client.Id, "operator": operator})
+	go client.ReadFromClientToChannel()
+
+	return client
+}
+
+// closeDetails returns the session log details of a closed client, with the
+// bytes uploaded from and downloaded to the operator.
+func (t *tunnel) closeDetails(client *common.Client) map[string]string {
+	download, upload := client.Traffic()
+
+	return map[string]string{
+		"tunnel":   t.getName(),
+		"client":   client.Id,
+		"operator": client.Operator,
+		"upload":   strconv.FormatUint(upload, 10),
+		"download": strconv.FormatUint(download, 10),
+	}
 }
 
+// handleClients delivers the messages of the channel to the clients until
+// the channel is closed. A tunnel reopened meanwhile gets a new loop reading
+// its new InChannel, this one stops.
 func (t *tunnel) handleClients() {
+	inChannel, closure := t.InChannel, t.NotifyClosure
+
 	for t.ChannelOpen {
-		msg := <-t.InChannel
+		var msg *common.DataMessage
+		select {
+		case msg = <-inChannel:
+		case <-closure:
+			return
+		}
+		t.InputTaken()
+		t.messageReceived()
 
 		if msg.KeepAlive {
 			continue
 		}
 
+		if msg.Setup && !msg.IsCorrupted() {
+			t.receiveHello(msg)
+			continue
+		}
+
 		t.ClientsLock.Lock()
 
 		client, prs := t.Clients[msg.ClientId]
@@ -280,20 +686,31 @@ func (t *tunnel) handleClients() {
 		if prs == false {
 			utils.Logger.Warning("Received data from closed client", msg.ClientId)
 		} else {
-			if msg.DeadClient {
+			if msg.IsCorrupted() {
+				// Never deliver damaged data, reset the connection instead
+				client.Terminate()
+				client.NotifyEOF(true)
+			} else if msg.DeadClient {
 				// ACK for client termination
 				client.NotifyEOF(false)
-				client.Terminate()
+				if msg.Reset {
+					client.Reset()
+				} else {
+					client.Terminate()
+				}
 				delete(t.Clients, msg.ClientId)
+				audit.Record("connection_close", t.closeDetails(client))
+				t.publishClosed(client)
 			} else if msg.CloseClient {
-				client.Close()
+				client.CloseWrite()
 				delete(t.Clients, msg.ClientId)
+				audit.Record("connection_close", t.closeDetails(client))
+				t.publishClosed(client)
 			} else if !client.IsDead() {
-				err := client.Write(msg.Data)
+				err := client.Deliver(msg)
 
 				if err != nil {
-					client.Terminate()
-					client.NotifyEOF(true)
+					client.NotifyError(err)
 
 					utils.Logger.Errorf("Error Writing: %s\n", err.Error())
 				}
@@ -305,30 +722,80 @@ func (t *tunnel) handleClients() {
 	}
 }
 
-func RunTransparent(transparentCmd []string, bindAddress string) {
-	ln, err := net.Listen("tcp", bindAddress)
+// listenProxy listens for proxy clients on bindAddress, and on the named
+// pipe from the Pipe option if any. Clients are accepted in the background
+// into a queue of AcceptQueue connections.
+func listenProxy(viper *viper.Viper, bindAddress string) (net.Listener, error) {
+	ln, err := utils.ListenProxy(bindAddress, viper.GetBool("Expose"))
+	if err != nil {
+		return nil, err
+	}
+
+	if backlog := viper.GetInt("ListenBacklog"); backlog > 0 {
+		if err := utils.SetListenBacklog(ln, backlog); err != nil {
+			utils.Logger.Warning(err.Error())
+		}
+	}
+
+	if pipe := viper.GetString("Pipe"); pipe != "" {
+		pipeLn, err := utils.ListenPipe(pipe)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+
+		ln = utils.JoinListeners(ln, pipeLn)
+	}
+
+	if size := viper.GetInt("AcceptQueue"); size > 0 {
+		ln = utils.QueueAccepts(ln, size)
+	}
+
+	return ln, nil
+}
+
+func RunTransparent(viper *viper.Viper, transparentCmd []string, bindAddress string) {
+	utils.RaiseFileLimit()
+
+	ln, err := listenProxy(viper, bindAddress)
 
 	if err != nil {
 		panic("Failed to bind local port " + err.Error())
 	}
 
-	utils.Logger.Notice("Proxy bind at", bindAddress)
+	tunnel := newTransparentTunnel(viper, transparentCmd)
+	utils.Logger.Notice("Proxy bind at", ln.Addr().String(), "for tunnel", tunnel.getName())
+
+	if healthBind := viper.GetString("HealthBind"); healthBind != "" {
+		go tunnel.serveHealth(healthBind)
+	}
 
-	tunnel := newTransparentTunnel(transparentCmd)
+	if pprofBind := viper.GetString("PprofBind"); pprofBind != "" {
+		go tunnel.servePprof(pprofBind)
+	}
 
 	go func() {
 		err = tunnel.openTransparentTunnel()
 
 		if err != nil {
-			utils.Logger.Fatal("Failed to open tunnel ", err.Error())
+			failTunnel(err)
 		}
 	}()
 
 	go tunnel.handleClients()
 	go tunnel.KeepAlive()
+	go utils.WatchLeaks(tunnel.leakCounters()...)
 
+	if idleTimeout := viper.GetDuration("IdleTimeout"); idleTimeout > 0 {
+		go tunnel.exitWhenIdle(idleTimeout, func() {
+			tunnel.Terminate()
+			ln.Close()
+		})
+	}
+
+	operator := localOperator()
 	for tunnel.ChannelOpen {
-		conn, err := ln.Accept()
+		conn, err := utils.Accept(ln)
 		if err != nil {
 			utils.Logger.Fatalf("Error in connection accept: %s", err.Error())
 			continue
@@ -336,32 +803,51 @@ func RunTransparent(transparentCmd []string, bindAddress string) {
 
 		utils.Logger.Debug("New connection from ", conn.RemoteAddr().String())
 
-		client := common.NewClient(
-			conn.RemoteAddr().String(),
-			conn,
-			tunnel.OutChannel,
-		)
-
-		tunnel.Clients[client.Id] = client
-		go client.ReadFromClientToChannel()
+		tunnel.addClient(conn, operator)
 	}
 }
 
 func Run(viper *viper.Viper, bindAddress string, verboseLevel int) {
 
-	ln, err := net.Listen("tcp", bindAddress)
+	utils.RaiseFileLimit()
+
+	ln, err := listenProxy(viper, bindAddress)
 
 	if err != nil {
 		panic("Failed to bind local port " + err.Error())
 	}
 
-	utils.Logger.Notice("Proxy bind at", bindAddress)
-
 	tunnel := newTunnel(viper)
+	utils.Logger.Notice("Proxy bind at", ln.Addr().String(), "for tunnel", tunnel.getName())
+
+	if healthBind := viper.GetString("HealthBind"); healthBind != "" {
+		go tunnel.serveHealth(healthBind)
+	}
+
+	if pprofBind := viper.GetString("PprofBind"); pprofBind != "" {
+		go tunnel.servePprof(pprofBind)
+	}
+
+	if sshBind := viper.GetString("SSHBind"); sshBind != "" {
+		go tunnel.serveSSH(sshBind)
+	}
+
+	go tunnel.serveTLSForwards()
+
+	if sniBind := viper.GetString("SNIBind"); sniBind != "" {
+		go tunnel.serveSNI(sniBind)
+	}
+
+	if webBind := viper.GetString("WebBind"); webBind != "" {
+		go tunnel.serveWeb(webBind, viper.GetString("WebTarget"), viper.GetBool("WebInsecure"))
+	}
+
+	tunnel.addHosts()
 
 	termios := TermiosSaveStdin()
 	onExit := func() {
 		TermiosRestoreStdin(termios)
+		tunnel.restoreHosts()
 		tunnel.Terminate()
 
 		utils.Logger.Notice("Waiting to remote process to clean up...")
@@ -385,20 +871,51 @@ func Run(viper *viper.Viper, bindAddress string, verboseLevel int) {
 	}
 
 	utils.ExitCallback(onExit)
+	utils.HandleRuntimeSignals(tunnel.runtimeControls(verboseLevel))
+
+	probe := func() {
+		go tunnel.probeChannel(viper.GetDuration("ProbeInterval"), viper.GetInt("ProbeFailures"), tunnel.healSession)
+	}
 
 	go func() {
-		err = tunnel.openTunnel(verboseLevel)
+		for {
+			err = tunnel.openTunnel(verboseLevel)
+
+			// The session ends on purpose when it is replaced
+			if atomic.LoadInt32(&tunnel.restarting) == 1 {
+				tunnel.reopenSession()
+				go tunnel.handleClients()
+				go tunnel.KeepAlive()
+				probe()
+				atomic.StoreInt32(&tunnel.restarting, 0)
+				continue
+			}
 
-		if err != nil {
-			utils.Logger.Fatal("Failed to open tunnel ", err.Error())
+			if err != nil {
+				tunnel.restoreHosts()
+				failTunnel(err)
+			}
+			return
 		}
 	}()
 
+	if upgrade := viper.GetString("UpgradeAgent"); upgrade != "" {
+		go tunnel.upgradeWhenReady(upgrade)
+	}
+
 	go tunnel.handleClients()
 	go tunnel.KeepAlive()
+	go utils.WatchLeaks(tunnel.leakCounters()...)
 
-	for tunnel.ChannelOpen {
-		conn, err := ln.Accept()
+	if idleTimeout := viper.GetDuration("IdleTimeout"); idleTimeout > 0 {
+		go tunnel.exitWhenIdle(idleTimeout, onExit)
+	}
+
+	probe()
+
+	operator := localOperator()
+	for tunnel.ChannelOpen || atomic.LoadInt32(&tunnel.restarting) == 1 {
+		conn, err := utils.Accept(ln)
 		if err != nil {
 			utils.Logger.Fatalf("Error in conncetion accept: %s", err.Error())
 			continue
@@ -406,13 +923,6 @@ func Run(viper *viper.Viper, bindAddress string, verboseLevel int) {
 
 		utils.Logger.Debug("New connection from ", conn.RemoteAddr().String())
 
-		client := common.NewClient(
-			conn.RemoteAddr().String(),
-			conn,
-			tunnel.OutChannel,
-		)
-
-		tunnel.Clients[client.Id] = client
-		go client.ReadFromClientToChannel()
+		tunnel.addClient(conn, operator)
 	}
 }
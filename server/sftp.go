@@ -0,0 +1,265 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+)
+
+// Minimal SFTP version 3 client, just enough to deploy the agent on hosts
+// where the shell is restricted but the SFTP subsystem is available.
+
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpWrite    = 6
+	sshFxpSetstat  = 9
+	sshFxpRealpath = 16
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpName     = 104
+
+	sshFxfWrite = 0x02
+	sshFxfCreat = 0x08
+	sshFxfTrunc = 0x10
+
+	sshFileXferAttrPermissions = 0x04
+
+	sshFxOk = 0
+
+	sftpChunkSize = 32 * 1024
+)
+
+type sftpClient struct {
+	session *ssh.Session
+	in      io.WriteCloser
+	out     io.Reader
+	nextId  uint32
+}
+
+func appendUint32(buffer []byte, value uint32) []byte {
+	return append(buffer, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func appendUint64(buffer []byte, value uint64) []byte {
+	return appendUint32(appendUint32(buffer, uint32(value>>32)), uint32(value))
+}
+
+func appendString(buffer []byte, value string) []byte {
+	return append(appendUint32(buffer, uint32(len(value))), value...)
+}
+
+func readString(buffer []byte) (string, []byte, error) {
+	if len(buffer) < 4 {
+		return "", nil, errors.New("short SFTP packet")
+	}
+	length := binary.BigEndian.Uint32(buffer)
+	if uint32(len(buffer)-4) < length {
+		return "", nil, errors.New("short SFTP packet")
+	}
+	return string(buffer[4 : 4+length]), buffer[4+length:], nil
+}
+
+func newSftpClient(client *ssh.Client) (*sftpClient, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create session: %w", err)
+	}
+
+	c := &sftpClient{session: session}
+
+	c.in, err = session.StdinPipe()
+	if err == nil {
+		c.out, err = session.StdoutPipe()
+	}
+	if err == nil {
+		err = session.RequestSubsystem("sftp")
+	}
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("Failed to start SFTP subsystem: %w", err)
+	}
+
+	err = c.sendPacket(sshFxpInit, appendUint32(nil, 3))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	packetType, _, err := c.readPacket()
+	if err != nil || packetType != sshFxpVersion {
+		c.Close()
+		return nil, errors.New("SFTP version negotiation failed")
+	}
+
+	return c, nil
+}
+
+func (c *sftpClient) Close() {
+	c.in.Close()
+	c.session.Close()
+}
+
+func (c *sftpClient) sendPacket(packetType byte, payload []byte) error {
+	packet := appendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, packetType)
+	packet = append(packet, payload...)
+
+	_, err := c.in.Write(packet)
+	return err
+}
+
+func (c *sftpClient) readPacket() (byte, []byte, error) {
+	var header [5]byte
+	_, err := io.ReadFull(c.out, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 256*1024 {
+		return 0, nil, errors.New("invalid SFTP packet length")
+	}
+
+	payload := make([]byte, length-1)
+	_, err = io.ReadFull(c.out, payload)
+	return header[4], payload, err
+}
+
+// request sends a packet with a new request id and returns the response
+// payload without the id.
+func (c *sftpClient) request(packetType byte, payload []byte) (byte, []byte, error) {
+	c.nextId++
+	id := c.nextId
+
+	err := c.sendPacket(packetType, append(appendUint32(nil, id), payload...))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	responseType, response, err := c.readPacket()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(response) < 4 || binary.BigEndian.Uint32(response) != id {
+		return 0, nil, errors.New("unexpected SFTP response")
+	}
+
+	return responseType, response[4:], nil
+}
+
+func statusError(responseType byte, response []byte) error {
+	if responseType != sshFxpStatus || len(response) < 4 {
+		return fmt.Errorf("unexpected SFTP response type %d", responseType)
+	}
+
+	code := binary.BigEndian.Uint32(response)
+	if code == sshFxOk {
+		return nil
+	}
+
+	message, _, _ := readString(response[4:])
+	return fmt.Errorf("SFTP error %d: %s", code, message)
+}
+
+func (c *sftpClient) RealPath(path string) (string, error) {
+	responseType, response, err := c.request(sshFxpRealpath, appendString(nil, path))
+	if err != nil {
+		return "", err
+	}
+	if responseType != sshFxpName || len(response) < 4 {
+		return "", statusError(responseType, response)
+	}
+
+	name, _, err := readString(response[4:])
+	return name, err
+}
+
+func (c *sftpClient) Chmod(path string, mode os.FileMode) error {
+	payload := appendString(nil, path)
+	payload = appendUint32(payload, sshFileXferAttrPermissions)
+	payload = appendUint32(payload, uint32(mode.Perm()))
+
+	responseType, response, err := c.request(sshFxpSetstat, payload)
+	if err != nil {
+		return err
+	}
+	return statusError(responseType, response)
+}
+
+// WriteFile stores the content of reader into path on the remote host
+func (c *sftpClient) WriteFile(path string, reader io.Reader, mode os.FileMode) error {
+	payload := appendString(nil, path)
+	payload = appendUint32(payload, sshFxfWrite|sshFxfCreat|sshFxfTrunc)
+	payload = appendUint32(payload, sshFileXferAttrPermissions)
+	payload = appendUint32(payload, uint32(mode.Perm()))
+
+	responseType, response, err := c.request(sshFxpOpen, payload)
+	if err != nil {
+		return err
+	}
+	if responseType != sshFxpHandle {
+		return statusError(responseType, response)
+	}
+
+	handle, _, err := readString(response)
+	if err != nil {
+		return err
+	}
+
+	var offset uint64
+	chunk := make([]byte, sftpChunkSize)
+
+	for {
+		readed, readErr := reader.Read(chunk)
+
+		if readed > 0 {
+			payload := appendString(nil, handle)
+			payload = appendUint64(payload, offset)
+			payload = appendString(payload, string(chunk[:readed]))
+
+			responseType, response, err := c.request(sshFxpWrite, payload)
+			if err == nil {
+				err = statusError(responseType, response)
+			}
+			if err != nil {
+				c.request(sshFxpClose, appendString(nil, handle))
+				return err
+			}
+			offset += uint64(readed)
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			c.request(sshFxpClose, appendString(nil, handle))
+			return readErr
+		}
+	}
+
+	responseType, response, err = c.request(sshFxpClose, appendString(nil, handle))
+	if err != nil {
+		return err
+	}
+	return statusError(responseType, response)
+}
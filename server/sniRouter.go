@@ -0,0 +1,207 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sniTimeout is how long a client has to send its TLS ClientHello
+const sniTimeout = 10 * time.Second
+
+// errSNIRead stops the handshake once the ClientHello is read
+var errSNIRead = errors.New("ClientHello read")
+
+// helloConn reads the ClientHello from a connection, keeping the bytes read
+// so they can be replayed to the destination
+type helloConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c helloConn) Read(data []byte) (int, error) {
+	return c.reader.Read(data)
+}
+
+func (c helloConn) Write(data []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// readServerName returns the SNI of the ClientHello sent on conn, and the
+// bytes read from conn
+func readServerName(conn net.Conn) (string, []byte, error) {
+	var read bytes.Buffer
+	var serverName string
+
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errSNIRead
+		},
+	}
+
+	conn.SetReadDeadline(time.Now().Add(sniTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	err := tls.Server(helloConn{Conn: conn, reader: io.TeeReader(conn, &read)}, config).Handshake()
+	if serverName == "" {
+		if err == nil || strings.Contains(err.Error(), errSNIRead.Error()) {
+			err = errors.New("no server name in the ClientHello")
+		}
+		return "", nil, err
+	}
+
+	return serverName, read.Bytes(), nil
+}
+
+// sniRoutes maps server names to host:port destinations. Names can be
+// exact, *.domain for any name under domain, or * for any name.
+type sniRoutes map[string]string
+
+// ParseSNIRoute reads a name=host:port SNI route specification
+func ParseSNIRoute(spec string) (string, string, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", errors.New("invalid SNI route " + spec + ", expected name=host:port")
+	}
+
+	if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+		return "", "", fmt.Errorf("invalid SNI route %s: %w", spec, err)
+	}
+
+	return strings.ToLower(parts[0]), parts[1], nil
+}
+
+// match returns the destination of serverName: the exact route, else the
+// longest matching *.domain route, else the * route
+func (r sniRoutes) match(serverName string) (string, bool) {
+	serverName = strings.ToLower(serverName)
+
+	if target, ok := r[serverName]; ok {
+		return target, true
+	}
+
+	var wildcards []string
+	for name := range r {
+		if strings.HasPrefix(name, "*.") && strings.HasSuffix(serverName, name[1:]) {
+			wildcards = append(wildcards, name)
+		}
+	}
+
+	if len(wildcards) > 0 {
+		sort.Slice(wildcards, func(i, j int) bool { return len(wildcards[i]) > len(wildcards[j]) })
+		return r[wildcards[0]], true
+	}
+
+	target, ok := r["*"]
+	return target, ok
+}
+
+// getSNIRoutes returns the routes of the SNIRoutes configuration map, then
+// the ones given as name=host:port in SNIRoute
+func (t *tunnel) getSNIRoutes() (sniRoutes, error) {
+	routes := sniRoutes{}
+
+	for name, target := range t.viper.GetStringMapString("SNIRoutes") {
+		routes[strings.ToLower(name)] = target
+	}
+
+	for _, spec := range t.viper.GetStringSlice("SNIRoute") {
+		name, target, err := ParseSNIRoute(spec)
+		if err != nil {
+			return nil, err
+		}
+		routes[name] = target
+	}
+
+	return routes, nil
+}
+
+// serveSNI accepts TLS connections on bindAddress and forwards them,
+// without decrypting them, to the destination routed by their SNI
+func (t *tunnel) serveSNI(bindAddress string) {
+	routes, err := t.getSNIRoutes()
+	if err != nil {
+		utils.Logger.Error(err.Error())
+		return
+	}
+
+	if len(routes) == 0 {
+		utils.Logger.Error("SNI port disabled: no SNI route")
+		return
+	}
+
+	ln, err := utils.ListenProxy(bindAddress, t.viper.GetBool("Expose"))
+	if err != nil {
+		utils.Logger.Error("Failed to bind SNI port " + err.Error())
+		return
+	}
+	defer ln.Close()
+
+	utils.Logger.Notice("SNI port bind at", ln.Addr().String(), "with", len(routes), "routes")
+
+	operator := localOperator()
+	for t.ChannelOpen {
+		conn, err := ln.Accept()
+		if err != nil {
+			utils.Logger.Error("Error in SNI port accept: ", err.Error())
+			return
+		}
+
+		go t.forwardSNI(conn, routes, operator)
+	}
+}
+
+// forwardSNI forwards conn to the destination routed by its SNI
+func (t *tunnel) forwardSNI(conn net.Conn, routes sniRoutes, operator string) {
+	defer conn.Close()
+
+	serverName, hello, err := readServerName(conn)
+	if err != nil {
+		utils.Logger.Warning("SNI connection from", conn.RemoteAddr().String(), "dropped:", err.Error())
+		return
+	}
+
+	target, ok := routes.match(serverName)
+	if !ok {
+		utils.Logger.Warning("No SNI route for", serverName)
+		return
+	}
+
+	utils.Logger.Debug("SNI", serverName, "routed to", target)
+
+	remote, err := t.dialThroughAgent(target, conn.RemoteAddr().String(), operator)
+	if err != nil {
+		utils.Logger.Debug("SNI forward to", target, "failed:", err.Error())
+		return
+	}
+
+	_, err = remote.Write(hello)
+	if err != nil {
+		remote.Close()
+		return
+	}
+
+	splice(conn, remote)
+}
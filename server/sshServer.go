@@ -0,0 +1,234 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// directTCPIP is the payload of the channels opened by ssh -D and ssh -L
+type directTCPIP struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// pipeDialer dials the agent SOCKS server through a new client of the tunnel
+type pipeDialer struct {
+	tunnel   *tunnel
+	id       string
+	operator string
+}
+
+func (d pipeDialer) Dial(network, address string) (net.Conn, error) {
+	local, remote := utils.HalfClosePipe()
+	d.tunnel.addClientId(d.id, local, d.operator)
+	return remote, nil
+}
+
+// dialThroughAgent connects to address through the agent SOCKS server, with
+// a new client of the tunnel identified by source and a sequence number
+func (t *tunnel) dialThroughAgent(address, source, operator string) (net.Conn, error) {
+	id := fmt.Sprintf("%s#%d", source, atomic.AddUint64(&t.agentDials, 1))
+	dialer, err := proxy.SOCKS5("tcp", "agent", nil, pipeDialer{tunnel: t, id: id, operator: operator})
+	if err != nil {
+		return nil, err
+	}
+
+	return dialer.Dial("tcp", address)
+}
+
+// sshServerConfig accepts the public keys listed in the SSHAuthorizedKeys
+// file, and presents the SSHHostKey private key, or a new key if none is set.
+func (t *tunnel) sshServerConfig() (*ssh.ServerConfig, error) {
+	authorizedPath := t.viper.GetString("SSHAuthorizedKeys")
+	if authorizedPath == "" {
+		return nil, errors.New("SSHAuthorizedKeys is required to accept ssh clients")
+	}
+
+	authorizedBytes, err := ioutil.ReadFile(authorizedPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorized keys: %w", err)
+	}
+
+	authorized := map[string]string{}
+	for len(authorizedBytes) > 0 {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(authorizedBytes)
+		if err != nil {
+			break
+		}
+		authorized[string(key.Marshal())] = comment
+		authorizedBytes = rest
+	}
+
+	if len(authorized) == 0 {
+		return nil, errors.New("no key found in " + authorizedPath)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			comment, ok := authorized[string(key.Marshal())]
+			if !ok {
+				return nil, errors.New("unknown public key for " + conn.User())
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"comment": comment}}, nil
+		},
+	}
+
+	var signer ssh.Signer
+	if hostKeyPath := t.viper.GetString("SSHHostKey"); hostKeyPath != "" {
+		hostKeyBytes, err := ioutil.ReadFile(hostKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read host key: %w", err)
+		}
+
+		signer, err = ssh.ParsePrivateKey(hostKeyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse host key: %w", err)
+		}
+	} else {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err = ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	utils.Logger.Notice("SSH server host key", ssh.FingerprintSHA256(signer.PublicKey()))
+	config.AddHostKey(signer)
+
+	return config, nil
+}
+
+// serveSSH runs an SSH server on bindAddress only accepting port
+// forwarding, so operators reach the tunnel with ssh -D or ssh -L without
+// running SaSSHimi themselves.
+func (t *tunnel) serveSSH(bindAddress string) {
+	config, err := t.sshServerConfig()
+	if err != nil {
+		utils.Logger.Error("Failed to start SSH server: " + err.Error())
+		return
+	}
+
+	ln, err := utils.Listen(bindAddress)
+	if err != nil {
+		utils.Logger.Error("Failed to bind SSH server port " + err.Error())
+		return
+	}
+	defer ln.Close()
+
+	utils.Logger.Notice("SSH server bind at", ln.Addr().String())
+
+	for t.ChannelOpen {
+		conn, err := ln.Accept()
+		if err != nil {
+			utils.Logger.Error("Error in SSH server accept: ", err.Error())
+			return
+		}
+
+		go t.handleSSHConn(conn, config)
+	}
+}
+
+// handleSSHConn forwards the direct-tcpip channels of an SSH connection
+// through the tunnel, the SSH user name is the operator of its clients.
+func (t *tunnel) handleSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		utils.Logger.Warning("SSH handshake from", conn.RemoteAddr().String(), "failed:", err.Error())
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+
+	operator := serverConn.User()
+	utils.Logger.Notice("SSH operator", operator, "connected from", conn.RemoteAddr().String(),
+		"with key", serverConn.Permissions.Extensions["comment"])
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "only port forwarding is allowed")
+			continue
+		}
+
+		var target directTCPIP
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+			continue
+		}
+
+		go t.forwardSSHChannel(newChannel, target, operator, conn.RemoteAddr().String())
+	}
+
+	utils.Logger.Notice("SSH operator", operator, "disconnected")
+}
+
+// forwardSSHChannel connects to target through the agent SOCKS server and
+// copies data between it and the channel.
+func (t *tunnel) forwardSSHChannel(newChannel ssh.NewChannel, target directTCPIP, operator, remoteAddr string) {
+	address := net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port)))
+	remote, err := t.dialThroughAgent(address, remoteAddr, operator)
+	if err != nil {
+		utils.Logger.Debug("SSH forward to", address, "failed:", err.Error())
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer remote.Close()
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		io.Copy(remote, channel)
+		// Responses can still come back, remote is closed once both are done
+		utils.CloseWrite(remote)
+	}()
+
+	go func() {
+		defer wg.Done()
+		io.Copy(channel, remote)
+		channel.CloseWrite()
+	}()
+
+	wg.Wait()
+}
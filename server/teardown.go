@@ -0,0 +1,191 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/agent"
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/state"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+// remoteTeardownScript stops the agents run from a remote directory and
+// removes the files they leave, printing one key=value per action. Agents
+// are found by their executable in /proc, or with fuser elsewhere, and
+// checked again before SIGKILL as their PID may have been reused.
+const remoteTeardownScript = `cd %s 2>/dev/null || { echo missing=1; exit 0; }
+dir=$(pwd -P)
+is_agent() {
+  if [ -d /proc/self ]; then
+    case "$(readlink /proc/$1/exe 2>/dev/null)" in
+      "$dir/.daemon"|"$dir/.daemon (deleted)") return 0;;
+    esac
+    return 1
+  fi
+  case " $(fuser ./.daemon 2>/dev/null) " in
+    *" $1 "*) return 0;;
+  esac
+  return 1
+}
+pids=""
+if [ -d /proc/self ]; then
+  for p in /proc/[0-9]*; do
+    is_agent ${p#/proc/} && pids="$pids ${p#/proc/}"
+  done
+else
+  pids=$(fuser ./.daemon 2>/dev/null)
+fi
+for p in $pids; do kill $p 2>/dev/null && echo "killed=$p"; done
+[ -n "$pids" ] && sleep 2
+for p in $pids; do is_agent $p && kill -9 $p 2>/dev/null && echo "forced=$p"; done
+for f in .daemon ..daemon.* daemon_* %s sasshimi-agent.pid; do
+  [ -e "$f" ] || continue
+  rm -f "./$f" && echo "removed=$dir/$f"
+  [ -e "$f" ] && echo "left=$dir/$f"
+done
+exit 0`
+
+// TeardownResult is what was cleaned in an agent directory of a host
+type TeardownResult struct {
+	Directory string   `json:"directory"`
+	Missing   bool     `json:"missing,omitempty"`
+	Killed    []string `json:"killed"`
+	Removed   []string `json:"removed"`
+	Left      []string `json:"left,omitempty"`
+}
+
+// parseTeardown reads the output of remoteTeardownScript
+func parseTeardown(directory string, output string) TeardownResult {
+	result := TeardownResult{Directory: directory, Killed: []string{}, Removed: []string{}}
+
+	for _, line := range strings.Split(output, "\n") {
+		tokens := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+
+		switch tokens[0] {
+		case "missing":
+			result.Missing = true
+		case "killed":
+			result.Killed = append(result.Killed, tokens[1])
+		case "forced":
+			result.Killed = append(result.Killed, tokens[1]+" (SIGKILL)")
+		case "removed":
+			result.Removed = append(result.Removed, tokens[1])
+		case "left":
+			result.Left = append(result.Left, tokens[1])
+		}
+	}
+	return result
+}
+
+// Teardown connects to the host configured in viper, stops the agents run
+// from its agent path, fallback agent paths and the paths the state file
+// lists for it, and removes the files they left. With Elevate, the cleanup
+// is done as root. Cleaned paths are dropped from the state file.
+func Teardown(viper *viper.Viper) ([]TeardownResult, error) {
+	t := newTunnel(viper)
+
+	err := t.dialSSH()
+	if err != nil {
+		return nil, err
+	}
+	defer t.sshClient.Close()
+
+	if t.remote.restricted {
+		return nil, errors.New("Restricted shell " + t.remote.shell + " cannot run the cleanup commands")
+	}
+
+	err = t.prepareElevation()
+	if err != nil {
+		return nil, err
+	}
+
+	deployed, err := state.Paths(t.getRemoteHost(), t.getUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	directories := append([]string{t.getRemoteAgentPath()}, viper.GetStringSlice("FallbackAgentPaths")...)
+	directories = append(directories, deployed...)
+
+	var results []TeardownResult
+	seen := make(map[string]bool)
+	for _, directory := range directories {
+		if seen[directory] || checkRemotePath(directory) != nil {
+			continue
+		}
+		seen[directory] = true
+
+		result, err := t.teardownDirectory(directory)
+		if err != nil {
+			return results, err
+		}
+
+		audit.Record("agent_teardown", map[string]string{
+			"tunnel":    t.getName(),
+			"remote":    t.getRemoteHost(),
+			"directory": directory,
+			"killed":    strings.Join(result.Killed, ","),
+			"removed":   strings.Join(result.Removed, ","),
+			"left":      strings.Join(result.Left, ","),
+		})
+		results = append(results, result)
+
+		if len(result.Left) == 0 {
+			err = state.Remove(t.getRemoteHost(), t.getUsername(), directory)
+			if err != nil {
+				utils.Logger.Error("Failed to update the state file:", err.Error())
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// teardownCommand returns the command running remoteTeardownScript in
+// directory, as root with Elevate
+func (t *tunnel) teardownCommand(directory string) string {
+	script := fmt.Sprintf(remoteTeardownScript, quoteRemotePath(directory), agent.ShareSocket)
+	if t.elevatePrefix != "" {
+		return t.elevatePrefix + "sh -c " + utils.EscapeBashArgument(script)
+	}
+	return script
+}
+
+// teardownDirectory runs remoteTeardownScript in directory
+func (t *tunnel) teardownDirectory(directory string) (TeardownResult, error) {
+	session, err := t.sshClient.NewSession()
+	if err != nil {
+		return TeardownResult{}, fmt.Errorf("Failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	if t.elevatePrefix != "" && t.elevatePassword != "" {
+		session.Stdin = strings.NewReader(t.elevatePassword + "\n")
+	}
+
+	output, err := session.CombinedOutput(t.shellCommand(t.teardownCommand(directory)))
+	if err != nil {
+		return TeardownResult{}, fmt.Errorf("Cleanup of %s failed: %w: %s", directory, err, strings.TrimSpace(string(output)))
+	}
+
+	return parseTeardown(directory, string(output)), nil
+}
@@ -23,10 +23,13 @@ import (
 )
 
 func TermiosSaveStdin() *unix.Termios {
-	termios, _ := unix.IoctlGetTermios(int(syscall.Stdin), unix.TCGETS)
+	termios, _ := unix.IoctlGetTermios(int(syscall.Stdin), ioctlGetTermios)
 	return termios
 }
 
 func TermiosRestoreStdin(value *unix.Termios) {
-	unix.IoctlSetTermios(int(syscall.Stdin), unix.TCGETS, value)
+	if value == nil {
+		return
+	}
+	unix.IoctlSetTermios(int(syscall.Stdin), ioctlSetTermios, value)
 }
@@ -16,9 +16,27 @@
 
 package server
 
-func TermiosSaveStdin() int {
-	return 0
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// TermiosSaveStdin returns the console mode of stdin, nil when stdin is not
+// a console
+func TermiosSaveStdin() *uint32 {
+	var mode uint32
+	if windows.GetConsoleMode(windows.Handle(os.Stdin.Fd()), &mode) != nil {
+		return nil
+	}
+	return &mode
 }
 
-func TermiosRestoreStdin(value int) {
+// TermiosRestoreStdin sets back the console mode saved by TermiosSaveStdin,
+// changed by password prompts and interrupted programs
+func TermiosRestoreStdin(value *uint32) {
+	if value == nil {
+		return
+	}
+	windows.SetConsoleMode(windows.Handle(os.Stdin.Fd()), *value)
 }
@@ -0,0 +1,211 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+)
+
+// TLSForward is a local port whose plaintext connections reach Target
+// through the tunnel wrapped in TLS, so the destination only sees TLS
+// coming from the remote host
+type TLSForward struct {
+	Bind   string
+	Target string
+
+	// ServerName is checked against the certificate of Target and sent as
+	// SNI (default: the host of Target)
+	ServerName string
+
+	// CA is a PEM file of the authorities trusted for Target (default: the
+	// system ones), Insecure skips the verification
+	CA       string
+	Insecure bool
+
+	// ClientCert and ClientKey are PEM files of a client certificate
+	ClientCert string
+	ClientKey  string
+}
+
+// ParseTLSForward reads a bind=host:port TLS forward specification
+func ParseTLSForward(spec string) (TLSForward, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return TLSForward{}, errors.New("invalid TLS forward " + spec + ", expected bind=host:port")
+	}
+
+	return TLSForward{Bind: parts[0], Target: parts[1]}, nil
+}
+
+// tlsForwards returns the TLS forwards of the TLSForwards configuration
+// key, then the ones given as bind=host:port in TLSForward, which share the
+// TLSClientCert, TLSClientKey, TLSCA and TLSInsecure options
+func (t *tunnel) tlsForwards() ([]TLSForward, error) {
+	var forwards []TLSForward
+
+	err := t.viper.UnmarshalKey("TLSForwards", &forwards)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLSForwards: %w", err)
+	}
+
+	for _, spec := range t.viper.GetStringSlice("TLSForward") {
+		forward, err := ParseTLSForward(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		forward.ClientCert = t.viper.GetString("TLSClientCert")
+		forward.ClientKey = t.viper.GetString("TLSClientKey")
+		forward.CA = t.viper.GetString("TLSCA")
+		forward.Insecure = t.viper.GetBool("TLSInsecure")
+		forwards = append(forwards, forward)
+	}
+
+	return forwards, nil
+}
+
+// tlsConfig returns the client configuration of the TLS connections to
+// the forward target
+func (f TLSForward) tlsConfig() (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(f.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS forward target: %w", err)
+	}
+
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: f.Insecure,
+	}
+
+	if f.ServerName != "" {
+		config.ServerName = f.ServerName
+	}
+
+	if f.CA != "" {
+		caBytes, err := ioutil.ReadFile(f.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, errors.New("no certificate found in " + f.CA)
+		}
+	}
+
+	if f.ClientCert != "" || f.ClientKey != "" {
+		certificate, err := tls.LoadX509KeyPair(f.ClientCert, f.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// serveTLSForwards starts the TLS forwards of the tunnel configuration
+func (t *tunnel) serveTLSForwards() {
+	forwards, err := t.tlsForwards()
+	if err != nil {
+		utils.Logger.Error(err.Error())
+		return
+	}
+
+	for _, forward := range forwards {
+		go t.serveTLSForward(forward)
+	}
+}
+
+// serveTLSForward accepts plaintext connections on the forward bind
+// address and wraps them in TLS to its target
+func (t *tunnel) serveTLSForward(forward TLSForward) {
+	config, err := forward.tlsConfig()
+	if err != nil {
+		utils.Logger.Error("TLS forward to", forward.Target, "disabled:", err.Error())
+		return
+	}
+
+	ln, err := utils.ListenProxy(forward.Bind, t.viper.GetBool("Expose"))
+	if err != nil {
+		utils.Logger.Error("Failed to bind TLS forward port " + err.Error())
+		return
+	}
+	defer ln.Close()
+
+	utils.Logger.Notice("TLS forward bind at", ln.Addr().String(), "to", forward.Target)
+
+	operator := localOperator()
+	for t.ChannelOpen {
+		conn, err := ln.Accept()
+		if err != nil {
+			utils.Logger.Error("Error in TLS forward accept: ", err.Error())
+			return
+		}
+
+		go t.forwardTLS(conn, forward.Target, config, operator)
+	}
+}
+
+// forwardTLS copies data between conn and a TLS connection to target
+// opened through the agent
+func (t *tunnel) forwardTLS(conn net.Conn, target string, config *tls.Config, operator string) {
+	defer conn.Close()
+
+	remote, err := t.dialThroughAgent(target, conn.RemoteAddr().String(), operator)
+	if err != nil {
+		utils.Logger.Debug("TLS forward to", target, "failed:", err.Error())
+		return
+	}
+
+	tlsConn := tls.Client(remote, config)
+	defer tlsConn.Close()
+
+	err = tlsConn.Handshake()
+	if err != nil {
+		utils.Logger.Warning("TLS handshake with", target, "failed:", err.Error())
+		return
+	}
+
+	splice(conn, tlsConn)
+}
+
+// splice copies data both ways between a and b until one of them is closed
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copyClose := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		dst.Close()
+		src.Close()
+	}
+
+	go copyClose(a, b)
+	go copyClose(b, a)
+
+	wg.Wait()
+}
@@ -0,0 +1,128 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/common"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// upgradeTimeout is how long the new agent has to be sent and to reply
+// to the setup message once restarted
+const upgradeTimeout = 5 * time.Minute
+
+// upgradeAgent sends the agent binary at path over the channel and restarts
+// the agent with it. The tunnel stays open, connections are closed.
+func (t *tunnel) upgradeAgent(path string) error {
+	if utils.RelayOnly {
+		return errors.New("Agent upgrade is disabled in relay-only builds")
+	}
+	if t.BinaryFraming {
+		return errors.New("The interpreter agent cannot be upgraded")
+	}
+
+	hello, ok := t.agentHello.Load().(common.AgentHello)
+	if !ok || hello.Protocol < 2 {
+		return errors.New("The agent does not support upgrades, it must be redeployed")
+	}
+
+	binary, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read agent binary: %w", err)
+	}
+	sum := sha256.Sum256(binary)
+
+	utils.Logger.Notice("Sending agent", path, "to", t.getName())
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	remote.SetDeadline(time.Now().Add(upgradeTimeout))
+
+	client := common.NewClient(common.UpgradeClientPrefix+utils.RandStringRunes(8), local, t.OutQueue)
+	client.SetFrameSize(t.viper.GetInt("FrameSize"))
+	t.ClientsLock.Lock()
+	t.Clients[client.Id] = client
+	t.ClientsLock.Unlock()
+	go client.ReadFromClientToChannel()
+
+	reply := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(remote).ReadString('\n')
+		reply <- strings.TrimSpace(line)
+	}()
+
+	_, err = fmt.Fprintf(remote, "%d %s\n", len(binary), hex.EncodeToString(sum[:]))
+	if err == nil {
+		_, err = remote.Write(binary)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to send agent binary: %w", err)
+	}
+
+	if answer := <-reply; answer != "OK" {
+		return errors.New("Agent refused the upgrade: " + strings.TrimPrefix(answer, "ERROR "))
+	}
+
+	// Connections do not survive the agent process
+	t.ClientsLock.Lock()
+	for id, client := range t.Clients {
+		client.Terminate()
+		client.NotifyEOF(true)
+		delete(t.Clients, id)
+	}
+	t.ClientsLock.Unlock()
+
+	helloCount := atomic.LoadInt32(&t.helloCount)
+	t.OutQueue.Push(common.NewRestartMessage())
+
+	deadline := time.Now().Add(upgradeTimeout)
+	for atomic.LoadInt32(&t.helloCount) == helloCount {
+		if !t.ChannelOpen || time.Now().After(deadline) {
+			return errors.New("The agent did not come back after the restart")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	hello = t.agentHello.Load().(common.AgentHello)
+	utils.Logger.Notice("Agent restarted with version", hello.Version)
+	audit.Record("agent_upgrade", map[string]string{"tunnel": t.getName(), "path": path, "sha256": hex.EncodeToString(sum[:])})
+	return nil
+}
+
+// upgradeWhenReady upgrades the agent with the binary at path once it
+// replied to the setup message
+func (t *tunnel) upgradeWhenReady(path string) {
+	select {
+	case <-t.hello:
+	case <-time.After(helloTimeout):
+		utils.Logger.Error("Agent upgrade skipped, the agent did not report its version")
+		return
+	}
+
+	if err := t.upgradeAgent(path); err != nil {
+		utils.Logger.Error(err.Error())
+	}
+}
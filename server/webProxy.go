@@ -0,0 +1,147 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// webProxy serves an internal web application on a local port, as if it
+// was hosted there
+type webProxy struct {
+	tunnel   *tunnel
+	target   *url.URL
+	operator string
+}
+
+// newWebProxy returns the reverse proxy of the target URL, whose
+// connections go through the tunnel
+func (t *tunnel) newWebProxy(target string, insecure bool) (*httputil.ReverseProxy, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid web target: %w", err)
+	}
+
+	if targetURL.Scheme != "http" && targetURL.Scheme != "https" || targetURL.Host == "" {
+		return nil, errors.New("invalid web target " + target + ", expected http://host[:port] or https://host[:port]")
+	}
+
+	w := &webProxy{tunnel: t, target: targetURL, operator: localOperator()}
+
+	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	director := proxy.Director
+	proxy.Director = func(request *http.Request) {
+		director(request)
+		request.Host = targetURL.Host
+		if origin := request.Header.Get("Origin"); origin != "" {
+			request.Header.Set("Origin", targetURL.Scheme+"://"+targetURL.Host)
+		}
+	}
+	proxy.Transport = &http.Transport{
+		Dial:            w.dial,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+	}
+	proxy.ModifyResponse = w.rewriteResponse
+
+	return proxy, nil
+}
+
+func (w *webProxy) dial(network, address string) (net.Conn, error) {
+	return w.tunnel.dialThroughAgent(address, "web", w.operator)
+}
+
+// rewriteResponse points the redirections to the target back to this
+// proxy, and makes the cookies of the target valid for it
+func (w *webProxy) rewriteResponse(response *http.Response) error {
+	localHost, _ := response.Request.Context().Value(localHostKey{}).(string)
+	local := "http://" + localHost
+
+	if location := response.Header.Get("Location"); location != "" {
+		if locationURL, err := url.Parse(location); err == nil && strings.EqualFold(locationURL.Host, w.target.Host) {
+			response.Header.Set("Location", local+locationURL.RequestURI())
+		}
+	}
+
+	cookies := response.Header["Set-Cookie"]
+	for i, cookie := range cookies {
+		cookies[i] = rewriteCookie(cookie)
+	}
+
+	return nil
+}
+
+// localHostKey is the request context key of the host the client used to
+// reach the proxy, saved before the request is rewritten
+type localHostKey struct{}
+
+// rewriteCookie removes the Domain and Secure attributes of a Set-Cookie
+// header, so the browser sends the cookie back to the local plain HTTP port
+func rewriteCookie(cookie string) string {
+	attributes := strings.Split(cookie, ";")
+	kept := attributes[:1]
+
+	for _, attribute := range attributes[1:] {
+		parts := strings.SplitN(attribute, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "domain" || name == "secure" {
+			continue
+		}
+		if name == "samesite" && len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[1]), "none") {
+			// SameSite=None requires Secure
+			continue
+		}
+		kept = append(kept, attribute)
+	}
+
+	return strings.Join(kept, ";")
+}
+
+// serveWeb reverse proxies target, an internal http or https URL, on
+// bindAddress through the tunnel
+func (t *tunnel) serveWeb(bindAddress string, target string, insecure bool) {
+	proxy, err := t.newWebProxy(target, insecure)
+	if err != nil {
+		utils.Logger.Error(err.Error())
+		return
+	}
+
+	ln, err := utils.ListenProxy(bindAddress, t.viper.GetBool("Expose"))
+	if err != nil {
+		utils.Logger.Error("Failed to bind web port " + err.Error())
+		return
+	}
+	defer ln.Close()
+
+	utils.Logger.Notice("Web proxy of", target, "bind at", "http://"+ln.Addr().String())
+
+	handler := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		ctx := context.WithValue(request.Context(), localHostKey{}, request.Host)
+		proxy.ServeHTTP(response, request.WithContext(ctx))
+	})
+
+	err = http.Serve(ln, handler)
+	if err != nil && t.ChannelOpen {
+		utils.Logger.Error("Error in web port: ", err.Error())
+	}
+}
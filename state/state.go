@@ -0,0 +1,165 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package state keeps the local list of the agents deployed on remote hosts,
+// so none is forgotten at the end of an engagement. Uploads add an entry and
+// cleanups remove it.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Agent is an agent deployed on a remote host
+type Agent struct {
+	Host     string    `json:"host"`
+	User     string    `json:"user"`
+	Tunnel   string    `json:"tunnel"`
+	Path     string    `json:"path"`
+	SHA256   string    `json:"sha256"`
+	Time     time.Time `json:"time"`
+	Operator string    `json:"operator"`
+}
+
+var path string
+var lock sync.Mutex
+
+// Enable keeps the state in the file at path
+func Enable(statePath string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	path = statePath
+}
+
+// Path returns the path of the state file, or an empty string if the state
+// is not kept
+func Path() string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return path
+}
+
+// Load returns the agents listed in the state file at path, oldest first.
+// A missing file lists no agent.
+func Load(statePath string) ([]Agent, error) {
+	data, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return []Agent{}, nil
+	}
+	if err != nil {
+		return nil, errors.New("failed to read state file: " + err.Error())
+	}
+
+	agents := []Agent{}
+	if err := json.Unmarshal(data, &agents); err != nil {
+		return nil, errors.New("failed to parse state file " + statePath + ": " + err.Error())
+	}
+	return agents, nil
+}
+
+// Add records agent in the state file, replacing the entry of the same
+// host, user and path
+func Add(agent Agent) error {
+	return update(func(agents []Agent) []Agent {
+		return append(without(agents, agent.Host, agent.User, agent.Path), agent)
+	})
+}
+
+// Remove drops the agent of user on host at path from the state file
+func Remove(host string, user string, agentPath string) error {
+	return update(func(agents []Agent) []Agent {
+		return without(agents, host, user, agentPath)
+	})
+}
+
+// Paths returns the paths of the agents of user on host in the state file.
+// Relative paths are relative to the home directory of user.
+func Paths(host string, user string) ([]string, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if path == "" {
+		return nil, nil
+	}
+
+	agents, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, agent := range agents {
+		if agent.Host == host && agent.User == user {
+			paths = append(paths, agent.Path)
+		}
+	}
+	return paths, nil
+}
+
+func without(agents []Agent, host string, user string, agentPath string) []Agent {
+	kept := agents[:0]
+	for _, agent := range agents {
+		if agent.Host != host || agent.User != user || agent.Path != agentPath {
+			kept = append(kept, agent)
+		}
+	}
+	return kept
+}
+
+// update applies change to the agents of the state file and writes it back,
+// replacing the file at once so it is never left half written
+func update(change func([]Agent) []Agent) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if path == "" {
+		return nil
+	}
+
+	agents, err := Load(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(change(agents), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".sasshimi-state")
+	if err != nil {
+		return errors.New("failed to write state file: " + err.Error())
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(append(data, '\n'))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		return errors.New("failed to write state file: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package teamserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"io"
+	"net"
+)
+
+type operatorClient struct {
+	address string
+	config  *tls.Config
+}
+
+func newOperatorClient(address string, files TLSFiles) (*operatorClient, error) {
+	cert, pool, err := files.load()
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.New("Invalid team server address: " + err.Error())
+	}
+
+	return &operatorClient{
+		address: address,
+		config: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			ServerName:   host,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}, nil
+}
+
+// open sends req to the team server and returns the connection once the
+// request is accepted.
+func (c *operatorClient) open(req request) (net.Conn, error) {
+	conn, err := tls.Dial("tcp", c.address, c.config)
+	if err != nil {
+		return nil, errors.New("Failed to connect to team server: " + err.Error())
+	}
+
+	err = writeRequest(conn, req)
+	if err == nil {
+		err = readResponse(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func relay(local net.Conn, remote net.Conn) {
+	go func() {
+		io.Copy(remote, local)
+		remote.Close()
+	}()
+
+	io.Copy(local, remote)
+	local.Close()
+}
+
+// RunOperator binds a local SOCKS endpoint on bindAddress whose connections
+// go through the tunnel to target owned by the team server.
+func RunOperator(teamServer string, files TLSFiles, target string, bindAddress string, expose bool) error {
+	client, err := newOperatorClient(teamServer, files)
+	if err != nil {
+		return err
+	}
+
+	// Fail early if the team server refuses the target
+	conn, err := client.open(request{Command: commandConnect, Target: target})
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	utils.RaiseFileLimit()
+
+	ln, err := utils.ListenProxy(bindAddress, expose)
+	if err != nil {
+		return errors.New("Failed to bind local port " + err.Error())
+	}
+	defer ln.Close()
+
+	utils.Logger.Notice("Proxy bind at", ln.Addr().String(), "through team server", teamServer)
+
+	for {
+		local, err := utils.Accept(ln)
+		if err != nil {
+			return errors.New("Error in connection accept: " + err.Error())
+		}
+
+		go func() {
+			remote, err := client.open(request{Command: commandConnect, Target: target})
+			if err != nil {
+				utils.Logger.Error(err.Error())
+				local.Close()
+				return
+			}
+
+			relay(local, remote)
+		}()
+	}
+}
+
+// FetchAudit writes the session log of the team server to output
+func FetchAudit(teamServer string, files TLSFiles, output io.Writer) error {
+	return fetch(teamServer, files, commandAudit, output)
+}
+
+// FetchStats writes the traffic of every operator of the team server to
+// output.
+func FetchStats(teamServer string, files TLSFiles, output io.Writer) error {
+	return fetch(teamServer, files, commandStats, output)
+}
+
+func fetch(teamServer string, files TLSFiles, command string, output io.Writer) error {
+	client, err := newOperatorClient(teamServer, files)
+	if err != nil {
+		return err
+	}
+
+	conn, err := client.open(request{Command: command})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = io.Copy(output, conn)
+	return err
+}
@@ -0,0 +1,130 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package teamserver lets several operators share the tunnels opened by a
+// single SaSSHimi process. Operators authenticate with TLS client
+// certificates and every connection starts with a one line JSON request,
+// answered with "OK" or "ERR <reason>", before the SOCKS traffic.
+package teamserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+const (
+	commandConnect = "connect"
+	commandAudit   = "audit"
+	commandStats   = "stats"
+)
+
+const maxLineLength = 4096
+
+type request struct {
+	Command string `json:"command"`
+	Target  string `json:"target,omitempty"`
+}
+
+// TLSFiles are the PEM files used to authenticate both ends. CA signs the
+// certificates of the other end.
+type TLSFiles struct {
+	Cert string
+	Key  string
+	CA   string
+}
+
+func (f TLSFiles) load() (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+	if err != nil {
+		return cert, nil, errors.New("Failed to load certificate: " + err.Error())
+	}
+
+	caData, err := ioutil.ReadFile(f.CA)
+	if err != nil {
+		return cert, nil, errors.New("Failed to read CA: " + err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return cert, nil, errors.New("No certificate found in CA file " + f.CA)
+	}
+
+	return cert, pool, nil
+}
+
+// readLine reads a line one byte at a time, so nothing that follows it is
+// consumed from conn.
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+
+	for len(line) < maxLineLength {
+		_, err := conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		if buf[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, buf[0])
+	}
+
+	return "", errors.New("line too long")
+}
+
+func writeRequest(conn net.Conn, req request) error {
+	data, _ := json.Marshal(req)
+	_, err := conn.Write(append(data, '\n'))
+	return err
+}
+
+func readRequest(conn net.Conn) (request, error) {
+	var req request
+
+	line, err := readLine(conn)
+	if err != nil {
+		return req, err
+	}
+
+	err = json.Unmarshal([]byte(line), &req)
+	return req, err
+}
+
+func writeResponse(conn net.Conn, err error) error {
+	response := "OK\n"
+	if err != nil {
+		response = "ERR " + strings.Replace(err.Error(), "\n", " ", -1) + "\n"
+	}
+
+	_, err = conn.Write([]byte(response))
+	return err
+}
+
+func readResponse(conn net.Conn) error {
+	line, err := readLine(conn)
+	if err != nil {
+		return errors.New("Failed to read team server response: " + err.Error())
+	}
+
+	if line != "OK" {
+		return errors.New("Team server refused request: " + strings.TrimPrefix(line, "ERR "))
+	}
+
+	return nil
+}
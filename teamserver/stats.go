@@ -0,0 +1,92 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package teamserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+type statsKey struct {
+	operator string
+	tunnel   string
+}
+
+// operatorStats accumulates the traffic of one operator through one tunnel
+type operatorStats struct {
+	connections uint64
+	upload      uint64
+	download    uint64
+}
+
+// countingConn counts the traffic going through an operator connection
+type countingConn struct {
+	net.Conn
+	stats *operatorStats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.stats.upload, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.stats.download, uint64(n))
+	return n, err
+}
+
+// operatorStats returns the stats of operator through tunnel, creating them
+// if needed.
+func (s *teamServer) operatorStats(operator string, tunnel string) *operatorStats {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	key := statsKey{operator: operator, tunnel: tunnel}
+	stats, prs := s.stats[key]
+	if !prs {
+		stats = &operatorStats{}
+		s.stats[key] = stats
+	}
+
+	return stats
+}
+
+func (s *teamServer) writeStats(output io.Writer) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	keys := make([]statsKey, 0, len(s.stats))
+	for key := range s.stats {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].operator != keys[j].operator {
+			return keys[i].operator < keys[j].operator
+		}
+		return keys[i].tunnel < keys[j].tunnel
+	})
+
+	fmt.Fprintf(output, "%-20s %-20s %12s %15s %15s\n", "OPERATOR", "TUNNEL", "CONNECTIONS", "UPLOAD", "DOWNLOAD")
+	for _, key := range keys {
+		stats := s.stats[key]
+		fmt.Fprintf(output, "%-20s %-20s %12d %15d %15d\n", key.operator, key.tunnel,
+			atomic.LoadUint64(&stats.connections), atomic.LoadUint64(&stats.upload), atomic.LoadUint64(&stats.download))
+	}
+}
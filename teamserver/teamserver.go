@@ -0,0 +1,217 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package teamserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/audit"
+	"github.com/rsrdesarrollo/SaSSHimi/server"
+	"github.com/rsrdesarrollo/SaSSHimi/utils"
+	"github.com/spf13/viper"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const requestTimeout = 10 * time.Second
+
+// HostConfig returns the configuration of the host target, or nil if
+// operators are not allowed to open tunnels to it.
+type HostConfig func(target string) *viper.Viper
+
+type teamServer struct {
+	hostConfig   HostConfig
+	verboseLevel int
+
+	endpoints     map[string]*server.Endpoint
+	endpointsLock sync.Mutex
+
+	stats     map[statsKey]*operatorStats
+	statsLock sync.Mutex
+}
+
+// endpoint returns the tunnel to target, opening it if needed
+func (s *teamServer) endpoint(target string) (*server.Endpoint, error) {
+	s.endpointsLock.Lock()
+	defer s.endpointsLock.Unlock()
+
+	endpoint, prs := s.endpoints[target]
+	if prs && endpoint.Alive() {
+		return endpoint, nil
+	}
+
+	hostViper := s.hostConfig(target)
+	if hostViper == nil {
+		return nil, errors.New("unknown host " + target)
+	}
+
+	endpoint = server.OpenEndpoint(hostViper, s.verboseLevel)
+	s.endpoints[target] = endpoint
+
+	utils.Logger.Notice("Opening tunnel", endpoint.Name(), "to", target)
+	audit.Record("team_tunnel_open", map[string]string{"tunnel": endpoint.Name(), "target": target})
+
+	return endpoint, nil
+}
+
+func (s *teamServer) endpointCount() int {
+	s.endpointsLock.Lock()
+	defer s.endpointsLock.Unlock()
+	return len(s.endpoints)
+}
+
+func (s *teamServer) statsCount() int {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	return len(s.stats)
+}
+
+func (s *teamServer) handleOperator(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	err := conn.Handshake()
+	if err != nil {
+		utils.Logger.Warning("TLS handshake failed with", conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+
+	operator := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+
+	req, err := readRequest(conn)
+	if err != nil {
+		utils.Logger.Warning("Invalid request from operator", operator, err.Error())
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	utils.Logger.Debug("Operator", operator, "request", req.Command, req.Target)
+
+	switch req.Command {
+	case commandConnect:
+		var endpoint *server.Endpoint
+		endpoint, err = s.endpoint(req.Target)
+		if err == nil {
+			err = writeResponse(conn, nil)
+		}
+		if err == nil {
+			stats := s.operatorStats(operator, endpoint.Name())
+			atomic.AddUint64(&stats.connections, 1)
+			err = endpoint.Serve(&countingConn{Conn: conn, stats: stats}, operator)
+		}
+	case commandAudit:
+		audit.Record("team_audit_read", map[string]string{"operator": operator})
+		err = s.sendAudit(conn)
+	case commandStats:
+		err = writeResponse(conn, nil)
+		if err == nil {
+			s.writeStats(conn)
+			conn.Close()
+		}
+	default:
+		err = errors.New("unknown command " + req.Command)
+	}
+
+	if err != nil {
+		utils.Logger.Warning("Request from operator", operator, "failed:", err.Error())
+		writeResponse(conn, err)
+		conn.Close()
+	}
+}
+
+func (s *teamServer) sendAudit(conn net.Conn) error {
+	path := audit.Path()
+	if path == "" {
+		return errors.New("session log is not enabled on the team server")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = writeResponse(conn, nil)
+	if err != nil {
+		return err
+	}
+
+	io.Copy(conn, file)
+	conn.Close()
+	return nil
+}
+
+func (s *teamServer) close() {
+	s.endpointsLock.Lock()
+	defer s.endpointsLock.Unlock()
+
+	for target, endpoint := range s.endpoints {
+		utils.Logger.Notice("Closing tunnel", endpoint.Name(), "to", target)
+		endpoint.Close()
+	}
+}
+
+// Run starts the team server on listenAddress. Only operators presenting a
+// certificate signed by the CA in files are accepted.
+func Run(listenAddress string, files TLSFiles, hostConfig HostConfig, verboseLevel int) error {
+	cert, pool, err := files.load()
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	utils.RaiseFileLimit()
+
+	ln, err := utils.Listen(listenAddress)
+	if err != nil {
+		return errors.New("Failed to bind team server port " + err.Error())
+	}
+
+	s := &teamServer{
+		hostConfig:   hostConfig,
+		verboseLevel: verboseLevel,
+		endpoints:    make(map[string]*server.Endpoint),
+		stats:        make(map[statsKey]*operatorStats),
+	}
+
+	utils.ExitCallback(s.close)
+
+	go utils.WatchLeaks(
+		utils.LeakCounter{Name: "endpoints", Count: s.endpointCount},
+		utils.LeakCounter{Name: "stats", Count: s.statsCount},
+	)
+
+	utils.Logger.Notice("Team server listening at", ln.Addr().String())
+
+	for {
+		conn, err := utils.Accept(ln)
+		if err != nil {
+			return errors.New("Error in connection accept: " + err.Error())
+		}
+
+		go s.handleOperator(tls.Server(conn, config))
+	}
+}
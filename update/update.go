@@ -0,0 +1,254 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package update downloads the releases of SaSSHimi. Every release has a
+// SHA256SUMS asset listing the hash of the other assets. The release tag and
+// SHA256SUMS are signed with the ed25519 release key in SHA256SUMS.sig, so
+// an asset is only installed when both the signature and its hash match,
+// and an older release cannot be passed off as the latest one.
+package update
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/rsrdesarrollo/SaSSHimi/version"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChecksumsAsset is the name of the asset listing the SHA-256 of the others
+const ChecksumsAsset = "SHA256SUMS"
+
+// SignatureAsset is the name of the ed25519 signature of the release tag and
+// ChecksumsAsset, see SignedPayload
+const SignatureAsset = ChecksumsAsset + ".sig"
+
+var client = &http.Client{Timeout: 5 * time.Minute}
+
+// Release is a published release and the download URL of its assets
+type Release struct {
+	Tag    string
+	Assets map[string]string
+}
+
+// Latest returns the latest release published on the repository
+func Latest() (*Release, error) {
+	apiURL := strings.Replace(version.RepoURL, "https://github.com/", "https://api.github.com/repos/", 1) + "/releases/latest"
+
+	response, err := client.Get(apiURL)
+	if err != nil {
+		return nil, errors.New("Failed to get the latest release: " + err.Error())
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("Failed to get the latest release: " + response.Status)
+	}
+
+	var latest struct {
+		TagName string `json:"tag_name"`
+		Assets  []struct {
+			Name string `json:"name"`
+			URL  string `json:"browser_download_url"`
+		} `json:"assets"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&latest)
+	if err != nil {
+		return nil, errors.New("Failed to read the latest release: " + err.Error())
+	}
+
+	release := &Release{Tag: latest.TagName, Assets: make(map[string]string)}
+	for _, asset := range latest.Assets {
+		release.Assets[asset.Name] = asset.URL
+	}
+	return release, nil
+}
+
+// SignedPayload returns what the release key signs for the release tag: the
+// tag on its own line followed by the content of ChecksumsAsset
+func SignedPayload(tag string, sums []byte) []byte {
+	return append([]byte(tag+"\n"), sums...)
+}
+
+// parseVersion returns the numbers of a vMAJOR.MINOR.PATCH tag, a pre-release
+// suffix after a dash is ignored
+func parseVersion(tag string) ([]int, error) {
+	numbers := strings.SplitN(strings.TrimPrefix(tag, "v"), "-", 2)[0]
+
+	var parsed []int
+	for _, field := range strings.Split(numbers, ".") {
+		number, err := strconv.Atoi(field)
+		if err != nil || number < 0 {
+			return nil, errors.New("Invalid version " + tag)
+		}
+		parsed = append(parsed, number)
+	}
+	return parsed, nil
+}
+
+// IsNewer tells if the release tag is a later version than current
+func IsNewer(tag string, current string) (bool, error) {
+	release, err := parseVersion(tag)
+	if err != nil {
+		return false, err
+	}
+	running, err := parseVersion(current)
+	if err != nil {
+		return false, err
+	}
+
+	for i := 0; i < len(release) || i < len(running); i++ {
+		var a, b int
+		if i < len(release) {
+			a = release[i]
+		}
+		if i < len(running) {
+			b = running[i]
+		}
+		if a != b {
+			return a > b, nil
+		}
+	}
+	return false, nil
+}
+
+// BinaryAsset returns the name of the release asset of the client for goos
+// and goarch, the relay-only build when relayOnly is set
+func BinaryAsset(goos string, goarch string, relayOnly bool) string {
+	name := version.ToolName + "-"
+	if relayOnly {
+		name += "relayonly-"
+	}
+	name += goos + "-" + goarch
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func (r *Release) fetch(name string) ([]byte, error) {
+	url, prs := r.Assets[name]
+	if !prs {
+		return nil, errors.New("Release " + r.Tag + " has no asset " + name)
+	}
+
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, errors.New("Failed to download " + name + ": " + err.Error())
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("Failed to download " + name + ": " + response.Status)
+	}
+
+	return ioutil.ReadAll(response.Body)
+}
+
+// Checksums downloads the signed list of SHA-256 of the release assets, and
+// returns it by asset name once its signature, together with the release
+// tag, is verified with publicKey
+func (r *Release) Checksums(publicKey ed25519.PublicKey) (map[string]string, error) {
+	sums, err := r.fetch(ChecksumsAsset)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := r.fetch(SignatureAsset)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ed25519.Verify(publicKey, SignedPayload(r.Tag, sums), signature) {
+		return nil, errors.New("Invalid signature of " + ChecksumsAsset + " and tag of release " + r.Tag)
+	}
+
+	// Lines of sha256sum: hash, two spaces or space and star, name
+	checksums := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(string(sums)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			checksums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+		}
+	}
+	return checksums, nil
+}
+
+// Install downloads the asset name, checks its SHA-256 against checksums and
+// replaces the file at path with it. The asset is written next to path and
+// renamed over it, so path is never left half written.
+func (r *Release) Install(name string, checksums map[string]string, path string) error {
+	sum, prs := checksums[name]
+	if !prs {
+		return errors.New(ChecksumsAsset + " of release " + r.Tag + " has no hash for " + name)
+	}
+
+	data, err := r.fetch(name)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(data)
+	if hex.EncodeToString(hash[:]) != sum {
+		return errors.New("SHA-256 of " + name + " does not match " + ChecksumsAsset)
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return errors.New("Failed to write " + name + ": " + err.Error())
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0755)
+	}
+	if err != nil {
+		return errors.New("Failed to write " + name + ": " + err.Error())
+	}
+
+	return replaceFile(temp.Name(), path)
+}
+
+// replaceFile renames source over path. Windows refuses to replace a running
+// executable but lets it be renamed, so it is moved aside first.
+func replaceFile(source string, path string) error {
+	if runtime.GOOS == "windows" {
+		old := path + ".old"
+		os.Remove(old)
+		if err := os.Rename(path, old); err != nil && !os.IsNotExist(err) {
+			return errors.New("Failed to move " + path + " aside: " + err.Error())
+		}
+	}
+
+	err := os.Rename(source, path)
+	if err != nil {
+		return errors.New("Failed to replace " + path + ": " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"net"
+)
+
+type lingerer interface {
+	SetLinger(sec int) error
+}
+
+// SetLinger sets how long closing conn waits for unsent data, on
+// connections that support it
+func SetLinger(conn net.Conn, sec int) error {
+	l, ok := conn.(lingerer)
+	if !ok {
+		return nil
+	}
+	return l.SetLinger(sec)
+}
+
+// ResetConn closes conn so its peer sees a connection reset instead of a
+// graceful close, on connections that support it
+func ResetConn(conn net.Conn) error {
+	SetLinger(conn, 0)
+	return conn.Close()
+}
+
+// IsConnReset tells whether err reports a connection reset by the peer
+func IsConnReset(err error) bool {
+	return errors.Is(err, connResetErrno)
+}
@@ -0,0 +1,47 @@
+//go:build windows
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+var procSetConsoleCtrlHandler = windows.NewLazySystemDLL("kernel32.dll").NewProc("SetConsoleCtrlHandler")
+
+// notifyConsoleClose sends SIGTERM to stop when the console window is
+// closed, or the user logs off or the system shuts down. Windows ends the
+// process when the handler returns, so it never returns and the process
+// exits once the exit callback is done, or is killed after a few seconds.
+func notifyConsoleClose(stop chan<- os.Signal) {
+	handler := syscall.NewCallback(func(ctrlType uint32) uintptr {
+		switch ctrlType {
+		case windows.CTRL_CLOSE_EVENT, windows.CTRL_LOGOFF_EVENT, windows.CTRL_SHUTDOWN_EVENT:
+			select {
+			case stop <- syscall.SIGTERM:
+			default:
+			}
+			select {}
+		}
+		// Let the next handler, the Go runtime one, handle Ctrl+C
+		return 0
+	})
+
+	procSetConsoleCtrlHandler.Call(handler, 1)
+}
@@ -0,0 +1,52 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var engagementDir string
+
+// SetEngagementDir makes dir, created readable by the current user only,
+// the directory of the files written by the client
+func SetEngagementDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.New("failed to create engagement directory: " + err.Error())
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return errors.New("failed to restrict engagement directory: " + err.Error())
+	}
+
+	engagementDir = dir
+	return nil
+}
+
+// EngagementDir returns the engagement directory, or an empty string if
+// none is set
+func EngagementDir() string {
+	return engagementDir
+}
+
+// ArtifactPath returns where the client reads and writes the file at path:
+// in the engagement directory if one is set and path is relative
+func ArtifactPath(path string) string {
+	if engagementDir == "" || path == "" || path == "-" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(engagementDir, path)
+}
@@ -17,22 +17,32 @@ package utils
 import (
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 )
 
+// hangupReloads is set when SIGHUP reloads the configuration instead of
+// stopping the process
+var hangupReloads int32
+
 func ExitCallback(callBack func()) {
 
-	var gracefulStop = make(chan os.Signal)
+	var gracefulStop = make(chan os.Signal, 1)
 
 	signal.Notify(gracefulStop, syscall.SIGTERM)
 	signal.Notify(gracefulStop, syscall.SIGINT)
 	signal.Notify(gracefulStop, syscall.SIGKILL)
 	signal.Notify(gracefulStop, syscall.SIGQUIT)
 	signal.Notify(gracefulStop, syscall.SIGHUP)
+	notifyConsoleClose(gracefulStop)
 
 	go func() {
-		<-gracefulStop
-		callBack()
-		os.Exit(0)
+		for sig := range gracefulStop {
+			if sig == syscall.SIGHUP && atomic.LoadInt32(&hangupReloads) == 1 {
+				continue
+			}
+			callBack()
+			os.Exit(0)
+		}
 	}()
 }
@@ -0,0 +1,39 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrHalfCloseUnsupported is returned by CloseWrite for connections that
+// cannot be half-closed, like named pipes
+var ErrHalfCloseUnsupported = errors.New("half-close not supported")
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite shuts down the writing side of conn so its peer reads EOF while
+// it can still send
+func CloseWrite(conn net.Conn) error {
+	writer, ok := conn.(closeWriter)
+	if !ok {
+		return ErrHalfCloseUnsupported
+	}
+
+	return writer.CloseWrite()
+}
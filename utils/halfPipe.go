@@ -0,0 +1,74 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"net"
+	"time"
+)
+
+// halfPipeConn is one end of HalfClosePipe, made of a net.Pipe per
+// direction so each direction can be closed alone
+type halfPipeConn struct {
+	reader net.Conn
+	writer net.Conn
+}
+
+// HalfClosePipe is like net.Pipe, but its ends support CloseWrite: the
+// other end reads EOF and can still write
+func HalfClosePipe() (net.Conn, net.Conn) {
+	aReader, bWriter := net.Pipe()
+	bReader, aWriter := net.Pipe()
+
+	return &halfPipeConn{reader: aReader, writer: aWriter}, &halfPipeConn{reader: bReader, writer: bWriter}
+}
+
+func (c *halfPipeConn) Read(data []byte) (int, error) {
+	return c.reader.Read(data)
+}
+
+func (c *halfPipeConn) Write(data []byte) (int, error) {
+	return c.writer.Write(data)
+}
+
+func (c *halfPipeConn) CloseWrite() error {
+	return c.writer.Close()
+}
+
+func (c *halfPipeConn) Close() error {
+	c.writer.Close()
+	return c.reader.Close()
+}
+
+func (c *halfPipeConn) LocalAddr() net.Addr {
+	return pipeAddr{}
+}
+
+func (c *halfPipeConn) RemoteAddr() net.Addr {
+	return pipeAddr{}
+}
+
+func (c *halfPipeConn) SetDeadline(t time.Time) error {
+	c.writer.SetWriteDeadline(t)
+	return c.reader.SetReadDeadline(t)
+}
+
+func (c *halfPipeConn) SetReadDeadline(t time.Time) error {
+	return c.reader.SetReadDeadline(t)
+}
+
+func (c *halfPipeConn) SetWriteDeadline(t time.Time) error {
+	return c.writer.SetWriteDeadline(t)
+}
@@ -0,0 +1,88 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Number of samples in a row a value must grow before a leak is reported
+const leakGrowthSamples = 5
+
+var leakInterval time.Duration
+
+// LeakCounter samples the size of a resource watched by WatchLeaks
+type LeakCounter struct {
+	Name  string
+	Count func() int
+}
+
+// SetLeakInterval sets the time between two WatchLeaks samples, zero
+// disables leak detection.
+func SetLeakInterval(interval time.Duration) {
+	leakInterval = interval
+}
+
+// LeakInterval returns the time between two WatchLeaks samples
+func LeakInterval() time.Duration {
+	return leakInterval
+}
+
+// WatchLeaks logs the number of goroutines, open files and the values of
+// counters at every leak interval, and warns when one of them keeps growing.
+// It returns immediately if leak detection is disabled.
+func WatchLeaks(counters ...LeakCounter) {
+	if leakInterval <= 0 {
+		return
+	}
+
+	counters = append([]LeakCounter{
+		{"goroutines", runtime.NumGoroutine},
+		{"files", openFiles},
+	}, counters...)
+
+	previous := make([]int, len(counters))
+	growth := make([]int, len(counters))
+
+	for {
+		fields := make([]string, 0, len(counters))
+
+		for i, counter := range counters {
+			value := counter.Count()
+			if value < 0 {
+				continue
+			}
+
+			fields = append(fields, fmt.Sprintf("%s=%d", counter.Name, value))
+
+			if value > previous[i] {
+				growth[i]++
+			} else {
+				growth[i] = 0
+			}
+			previous[i] = value
+
+			if growth[i] > 0 && growth[i]%leakGrowthSamples == 0 {
+				Logger.Warningf("Possible leak: %s grew in the last %d samples, now %d", counter.Name, growth[i], value)
+			}
+		}
+
+		Logger.Notice("Leak check:", strings.Join(fields, " "))
+		time.Sleep(leakInterval)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NormalizeBindAddress turns the bind addresses accepted on the command line
+// into the host:port form of the net package:
+//
+//	1080, :1080      all interfaces, IPv4 and IPv6
+//	[::]:1080        all interfaces, IPv4 and IPv6
+//	0.0.0.0:1080     all IPv4 interfaces
+//	::1:1080         IPv6 address without brackets, the port is the last field
+//	fe80::1%eth0:1080  link-local IPv6 address with its zone
+func NormalizeBindAddress(bindAddress string) (string, error) {
+	bindAddress = strings.TrimSpace(bindAddress)
+
+	if _, err := strconv.ParseUint(bindAddress, 10, 16); err == nil {
+		return ":" + bindAddress, nil
+	}
+
+	host, port, err := net.SplitHostPort(bindAddress)
+	if err != nil {
+		idx := strings.LastIndex(bindAddress, ":")
+		if idx < 0 || net.ParseIP(strings.SplitN(bindAddress[:idx], "%", 2)[0]) == nil {
+			return "", errors.New("invalid bind address " + bindAddress + ": " + err.Error())
+		}
+		host, port = bindAddress[:idx], bindAddress[idx+1:]
+	}
+
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", errors.New("invalid port in bind address " + bindAddress)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// Listen listens for TCP connections on bindAddress, see NormalizeBindAddress
+// for the accepted forms. Unspecified IPv6 addresses accept IPv4 clients too,
+// IPv4 addresses are listened on with tcp4 as Go would otherwise accept IPv6
+// clients on 0.0.0.0.
+// bindAddress can be a comma separated list of addresses to listen on all of
+// them at once.
+func Listen(bindAddress string) (net.Listener, error) {
+	var listeners []net.Listener
+
+	closeAll := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+
+	for _, item := range strings.Split(bindAddress, ",") {
+		address, err := NormalizeBindAddress(item)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		ln, err := net.Listen(bindNetwork(address), address)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+
+	return newMultiListener(listeners), nil
+}
+
+// bindNetwork returns tcp4 for the IPv4 addresses, tcp for the others
+func bindNetwork(address string) string {
+	host, _, _ := net.SplitHostPort(address)
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp"
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// Accept waits for the next connection on ln. Temporary errors, like running
+// out of file descriptors in the middle of a scan, are logged and retried
+// instead of being returned.
+func Accept(ln net.Listener) (net.Conn, error) {
+	delay := 5 * time.Millisecond
+
+	for {
+		conn, err := ln.Accept()
+		if err == nil || !isTemporary(err) {
+			return conn, err
+		}
+
+		Logger.Warning("Connection accept failed, retrying in", delay, ":", err.Error())
+		time.Sleep(delay)
+
+		if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+	}
+}
+
+func isTemporary(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Temporary()
+}
+
+// JoinListeners returns a listener accepting the connections of all the
+// given listeners
+func JoinListeners(listeners ...net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+	return newMultiListener(listeners)
+}
+
+// QueueAccepts returns a listener accepting the connections of ln in the
+// background, keeping up to size of them until they are taken by Accept. A
+// burst of clients is then accepted even while the caller of Accept is busy,
+// instead of overflowing the listen backlog and being reset.
+func QueueAccepts(ln net.Listener, size int) net.Listener {
+	return newQueuedListener([]net.Listener{ln}, size)
+}
+
+// multiListener accepts connections from several listeners
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	return newQueuedListener(listeners, 0)
+}
+
+func newQueuedListener(listeners []net.Listener, size int) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult, size),
+		closed:    make(chan struct{}),
+	}
+
+	for _, ln := range listeners {
+		go m.serve(ln)
+	}
+
+	return m
+}
+
+func (m *multiListener) serve(ln net.Listener) {
+	for {
+		conn, err := Accept(ln)
+
+		select {
+		case m.accepted <- acceptResult{conn, err}:
+		case <-m.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-m.accepted:
+		return result.conn, result.err
+	case <-m.closed:
+		return nil, errors.New("use of closed network connection")
+	}
+}
+
+func (m *multiListener) Close() error {
+	m.closeOnce.Do(func() { close(m.closed) })
+
+	// Drop the connections still queued
+	for {
+		select {
+		case result := <-m.accepted:
+			if result.conn != nil {
+				result.conn.Close()
+			}
+			continue
+		default:
+		}
+		break
+	}
+
+	var err error
+	for _, ln := range m.listeners {
+		if closeErr := ln.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (m *multiListener) Addr() net.Addr {
+	addrs := make(multiAddr, len(m.listeners))
+	for i, ln := range m.listeners {
+		addrs[i] = ln.Addr()
+	}
+	return addrs
+}
+
+// multiAddr is the address of a multiListener, the list of its addresses
+type multiAddr []net.Addr
+
+func (a multiAddr) Network() string {
+	return a[0].Network()
+}
+
+func (a multiAddr) String() string {
+	addrs := make([]string, len(a))
+	for i, addr := range a {
+		addrs[i] = addr.String()
+	}
+	return strings.Join(addrs, ",")
+}
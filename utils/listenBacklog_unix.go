@@ -0,0 +1,60 @@
+//go:build !windows
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// SetListenBacklog changes the number of connections the system keeps for
+// the TCP sockets of ln while they wait to be accepted. The system caps it,
+// to net.core.somaxconn on Linux.
+func SetListenBacklog(ln net.Listener, backlog int) error {
+	listeners := []net.Listener{ln}
+	if multi, ok := ln.(*multiListener); ok {
+		listeners = multi.listeners
+	}
+
+	for _, ln := range listeners {
+		conn, ok := ln.(syscall.Conn)
+		if !ok {
+			continue
+		}
+
+		raw, err := conn.SyscallConn()
+		if err != nil {
+			return errors.New("cannot set listen backlog: " + err.Error())
+		}
+
+		// Listening again on a listening socket only updates its backlog
+		var listenErr error
+		err = raw.Control(func(fd uintptr) {
+			listenErr = syscall.Listen(int(fd), backlog)
+		})
+		if err == nil {
+			err = listenErr
+		}
+		if err != nil {
+			return errors.New("cannot set listen backlog to " + strconv.Itoa(backlog) + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
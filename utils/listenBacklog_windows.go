@@ -0,0 +1,28 @@
+//go:build windows
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"net"
+)
+
+// SetListenBacklog fails on Windows, where the backlog of a listening socket
+// cannot be changed after it was created.
+func SetListenBacklog(ln net.Listener, backlog int) error {
+	return errors.New("cannot set listen backlog: not supported on Windows")
+}
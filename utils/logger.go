@@ -21,6 +21,8 @@ import (
 
 var Logger = logging.MustGetLogger("SaSSHimi")
 
+var backends []logging.Backend
+
 func init() {
 	var format = logging.MustStringFormatter(
 		`%{color}%{time:15:04:05.000} %{program:10s} - %{shortfunc:-20s} ▶ %{level:-8s} %{id:03x}%{color:reset} %{message}`,
@@ -35,6 +37,55 @@ func init() {
 
 	stderrBackendLeveled := logging.AddModuleLevel(stderrBackendFormater)
 
-	logging.SetBackend(stderrBackendLeveled, fileBackend)
+	backends = []logging.Backend{redactingBackend{stderrBackendLeveled}, redactingBackend{fileBackend}}
+	logging.SetBackend(backends...)
+
+}
+
+// SetVerbosity sets the log level from the number of -v flags, a negative
+// level only logs errors
+func SetVerbosity(verboseLevel int) {
+	if verboseLevel < 0 {
+		logging.SetLevel(logging.ERROR, Logger.Module)
+	} else if verboseLevel == 0 {
+		logging.SetLevel(logging.NOTICE, Logger.Module)
+	} else if verboseLevel == 1 {
+		logging.SetLevel(logging.INFO, Logger.Module)
+	} else {
+		logging.SetLevel(logging.DEBUG, Logger.Module)
+	}
+}
+
+// debugToggledFrom is the log level before ToggleDebug enabled debug logs
+var debugToggledFrom *logging.Level
+
+// ToggleDebug switches to debug logs, or back to the previous log level
+func ToggleDebug() {
+	if debugToggledFrom != nil {
+		logging.SetLevel(*debugToggledFrom, Logger.Module)
+		Logger.Notice("Debug logs disabled")
+		debugToggledFrom = nil
+		return
+	}
+
+	level := logging.GetLevel(Logger.Module)
+	debugToggledFrom = &level
+	logging.SetLevel(logging.DEBUG, Logger.Module)
+	Logger.Notice("Debug logs enabled")
+}
+
+// EnableSyslog sends every log message to the local syslog too
+func EnableSyslog(prefix string) error {
+	syslogBackend, err := logging.NewSyslogBackend(prefix)
+	if err != nil {
+		return err
+	}
+
+	level := logging.GetLevel(Logger.Module)
+
+	backends = append(backends, redactingBackend{syslogBackend})
+	logging.SetBackend(backends...)
+	logging.SetLevel(level, Logger.Module)
 
+	return nil
 }
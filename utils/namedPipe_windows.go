@@ -0,0 +1,294 @@
+//go:build windows
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/windows"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const pipeBufferSize = 65536
+
+var errPipeClosed = errors.New("use of closed named pipe")
+
+// DisconnectNamedPipe is missing from golang.org/x/sys/windows
+var procDisconnectNamedPipe = windows.NewLazySystemDLL("kernel32.dll").NewProc("DisconnectNamedPipe")
+
+func disconnectNamedPipe(handle windows.Handle) {
+	procDisconnectNamedPipe.Call(uintptr(handle))
+}
+
+// ListenPipe listens on the named pipe name, \\.\pipe\ is prepended to
+// names without it. The pipe is only accessible to the current user and
+// refuses remote clients.
+func ListenPipe(name string) (net.Listener, error) {
+	if !strings.HasPrefix(name, `\\`) {
+		name = `\\.\pipe\` + name
+	}
+
+	security, err := pipeSecurity()
+	if err != nil {
+		return nil, errors.New("Failed to create the named pipe ACL: " + err.Error())
+	}
+
+	l := &namedPipeListener{
+		name:     name,
+		security: security,
+		closed:   make(chan struct{}),
+	}
+
+	// The first instance fails if another process already owns the name
+	l.next, err = l.createInstance(true)
+	if err != nil {
+		return nil, errors.New("Failed to create named pipe " + name + ": " + err.Error())
+	}
+
+	return l, nil
+}
+
+// pipeSecurity returns security attributes giving access to the current
+// user and SYSTEM only
+func pipeSecurity() (*windows.SecurityAttributes, error) {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return nil, err
+	}
+
+	descriptor, err := windows.SecurityDescriptorFromString("D:P(A;;GA;;;" + user.User.Sid.String() + ")(A;;GA;;;SY)")
+	if err != nil {
+		return nil, err
+	}
+
+	return &windows.SecurityAttributes{
+		Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+		SecurityDescriptor: descriptor,
+	}, nil
+}
+
+// overlappedIO runs the overlapped operation started by start on handle and
+// waits for its result
+func overlappedIO(handle windows.Handle, start func(*windows.Overlapped) error) (uint32, error) {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(event)
+
+	overlapped := &windows.Overlapped{HEvent: event}
+
+	err = start(overlapped)
+	if err != nil && err != windows.ERROR_IO_PENDING {
+		return 0, err
+	}
+
+	var done uint32
+	err = windows.GetOverlappedResult(handle, overlapped, &done, true)
+	return done, err
+}
+
+type namedPipeListener struct {
+	name     string
+	security *windows.SecurityAttributes
+	count    uint64
+
+	// next is the pipe instance waiting for the next client
+	next      windows.Handle
+	nextLock  sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *namedPipeListener) createInstance(first bool) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(l.name)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+
+	mode := uint32(windows.PIPE_TYPE_BYTE | windows.PIPE_READMODE_BYTE | windows.PIPE_WAIT | windows.PIPE_REJECT_REMOTE_CLIENTS)
+
+	return windows.CreateNamedPipe(name, flags, mode, windows.PIPE_UNLIMITED_INSTANCES, pipeBufferSize, pipeBufferSize, 0, l.security)
+}
+
+func (l *namedPipeListener) Accept() (net.Conn, error) {
+	for {
+		l.nextLock.Lock()
+		handle := l.next
+		l.nextLock.Unlock()
+
+		if handle == windows.InvalidHandle {
+			return nil, errPipeClosed
+		}
+
+		_, err := overlappedIO(handle, func(overlapped *windows.Overlapped) error {
+			return windows.ConnectNamedPipe(handle, overlapped)
+		})
+
+		select {
+		case <-l.closed:
+			return nil, errPipeClosed
+		default:
+		}
+
+		if err == windows.ERROR_NO_DATA {
+			// The client already left, wait for another one
+			disconnectNamedPipe(handle)
+			continue
+		}
+		if err != nil && err != windows.ERROR_PIPE_CONNECTED {
+			return nil, errors.New("named pipe connect: " + err.Error())
+		}
+
+		next, err := l.createInstance(false)
+
+		l.nextLock.Lock()
+		l.next = next
+		l.nextLock.Unlock()
+
+		l.count++
+		conn := &namedPipeConn{
+			handle: handle,
+			local:  namedPipeAddr(l.name),
+			remote: namedPipeAddr(fmt.Sprintf("%s#%d", l.name, l.count)),
+		}
+
+		if err != nil {
+			conn.Close()
+			return nil, errors.New("Failed to create named pipe instance: " + err.Error())
+		}
+
+		return conn, nil
+	}
+}
+
+func (l *namedPipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		l.nextLock.Lock()
+		if l.next != windows.InvalidHandle {
+			windows.CancelIoEx(l.next, nil)
+			windows.CloseHandle(l.next)
+			l.next = windows.InvalidHandle
+		}
+		l.nextLock.Unlock()
+	})
+	return nil
+}
+
+func (l *namedPipeListener) Addr() net.Addr {
+	return namedPipeAddr(l.name)
+}
+
+// namedPipeConn is a connection to a named pipe client. Reads and writes
+// use overlapped I/O so they can run at the same time.
+type namedPipeConn struct {
+	handle    windows.Handle
+	local     net.Addr
+	remote    net.Addr
+	closed    bool
+	closeOnce sync.Once
+}
+
+func (c *namedPipeConn) Read(data []byte) (int, error) {
+	if c.closed {
+		return 0, errPipeClosed
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	n, err := overlappedIO(c.handle, func(overlapped *windows.Overlapped) error {
+		return windows.ReadFile(c.handle, data, nil, overlapped)
+	})
+
+	switch {
+	case err == windows.ERROR_BROKEN_PIPE || err == windows.ERROR_PIPE_NOT_CONNECTED:
+		return int(n), io.EOF
+	case err == windows.ERROR_OPERATION_ABORTED:
+		return int(n), errPipeClosed
+	case err == nil && n == 0:
+		return 0, io.EOF
+	}
+	return int(n), err
+}
+
+func (c *namedPipeConn) Write(data []byte) (int, error) {
+	if c.closed {
+		return 0, errPipeClosed
+	}
+
+	n, err := overlappedIO(c.handle, func(overlapped *windows.Overlapped) error {
+		return windows.WriteFile(c.handle, data, nil, overlapped)
+	})
+
+	if err == windows.ERROR_OPERATION_ABORTED {
+		err = errPipeClosed
+	}
+	return int(n), err
+}
+
+func (c *namedPipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closed = true
+		windows.CancelIoEx(c.handle, nil)
+		disconnectNamedPipe(c.handle)
+		windows.CloseHandle(c.handle)
+	})
+	return nil
+}
+
+func (c *namedPipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *namedPipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *namedPipeConn) SetDeadline(t time.Time) error {
+	return errors.New("deadlines are not supported on named pipes")
+}
+
+func (c *namedPipeConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *namedPipeConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+type namedPipeAddr string
+
+func (a namedPipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a namedPipeAddr) String() string {
+	return string(a)
+}
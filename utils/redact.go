@@ -0,0 +1,130 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/op/go-logging"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// redactedText replaces secrets in the logs
+const redactedText = "********"
+
+// minSecretSize is the size under which AddSecret ignores a value, redacting
+// it everywhere would make the logs unreadable
+const minSecretSize = 4
+
+var secretsLock sync.RWMutex
+var secrets []string
+
+var secretPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{
+		regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(-----END [A-Z ]*PRIVATE KEY-----|$)`),
+		"[private key " + redactedText + "]",
+	},
+	{
+		regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`),
+		"$1 " + redactedText,
+	},
+	{
+		regexp.MustCompile(`(?i)((?:password|passwd|passphrase|pwd|secret|token|api[_-]?key|access[_-]?key)["']?\s*[:=]\s*["']?)[^\s"',;&]+`),
+		"${1}" + redactedText,
+	},
+	{
+		regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`),
+		"${1}" + redactedText + "@",
+	},
+}
+
+// AddSecret makes the logs redact value, like a password read from the
+// configuration
+func AddSecret(value string) {
+	if len(value) < minSecretSize {
+		return
+	}
+
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	for _, secret := range secrets {
+		if secret == value {
+			return
+		}
+	}
+	secrets = append(secrets, value)
+}
+
+// Redact replaces in text the values given to AddSecret, and what looks like
+// passwords, tokens, credentials in URLs or private keys
+func Redact(text string) string {
+	secretsLock.RLock()
+	for _, secret := range secrets {
+		text = strings.Replace(text, secret, redactedText, -1)
+	}
+	secretsLock.RUnlock()
+
+	for _, secret := range secretPatterns {
+		text = secret.pattern.ReplaceAllString(text, secret.replacement)
+	}
+
+	return text
+}
+
+// redactedArg formats a log argument like fmt would, then redacts it
+type redactedArg struct {
+	value interface{}
+}
+
+func (a redactedArg) Format(state fmt.State, verb rune) {
+	var format bytes.Buffer
+	format.WriteByte('%')
+	for _, flag := range "+-# 0" {
+		if state.Flag(int(flag)) {
+			format.WriteRune(flag)
+		}
+	}
+	if width, ok := state.Width(); ok {
+		format.WriteString(strconv.Itoa(width))
+	}
+	if precision, ok := state.Precision(); ok {
+		format.WriteString("." + strconv.Itoa(precision))
+	}
+	format.WriteRune(verb)
+
+	fmt.Fprint(state, Redact(fmt.Sprintf(format.String(), a.value)))
+}
+
+// redactingBackend redacts the arguments of the records logged by backend
+type redactingBackend struct {
+	backend logging.Backend
+}
+
+func (b redactingBackend) Log(level logging.Level, calldepth int, record *logging.Record) error {
+	redacted := *record
+	redacted.Args = make([]interface{}, len(record.Args))
+	for i, arg := range record.Args {
+		redacted.Args[i] = redactedArg{arg}
+	}
+
+	return b.backend.Log(level, calldepth+1, &redacted)
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"syscall"
+)
+
+// Open file limit below which heavy scans are likely to run out of sockets
+const lowFileLimit = 4096
+
+// Descriptors kept for logs, the SSH connection and the listeners
+const reservedFiles = 32
+
+// RaiseFileLimit raises the soft RLIMIT_NOFILE to the hard limit and warns
+// when the result still limits the number of concurrent connections.
+func RaiseFileLimit() {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		Logger.Warning("Unable to read the open file limit:", err.Error())
+		return
+	}
+
+	if limit.Cur < limit.Max {
+		raised := limit
+		raised.Cur = limit.Max
+
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err != nil {
+			Logger.Warningf("Unable to raise the open file limit from %d to %d: %s", limit.Cur, limit.Max, err.Error())
+		} else {
+			Logger.Debugf("Open file limit raised from %d to %d", limit.Cur, raised.Cur)
+			limit = raised
+		}
+	}
+
+	if limit.Cur < lowFileLimit {
+		Logger.Warningf("Open file limit is %d: connections above about %d at once will be refused (raise it with ulimit -n)",
+			limit.Cur, limit.Cur-reservedFiles)
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+// RuntimeControls are run on the runtime control signals, on the systems
+// having them: DumpState on SIGUSR1 and Reload on SIGHUP, which then no
+// longer stops the process. SIGUSR2 toggles debug logging.
+type RuntimeControls struct {
+	DumpState func()
+	Reload    func()
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// HandleRuntimeSignals runs the controls on their signals
+func HandleRuntimeSignals(controls RuntimeControls) {
+	signals := make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	if controls.Reload != nil {
+		atomic.StoreInt32(&hangupReloads, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+	}
+
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGUSR1:
+				if controls.DumpState != nil {
+					controls.DumpState()
+				}
+			case syscall.SIGUSR2:
+				ToggleDebug()
+			case syscall.SIGHUP:
+				controls.Reload()
+			}
+		}
+	}()
+}
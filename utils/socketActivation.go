@@ -0,0 +1,124 @@
+// Copyright © 2018 Raul Sampedro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// First file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// ActivationListeners returns the sockets passed to the process by systemd
+// socket activation, or nil if it was not socket activated. The environment
+// variables are cleared so child processes do not use the sockets too.
+func ActivationListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(file)
+		file.Close()
+
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, errors.New("invalid socket passed by systemd: " + err.Error())
+		}
+
+		listeners = append(listeners, ln)
+	}
+
+	return listeners, nil
+}
+
+// ListenProxy returns the sockets passed by systemd socket activation if
+// any, otherwise it listens on bindAddress like Listen. The proxy has no
+// authentication, so addresses reachable from the network are refused
+// unless expose is set.
+func ListenProxy(bindAddress string, expose bool) (net.Listener, error) {
+	listeners, err := ActivationListeners()
+	if err != nil {
+		return nil, err
+	}
+
+	var ln net.Listener
+	switch len(listeners) {
+	case 0:
+		ln, err = Listen(bindAddress)
+		if err != nil {
+			return nil, err
+		}
+	case 1:
+		Logger.Info("Using the socket passed by systemd")
+		ln = listeners[0]
+	default:
+		Logger.Info("Using the sockets passed by systemd")
+		ln = newMultiListener(listeners)
+	}
+
+	exposed := exposedAddresses(ln)
+	if len(exposed) == 0 {
+		return ln, nil
+	}
+
+	if !expose {
+		ln.Close()
+		return nil, errors.New("refusing to listen on " + strings.Join(exposed, ", ") +
+			": the proxy has no authentication, use --expose to accept connections from the network")
+	}
+
+	Logger.Warning("*******************************************************************")
+	Logger.Warning("Proxy reachable from the network WITHOUT AUTHENTICATION at", strings.Join(exposed, ", "))
+	Logger.Warning("Anyone able to connect can use the tunnel to reach the remote network")
+	Logger.Warning("*******************************************************************")
+
+	return ln, nil
+}
+
+// exposedAddresses returns the addresses of ln that are not loopback ones
+func exposedAddresses(ln net.Listener) []string {
+	listeners := []net.Listener{ln}
+	if multi, ok := ln.(*multiListener); ok {
+		listeners = multi.listeners
+	}
+
+	var exposed []string
+	for _, ln := range listeners {
+		addr, ok := ln.Addr().(*net.TCPAddr)
+		if ok && !addr.IP.IsLoopback() {
+			exposed = append(exposed, addr.String())
+		}
+	}
+	return exposed
+}
@@ -4,3 +4,12 @@ var VersionTag = "v1.0.2"
 var ToolName = "SaSSHimi"
 var Author = "@rsrdesarrollo"
 var RepoURL = "https://github.com/rsrdesarrollo/SaSSHimi"
+
+// Engagement identifies the engagement an agent was built for, it is set
+// with -ldflags "-X github.com/rsrdesarrollo/SaSSHimi/version.Engagement=..."
+var Engagement = ""
+
+// UpdateKey is the base64 ed25519 public key verifying the releases
+// installed by the update command, it is set with -ldflags
+// "-X github.com/rsrdesarrollo/SaSSHimi/version.UpdateKey=..."
+var UpdateKey = ""